@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/lego/mongotunnel/util/capture"
+	"github.com/pkg/errors"
+)
+
+// dump - Print the messages of captures written with -capture, decoding
+// their ops.
+func dump(args []string) error {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	conn := flags.Uint64("conn", 0, "only print messages of this connection ID (0 for all)")
+	raw := flags.Bool("hex", false, "also print the raw bytes of each message")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s dump [flags] capture...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	for _, name := range flags.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		err = dumpCapture(f, *conn, *raw)
+		f.Close()
+		if err != nil {
+			return errors.Wrap(err, name)
+		}
+	}
+	return nil
+}
+
+func dumpCapture(r io.Reader, conn uint64, raw bool) error {
+	cr, err := capture.NewReader(r)
+	if err != nil {
+		return err
+	}
+	for {
+		rec, err := cr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if conn != 0 && rec.Conn != conn {
+			continue
+		}
+
+		fmt.Printf("%s conn=%d %-3s ", rec.Time.UTC().Format(time.RFC3339Nano), rec.Conn, rec.Direction)
+		msg, err := mongo.ReadMessage(bytes.NewReader(rec.Data))
+		if err != nil {
+			fmt.Printf("%d bytes, failed to read message: %s\n", len(rec.Data), err)
+			continue
+		}
+		fmt.Println(msg.Head)
+		if op, err := msg.Decode(); err != nil {
+			fmt.Printf("   %s\n", err)
+		} else {
+			fmt.Printf("   %s\n", op)
+		}
+		if raw {
+			fmt.Printf("   %x\n", rec.Data)
+		}
+	}
+}
@@ -1,27 +1,36 @@
 package main
 
 import (
+	"crypto/tls"
 	"database/sql"
 	"flag"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
 	"strings"
+	"syscall"
+	"time"
 
 	_ "github.com/lib/pq"
 
 	"github.com/lego/mongotunnel/proxy"
+	"github.com/lego/mongotunnel/util/capture"
 	"github.com/lego/mongotunnel/util/log"
+	"github.com/lego/mongotunnel/util/tlsutil"
+	"github.com/lego/mongotunnel/util/trace"
+	"github.com/pkg/errors"
 )
 
 var (
-	matchid = uint64(0)
-	connid  = uint64(0)
-	logger  log.ColorLogger
+	matchid            = uint64(0)
+	connid             = uint64(0)
+	logger  log.Logger = log.NullLogger{}
 
 	localAddr     = flag.String("l", ":9999", "local address")
-	remoteAddr    = flag.String("r", "localhost:80", "remote address")
+	remoteAddr    = flag.String("r", "localhost:80", "remote address (empty to answer everything from CockroachDB)")
 	cockroachAddr = flag.String("crdb", "postgresql://root@cdb-joey:26257?application_name=cockroach&sslmode=disable", "cockroach address")
 	verbose       = flag.Bool("v", false, "display server actions")
 	veryverbose   = flag.Bool("vv", false, "display server actions and all tcp data")
@@ -31,27 +40,96 @@ var (
 	unwrapTLS     = flag.Bool("unwrap-tls", false, "remote connection with TLS exposed unencrypted locally")
 	match         = flag.String("match", "", "match regex (in the form 'regex')")
 	replace       = flag.String("replace", "", "replace regex (in the form 'regex~replacer')")
+
+	tlsCert       = flag.String("tls-cert", "", "PEM certificate for TLS on the local listener")
+	tlsKey        = flag.String("tls-key", "", "PEM private key for TLS on the local listener")
+	tlsClientCA   = flag.String("tls-client-ca", "", "PEM CA bundle used to verify client certificates (enables mutual TLS)")
+	tlsClientAuth = flag.String("tls-client-auth", "", "client certificate policy: none, request, require, verify-if-given or require-and-verify")
+	tlsMinVersion = flag.String("tls-min-version", "", "minimum TLS version (1.0, 1.1, 1.2 or 1.3)")
+	tlsMaxVersion = flag.String("tls-max-version", "", "maximum TLS version (1.0, 1.1, 1.2 or 1.3)")
+	tlsCiphers    = flag.String("tls-ciphers", "", "comma separated TLS cipher suites")
+	tlsHandshake  = flag.Duration("tls-handshake-timeout", 10*time.Second, "give up on TLS handshakes with clients and the remote taking longer than this (0 to wait forever)")
+	sqlAuth       = flag.Bool("sql-require-auth", false, "only translate the commands of clients that authenticated with the proxy through MONGODB-X509")
+
+	upstreamCA         = flag.String("upstream-tls-ca", "", "PEM CA bundle used to verify the remote with -unwrap-tls")
+	upstreamServerName = flag.String("upstream-tls-server-name", "", "SNI and verification name for the remote with -unwrap-tls")
+	upstreamCert       = flag.String("upstream-tls-cert", "", "PEM client certificate presented to the remote with -unwrap-tls")
+	upstreamKey        = flag.String("upstream-tls-key", "", "PEM client private key presented to the remote with -unwrap-tls")
+	upstreamInsecure   = flag.Bool("upstream-tls-insecure", false, "skip verification of the remote certificate with -unwrap-tls")
+	upstreamMinVersion = flag.String("upstream-tls-min-version", "", "minimum TLS version toward the remote with -unwrap-tls (1.0, 1.1, 1.2 or 1.3)")
+	upstreamMaxVersion = flag.String("upstream-tls-max-version", "", "maximum TLS version toward the remote with -unwrap-tls (1.0, 1.1, 1.2 or 1.3)")
+	upstreamCiphers    = flag.String("upstream-tls-ciphers", "", "comma separated TLS cipher suites toward the remote with -unwrap-tls")
+
+	poolSize        = flag.Int("pool-size", 0, "share at most this many remote connections between clients that do not authenticate (0 dials one per client)")
+	poolMinSize     = flag.Int("pool-min-size", 0, "remote connections kept open while idle when pooling")
+	poolIdleTimeout = flag.Duration("pool-idle-timeout", 5*time.Minute, "close idle pooled remote connections after this long")
+
+	shadow       = flag.Bool("shadow", false, "without -route, send translatable commands, writes included, to both the remote and CockroachDB, replying with the remote's answer (legacy write opcodes are not mirrored)")
+	shadowReport = flag.String("shadow-report", "shadow-report.jsonl", "file receiving shadow mismatches as JSON lines (- for stdout)")
+
+	routes    = flag.String("route", "", "comma separated routing rules 'database.collection[:command]=upstream|sql|both', first match wins")
+	routeFile = flag.String("route-file", "", "file of routing rules, one per line")
+	routeElse = flag.String("route-default", "upstream", "target for requests matching no rule")
+
+	metricsAddr = flag.String("metrics", "", "address serving Prometheus metrics on /metrics (empty to disable)")
+	adminAddr   = flag.String("admin", "", "address serving the admin API of connections and cursors on /connections and /cursors (empty to disable)")
+	opsOpen     = flag.Bool("ops-unauthenticated", false, "let every client, even without authenticating with the proxy, list and kill the operations of every connection with currentOp and killOp")
+	opsUsers    = stringsFlag("ops-operator", "certificate subject of a MONGODB-X509 user that may list and kill the operations of every connection with currentOp and killOp (may be repeated)")
+
+	slowQuery        = flag.Duration("slow-query", 0, "log queries taking at least this long with the SQL they ran (0 to disable)")
+	slowQueryExplain = flag.Bool("slow-query-explain", false, "also log the EXPLAIN ANALYZE plans of slow queries, running their SELECTs again")
+
+	captureFile = flag.String("capture", "", "append every message to and from clients to this file, read with the dump subcommand")
+
+	traceTo = flag.String("trace", "", "export request spans: - for stdout, the http(s) URL of an OTLP collector such as http://localhost:4318/v1/traces, or a file of OTLP JSON lines (empty to disable)")
+
+	logFormat = flag.String("log-format", "text", "log format: text, or json for one object per line with the fields of each request")
+	logLevel  = flag.String("log-level", "", "log level: warn, info, debug or trace (info by default, debug with -v, trace with -vv)")
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		var subcommand func([]string) error
+		switch os.Args[1] {
+		case "dump":
+			subcommand = dump
+		case "replay":
+			subcommand = replay
+		}
+		if subcommand != nil {
+			if err := subcommand(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
 	flag.Parse()
 
-	logger := log.ColorLogger{
-		Verbose: *verbose,
-		Color:   *colors,
+	if err := configureLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
+	logger = newLogger("", nil)
 
-	logger.Info("Proxying server at %v. Proxy is at %v", *remoteAddr, *localAddr)
+	if *remoteAddr == "" {
+		logger.Info("Answering from CockroachDB without a remote. Proxy is at %v", *localAddr)
+	} else {
+		logger.Info("Proxying server at %v. Proxy is at %v", *remoteAddr, *localAddr)
+	}
 
 	laddr, err := net.ResolveTCPAddr("tcp", *localAddr)
 	if err != nil {
 		logger.Warn("failed to resolve local address: %s", err)
 		os.Exit(1)
 	}
-	raddr, err := net.ResolveTCPAddr("tcp", *remoteAddr)
-	if err != nil {
-		logger.Warn("failed to resolve remote address: %s", err)
-		os.Exit(1)
+	var raddr *net.TCPAddr
+	if *remoteAddr != "" {
+		raddr, err = net.ResolveTCPAddr("tcp", *remoteAddr)
+		if err != nil {
+			logger.Warn("failed to resolve remote address: %s", err)
+			os.Exit(1)
+		}
 	}
 	listener, err := net.ListenTCP("tcp", laddr)
 	if err != nil {
@@ -59,52 +137,345 @@ func main() {
 		os.Exit(1)
 	}
 
+	var serverTLS *tls.Config
+	if *tlsCert != "" || *tlsKey != "" {
+		serverTLS, err = tlsutil.ServerConfig(tlsutil.ServerOptions{
+			CertFile:     *tlsCert,
+			KeyFile:      *tlsKey,
+			ClientCAFile: *tlsClientCA,
+			ClientAuth:   *tlsClientAuth,
+			MinVersion:   *tlsMinVersion,
+			MaxVersion:   *tlsMaxVersion,
+			CipherSuites: *tlsCiphers,
+		})
+		if err != nil {
+			logger.Warn("failed to configure local TLS: %+v", err)
+			os.Exit(1)
+		}
+		logger.Info("Terminating TLS on %v", *localAddr)
+	}
+
+	var upstreamTLS *tls.Config
+	if *unwrapTLS {
+		upstreamTLS, err = tlsutil.ClientConfig(tlsutil.ClientOptions{
+			CAFile:             *upstreamCA,
+			ServerName:         *upstreamServerName,
+			CertFile:           *upstreamCert,
+			KeyFile:            *upstreamKey,
+			InsecureSkipVerify: *upstreamInsecure,
+			MinVersion:         *upstreamMinVersion,
+			MaxVersion:         *upstreamMaxVersion,
+			CipherSuites:       *upstreamCiphers,
+		})
+		if err != nil {
+			logger.Warn("failed to configure remote TLS: %+v", err)
+			os.Exit(1)
+		}
+	}
+
 	db, err := sql.Open("postgres", *cockroachAddr)
 	if err != nil {
 		logger.Warn("failed to open connection to CockroachDB: %+v", err)
 		os.Exit(1)
 	}
 
+	var pool *proxy.Pool
+	if *poolSize > 0 && raddr != nil {
+		pool, err = proxy.NewPool(proxy.PoolOptions{
+			Dial: func() (net.Conn, error) {
+				var conn net.Conn
+				var err error
+				if *unwrapTLS {
+					dialer := &net.Dialer{Timeout: *tlsHandshake}
+					conn, err = tls.DialWithDialer(dialer, "tcp", *remoteAddr, upstreamTLS)
+				} else {
+					conn, err = net.DialTCP("tcp", nil, raddr)
+				}
+				if err == nil && *nagles {
+					if tcpConn, ok := conn.(*net.TCPConn); ok {
+						tcpConn.SetNoDelay(true)
+					}
+				}
+				return conn, err
+			},
+			MinSize:     *poolMinSize,
+			MaxSize:     *poolSize,
+			IdleTimeout: *poolIdleTimeout,
+			Log:         newLogger("Pool ", log.Fields{"component": "pool"}),
+		})
+		if err != nil {
+			logger.Warn("failed to open remote connection pool: %+v", err)
+			os.Exit(1)
+		}
+		defer pool.Close()
+		logger.Info("Pooling up to %d remote connections", *poolSize)
+	}
+
+	router, err := createRouter()
+	if err != nil {
+		logger.Warn("invalid routing rules: %+v", err)
+		os.Exit(1)
+	}
+	for _, rule := range router.Rules {
+		logger.Info("Routing %s", rule)
+	}
+
+	var shadowReporter *proxy.ShadowReporter
+	if router.UsesTarget(proxy.TargetBoth) && raddr != nil {
+		out := os.Stdout
+		if *shadowReport != "-" {
+			out, err = os.OpenFile(*shadowReport, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				logger.Warn("failed to open shadow report: %+v", err)
+				os.Exit(1)
+			}
+			defer out.Close()
+		}
+		shadowReporter = proxy.NewShadowReporter(out)
+		logger.Info("Shadowing queries to CockroachDB, reporting to %s", *shadowReport)
+	}
+
+	sessions := proxy.NewSessions()
+	defer sessions.Close()
+
+	// Flags given the same address share its server.
+	muxes := make(map[string]*http.ServeMux)
+	handle := func(addr string, handler http.Handler, patterns ...string) {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		for _, pattern := range patterns {
+			muxes[addr].Handle(pattern, handler)
+		}
+	}
+
+	var metrics *proxy.Metrics
+	if *metricsAddr != "" {
+		metrics = proxy.NewMetrics()
+		metrics.WatchSessions(sessions)
+		metrics.WatchDB(db)
+		handle(*metricsAddr, metrics, "/metrics")
+		logger.Info("Serving metrics on http://%s/metrics", *metricsAddr)
+	}
+
+	connections := proxy.NewConnections()
+	connections.UnauthenticatedOps = *opsOpen
+	connections.Operators = make(map[string]bool)
+	for _, user := range *opsUsers {
+		connections.Operators[user] = true
+	}
+	if *adminAddr != "" {
+		handle(*adminAddr, proxy.NewAdmin(connections, sessions), "/connections", "/connections/", "/cursors", "/cursors/")
+		logger.Info("Serving the admin API on http://%s/connections", *adminAddr)
+	}
+
+	for addr, mux := range muxes {
+		go func(addr string, mux *http.ServeMux) {
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				logger.Warn("failed to serve HTTP on %s: %+v", addr, err)
+				os.Exit(1)
+			}
+		}(addr, mux)
+	}
+
+	var tracer *trace.Tracer
+	if *traceTo != "" {
+		var exporter trace.Exporter
+		switch {
+		case *traceTo == "-":
+			exporter = trace.NewWriterExporter(os.Stdout)
+		case strings.HasPrefix(*traceTo, "http://") || strings.HasPrefix(*traceTo, "https://"):
+			exporter = trace.NewOTLPExporter(*traceTo)
+		default:
+			out, err := os.OpenFile(*traceTo, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				logger.Warn("failed to open trace file: %+v", err)
+				os.Exit(1)
+			}
+			defer out.Close()
+			exporter = trace.NewWriterExporter(out)
+		}
+		tracer = trace.NewTracer("mongotunnel", exporter)
+		tracer.Log = newLogger("Trace ", log.Fields{"component": "trace"})
+		defer tracer.Close()
+		logger.Info("Tracing requests to %s", *traceTo)
+	}
+
+	var captureWriter *capture.Writer
+	if *captureFile != "" {
+		out, err := os.OpenFile(*captureFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			logger.Warn("failed to open capture file: %+v", err)
+			os.Exit(1)
+		}
+		defer out.Close()
+		if captureWriter, err = capture.NewWriter(out); err != nil {
+			logger.Warn("failed to start capture: %+v", err)
+			os.Exit(1)
+		}
+		logger.Info("Capturing messages to %s", *captureFile)
+	}
+
 	matcher := createMatcher(*match)
 	replacer := createReplacer(*replace)
 
-	if *veryverbose {
-		*verbose = true
-	}
+	// Stop accepting on SIGINT or SIGTERM, so that main returns and closes
+	// the pool, sessions and outputs deferred above.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	stopping := make(chan struct{})
+	go func() {
+		sig := <-stop
+		logger.Info("Shutting down on %s", sig)
+		close(stopping)
+		listener.Close()
+	}()
 
 	for {
-		conn, err := listener.AcceptTCP()
+		tcpConn, err := listener.AcceptTCP()
 		if err != nil {
+			select {
+			case <-stopping:
+				return
+			default:
+			}
 			logger.Warn("failed to accept connection '%s'", err)
 			continue
 		}
 		connid++
 
+		var conn net.Conn = tcpConn
+		if serverTLS != nil {
+			conn = tls.Server(tcpConn, serverTLS)
+		}
+
 		var p *proxy.Proxy
-		if *unwrapTLS {
+		if raddr == nil {
+			p = proxy.NewStandalone(conn, laddr)
+		} else if pool != nil {
+			p = proxy.NewPooled(conn, laddr, raddr, pool)
+		} else if *unwrapTLS {
 			logger.Info("Unwrapping TLS")
-			p = proxy.NewTLSUnwrapped(conn, laddr, raddr, *remoteAddr)
+			p = proxy.NewTLSUnwrapped(conn, laddr, raddr, *remoteAddr, upstreamTLS)
 		} else {
 			p = proxy.New(conn, laddr, raddr)
 		}
 
 		p.Matcher = matcher
 		p.Replacer = replacer
+		p.Router = router
+		p.Shadow = shadowReporter
+		p.HandshakeTimeout = *tlsHandshake
+		p.RequireIdentity = *sqlAuth
+		p.Sessions = sessions
+		p.Metrics = metrics
+		p.Connections = connections
+		p.Tracer = tracer
+		p.Capture = captureWriter
+		p.SlowQueryThreshold = *slowQuery
+		p.ExplainSlowQueries = *slowQueryExplain
 
 		p.Nagles = *nagles
 		p.OutputHex = *hex
-		p.Ctx().SetLogger(log.ColorLogger{
-			Verbose:     *verbose,
-			VeryVerbose: *veryverbose,
-			Prefix:      fmt.Sprintf("Conn #%03d ", connid),
-			Color:       *colors,
-		})
+		p.Ctx().SetLogger(newLogger(fmt.Sprintf("Conn #%03d ", connid), log.Fields{"conn": connid}))
 		p.Ctx().SetDB(db)
+		p.Ctx().SetConnID(connid)
 
 		go p.Start()
 	}
 }
 
+// stringList - The values of a flag given several times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// stringsFlag - Define a flag that may be given several times.
+func stringsFlag(name, usage string) *[]string {
+	var values stringList
+	flag.Var(&values, name, usage)
+	return (*[]string)(&values)
+}
+
+// level - The verbosity of the logs.
+var level = log.Info
+
+// configureLogging - Check the log flags and settle the level, from
+// -log-level or else -v and -vv.
+func configureLogging() error {
+	switch *logFormat {
+	case "text", "json":
+	default:
+		return errors.Errorf("unknown log format %q", *logFormat)
+	}
+	switch {
+	case *logLevel != "":
+		var err error
+		if level, err = log.ParseVerbosity(*logLevel); err != nil {
+			return err
+		}
+	case *veryverbose:
+		level = log.Trace
+	case *verbose:
+		level = log.Debug
+	}
+	return nil
+}
+
+// newLogger - A logger in the chosen format. Text lines start with prefix,
+// while JSON lines carry fields.
+func newLogger(prefix string, fields log.Fields) log.Logger {
+	if *logFormat == "json" {
+		return log.JSONLogger{Level: level}.WithFields(fields)
+	}
+	return log.ColorLogger{
+		Verbose:     level >= log.Debug,
+		VeryVerbose: level >= log.Trace,
+		Quiet:       level < log.Info,
+		Prefix:      prefix,
+		Color:       *colors,
+	}
+}
+
+func createRouter() (*proxy.Router, error) {
+	if *routes == "" && *routeFile == "" {
+		if *shadow {
+			return &proxy.Router{Default: proxy.TargetBoth}, nil
+		}
+		return proxy.DefaultRouter(), nil
+	}
+
+	router := &proxy.Router{}
+	var err error
+	if router.Default, err = proxy.ParseTarget(*routeElse); err != nil {
+		return nil, err
+	}
+	// Rules on the command line take precedence over the file.
+	if router.Rules, err = proxy.ParseRules(*routes); err != nil {
+		return nil, err
+	}
+	if *routeFile != "" {
+		f, err := os.Open(*routeFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		rules, err := proxy.ReadRules(f)
+		if err != nil {
+			return nil, err
+		}
+		router.Rules = append(router.Rules, rules...)
+	}
+	return router, nil
+}
+
 func createMatcher(match string) func([]byte) {
 	if match == "" {
 		return nil
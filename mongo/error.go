@@ -0,0 +1,151 @@
+package mongo
+
+import (
+	"fmt"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrorCode - Numeric server error code, returned in the `code` field of a
+// failed command reply.
+type ErrorCode int32
+
+const (
+	ErrorCodeInternalError                  ErrorCode = 1
+	ErrorCodeBadValue                       ErrorCode = 2
+	ErrorCodeUnauthorized                   ErrorCode = 13
+	ErrorCodeAuthenticationFailed           ErrorCode = 18
+	ErrorCodeIllegalOperation               ErrorCode = 20
+	ErrorCodeNamespaceNotFound              ErrorCode = 26
+	ErrorCodeIndexNotFound                  ErrorCode = 27
+	ErrorCodeCursorNotFound                 ErrorCode = 43
+	ErrorCodeNamespaceExists                ErrorCode = 48
+	ErrorCodeMaxTimeMSExpired               ErrorCode = 50
+	ErrorCodeCommandNotFound                ErrorCode = 59
+	ErrorCodeImmutableField                 ErrorCode = 66
+	ErrorCodeCannotCreateIndex              ErrorCode = 67
+	ErrorCodeInvalidOptions                 ErrorCode = 72
+	ErrorCodeInvalidNamespace               ErrorCode = 73
+	ErrorCodeIndexOptionsConflict           ErrorCode = 85
+	ErrorCodeIndexKeySpecsConflict          ErrorCode = 86
+	ErrorCodeWriteConflict                  ErrorCode = 112
+	ErrorCodeConflictingOperationInProgress ErrorCode = 117
+	ErrorCodeTransactionTooOld              ErrorCode = 225
+	ErrorCodeNotImplemented                 ErrorCode = 238
+	ErrorCodeNoSuchTransaction              ErrorCode = 251
+	ErrorCodeMechanismUnavailable           ErrorCode = 334
+	ErrorCodeDuplicateKey                   ErrorCode = 11000
+	ErrorCodeInterrupted                    ErrorCode = 11601
+
+	// ErrorCodeUnrecognizedPipelineStage has no code name, MongoDB reports
+	// it as Location40324.
+	ErrorCodeUnrecognizedPipelineStage ErrorCode = 40324
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case ErrorCodeInternalError:
+		return "InternalError"
+	case ErrorCodeBadValue:
+		return "BadValue"
+	case ErrorCodeUnauthorized:
+		return "Unauthorized"
+	case ErrorCodeAuthenticationFailed:
+		return "AuthenticationFailed"
+	case ErrorCodeIllegalOperation:
+		return "IllegalOperation"
+	case ErrorCodeNamespaceNotFound:
+		return "NamespaceNotFound"
+	case ErrorCodeIndexNotFound:
+		return "IndexNotFound"
+	case ErrorCodeCursorNotFound:
+		return "CursorNotFound"
+	case ErrorCodeNamespaceExists:
+		return "NamespaceExists"
+	case ErrorCodeMaxTimeMSExpired:
+		return "MaxTimeMSExpired"
+	case ErrorCodeCommandNotFound:
+		return "CommandNotFound"
+	case ErrorCodeImmutableField:
+		return "ImmutableField"
+	case ErrorCodeCannotCreateIndex:
+		return "CannotCreateIndex"
+	case ErrorCodeInvalidOptions:
+		return "InvalidOptions"
+	case ErrorCodeInvalidNamespace:
+		return "InvalidNamespace"
+	case ErrorCodeIndexOptionsConflict:
+		return "IndexOptionsConflict"
+	case ErrorCodeIndexKeySpecsConflict:
+		return "IndexKeySpecsConflict"
+	case ErrorCodeWriteConflict:
+		return "WriteConflict"
+	case ErrorCodeConflictingOperationInProgress:
+		return "ConflictingOperationInProgress"
+	case ErrorCodeTransactionTooOld:
+		return "TransactionTooOld"
+	case ErrorCodeNotImplemented:
+		return "NotImplemented"
+	case ErrorCodeNoSuchTransaction:
+		return "NoSuchTransaction"
+	case ErrorCodeMechanismUnavailable:
+		return "MechanismUnavailable"
+	case ErrorCodeDuplicateKey:
+		return "DuplicateKey"
+	case ErrorCodeInterrupted:
+		return "Interrupted"
+	default:
+		return fmt.Sprintf("Location%d", int32(c))
+	}
+}
+
+// CommandError - A command failure that is reported back to the client as
+// an `ok: 0` document rather than dropping the connection.
+type CommandError struct {
+	Code    ErrorCode
+	Message string
+	// Labels tell drivers how to handle the failure, such as retrying a
+	// transaction on TransientTransactionError.
+	Labels []string
+}
+
+const (
+	// ErrorLabelTransientTransactionError - The whole transaction can be
+	// retried.
+	ErrorLabelTransientTransactionError = "TransientTransactionError"
+	// ErrorLabelUnknownTransactionCommitResult - The commit may or may not
+	// have happened, and can be retried.
+	ErrorLabelUnknownTransactionCommitResult = "UnknownTransactionCommitResult"
+)
+
+// NewCommandError - Create a CommandError with a formatted message.
+func NewCommandError(code ErrorCode, f string, args ...interface{}) *CommandError {
+	return &CommandError{
+		Code:    code,
+		Message: fmt.Sprintf(f, args...),
+	}
+}
+
+// WithLabels - Add error labels to the failure.
+func (e *CommandError) WithLabels(labels ...string) *CommandError {
+	e.Labels = append(e.Labels, labels...)
+	return e
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("%s (%d): %s", e.Code, int32(e.Code), e.Message)
+}
+
+// Document - The reply document for the failure.
+func (e *CommandError) Document() bson.D {
+	doc := bson.D{
+		bson.DocElem{"ok", 0},
+		bson.DocElem{"errmsg", e.Message},
+		bson.DocElem{"code", int32(e.Code)},
+		bson.DocElem{"codeName", e.Code.String()},
+	}
+	if len(e.Labels) > 0 {
+		doc = append(doc, bson.DocElem{"errorLabels", e.Labels})
+	}
+	return doc
+}
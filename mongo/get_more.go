@@ -0,0 +1,38 @@
+package mongo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/lego/mongotunnel/util/bytesutil"
+	"github.com/pkg/errors"
+)
+
+type GetMoreOp struct {
+	Collection     string
+	NumberToReturn int32
+	CursorID       int64
+}
+
+func (op *GetMoreOp) ReadFromBuffer(buf *bytes.Buffer) error {
+	var zero int32
+	if err := binary.Read(buf, binary.LittleEndian, &zero); err != nil {
+		return errors.Wrap(err, "failed to read ZERO")
+	}
+
+	op.Collection = bytesutil.ReadCString(buf)
+
+	if err := binary.Read(buf, binary.LittleEndian, &op.NumberToReturn); err != nil {
+		return errors.Wrap(err, "failed to read NumberToReturn")
+	}
+
+	if err := binary.Read(buf, binary.LittleEndian, &op.CursorID); err != nil {
+		return errors.Wrap(err, "failed to read CursorID")
+	}
+	return nil
+}
+
+func (op GetMoreOp) String() string {
+	return fmt.Sprintf("<GetMoreOp Collection=%s NumberToReturn=%d CursorID=%d>", op.Collection, op.NumberToReturn, op.CursorID)
+}
@@ -0,0 +1,60 @@
+package mongo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+type KillCursorsOp struct {
+	CursorIDs []int64
+}
+
+func (op *KillCursorsOp) ReadFromBuffer(buf io.Reader) error {
+	var zero int32
+	if err := binary.Read(buf, binary.LittleEndian, &zero); err != nil {
+		return errors.Wrap(err, "failed to read ZERO")
+	}
+
+	var count int32
+	if err := binary.Read(buf, binary.LittleEndian, &count); err != nil {
+		return errors.Wrap(err, "failed to read NumberOfCursorIDs")
+	}
+	if count < 0 || count > MaxMessageSize/8 {
+		return errors.Errorf("invalid NumberOfCursorIDs %d", count)
+	}
+
+	op.CursorIDs = make([]int64, count)
+	if err := binary.Read(buf, binary.LittleEndian, op.CursorIDs); err != nil {
+		return errors.Wrap(err, "failed to read CursorIDs")
+	}
+	return nil
+}
+
+func (op *KillCursorsOp) WriteToBuffer(buf io.Writer) error {
+	if err := binary.Write(buf, binary.LittleEndian, int32(0)); err != nil {
+		return errors.Wrap(err, "failed to write ZERO")
+	}
+	if err := binary.Write(buf, binary.LittleEndian, int32(len(op.CursorIDs))); err != nil {
+		return errors.Wrap(err, "failed to write NumberOfCursorIDs")
+	}
+	if err := binary.Write(buf, binary.LittleEndian, op.CursorIDs); err != nil {
+		return errors.Wrap(err, "failed to write CursorIDs")
+	}
+	return nil
+}
+
+func (op *KillCursorsOp) Size() int32 {
+	// ZERO, count, cursor IDs
+	return 4 + 4 + 8*int32(len(op.CursorIDs))
+}
+
+func (op *KillCursorsOp) Opcode() Opcode {
+	return Opcode_KILL_CURSORS
+}
+
+func (op KillCursorsOp) String() string {
+	return fmt.Sprintf("<KillCursorsOp CursorIDs=%v>", op.CursorIDs)
+}
@@ -0,0 +1,107 @@
+package mongo
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// MaxMessageSize - Largest message accepted off the wire, matching the
+// maxMessageSizeBytes advertised during negotiation.
+const MaxMessageSize = 48000000
+
+// Message - A single framed wire protocol message. The body is kept raw so
+// it can be forwarded untouched after the header is rewritten.
+type Message struct {
+	Head MsgHead
+	Body []byte
+}
+
+// NewMessage - Serialize an Op into a framed message.
+func NewMessage(op Op, responseID, responseTo int32) (*Message, error) {
+	head := NewMsgHead(op, responseID, responseTo)
+	var body bytes.Buffer
+	if err := op.WriteToBuffer(&body); err != nil {
+		return nil, err
+	}
+	return &Message{
+		Head: *head,
+		Body: body.Bytes(),
+	}, nil
+}
+
+// ReadMessage - Read exactly one message from r.
+func ReadMessage(r io.Reader) (*Message, error) {
+	msg := &Message{}
+	if err := msg.Head.ReadFromBuffer(r); err != nil {
+		return nil, err
+	}
+	if msg.Head.TotalLen < MsgHeadSize() || msg.Head.TotalLen > MaxMessageSize {
+		return nil, errors.Errorf("invalid message length %d", msg.Head.TotalLen)
+	}
+	msg.Body = make([]byte, msg.Head.TotalLen-MsgHeadSize())
+	if _, err := io.ReadFull(r, msg.Body); err != nil {
+		return nil, errors.Wrap(err, "failed to read message body")
+	}
+	return msg, nil
+}
+
+// Bytes - The full message including its header.
+func (m *Message) Bytes() []byte {
+	var buf bytes.Buffer
+	buf.Grow(int(MsgHeadSize()) + len(m.Body))
+	m.Head.WriteToBuffer(&buf)
+	buf.Write(m.Body)
+	return buf.Bytes()
+}
+
+// BodyBuffer - A fresh buffer over the body for decoding the op.
+func (m *Message) BodyBuffer() *bytes.Buffer {
+	return bytes.NewBuffer(m.Body)
+}
+
+// WriteTo - Write the message in a single call so concurrent writers
+// holding a lock cannot interleave partial messages.
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(m.Bytes())
+	return int64(n), err
+}
+
+// Decode - Read the op of the message, for the opcodes this package can
+// read.
+func (m *Message) Decode() (fmt.Stringer, error) {
+	buf := m.BodyBuffer()
+	switch m.Head.Opcode {
+	case Opcode_QUERY:
+		op := QueryOp{}
+		err := op.ReadFromBuffer(buf)
+		return op, err
+	case Opcode_REPLY:
+		op := ReplyOp{}
+		err := op.ReadFromBuffer(buf)
+		return op, err
+	case Opcode_COMMAND:
+		op := CommandOp{}
+		err := op.ReadFromBuffer(buf)
+		return op, err
+	case Opcode_COMMANDREPLY:
+		op := CommandReplyOp{}
+		err := op.ReadFromBuffer(buf)
+		return op, err
+	case Opcode_GET_MORE:
+		op := GetMoreOp{}
+		err := op.ReadFromBuffer(buf)
+		return op, err
+	case Opcode_KILL_CURSORS:
+		op := KillCursorsOp{}
+		err := op.ReadFromBuffer(buf)
+		return op, err
+	case Opcode_MSG:
+		op := MsgOp{}
+		err := op.ReadFromBuffer(buf)
+		return op, err
+	}
+	return nil, errors.Errorf("cannot decode opcode %s", m.Head.Opcode)
+}
@@ -0,0 +1,114 @@
+package mongo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type MsgOpFlags uint32
+
+const (
+	MsgFlagChecksumPresent MsgOpFlags = 1 << 0
+	// MsgFlagMoreToCome is set on requests that get no reply, and on
+	// replies followed by another one.
+	MsgFlagMoreToCome MsgOpFlags = 1 << 1
+	// MsgFlagExhaustAllowed lets the remote answer with several replies.
+	MsgFlagExhaustAllowed MsgOpFlags = 1 << 16
+)
+
+const (
+	msgSectionBody     byte = 0
+	msgSectionSequence byte = 1
+)
+
+// MsgOp - An OP_MSG. Only the body section is kept: document sequences are
+// skipped when reading, as routing needs nothing but the command.
+type MsgOp struct {
+	Flags MsgOpFlags
+	Body  bson.D
+}
+
+func (op *MsgOp) ReadFromBuffer(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.Wrap(err, "failed to read OP_MSG")
+	}
+	buf := bytes.NewBuffer(data)
+	if err := binary.Read(buf, binary.LittleEndian, &op.Flags); err != nil {
+		return errors.Wrap(err, "failed to read FlagBits")
+	}
+	trailer := 0
+	if op.Flags&MsgFlagChecksumPresent != 0 {
+		trailer = 4
+	}
+	for buf.Len() > trailer {
+		kind, err := buf.ReadByte()
+		if err != nil {
+			return errors.Wrap(err, "failed to read section kind")
+		}
+		if buf.Len() < 4 {
+			return errors.New("failed to read section size")
+		}
+		size := int32(binary.LittleEndian.Uint32(buf.Bytes()))
+		if size < 4 || int(size) > buf.Len() {
+			return errors.Errorf("invalid section size %d", size)
+		}
+		section := buf.Next(int(size))
+		switch kind {
+		case msgSectionBody:
+			if err := bson.Unmarshal(section, &op.Body); err != nil {
+				return errors.Wrap(err, "failed to read body section")
+			}
+		case msgSectionSequence:
+		default:
+			return errors.Errorf("invalid section kind %d", kind)
+		}
+	}
+	return nil
+}
+
+func (op *MsgOp) WriteToBuffer(buf io.Writer) error {
+	if err := binary.Write(buf, binary.LittleEndian, op.Flags&^MsgFlagChecksumPresent); err != nil {
+		return errors.Wrap(err, "failed to write FlagBits")
+	}
+	body, err := bson.Marshal(op.Body)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal body section")
+	}
+	if _, err := buf.Write(append([]byte{msgSectionBody}, body...)); err != nil {
+		return errors.Wrap(err, "failed to write body section")
+	}
+	return nil
+}
+
+func (op *MsgOp) Size() int32 {
+	body, err := bson.Marshal(op.Body)
+	if err != nil {
+		panic(fmt.Sprintf("got error while trying to marshal MsgOp.Body: %+v", err))
+	}
+	// FlagBits, section kind, body
+	return int32(4 + 1 + len(body))
+}
+
+func (op *MsgOp) Opcode() Opcode {
+	return Opcode_MSG
+}
+
+func (op MsgOp) String() string {
+	return fmt.Sprintf("<MsgOp Flags=%d Body=%v>", op.Flags, op.Body)
+}
+
+// CompressedOpcode - The opcode of the message wrapped by an OP_COMPRESSED
+// body.
+func CompressedOpcode(body []byte) (Opcode, bool) {
+	if len(body) < 4 {
+		return 0, false
+	}
+	return Opcode(int32(binary.LittleEndian.Uint32(body))), true
+}
@@ -25,7 +25,7 @@ const (
 	Opcode_QUERY Opcode = 2004
 	// Opcode_GET_MORE
 	// Get more data from a query. See Cursors.
-	Opcode_GET_MORE Opcode = 20
+	Opcode_GET_MORE Opcode = 2005
 	// Opcode_DELETE
 	// Delete documents.
 	Opcode_DELETE Opcode = 2006
@@ -38,6 +38,12 @@ const (
 	// Opcode_COMMANDREPLY
 	// Cluster internal protocol representing a reply to an OP_COMMAND.
 	Opcode_COMMANDREPLY Opcode = 2011
+	// Opcode_COMPRESSED
+	// Another message, compressed.
+	Opcode_COMPRESSED Opcode = 2012
+	// Opcode_MSG
+	// Extensible message format, used for commands since MongoDB 3.6.
+	Opcode_MSG Opcode = 2013
 )
 
 func (o Opcode) String() string {
@@ -62,8 +68,12 @@ func (o Opcode) String() string {
 		return "COMMAND"
 	case Opcode_COMMANDREPLY:
 		return "COMMANDREPLY"
+	case Opcode_COMPRESSED:
+		return "COMPRESSED"
+	case Opcode_MSG:
+		return "MSG"
 	default:
-		panic(fmt.Sprintf("unhandled Opcode: %d", o))
+		return fmt.Sprintf("Opcode(%d)", int32(o))
 	}
 }
 
@@ -77,3 +87,5 @@ type Op interface {
 }
 
 var _ Op = (*ReplyOp)(nil)
+var _ Op = (*KillCursorsOp)(nil)
+var _ Op = (*MsgOp)(nil)
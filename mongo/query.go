@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 
 	"gopkg.in/mgo.v2/bson"
 
@@ -20,6 +21,8 @@ const (
 	QueryFlagLogReplay
 	QueryFlagNoCursorTimeout
 	QueryFlagAwaitData
+	QueryFlagExhaust
+	QueryFlagPartial
 )
 
 func (f QueryOpFlags) String() string {
@@ -40,6 +43,12 @@ func (f QueryOpFlags) String() string {
 	if (f & QueryFlagAwaitData) != 0 {
 		flags = append(flags, "awaitData")
 	}
+	if (f & QueryFlagExhaust) != 0 {
+		flags = append(flags, "exhaust")
+	}
+	if (f & QueryFlagPartial) != 0 {
+		flags = append(flags, "partial")
+	}
 
 	buf.WriteByte('[')
 	for i, flag := range flags {
@@ -114,6 +123,36 @@ func (op *QueryOp) ReadFromBuffer(buf *bytes.Buffer) error {
 	return nil
 }
 
+func (op *QueryOp) WriteToBuffer(buf io.Writer) error {
+	if err := binary.Write(buf, binary.LittleEndian, &op.Flags); err != nil {
+		return errors.Wrap(err, "failed to write Flags")
+	}
+
+	if err := bytesutil.WriteCString(buf, op.Collection); err != nil {
+		return errors.Wrap(err, "failed to write Collection")
+	}
+
+	if err := binary.Write(buf, binary.LittleEndian, &op.Skip); err != nil {
+		return errors.Wrap(err, "failed to write Skip")
+	}
+
+	if err := binary.Write(buf, binary.LittleEndian, &op.Limit); err != nil {
+		return errors.Wrap(err, "failed to write Limit")
+	}
+
+	if _, err := bytesutil.WriteBSON(buf, op.Query); err != nil {
+		return errors.Wrap(err, "failed to write Query")
+	}
+
+	if len(op.Selector) == 0 {
+		return nil
+	}
+	if _, err := bytesutil.WriteBSON(buf, op.Selector); err != nil {
+		return errors.Wrap(err, "failed to write Selector")
+	}
+	return nil
+}
+
 func (op QueryOp) String() string {
 	return fmt.Sprintf("<QueryOp Collection=%s Skip=%d Limit=%d Query=%v Selector=%v Flags=%s>", op.Collection, op.Skip, op.Limit, op.Query, op.Selector, op.Flags)
 }
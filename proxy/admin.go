@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The admin API serves JSON over HTTP:
+//
+//	GET    /connections       the open connections, with their operations and cursors
+//	GET    /connections/<id>  one connection
+//	DELETE /connections/<id>  close a connection
+//	GET    /cursors           the open cursors of translated queries
+//	DELETE /cursors/<id>      close a cursor
+//
+// It has no authentication, so it should only listen where operators can
+// reach it.
+
+// Admin - The admin API over the connections and cursors of the proxy.
+type Admin struct {
+	Connections *Connections
+	Sessions    *Sessions
+}
+
+// NewAdmin - Serve the admin API of connections and the cursors of sessions.
+func NewAdmin(connections *Connections, sessions *Sessions) *Admin {
+	return &Admin{Connections: connections, Sessions: sessions}
+}
+
+// ServeHTTP - Answer a request of the admin API.
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "connections":
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		adminReply(w, http.StatusOK, a.Connections.List(a.Sessions))
+	case len(parts) == 2 && parts[0] == "connections":
+		id, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			adminError(w, http.StatusBadRequest, "invalid connection id %q", parts[1])
+			return
+		}
+		if !allowMethods(w, r, http.MethodGet, http.MethodDelete) {
+			return
+		}
+		if r.Method == http.MethodDelete {
+			if !a.Connections.Kill(id) {
+				adminError(w, http.StatusNotFound, "connection %d not found", id)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		info, ok := a.Connections.Info(id, a.Sessions)
+		if !ok {
+			adminError(w, http.StatusNotFound, "connection %d not found", id)
+			return
+		}
+		adminReply(w, http.StatusOK, info)
+	case len(parts) == 1 && parts[0] == "cursors":
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		adminReply(w, http.StatusOK, a.Sessions.Cursors())
+	case len(parts) == 2 && parts[0] == "cursors":
+		id, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			adminError(w, http.StatusBadRequest, "invalid cursor id %q", parts[1])
+			return
+		}
+		if !allowMethods(w, r, http.MethodDelete) {
+			return
+		}
+		if !a.Sessions.KillCursor(id) {
+			adminError(w, http.StatusNotFound, "cursor %d not found", id)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		adminError(w, http.StatusNotFound, "no such endpoint %s", r.URL.Path)
+	}
+}
+
+// allowMethods - Whether the request uses one of the methods, answering
+// 405 when it does not.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	adminError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	return false
+}
+
+// adminReply - Answer with v as JSON.
+func adminReply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// adminError - Answer with an error message.
+func adminError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	adminReply(w, status, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
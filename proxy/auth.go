@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/lego/mongotunnel/util/context"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Handles client authentication that the proxy can answer itself. The
+// identity of a client stays with the proxy: the remote connection is not
+// authenticated as it, since that takes the client's private key. It gates
+// the operations of other connections and, with RequireIdentity, the
+// translated commands.
+
+const mechanismX509 = "MONGODB-X509"
+
+// refusesTranslation - Whether the client may not have its commands
+// translated.
+func (p *Proxy) refusesTranslation(ctx *context.Context) bool {
+	return p.RequireIdentity && ctx.Identity == nil
+}
+
+func isX509Authenticate(query mongo.QueryOp) bool {
+	doc := query.Query.Map()
+	return doc["mechanism"] == mechanismX509
+}
+
+// createX509AuthReply - Authenticate the client as the subject DN of its
+// verified TLS certificate. Drivers send the DN as `user`, which is
+// optional since MongoDB 3.4.
+func createX509AuthReply(ctx *context.Context, query mongo.QueryOp) (mongo.Op, error) {
+	database := strings.TrimSuffix(query.Collection, ".$cmd")
+	doc := query.Query.Map()
+	user, _ := doc["user"].(string)
+
+	identity, cmdErr := authenticateX509(ctx, database, user)
+	if cmdErr != nil {
+		ctx.Log.Warn("X.509 authentication failed: %s", cmdErr)
+		return newReply(cmdErr.Document()), nil
+	}
+
+	ctx.SetIdentity(identity)
+	ctx.Log.Info("Authenticated %q via %s", identity.User, identity.Mechanism)
+	return newReply(bson.D{
+		bson.DocElem{"dbname", identity.Database},
+		bson.DocElem{"user", identity.User},
+		bson.DocElem{"ok", 1},
+	}), nil
+}
+
+func authenticateX509(ctx *context.Context, database, user string) (*context.Identity, *mongo.CommandError) {
+	if database != "$external" {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "X.509 authentication must always use the $external database.")
+	}
+	if ctx.TLS == nil || len(ctx.TLS.VerifiedChains) == 0 || len(ctx.TLS.PeerCertificates) == 0 {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeAuthenticationFailed, "No verified subject name available from client")
+	}
+
+	subject := ctx.TLS.PeerCertificates[0].Subject.String()
+	if user != "" && !equalDN(user, subject) {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeAuthenticationFailed, "Username %q does not match the provided client certificate user %q", user, subject)
+	}
+
+	return &context.Identity{
+		User:      subject,
+		Database:  database,
+		Mechanism: mechanismX509,
+	}, nil
+}
+
+// equalDN - Compare two RFC 2253 distinguished names, ignoring the case of
+// attribute types and whitespace around separators.
+func equalDN(a, b string) bool {
+	as, bs := splitDN(a), splitDN(b)
+	if len(as) != len(bs) {
+		return false
+	}
+	for i := range as {
+		if as[i] != bs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func splitDN(dn string) []string {
+	var parts []string
+	var part strings.Builder
+	flush := func() {
+		rdn := strings.TrimSpace(part.String())
+		if i := strings.IndexByte(rdn, '='); i >= 0 {
+			rdn = strings.ToUpper(strings.TrimSpace(rdn[:i])) + "=" + strings.TrimSpace(rdn[i+1:])
+		}
+		parts = append(parts, rdn)
+		part.Reset()
+	}
+
+	escaped := false
+	for _, r := range dn {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ',' || r == ';':
+			flush()
+			continue
+		}
+		part.WriteRune(r)
+	}
+	flush()
+	return parts
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/lego/mongotunnel/util/context"
+	"github.com/lego/mongotunnel/util/log"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestEqualDN(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"CN=client,OU=eng,O=lego", "CN=client,OU=eng,O=lego", true},
+		{"cn=client, ou=eng, o=lego", "CN=client,OU=eng,O=lego", true},
+		{"CN=client;OU=eng;O=lego", "CN=client,OU=eng,O=lego", true},
+		{"CN=Client,OU=eng,O=lego", "CN=client,OU=eng,O=lego", false},
+		{"CN=client,OU=eng", "CN=client,OU=eng,O=lego", false},
+		{"OU=eng,CN=client,O=lego", "CN=client,OU=eng,O=lego", false},
+		{`CN=a\,b,O=lego`, `CN=a\,b,O=lego`, true},
+		{`CN=a\,b,O=lego`, `CN=a,b,O=lego`, false},
+	}
+	for _, test := range tests {
+		if got := equalDN(test.a, test.b); got != test.want {
+			t.Errorf("equalDN(%q, %q) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestAuthenticateX509(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "client", Organization: []string{"lego"}}}
+	verified := &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	}
+	unverified := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	const subject = "CN=client,O=lego"
+
+	tests := []struct {
+		name     string
+		tls      *tls.ConnectionState
+		database string
+		user     string
+		code     mongo.ErrorCode
+	}{
+		{"subject as user", verified, "$external", subject, 0},
+		{"user left out", verified, "$external", "", 0},
+		{"user in another form", verified, "$external", "cn=client, o=lego", 0},
+		{"other user", verified, "$external", "CN=other,O=lego", mongo.ErrorCodeAuthenticationFailed},
+		{"other database", verified, "admin", subject, mongo.ErrorCodeBadValue},
+		{"without TLS", nil, "$external", subject, mongo.ErrorCodeAuthenticationFailed},
+		{"unverified certificate", unverified, "$external", subject, mongo.ErrorCodeAuthenticationFailed},
+	}
+	for _, test := range tests {
+		ctx := context.NewContext(&log.NullLogger{})
+		ctx.SetTLSState(test.tls)
+		identity, cmdErr := authenticateX509(ctx, test.database, test.user)
+		if test.code != 0 {
+			if cmdErr == nil || cmdErr.Code != test.code {
+				t.Errorf("%s: error %v, want code %d", test.name, cmdErr, test.code)
+			}
+			continue
+		}
+		if cmdErr != nil {
+			t.Errorf("%s: %v", test.name, cmdErr)
+			continue
+		}
+		if identity.User != subject || identity.Database != "$external" || identity.Mechanism != mechanismX509 {
+			t.Errorf("%s: identity %+v", test.name, identity)
+		}
+	}
+}
+
+func TestRequireIdentity(t *testing.T) {
+	query := mongo.QueryOp{Collection: "admin.$cmd", Query: bson.D{bson.DocElem{"startSession", 1}}}
+	tests := []struct {
+		name            string
+		requireIdentity bool
+		identity        *context.Identity
+		refused         bool
+	}{
+		{name: "not required"},
+		{name: "anonymous", requireIdentity: true, refused: true},
+		{name: "authenticated", requireIdentity: true, identity: &context.Identity{User: "CN=client", Database: "$external", Mechanism: mechanismX509}},
+	}
+	for _, test := range tests {
+		p := &Proxy{Sessions: NewSessions(), RequireIdentity: test.requireIdentity}
+		ctx := context.NewContext(&log.NullLogger{})
+		ctx.SetIdentity(test.identity)
+		_, err := p.handleSQL(ctx, query)
+		p.Sessions.Close()
+		if test.refused {
+			if code := commandErrorCode(err); code != mongo.ErrorCodeUnauthorized {
+				t.Errorf("%s: got %v, want Unauthorized", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package proxy
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/lego/mongotunnel/util/context"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The catalog commands answer from CockroachDB's catalog and change it with
+// DDL. Databases are databases and collections are the tables and views of
+// their public schema. Listings are SELECTs over the catalog, so that their
+// filters compile like any query filter.
+
+// systemDatabases - CockroachDB databases that are not listed.
+var systemDatabases = []string{"system", metadataDatabase}
+
+// collectionColumns - The columns a collection needs before any document
+// is written. Other fields become JSONB columns as they are used, see
+// addColumns.
+const collectionColumns = `("_id" TEXT PRIMARY KEY)`
+
+// handleListDatabases - Answer listDatabases. CockroachDB does not size
+// databases cheaply, so every database reports a size of zero.
+func handleListDatabases(ctx *context.Context, query mongo.QueryOp) (mongo.Op, error) {
+	m := query.Query.Map()
+	catalog := fmt.Sprintf(`SELECT d.database_name AS name, 0 AS "sizeOnDisk", count(t.table_name) = 0 AS empty `+
+		`FROM [SHOW DATABASES] AS d `+
+		`LEFT JOIN "".information_schema.tables AS t ON t.table_catalog = d.database_name AND t.table_schema = 'public' `+
+		`WHERE d.database_name NOT IN (%s) `+
+		`GROUP BY d.database_name`, quotedList(systemDatabases))
+	compiler := newCatalogCompiler(catalog, []column{{"name", false}, {"sizeOnDisk", false}, {"empty", false}})
+	if err := listingFilter(compiler, m["filter"], m["nameOnly"]); err != nil {
+		return nil, err
+	}
+	compiler.block.orderBy = []string{`"name"`}
+	docs, err := queryDocuments(ctx, compiler)
+	if err != nil {
+		return nil, err
+	}
+	if truthy(m["nameOnly"]) {
+		return newReply(bson.D{
+			bson.DocElem{"databases", docs},
+			bson.DocElem{"ok", 1},
+		}), nil
+	}
+	return newReply(bson.D{
+		bson.DocElem{"databases", docs},
+		bson.DocElem{"totalSize", 0},
+		bson.DocElem{"totalSizeMb", 0},
+		bson.DocElem{"ok", 1},
+	}), nil
+}
+
+// handleListCollections - Answer listCollections with the tables and views
+// of the database.
+func handleListCollections(ctx *context.Context, query mongo.QueryOp) (mongo.Op, error) {
+	databaseName := strings.Split(query.Collection, ".")[0]
+	m := query.Query.Map()
+	catalog := fmt.Sprintf(`SELECT table_name AS name, `+
+		`CASE table_type WHEN 'VIEW' THEN 'view' ELSE 'collection' END AS type, `+
+		`'{}'::JSONB AS options, `+
+		`jsonb_build_object('readOnly', table_type = 'VIEW') AS info `+
+		`FROM %s.information_schema.tables `+
+		`WHERE table_schema = 'public' AND table_type IN ('BASE TABLE', 'VIEW')`, quoteIdent(databaseName))
+	compiler := newCatalogCompiler(catalog, []column{{"name", false}, {"type", false}, {"options", true}, {"info", true}})
+	if err := listingFilter(compiler, m["filter"], m["nameOnly"]); err != nil {
+		return nil, err
+	}
+	compiler.block.orderBy = []string{`"name"`}
+	var docs []interface{}
+	err := probe(ctx, func() error {
+		var err error
+		docs, err = queryDocuments(ctx, compiler)
+		return err
+	})
+	if isUndefinedTable(err) {
+		docs, err = []interface{}{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cursorReply(fmt.Sprintf("%s.$cmd.listCollections", databaseName), docs), nil
+}
+
+// newCatalogCompiler - A compiler reading the rows of a catalog query.
+func newCatalogCompiler(catalog string, columns []column) *pipelineCompiler {
+	name := quoteIdent(internalPrefix + "catalog")
+	return &pipelineCompiler{
+		compilerState: &compilerState{},
+		block:         newSelectBlock("("+catalog+") AS "+name, name, columns),
+	}
+}
+
+// listingFilter - Apply the filter of a listing, and with nameOnly keep
+// just the names, along with the type that drivers expect of collections.
+func listingFilter(compiler *pipelineCompiler, filter, nameOnly interface{}) error {
+	if filter, ok := filter.(bson.D); ok && len(filter) > 0 {
+		if err := compiler.match(filter); err != nil {
+			return err
+		}
+	}
+	if !truthy(nameOnly) {
+		return nil
+	}
+	projection := bson.D{{"_id", 0}, {"name", 1}}
+	if compiler.block.hasColumn("type") {
+		projection = append(projection, bson.DocElem{"type", 1})
+	}
+	return compiler.project(projection)
+}
+
+// handleCreate - Answer create with CREATE TABLE, or CREATE VIEW for a
+// view. The database is created along with its first collection, as
+// MongoDB does.
+func handleCreate(ctx *context.Context, query mongo.QueryOp) (mongo.Op, error) {
+	databaseName := strings.Split(query.Collection, ".")[0]
+	tableName, ok := query.Query[0].Value.(string)
+	if !ok || tableName == "" {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "collection name has invalid type %T", query.Query[0].Value)
+	}
+	m := query.Query.Map()
+	for _, option := range []string{"capped", "timeseries", "clusteredIndex", "validator", "changeStreamPreAndPostImages"} {
+		if v, ok := m[option]; ok && truthy(v) {
+			return nil, mongo.NewCommandError(mongo.ErrorCodeNotImplemented, "the %s option is not supported by the SQL translator", option)
+		}
+	}
+
+	if _, err := tableColumns(ctx, databaseName, tableName); err == nil {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeNamespaceExists, "Collection %s.%s already exists.", databaseName, tableName)
+	} else if !isUndefinedTable(err) {
+		return nil, err
+	}
+
+	var statement string
+	if viewOn, ok := m["viewOn"].(string); ok {
+		pipeline, _ := m["pipeline"].([]interface{})
+		view, err := viewQuery(ctx, databaseName, viewOn, pipeline)
+		if err != nil {
+			return nil, err
+		}
+		statement = fmt.Sprintf("CREATE VIEW %s.%s AS %s", quoteIdent(databaseName), quoteIdent(tableName), view)
+	} else {
+		statement = fmt.Sprintf("CREATE TABLE %s.%s %s", quoteIdent(databaseName), quoteIdent(tableName), collectionColumns)
+	}
+	if err := createDatabase(ctx, databaseName); err != nil {
+		return nil, err
+	}
+	ctx.Log.Debug("sql=%s", statement)
+	if _, err := ctx.SQL().Exec(statement); err != nil {
+		return nil, err
+	}
+	return newReply(bson.D{bson.DocElem{"ok", 1}}), nil
+}
+
+// viewQuery - The SELECT of a view, with the arguments of the pipeline
+// written in as literals.
+func viewQuery(ctx *context.Context, databaseName, viewOn string, pipeline []interface{}) (string, error) {
+	columns, err := tableColumns(ctx, databaseName, viewOn)
+	if isUndefinedTable(err) {
+		return "", mongo.NewCommandError(mongo.ErrorCodeNotImplemented, "views on the collection %s.%s, which does not exist, are not supported by the SQL translator", databaseName, viewOn)
+	}
+	if err != nil {
+		return "", err
+	}
+	columnsOf := func(collection string) ([]column, error) {
+		return tableColumns(ctx, databaseName, collection)
+	}
+	compiler := newPipelineCompiler(databaseName, viewOn, columns, columnsOf)
+	compiler.inline = true
+	for _, stage := range pipeline {
+		if err := compiler.stage(stage); err != nil {
+			return "", err
+		}
+	}
+	statement, _ := compiler.SQL()
+	return statement, nil
+}
+
+// createCollection - Create the table of a collection that does not exist
+// yet, for commands that create it implicitly.
+func createCollection(ctx *context.Context, databaseName, tableName string) error {
+	if err := createDatabase(ctx, databaseName); err != nil {
+		return err
+	}
+	statement := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s.%s %s", quoteIdent(databaseName), quoteIdent(tableName), collectionColumns)
+	ctx.Log.Debug("sql=%s", statement)
+	_, err := ctx.SQL().Exec(statement)
+	return err
+}
+
+// addColumns - Add JSONB columns for top-level fields the table does not
+// have yet.
+func addColumns(ctx *context.Context, databaseName, tableName string, columns []column, fields []string) ([]column, error) {
+	columns, statements := addColumnStatements(databaseName, tableName, columns, fields)
+	for _, statement := range statements {
+		ctx.Log.Debug("sql=%s", statement)
+		if _, err := ctx.SQL().Exec(statement); err != nil {
+			return nil, err
+		}
+	}
+	return columns, nil
+}
+
+// addColumnStatements - The columns of the table once the top-level fields
+// it does not have yet are added, and the statements adding them.
+func addColumnStatements(databaseName, tableName string, columns []column, fields []string) ([]column, []string) {
+	have := make(map[string]bool, len(columns))
+	for _, col := range columns {
+		have[col.name] = true
+	}
+	var statements []string
+	for _, field := range fields {
+		if have[field] {
+			continue
+		}
+		statements = append(statements, fmt.Sprintf("ALTER TABLE %s.%s ADD COLUMN IF NOT EXISTS %s JSONB", quoteIdent(databaseName), quoteIdent(tableName), quoteIdent(field)))
+		have[field] = true
+		columns = append(columns, column{field, true})
+	}
+	return columns, statements
+}
+
+func createDatabase(ctx *context.Context, databaseName string) error {
+	statement := "CREATE DATABASE IF NOT EXISTS " + quoteIdent(databaseName)
+	ctx.Log.Debug("sql=%s", statement)
+	_, err := ctx.SQL().Exec(statement)
+	return err
+}
+
+// collectionType - The table_type of a table or view, or "" if there is
+// none by that name.
+func collectionType(ctx *context.Context, databaseName, tableName string) (string, error) {
+	statement := fmt.Sprintf("SELECT table_type FROM %s.information_schema.tables WHERE table_schema = 'public' AND table_name = $1", quoteIdent(databaseName))
+	var tableType string
+	err := probe(ctx, func() error {
+		return ctx.SQL().QueryRow(statement, tableName).Scan(&tableType)
+	})
+	if err == sql.ErrNoRows || isUndefinedTable(err) {
+		return "", nil
+	}
+	return tableType, err
+}
+
+// handleDrop - Answer drop with DROP TABLE, or DROP VIEW for a view.
+func handleDrop(ctx *context.Context, query mongo.QueryOp) (mongo.Op, error) {
+	databaseName := strings.Split(query.Collection, ".")[0]
+	tableName, ok := query.Query[0].Value.(string)
+	if !ok {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "collection name has invalid type %T", query.Query[0].Value)
+	}
+	tableType, err := collectionType(ctx, databaseName, tableName)
+	if err != nil {
+		return nil, err
+	}
+	ns := fmt.Sprintf("%s.%s", databaseName, tableName)
+	if tableType == "" {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeNamespaceNotFound, "ns not found")
+	}
+
+	reply := bson.D{}
+	statement := fmt.Sprintf("DROP VIEW %s.%s", quoteIdent(databaseName), quoteIdent(tableName))
+	if tableType != "VIEW" {
+		indexes, err := backendIndexes(ctx, databaseName, tableName)
+		if err != nil {
+			return nil, err
+		}
+		reply = append(reply, bson.DocElem{"nIndexesWas", len(indexes)})
+		statement = fmt.Sprintf("DROP TABLE %s.%s CASCADE", quoteIdent(databaseName), quoteIdent(tableName))
+	}
+	ctx.Log.Debug("sql=%s", statement)
+	if _, err := ctx.SQL().Exec(statement); err != nil {
+		return nil, err
+	}
+	return newReply(append(reply, bson.DocElem{"ns", ns}, bson.DocElem{"ok", 1})), nil
+}
+
+// handleDropDatabase - Answer dropDatabase. Dropping a database that does
+// not exist succeeds, like in MongoDB.
+func handleDropDatabase(ctx *context.Context, query mongo.QueryOp) (mongo.Op, error) {
+	databaseName := strings.Split(query.Collection, ".")[0]
+	for _, name := range systemDatabases {
+		if name == databaseName {
+			return nil, mongo.NewCommandError(mongo.ErrorCodeIllegalOperation, "Cannot drop the %s database", databaseName)
+		}
+	}
+	statement := fmt.Sprintf("DROP DATABASE IF EXISTS %s CASCADE", quoteIdent(databaseName))
+	ctx.Log.Debug("sql=%s", statement)
+	if _, err := ctx.SQL().Exec(statement); err != nil {
+		return nil, err
+	}
+	return newReply(bson.D{
+		bson.DocElem{"dropped", databaseName},
+		bson.DocElem{"ok", 1},
+	}), nil
+}
+
+// handleRenameCollection - Answer renameCollection, which is run on admin
+// with full namespaces. CockroachDB cannot move tables between databases.
+func handleRenameCollection(ctx *context.Context, query mongo.QueryOp) (mongo.Op, error) {
+	m := query.Query.Map()
+	from, _ := query.Query[0].Value.(string)
+	to, _ := m["to"].(string)
+	fromDatabase, fromTable := splitNamespace(from)
+	toDatabase, toTable := splitNamespace(to)
+	switch {
+	case fromTable == "" || toTable == "":
+		return nil, mongo.NewCommandError(mongo.ErrorCodeInvalidNamespace, "Invalid namespace specified '%s'", from+" to "+to)
+	case fromDatabase != toDatabase:
+		return nil, mongo.NewCommandError(mongo.ErrorCodeNotImplemented, "renaming collections across databases is not supported by the SQL translator")
+	}
+
+	fromType, err := collectionType(ctx, fromDatabase, fromTable)
+	if err != nil {
+		return nil, err
+	}
+	if fromType == "" {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeNamespaceNotFound, "Source collection %s does not exist", from)
+	}
+	toType, err := collectionType(ctx, toDatabase, toTable)
+	if err != nil {
+		return nil, err
+	}
+
+	var statements []string
+	if toType != "" {
+		if !truthy(m["dropTarget"]) {
+			return nil, mongo.NewCommandError(mongo.ErrorCodeNamespaceExists, "target namespace exists")
+		}
+		kind := "TABLE"
+		if toType == "VIEW" {
+			kind = "VIEW"
+		}
+		statements = append(statements, fmt.Sprintf("DROP %s %s.%s CASCADE", kind, quoteIdent(toDatabase), quoteIdent(toTable)))
+	}
+	kind := "TABLE"
+	if fromType == "VIEW" {
+		kind = "VIEW"
+	}
+	statements = append(statements, fmt.Sprintf("ALTER %s %s.%s RENAME TO %s", kind, quoteIdent(fromDatabase), quoteIdent(fromTable), quoteIdent(toTable)))
+
+	if err := execAtomically(ctx, statements); err != nil {
+		return nil, err
+	}
+	return newReply(bson.D{bson.DocElem{"ok", 1}}), nil
+}
+
+// execAtomically - Run statements in a transaction of their own, unless
+// the request is already part of one.
+func execAtomically(ctx *context.Context, statements []string) error {
+	if ctx.Tx != nil {
+		for _, statement := range statements {
+			ctx.Log.Debug("sql=%s", statement)
+			if _, err := ctx.Tx.ExecContext(ctx.RequestContext(), statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	tx, err := ctx.DB.BeginTx(ctx.RequestContext(), nil)
+	if err != nil {
+		return err
+	}
+	for _, statement := range statements {
+		ctx.Log.Debug("sql=%s", statement)
+		if _, err := tx.ExecContext(ctx.RequestContext(), statement); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// splitNamespace - Split database.collection. The collection is everything
+// after the first dot.
+func splitNamespace(ns string) (database, collection string) {
+	parts := strings.SplitN(ns, ".", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func quotedList(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = quoteString(v)
+	}
+	return strings.Join(quoted, ", ")
+}
@@ -0,0 +1,552 @@
+package proxy
+
+import (
+	"bytes"
+	gocontext "context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/lego/mongotunnel/util/context"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A change stream ($changeStream) reads a core changefeed of the table,
+// which streams the rows written to it with their HLC timestamp. Each row
+// becomes a change event, and the cursor of the stream never ends. Resume
+// tokens hold the timestamp and primary key of an event, or a resolved
+// timestamp, so that resuming starts the changefeed from that timestamp.
+//
+// The changefeed emits the rows of different keys in no particular order,
+// even within a timestamp, and only promises that a resolved timestamp
+// comes after every row up to it. Rows therefore wait for the resolved
+// timestamp covering them, and become events ordered by timestamp and then
+// by key, so that resuming after an event skips exactly the events before
+// it.
+
+// changefeedResolved - How often the changefeed reports resolved
+// timestamps, which advance the resume token while nothing changes.
+const changefeedResolved = "1s"
+
+// isChangeStream - Whether a command is an aggregate with $changeStream.
+func isChangeStream(query bson.D) bool {
+	if query[0].Name != "aggregate" {
+		return false
+	}
+	pipeline, _ := query.Map()["pipeline"].([]interface{})
+	if len(pipeline) == 0 {
+		return false
+	}
+	stage, ok := pipeline[0].(bson.D)
+	return ok && len(stage) == 1 && stage[0].Name == "$changeStream"
+}
+
+// watch - Answer an aggregate with $changeStream with the cursor of a
+// change stream.
+func (s *Sessions) watch(ctx *context.Context, query mongo.QueryOp, session string) (mongo.Op, error) {
+	databaseName := strings.Split(query.Collection, ".")[0]
+	tableName, ok := query.Query[0].Value.(string)
+	if !ok {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeNotImplemented, "change streams on a database are not supported by the SQL translator")
+	}
+	pipeline := query.Query.Map()["pipeline"].([]interface{})
+	if len(pipeline) > 1 {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeNotImplemented, "stages after $changeStream are not supported by the SQL translator")
+	}
+	options, _ := pipeline[0].(bson.D)[0].Value.(bson.D)
+	m := options.Map()
+	if truthy(m["allChangesForCluster"]) {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeNotImplemented, "allChangesForCluster is not supported by the SQL translator")
+	}
+
+	cs := &changeStream{
+		database:     databaseName,
+		table:        tableName,
+		fullDocument: m["fullDocument"] != nil && m["fullDocument"] != "default",
+	}
+	var start string
+	token := m["startAfter"]
+	if token == nil {
+		token = m["resumeAfter"]
+	}
+	switch {
+	case token != nil:
+		t, err := parseResumeToken(token)
+		if err != nil {
+			return nil, err
+		}
+		cs.token = t
+		start = t.updated
+		if t.key != "" {
+			// Events of the same timestamp may follow the token, so the
+			// changefeed starts just before it and skips up to it.
+			cs.resumeAfter = &t
+			start = previousHLC(t.updated)
+		}
+	case m["startAtOperationTime"] != nil:
+		ts, ok := m["startAtOperationTime"].(bson.MongoTimestamp)
+		if !ok {
+			return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "startAtOperationTime must be a timestamp")
+		}
+		start = previousHLC(timestampHLC(ts))
+		cs.token = resumeToken{updated: start}
+	default:
+		if err := ctx.DB.QueryRowContext(ctx.RequestContext(), "SELECT cluster_logical_timestamp()::STRING").Scan(&start); err != nil {
+			return nil, err
+		}
+		cs.token = resumeToken{updated: start}
+	}
+	if _, _, err := parseHLC(start); err != nil {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "invalid resume token: %s", err)
+	}
+
+	if err := createCollection(ctx, databaseName, tableName); err != nil {
+		return nil, err
+	}
+	statement := fmt.Sprintf("EXPERIMENTAL CHANGEFEED FOR %s.%s WITH updated, diff, resolved = '%s', cursor = '%s'",
+		quoteIdent(databaseName), quoteIdent(tableName), changefeedResolved, start)
+	ctx.Log.Debug("sql=%s", statement)
+	if err := cs.start(ctx.DB, statement); err != nil {
+		return nil, err
+	}
+
+	c := &cursor{
+		ns:      fmt.Sprintf("%s.%s", databaseName, tableName),
+		session: session,
+		conn:    ctx.ConnID,
+		tail:    cs,
+	}
+	id := s.register(c)
+	return c.reply("firstBatch", []interface{}{}, id), nil
+}
+
+// changeStream - The tail of a change stream cursor.
+type changeStream struct {
+	database, table string
+	fullDocument    bool
+
+	cancel gocontext.CancelFunc
+	done   <-chan struct{}
+	rows   chan changefeedRow
+	// err is why the changefeed ended, set before rows is closed.
+	err error
+
+	// token is the position of the last event or resolved timestamp.
+	token resumeToken
+	// resumeAfter is the token the stream resumes after, until a resolved
+	// timestamp gets past it.
+	resumeAfter *resumeToken
+	// pending are the changes after the last resolved timestamp.
+	pending []change
+	// ready are the events up to the last resolved timestamp, in order,
+	// which getMore has not returned yet.
+	ready []change
+	// resolved is the last resolved timestamp.
+	resolved resumeToken
+}
+
+// change - A changed row of a changefeed, with its position.
+type change struct {
+	token         resumeToken
+	after, before json.RawMessage
+	event         bson.D
+}
+
+// changefeedRow - A row of a core changefeed. Resolved timestamps have no
+// table.
+type changefeedRow struct {
+	table sql.NullString
+	key   []byte
+	value []byte
+}
+
+// start - Run the changefeed, reading its rows in the background.
+func (cs *changeStream) start(db *sql.DB, statement string) error {
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	rows, err := db.QueryContext(ctx, statement)
+	if err != nil {
+		cancel()
+		return err
+	}
+	cs.cancel = cancel
+	cs.done = ctx.Done()
+	cs.rows = make(chan changefeedRow)
+	go cs.read(rows)
+	return nil
+}
+
+func (cs *changeStream) read(rows *sql.Rows) {
+	defer close(cs.rows)
+	defer rows.Close()
+	for rows.Next() {
+		var row changefeedRow
+		if err := rows.Scan(&row.table, &row.key, &row.value); err != nil {
+			cs.err = err
+			return
+		}
+		select {
+		case cs.rows <- row:
+		case <-cs.done:
+			return
+		}
+	}
+	cs.err = rows.Err()
+}
+
+func (cs *changeStream) next(deadline time.Time, n int) ([]interface{}, error) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for len(cs.ready) == 0 {
+		select {
+		case row, ok := <-cs.rows:
+			if !ok {
+				if cs.err == nil {
+					cs.err = errors.New("changefeed ended")
+				}
+				return nil, errors.Wrap(cs.err, "change stream failed")
+			}
+			if err := cs.receive(row); err != nil {
+				return nil, err
+			}
+		case <-timer.C:
+			cs.advance()
+			return []interface{}{}, nil
+		}
+	}
+	// Take the rows that already arrived as well.
+more:
+	for n <= 0 || len(cs.ready) < n {
+		select {
+		case row, ok := <-cs.rows:
+			if !ok {
+				break more
+			}
+			if err := cs.receive(row); err != nil {
+				return nil, err
+			}
+		default:
+			break more
+		}
+	}
+
+	if n <= 0 || n > len(cs.ready) {
+		n = len(cs.ready)
+	}
+	docs := make([]interface{}, n)
+	for i, c := range cs.ready[:n] {
+		docs[i] = c.event
+	}
+	cs.token = cs.ready[n-1].token
+	cs.ready = cs.ready[n:]
+	cs.advance()
+	return docs, nil
+}
+
+// advance - Move the token to the last resolved timestamp once every event
+// up to it has been returned.
+func (cs *changeStream) advance() {
+	if len(cs.ready) == 0 && cs.resolved.updated != "" {
+		cs.token = cs.resolved
+	}
+}
+
+func (cs *changeStream) resumeToken() interface{} {
+	return cs.token.document()
+}
+
+func (cs *changeStream) close() {
+	cs.cancel()
+}
+
+// receive - Take a row of the changefeed: a change waits in pending, and a
+// resolved timestamp moves the changes up to it to ready.
+func (cs *changeStream) receive(row changefeedRow) error {
+	if !row.table.Valid {
+		var resolved struct {
+			Resolved string `json:"resolved"`
+		}
+		if err := json.Unmarshal(row.value, &resolved); err != nil {
+			return errors.Wrap(err, "failed to decode resolved timestamp")
+		}
+		return cs.resolve(resolved.Resolved)
+	}
+
+	var value struct {
+		After   json.RawMessage `json:"after"`
+		Before  json.RawMessage `json:"before"`
+		Updated string          `json:"updated"`
+	}
+	if err := json.Unmarshal(row.value, &value); err != nil {
+		return errors.Wrap(err, "failed to decode changefeed row")
+	}
+	token := resumeToken{updated: value.Updated, key: string(row.key)}
+	if _, _, err := parseHLC(token.updated); err != nil {
+		return err
+	}
+	if cs.skipping(token) {
+		return nil
+	}
+	cs.pending = append(cs.pending, change{token: token, after: value.After, before: value.Before})
+	return nil
+}
+
+// resolve - Turn the pending changes up to a resolved timestamp into
+// events, in order.
+func (cs *changeStream) resolve(resolved string) error {
+	if cs.resumeAfter != nil {
+		c, err := compareHLC(resolved, cs.resumeAfter.updated)
+		if err != nil {
+			return err
+		}
+		if c < 0 {
+			return nil
+		}
+		cs.resumeAfter = nil
+	}
+	sort.SliceStable(cs.pending, func(i, j int) bool {
+		return compareTokens(cs.pending[i].token, cs.pending[j].token) < 0
+	})
+	n := 0
+	for ; n < len(cs.pending); n++ {
+		c, err := compareHLC(cs.pending[n].token.updated, resolved)
+		if err != nil {
+			return err
+		}
+		if c > 0 {
+			break
+		}
+		event, err := cs.event(cs.pending[n])
+		if err != nil {
+			return err
+		}
+		cs.pending[n].event = event
+	}
+	cs.ready = append(cs.ready, cs.pending[:n]...)
+	cs.pending = append([]change(nil), cs.pending[n:]...)
+	cs.resolved = resumeToken{updated: resolved}
+	return nil
+}
+
+// event - The change event of a change.
+func (cs *changeStream) event(c change) (bson.D, error) {
+	key, err := decodeJSON([]byte(c.token.key))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode changefeed key")
+	}
+	var id interface{}
+	if values, ok := key.([]interface{}); ok && len(values) > 0 {
+		id = values[0]
+	}
+	after, err := changedDocument(c.after)
+	if err != nil {
+		return nil, err
+	}
+	before, err := changedDocument(c.before)
+	if err != nil {
+		return nil, err
+	}
+	clusterTime, err := hlcTimestamp(c.token.updated)
+	if err != nil {
+		return nil, err
+	}
+
+	event := bson.D{bson.DocElem{"_id", c.token.document()}}
+	switch {
+	case after == nil:
+		event = append(event, bson.DocElem{"operationType", "delete"})
+	case before == nil:
+		event = append(event, bson.DocElem{"operationType", "insert"})
+	default:
+		event = append(event, bson.DocElem{"operationType", "update"})
+	}
+	event = append(event,
+		bson.DocElem{"clusterTime", clusterTime},
+		bson.DocElem{"ns", bson.D{{"db", cs.database}, {"coll", cs.table}}},
+		bson.DocElem{"documentKey", bson.D{{"_id", id}}},
+	)
+	if after != nil && (before == nil || cs.fullDocument) {
+		event = append(event, bson.DocElem{"fullDocument", after})
+	}
+	if after != nil && before != nil {
+		description, err := updateDescription(before, after)
+		if err != nil {
+			return nil, err
+		}
+		event = append(event, bson.DocElem{"updateDescription", description})
+	}
+	return event, nil
+}
+
+// skipping - Whether a change is at or before the token the stream resumes
+// after, which the client has seen.
+func (cs *changeStream) skipping(token resumeToken) bool {
+	return cs.resumeAfter != nil && compareTokens(token, *cs.resumeAfter) <= 0
+}
+
+// compareTokens - The order of the events of two tokens: by timestamp, and
+// then by key. Tokens that do not parse are equal.
+func compareTokens(a, b resumeToken) int {
+	c, err := compareHLC(a.updated, b.updated)
+	if err != nil || c != 0 {
+		return c
+	}
+	return strings.Compare(a.key, b.key)
+}
+
+// changedDocument - The document of a row image of a changefeed, or nil
+// if there is none. Columns of the translator and CockroachDB are dropped.
+func changedDocument(raw json.RawMessage) (bson.D, error) {
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil, nil
+	}
+	v, err := decodeJSON(raw)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode changefeed row")
+	}
+	doc, _ := v.(bson.D)
+	changed := bson.D{}
+	for _, elem := range doc {
+		if strings.HasPrefix(elem.Name, internalPrefix) || strings.HasPrefix(elem.Name, "crdb_internal_") {
+			continue
+		}
+		changed = append(changed, elem)
+	}
+	return changed, nil
+}
+
+// updateDescription - The fields an update changed. Columns set to NULL
+// are removed fields.
+func updateDescription(before, after bson.D) (bson.D, error) {
+	old := before.Map()
+	updated := bson.D{}
+	removed := []interface{}{}
+	for _, elem := range after {
+		if elem.Value == nil {
+			if old[elem.Name] != nil {
+				removed = append(removed, elem.Name)
+			}
+			continue
+		}
+		a, err := encodeJSON(elem.Value)
+		if err != nil {
+			return nil, err
+		}
+		b, err := encodeJSON(old[elem.Name])
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(a, b) {
+			updated = append(updated, elem)
+		}
+	}
+	return bson.D{
+		bson.DocElem{"updatedFields", updated},
+		bson.DocElem{"removedFields", removed},
+		bson.DocElem{"truncatedArrays", []interface{}{}},
+	}, nil
+}
+
+// resumeToken - A position in a changefeed: the timestamp and primary key
+// of an event, or a resolved timestamp without a key.
+type resumeToken struct {
+	updated string
+	key     string
+}
+
+func (t resumeToken) document() bson.D {
+	return bson.D{bson.DocElem{"_data", hex.EncodeToString([]byte(t.updated + "/" + t.key))}}
+}
+
+func parseResumeToken(v interface{}) (resumeToken, error) {
+	doc, _ := v.(bson.D)
+	data, _ := doc.Map()["_data"].(string)
+	b, err := hex.DecodeString(data)
+	if err != nil || !bytes.Contains(b, []byte("/")) {
+		return resumeToken{}, mongo.NewCommandError(mongo.ErrorCodeBadValue, "invalid resume token %v", v)
+	}
+	parts := strings.SplitN(string(b), "/", 2)
+	return resumeToken{updated: parts[0], key: parts[1]}, nil
+}
+
+// parseHLC - The wall time in nanoseconds and logical counter of an HLC
+// timestamp, as CockroachDB prints it.
+func parseHLC(s string) (int64, int64, error) {
+	parts := strings.SplitN(s, ".", 2)
+	wall, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, errors.Errorf("invalid HLC timestamp %q", s)
+	}
+	var logical int64
+	if len(parts) == 2 {
+		if logical, err = strconv.ParseInt(parts[1], 10, 32); err != nil {
+			return 0, 0, errors.Errorf("invalid HLC timestamp %q", s)
+		}
+	}
+	return wall, logical, nil
+}
+
+func formatHLC(wall, logical int64) string {
+	return fmt.Sprintf("%d.%010d", wall, logical)
+}
+
+func compareHLC(a, b string) (int, error) {
+	aWall, aLogical, err := parseHLC(a)
+	if err != nil {
+		return 0, err
+	}
+	bWall, bLogical, err := parseHLC(b)
+	if err != nil {
+		return 0, err
+	}
+	if aWall != bWall {
+		return compareInt64(aWall, bWall), nil
+	}
+	return compareInt64(aLogical, bLogical), nil
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// previousHLC - The latest timestamp before an HLC timestamp, since
+// changefeeds start after their cursor.
+func previousHLC(s string) string {
+	wall, logical, err := parseHLC(s)
+	if err != nil {
+		return s
+	}
+	if logical > 0 {
+		return formatHLC(wall, logical-1)
+	}
+	return formatHLC(wall-1, math.MaxInt32)
+}
+
+// hlcTimestamp - The BSON timestamp of an HLC timestamp: its seconds and
+// the nanoseconds within them.
+func hlcTimestamp(s string) (bson.MongoTimestamp, error) {
+	wall, _, err := parseHLC(s)
+	if err != nil {
+		return 0, err
+	}
+	return bson.MongoTimestamp(wall/int64(time.Second)<<32 | wall%int64(time.Second)), nil
+}
+
+// timestampHLC - The HLC timestamp of a BSON timestamp, the inverse of
+// hlcTimestamp.
+func timestampHLC(ts bson.MongoTimestamp) string {
+	return formatHLC(int64(ts>>32)*int64(time.Second)+int64(ts&math.MaxUint32), 0)
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func changefeedInsert(updated, id string) changefeedRow {
+	return changefeedRow{
+		table: sql.NullString{String: "t", Valid: true},
+		key:   []byte(fmt.Sprintf(`["%s"]`, id)),
+		value: []byte(fmt.Sprintf(`{"after": {"_id": "%s"}, "before": null, "updated": "%s"}`, id, updated)),
+	}
+}
+
+func changefeedResolvedRow(resolved string) changefeedRow {
+	return changefeedRow{value: []byte(fmt.Sprintf(`{"resolved": "%s"}`, resolved))}
+}
+
+func TestChangeStreamResume(t *testing.T) {
+	const (
+		before = "100.0000000000"
+		at     = "200.0000000000"
+		after  = "300.0000000000"
+	)
+	tests := []struct {
+		name        string
+		resumeAfter *resumeToken
+		rows        []changefeedRow
+		want        []string
+	}{
+		{
+			name: "events in timestamp and key order",
+			rows: []changefeedRow{
+				changefeedInsert(at, "c"),
+				changefeedInsert(before, "z"),
+				changefeedInsert(at, "a"),
+				changefeedResolvedRow(at),
+			},
+			want: []string{"z", "a", "c"},
+		},
+		{
+			name:        "only keys up to the token skipped",
+			resumeAfter: &resumeToken{updated: at, key: `["b"]`},
+			rows: []changefeedRow{
+				changefeedInsert(at, "c"),
+				changefeedInsert(at, "a"),
+				changefeedInsert(at, "b"),
+				changefeedInsert(at, "d"),
+				changefeedResolvedRow(at),
+			},
+			want: []string{"c", "d"},
+		},
+		{
+			name:        "later timestamps kept",
+			resumeAfter: &resumeToken{updated: at, key: `["b"]`},
+			rows: []changefeedRow{
+				changefeedInsert(after, "a"),
+				changefeedInsert(at, "a"),
+				changefeedResolvedRow(after),
+			},
+			want: []string{"a"},
+		},
+		{
+			name: "changes after the resolved timestamp wait",
+			rows: []changefeedRow{
+				changefeedInsert(after, "b"),
+				changefeedInsert(at, "a"),
+				changefeedResolvedRow(at),
+			},
+			want: []string{"a"},
+		},
+	}
+	for _, test := range tests {
+		cs := &changeStream{database: "db", table: "t", resumeAfter: test.resumeAfter}
+		for _, row := range test.rows {
+			if err := cs.receive(row); err != nil {
+				t.Fatalf("%s: receive: %v", test.name, err)
+			}
+		}
+		docs, err := cs.next(time.Now(), 0)
+		if err != nil {
+			t.Fatalf("%s: next: %v", test.name, err)
+		}
+		var ids []string
+		for _, doc := range docs {
+			key := doc.(bson.D).Map()["documentKey"].(bson.D)
+			ids = append(ids, key.Map()["_id"].(string))
+		}
+		if !reflect.DeepEqual(ids, test.want) {
+			t.Errorf("%s: events %v, want %v", test.name, ids, test.want)
+		}
+	}
+}
+
+func TestParseResumeToken(t *testing.T) {
+	tests := []struct {
+		token interface{}
+		want  resumeToken
+		ok    bool
+	}{
+		{resumeToken{updated: "100.0000000001", key: `["a"]`}.document(), resumeToken{updated: "100.0000000001", key: `["a"]`}, true},
+		{resumeToken{updated: "100.0000000001"}.document(), resumeToken{updated: "100.0000000001"}, true},
+		{resumeToken{updated: "100.0000000001", key: `["a/b"]`}.document(), resumeToken{updated: "100.0000000001", key: `["a/b"]`}, true},
+		{bson.D{bson.DocElem{"_data", "not hex"}}, resumeToken{}, false},
+		{bson.D{bson.DocElem{"_data", "313030"}}, resumeToken{}, false},
+		{"100.0000000001", resumeToken{}, false},
+	}
+	for _, test := range tests {
+		token, err := parseResumeToken(test.token)
+		if (err == nil) != test.ok {
+			t.Errorf("parseResumeToken(%v): error %v", test.token, err)
+			continue
+		}
+		if token != test.want {
+			t.Errorf("parseResumeToken(%v) = %+v, want %+v", test.token, token, test.want)
+		}
+	}
+}
+
+func TestCompareHLC(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+		ok   bool
+	}{
+		{"100.0000000000", "100.0000000000", 0, true},
+		{"100", "100.0000000000", 0, true},
+		{"100.0000000001", "100.0000000002", -1, true},
+		{"101.0000000000", "100.0000000009", 1, true},
+		{"99.0000000009", "100.0000000000", -1, true},
+		{"100.x", "100", 0, false},
+		{"", "100", 0, false},
+	}
+	for _, test := range tests {
+		c, err := compareHLC(test.a, test.b)
+		if (err == nil) != test.ok {
+			t.Errorf("compareHLC(%q, %q): error %v", test.a, test.b, err)
+			continue
+		}
+		if c != test.want {
+			t.Errorf("compareHLC(%q, %q) = %d, want %d", test.a, test.b, c, test.want)
+		}
+	}
+}
+
+func TestPreviousHLC(t *testing.T) {
+	tests := []struct {
+		hlc, want string
+	}{
+		{"100.0000000002", "100.0000000001"},
+		{"100.0000000000", "99.2147483647"},
+		{"100", "99.2147483647"},
+	}
+	for _, test := range tests {
+		if previous := previousHLC(test.hlc); previous != test.want {
+			t.Errorf("previousHLC(%q) = %q, want %q", test.hlc, previous, test.want)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Every connection joins the Connections it is given while it is open, so
+// that operators can see what each client is doing and close the ones that
+// misbehave, through the admin API or with currentOp and killOp. Its
+// operations are the requests waiting for their reply, and its cursors the
+// cursors of translated queries it opened. Cursors of the remote stay on
+// the remote.
+
+// errConnectionKilled - Why a connection killed by an operator closed.
+var errConnectionKilled = errors.New("connection killed")
+
+// Connections - The open client connections. Share one between
+// connections.
+type Connections struct {
+	mu      sync.Mutex
+	conns   map[uint64]*Proxy
+	started time.Time
+	created uint64
+	// bytesIn and bytesOut are those of the connections that closed.
+	bytesIn, bytesOut uint64
+	// opcounters counts requests by their kind, as in serverStatus.
+	opcounters map[string]int64
+	lastOpID   int64
+
+	// Operators are the users, by the certificate subject they
+	// authenticated with, who see and kill the operations of every
+	// connection with currentOp and killOp. Other authenticated clients
+	// only reach the connections authenticated as the same user.
+	Operators map[string]bool
+	// UnauthenticatedOps lets every client see and kill the operations of
+	// every connection, even without authenticating with the proxy.
+	UnauthenticatedOps bool
+}
+
+// ConnectionInfo - A client connection and what it is doing.
+type ConnectionInfo struct {
+	ID     uint64    `json:"id"`
+	Client string    `json:"client"`
+	Opened time.Time `json:"opened"`
+	// User and Database are who the client authenticated as, if it did.
+	User     string `json:"user,omitempty"`
+	Database string `json:"db,omitempty"`
+	TLS      bool   `json:"tls"`
+	// BytesIn are read from the client and BytesOut written to it.
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+	// Session is the logical session of the latest command of the client.
+	Session    string          `json:"session,omitempty"`
+	Operations []OperationInfo `json:"operations"`
+	Cursors    []CursorInfo    `json:"cursors"`
+}
+
+// OperationInfo - A request waiting for its reply.
+type OperationInfo struct {
+	OpID      int64     `json:"opid"`
+	RequestID int32     `json:"request_id"`
+	Opcode    string    `json:"opcode"`
+	Command   string    `json:"command,omitempty"`
+	Namespace string    `json:"ns,omitempty"`
+	Route     string    `json:"route"`
+	Session   string    `json:"session,omitempty"`
+	Started   time.Time `json:"started"`
+	RunningMS float64   `json:"running_ms"`
+	// query is the command of the request, for currentOp.
+	query bson.D
+}
+
+// CursorInfo - An open cursor of a translated query.
+type CursorInfo struct {
+	ID        int64  `json:"id"`
+	Namespace string `json:"ns"`
+	// Conn is the ID of the connection that opened the cursor.
+	Conn    uint64 `json:"conn"`
+	Session string `json:"session,omitempty"`
+	// Buffered is how many documents wait for getMore.
+	Buffered  int       `json:"buffered"`
+	Tailable  bool      `json:"tailable"`
+	NoTimeout bool      `json:"no_timeout"`
+	Opened    time.Time `json:"opened"`
+	LastUse   time.Time `json:"last_use"`
+}
+
+// NewConnections - Create an empty Connections.
+func NewConnections() *Connections {
+	return &Connections{
+		conns:      make(map[uint64]*Proxy),
+		started:    time.Now(),
+		opcounters: make(map[string]int64),
+	}
+}
+
+// add - Register an open connection.
+func (c *Connections) add(p *Proxy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conns[p.ctx.ConnID] = p
+	c.created++
+}
+
+// remove - Forget a closed connection.
+func (c *Connections) remove(p *Proxy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conns[p.ctx.ConnID] == p {
+		delete(c.conns, p.ctx.ConnID)
+		c.bytesIn += atomic.LoadUint64(&p.readBytes)
+		c.bytesOut += atomic.LoadUint64(&p.receivedBytes)
+	}
+}
+
+// opID - A new operation ID, unique among all connections.
+func (c *Connections) opID() int64 {
+	return atomic.AddInt64(&c.lastOpID, 1)
+}
+
+// countOp - Count a request in opcounters.
+func (c *Connections) countOp(opcode, command string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.opcounters[opKind(opcode, command)]++
+}
+
+// opKind - The kind of a request, as currentOp and serverStatus name it.
+func opKind(opcode, command string) string {
+	switch opcode {
+	case mongo.Opcode_INSERT.String():
+		return "insert"
+	case mongo.Opcode_UPDATE.String():
+		return "update"
+	case mongo.Opcode_DELETE.String():
+		return "delete"
+	case mongo.Opcode_GET_MORE.String():
+		return "getmore"
+	case mongo.Opcode_QUERY.String():
+		switch command {
+		case "find":
+			return "query"
+		case "insert", "update", "delete":
+			return command
+		case "getMore":
+			return "getmore"
+		}
+	}
+	return "command"
+}
+
+// all - The open connections by ID.
+func (c *Connections) all() []*Proxy {
+	c.mu.Lock()
+	conns := make([]*Proxy, 0, len(c.conns))
+	for _, p := range c.conns {
+		conns = append(conns, p)
+	}
+	c.mu.Unlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ctx.ConnID < conns[j].ctx.ConnID })
+	return conns
+}
+
+// get - The open connection with the ID.
+func (c *Connections) get(id uint64) (*Proxy, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.conns[id]
+	return p, ok
+}
+
+// List - The open connections by ID, with their cursors among those of
+// sessions.
+func (c *Connections) List(sessions *Sessions) []ConnectionInfo {
+	conns := c.all()
+	cursors := sessions.Cursors()
+	infos := make([]ConnectionInfo, len(conns))
+	for i, p := range conns {
+		infos[i] = p.info(cursors)
+	}
+	return infos
+}
+
+// Info - The open connection with the ID.
+func (c *Connections) Info(id uint64, sessions *Sessions) (ConnectionInfo, bool) {
+	p, ok := c.get(id)
+	if !ok {
+		return ConnectionInfo{}, false
+	}
+	return p.info(sessions.Cursors()), true
+}
+
+// Kill - Close the connection with the ID. Returns false when there is no
+// such connection.
+func (c *Connections) Kill(id uint64) bool {
+	p, ok := c.get(id)
+	if ok {
+		p.kill()
+	}
+	return ok
+}
+
+// info - What the connection is doing, with the cursors it opened among
+// cursors.
+func (p *Proxy) info(cursors []CursorInfo) ConnectionInfo {
+	info := ConnectionInfo{
+		ID:         p.ctx.ConnID,
+		Opened:     p.opened,
+		TLS:        p.ctx.TLS != nil,
+		BytesIn:    atomic.LoadUint64(&p.readBytes),
+		BytesOut:   atomic.LoadUint64(&p.receivedBytes),
+		Operations: []OperationInfo{},
+		Cursors:    []CursorInfo{},
+	}
+	if p.client != nil {
+		info.Client = p.client.String()
+	}
+	for _, c := range cursors {
+		if c.Conn == info.ID {
+			info.Cursors = append(info.Cursors, c)
+		}
+	}
+
+	now := time.Now()
+	p.requests.mu.Lock()
+	defer p.requests.mu.Unlock()
+	info.Session = p.requests.session
+	if identity := p.requests.identity; identity != nil {
+		info.User, info.Database = identity.User, identity.Database
+	}
+	for _, req := range p.requests.pending {
+		info.Operations = append(info.Operations, OperationInfo{
+			OpID:      req.opid,
+			RequestID: req.id,
+			Opcode:    req.opcode,
+			Command:   req.command,
+			Namespace: req.namespace,
+			Route:     req.target,
+			Session:   req.session,
+			Started:   req.start,
+			RunningMS: float64(now.Sub(req.start)) / float64(time.Millisecond),
+			query:     req.query,
+		})
+	}
+	sort.Slice(info.Operations, func(i, j int) bool {
+		return info.Operations[i].Started.Before(info.Operations[j].Started)
+	})
+	return info
+}
+
+// kill - Close the connection, failing the requests it is waiting on.
+func (p *Proxy) kill() {
+	p.err("Closed '%s'\n", errConnectionKilled)
+}
+
+// useIdentity - Record who the client authenticated as. The context of the
+// connection is only read by its own goroutine.
+func (p *Proxy) useIdentity() {
+	if p.Connections == nil {
+		return
+	}
+	p.requests.mu.Lock()
+	defer p.requests.mu.Unlock()
+	p.requests.identity = p.ctx.Identity
+}
+
+// Cursors - The open cursors of translated queries, by ID.
+func (s *Sessions) Cursors() []CursorInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	infos := make([]CursorInfo, 0, len(s.cursors))
+	for id, c := range s.cursors {
+		infos = append(infos, CursorInfo{
+			ID:        id,
+			Namespace: c.ns,
+			Conn:      c.conn,
+			Session:   c.session,
+			Buffered:  len(c.docs),
+			Tailable:  c.tail != nil,
+			NoTimeout: c.noTimeout,
+			Opened:    c.opened,
+			LastUse:   c.lastUse,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// KillCursor - Close the cursor with the ID. Returns false when there is no
+// such cursor.
+func (s *Sessions) KillCursor(id int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cursors[id] == nil {
+		return false
+	}
+	s.closeCursor(id)
+	return true
+}
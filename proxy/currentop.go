@@ -0,0 +1,435 @@
+package proxy
+
+import (
+	gocontext "context"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/lego/mongotunnel/util/context"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The commands of ops tooling are answered from the state of the proxy
+// rather than by the remote or CockroachDB: currentOp lists the requests of
+// Connections waiting for their reply, killOp cancels one, serverStatus
+// reports the connections, cursors, opcounters and uptime of the proxy,
+// connectionStatus the user of the connection and buildInfo the version
+// the proxy answers as. A killed request has its SQL statement canceled
+// and fails with Interrupted. Requests forwarded to the remote run on.
+//
+// The statements of a request run under a context.Context derived from
+// that of its connection, so they are canceled when the client goes away,
+// when killOp kills the request, or when the maxTimeMS of the command runs
+// out. The request then fails with Interrupted or MaxTimeMSExpired, as on
+// MongoDB. The maxTimeMS of getMore is how long it waits for the documents
+// of a tail instead, see Sessions.getMore.
+//
+// The proxy answers currentOp and killOp before the remote could check the
+// privileges of the client, so only the users in Connections.Operators, or
+// every client with Connections.UnauthenticatedOps, see and kill the
+// operations of every connection. Other authenticated clients see and kill
+// those of connections authenticated as the same user, and the rest only
+// their own.
+
+// serverVersion - The MongoDB version the proxy answers as, matching the
+// maxWireVersion of ismaster.
+var serverVersion = []int{3, 4, 0, 0}
+
+// proxyCommands - The commands the proxy answers itself.
+var proxyCommands = map[string]func(*Proxy, mongo.QueryOp) (mongo.Op, error){
+	"currentOp":        (*Proxy).handleCurrentOp,
+	"killOp":           (*Proxy).handleKillOp,
+	"serverStatus":     (*Proxy).handleServerStatus,
+	"connectionStatus": (*Proxy).handleConnectionStatus,
+	"buildInfo":        (*Proxy).handleBuildInfo,
+	"buildinfo":        (*Proxy).handleBuildInfo,
+}
+
+// adminCommands - The proxy commands that only run on admin, as on
+// MongoDB.
+var adminCommands = map[string]bool{
+	"currentOp": true,
+	"killOp":    true,
+}
+
+// currentOpOptions - The fields of currentOp that are not filters.
+var currentOpOptions = map[string]bool{
+	"currentOp":       true,
+	"$all":            true,
+	"$ownOps":         true,
+	"comment":         true,
+	"lsid":            true,
+	"maxTimeMS":       true,
+	"$db":             true,
+	"$readPreference": true,
+	"$clusterTime":    true,
+	traceparentField:  true,
+}
+
+// isProxyCommand - Whether the proxy answers query itself.
+func (p *Proxy) isProxyCommand(query mongo.QueryOp) bool {
+	if p.Connections == nil || len(query.Query) == 0 || !strings.HasSuffix(query.Collection, ".$cmd") {
+		return false
+	}
+	_, ok := proxyCommands[query.Query[0].Name]
+	return ok
+}
+
+// handleProxyCommand - Answer a query for which isProxyCommand is true.
+func (p *Proxy) handleProxyCommand(query mongo.QueryOp) (mongo.Op, error) {
+	command := query.Query[0].Name
+	if adminCommands[command] && query.Collection != "admin.$cmd" {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeUnauthorized, "%s may only be run against the admin database.", command)
+	}
+	return proxyCommands[command](p, query)
+}
+
+// startOperation - Record the command of a request for currentOp, and
+// return the context.Context its statements run under, which killOp
+// cancels. The caller cancels it once the request is answered.
+func (p *Proxy) startOperation(requestID int32, command bson.D) (gocontext.Context, gocontext.CancelFunc) {
+	var request gocontext.Context
+	var cancel gocontext.CancelFunc
+	if limit, ok := maxTime(command); ok {
+		request, cancel = gocontext.WithTimeout(p.done, limit)
+	} else {
+		request, cancel = gocontext.WithCancel(p.done)
+	}
+	if p.Connections == nil {
+		return request, cancel
+	}
+	var session string
+	if lsid, ok := command.Map()["lsid"].(bson.D); ok {
+		session = sessionKey(lsid)
+	}
+	p.requests.mu.Lock()
+	defer p.requests.mu.Unlock()
+	if session != "" {
+		p.requests.session = session
+	}
+	if req, ok := p.requests.pending[requestID]; ok {
+		req.query = command
+		req.session = session
+		req.cancel = cancel
+	}
+	return request, cancel
+}
+
+// maxTime - The time limit a command sets with maxTimeMS, or with
+// $maxTimeMS as a legacy query modifier.
+func maxTime(command bson.D) (time.Duration, bool) {
+	if len(command) == 0 || command[0].Name == "getMore" {
+		return 0, false
+	}
+	m := command.Map()
+	ms, ok := toInt64(m["maxTimeMS"])
+	if !ok {
+		ms, ok = toInt64(m["$maxTimeMS"])
+	}
+	if !ok || ms <= 0 {
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+// interruption - The error of a request, as MaxTimeMSExpired when its
+// time limit ran out and as Interrupted when it was killed.
+func interruption(ctx *context.Context, err error) error {
+	if ctx.Request == nil {
+		return err
+	}
+	switch ctx.Request.Err() {
+	case gocontext.DeadlineExceeded:
+		return mongo.NewCommandError(mongo.ErrorCodeMaxTimeMSExpired, "operation exceeded time limit")
+	case gocontext.Canceled:
+		return mongo.NewCommandError(mongo.ErrorCodeInterrupted, "operation was interrupted")
+	}
+	return err
+}
+
+// opConnection - The connection waiting on the operation with the ID, or
+// nil.
+func (c *Connections) opConnection(opid int64) *Proxy {
+	for _, p := range c.all() {
+		p.requests.mu.Lock()
+		for _, req := range p.requests.pending {
+			if req.opid == opid {
+				p.requests.mu.Unlock()
+				return p
+			}
+		}
+		p.requests.mu.Unlock()
+	}
+	return nil
+}
+
+// cancelOp - Cancel the operation with the ID. Returns false when the
+// connection is no longer waiting on it.
+func (p *Proxy) cancelOp(opid int64) bool {
+	p.requests.mu.Lock()
+	for _, req := range p.requests.pending {
+		if req.opid == opid {
+			cancel := req.cancel
+			p.requests.mu.Unlock()
+			if cancel != nil {
+				cancel()
+			}
+			return true
+		}
+	}
+	p.requests.mu.Unlock()
+	return false
+}
+
+// mayManageOps - Whether the client may see and kill the operations of
+// conn, authenticated as user of database. With ownOps, only those of
+// connections authenticated as the same user as the client.
+func (p *Proxy) mayManageOps(conn *Proxy, user, database string, ownOps bool) bool {
+	if conn == p {
+		return true
+	}
+	identity := p.ctx.Identity
+	if !ownOps && (p.Connections.UnauthenticatedOps || identity != nil && p.Connections.Operators[identity.User]) {
+		return true
+	}
+	return identity != nil && user == identity.User && database == identity.Database
+}
+
+// handleCurrentOp - Answer currentOp with the operations of every
+// connection the client may see, or with $all the idle connections as
+// well. Other fields filter the operations by equality.
+func (p *Proxy) handleCurrentOp(query mongo.QueryOp) (mongo.Op, error) {
+	m := query.Query.Map()
+	var filter bson.D
+	for _, e := range query.Query {
+		if currentOpOptions[e.Name] {
+			continue
+		}
+		if v, ok := e.Value.(bson.D); ok && len(v) > 0 && strings.HasPrefix(v[0].Name, "$") {
+			return nil, mongo.NewCommandError(mongo.ErrorCodeNotImplemented, "currentOp filters only support equality, not %s", v[0].Name)
+		}
+		filter = append(filter, e)
+	}
+
+	inprog := []interface{}{}
+	for _, conn := range p.Connections.all() {
+		info := conn.info(nil)
+		if !p.mayManageOps(conn, info.User, info.Database, truthy(m["$ownOps"])) {
+			continue
+		}
+		client := bson.D{
+			bson.DocElem{"desc", fmt.Sprintf("conn%d", info.ID)},
+			bson.DocElem{"connectionId", int64(info.ID)},
+			bson.DocElem{"client", info.Client},
+		}
+		if info.User != "" {
+			client = append(client, bson.DocElem{"effectiveUsers", []interface{}{
+				bson.D{bson.DocElem{"user", info.User}, bson.DocElem{"db", info.Database}},
+			}})
+		}
+		var docs []bson.D
+		for _, op := range info.Operations {
+			command := op.query
+			if command == nil {
+				command = bson.D{}
+			}
+			docs = append(docs, append(client[:len(client):len(client)],
+				bson.DocElem{"active", true},
+				bson.DocElem{"opid", op.OpID},
+				bson.DocElem{"secs_running", int64(op.RunningMS / 1000)},
+				bson.DocElem{"microsecs_running", int64(op.RunningMS * 1000)},
+				bson.DocElem{"op", opKind(op.Opcode, op.Command)},
+				bson.DocElem{"ns", op.Namespace},
+				bson.DocElem{"command", command},
+				bson.DocElem{"route", op.Route},
+				bson.DocElem{"currentOpTime", op.Started.UTC().Format(time.RFC3339Nano)},
+			))
+		}
+		if len(docs) == 0 && truthy(m["$all"]) {
+			docs = append(docs, append(client, bson.DocElem{"active", false}))
+		}
+		for _, doc := range docs {
+			if matchesEquality(doc, filter) {
+				inprog = append(inprog, doc)
+			}
+		}
+	}
+	return newReply(bson.D{
+		bson.DocElem{"inprog", inprog},
+		bson.DocElem{"ok", 1},
+	}), nil
+}
+
+// matchesEquality - Whether each field of filter equals the field of doc.
+func matchesEquality(doc bson.D, filter bson.D) bool {
+	m := doc.Map()
+	for _, e := range filter {
+		v, ok := m[e.Name]
+		if !ok {
+			return false
+		}
+		a, aNumber := toInt64(v)
+		b, bNumber := toInt64(e.Value)
+		if aNumber && bNumber {
+			if a != b {
+				return false
+			}
+			continue
+		}
+		if !reflect.DeepEqual(v, e.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// handleKillOp - Answer killOp, canceling the operation. As on MongoDB,
+// killing an operation that does not exist succeeds, while killing one the
+// client may not see fails with Unauthorized.
+func (p *Proxy) handleKillOp(query mongo.QueryOp) (mongo.Op, error) {
+	opid, ok := toInt64(query.Query.Map()["op"])
+	if !ok {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "Did not provide \"op\" field")
+	}
+	conn := p.Connections.opConnection(opid)
+	if conn == nil {
+		return newReply(bson.D{
+			bson.DocElem{"info", "attempting to kill op"},
+			bson.DocElem{"ok", 1},
+		}), nil
+	}
+	info := conn.info(nil)
+	if !p.mayManageOps(conn, info.User, info.Database, false) {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeUnauthorized, "not authorized on admin to kill op %d", opid)
+	}
+	if conn.cancelOp(opid) {
+		p.ctx.Log.Info("killed op %d", opid)
+	}
+	return newReply(bson.D{
+		bson.DocElem{"info", "attempting to kill op"},
+		bson.DocElem{"ok", 1},
+	}), nil
+}
+
+// status - The counters of serverStatus.
+func (c *Connections) status() (current int, created, bytesIn, bytesOut uint64, opcounters map[string]int64) {
+	conns := c.all()
+	c.mu.Lock()
+	created, bytesIn, bytesOut = c.created, c.bytesIn, c.bytesOut
+	opcounters = make(map[string]int64, len(c.opcounters))
+	for kind, n := range c.opcounters {
+		opcounters[kind] = n
+	}
+	c.mu.Unlock()
+	for _, p := range conns {
+		bytesIn += atomic.LoadUint64(&p.readBytes)
+		bytesOut += atomic.LoadUint64(&p.receivedBytes)
+	}
+	return len(conns), created, bytesIn, bytesOut, opcounters
+}
+
+// handleServerStatus - Answer serverStatus with the state of the proxy.
+func (p *Proxy) handleServerStatus(query mongo.QueryOp) (mongo.Op, error) {
+	current, created, bytesIn, bytesOut, opcounters := p.Connections.status()
+	var sessions, cursors int
+	if p.Sessions != nil {
+		sessions, cursors = p.Sessions.counts()
+	}
+	uptime := time.Since(p.Connections.started)
+	host, _ := os.Hostname()
+
+	var requests int64
+	for _, n := range opcounters {
+		requests += n
+	}
+	return newReply(bson.D{
+		bson.DocElem{"host", host},
+		bson.DocElem{"version", versionString()},
+		bson.DocElem{"process", "mongotunnel"},
+		bson.DocElem{"pid", int64(os.Getpid())},
+		bson.DocElem{"uptime", uptime.Seconds()},
+		bson.DocElem{"uptimeMillis", int64(uptime / time.Millisecond)},
+		bson.DocElem{"uptimeEstimate", int64(uptime / time.Second)},
+		bson.DocElem{"localTime", time.Now()},
+		bson.DocElem{"connections", bson.D{
+			bson.DocElem{"current", current},
+			bson.DocElem{"totalCreated", int64(created)},
+		}},
+		bson.DocElem{"network", bson.D{
+			bson.DocElem{"bytesIn", int64(bytesIn)},
+			bson.DocElem{"bytesOut", int64(bytesOut)},
+			bson.DocElem{"numRequests", requests},
+		}},
+		bson.DocElem{"opcounters", bson.D{
+			bson.DocElem{"insert", opcounters["insert"]},
+			bson.DocElem{"query", opcounters["query"]},
+			bson.DocElem{"update", opcounters["update"]},
+			bson.DocElem{"delete", opcounters["delete"]},
+			bson.DocElem{"getmore", opcounters["getmore"]},
+			bson.DocElem{"command", opcounters["command"]},
+		}},
+		bson.DocElem{"logicalSessionRecordCache", bson.D{
+			bson.DocElem{"activeSessionsCount", sessions},
+		}},
+		bson.DocElem{"metrics", bson.D{
+			bson.DocElem{"cursor", bson.D{
+				bson.DocElem{"open", bson.D{
+					bson.DocElem{"total", int64(cursors)},
+				}},
+			}},
+		}},
+		bson.DocElem{"ok", 1},
+	}), nil
+}
+
+// handleConnectionStatus - Answer connectionStatus with the user the
+// client authenticated as.
+func (p *Proxy) handleConnectionStatus(query mongo.QueryOp) (mongo.Op, error) {
+	users := []interface{}{}
+	if identity := p.ctx.Identity; identity != nil {
+		users = append(users, bson.D{
+			bson.DocElem{"user", identity.User},
+			bson.DocElem{"db", identity.Database},
+		})
+	}
+	return newReply(bson.D{
+		bson.DocElem{"authInfo", bson.D{
+			bson.DocElem{"authenticatedUsers", users},
+			bson.DocElem{"authenticatedUserRoles", []interface{}{}},
+		}},
+		bson.DocElem{"ok", 1},
+	}), nil
+}
+
+// handleBuildInfo - Answer buildInfo with the version the proxy answers
+// as.
+func (p *Proxy) handleBuildInfo(query mongo.QueryOp) (mongo.Op, error) {
+	versionArray := make([]interface{}, len(serverVersion))
+	for i, n := range serverVersion {
+		versionArray[i] = n
+	}
+	return newReply(bson.D{
+		bson.DocElem{"version", versionString()},
+		bson.DocElem{"gitVersion", "mongotunnel"},
+		bson.DocElem{"versionArray", versionArray},
+		bson.DocElem{"javascriptEngine", "none"},
+		bson.DocElem{"allocator", "system"},
+		bson.DocElem{"bits", strconv.IntSize},
+		bson.DocElem{"debug", false},
+		bson.DocElem{"maxBsonObjectSize", 16777216},
+		bson.DocElem{"modules", []interface{}{}},
+		bson.DocElem{"storageEngines", []interface{}{}},
+		bson.DocElem{"ok", 1},
+	}), nil
+}
+
+// versionString - serverVersion without its build number.
+func versionString() string {
+	return fmt.Sprintf("%d.%d.%d", serverVersion[0], serverVersion[1], serverVersion[2])
+}
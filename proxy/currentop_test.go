@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/lego/mongotunnel/util/context"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// newOpsConnection - A connection of conns waiting on the operation opid,
+// authenticated as user unless it is empty.
+func newOpsConnection(conns *Connections, id uint64, opid int64, user string, canceled *bool) *Proxy {
+	_, server := net.Pipe()
+	p := New(server, &net.TCPAddr{}, &net.TCPAddr{})
+	p.Connections = conns
+	p.Ctx().SetConnID(id)
+	if user != "" {
+		p.Ctx().SetIdentity(&context.Identity{User: user, Database: "$external", Mechanism: mechanismX509})
+		p.useIdentity()
+	}
+	p.requests.pending = map[int32]*trackedRequest{
+		1: {id: 1, opid: opid, cancel: func() { *canceled = true }},
+	}
+	conns.add(p)
+	return p
+}
+
+func listedOps(t *testing.T, p *Proxy, cmd bson.D) []int64 {
+	t.Helper()
+	reply, err := p.handleCurrentOp(mongo.QueryOp{Collection: "admin.$cmd", Query: cmd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var opids []int64
+	for _, op := range reply.(*mongo.ReplyOp).Documents.Map()["inprog"].([]interface{}) {
+		opid, _ := toInt64(op.(bson.D).Map()["opid"])
+		opids = append(opids, opid)
+	}
+	return opids
+}
+
+func TestCurrentOpPrivileges(t *testing.T) {
+	tests := []struct {
+		name               string
+		user               string
+		operators          []string
+		unauthenticatedOps bool
+		ownOps             bool
+		want               []int64
+	}{
+		{name: "unauthenticated", want: []int64{1}},
+		{name: "unauthenticated ownOps", ownOps: true, want: []int64{1}},
+		{name: "unauthenticated allowed", unauthenticatedOps: true, want: []int64{1, 2, 3}},
+		{name: "authenticated", user: "CN=alice", want: []int64{1, 2}},
+		{name: "authenticated ownOps", user: "CN=alice", ownOps: true, want: []int64{1, 2}},
+		{name: "operator", user: "CN=alice", operators: []string{"CN=alice"}, want: []int64{1, 2, 3}},
+		{name: "operator ownOps", user: "CN=alice", operators: []string{"CN=alice"}, ownOps: true, want: []int64{1, 2}},
+		{name: "authenticated allowed", user: "CN=alice", unauthenticatedOps: true, want: []int64{1, 2, 3}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conns := NewConnections()
+			conns.UnauthenticatedOps = test.unauthenticatedOps
+			conns.Operators = make(map[string]bool)
+			for _, user := range test.operators {
+				conns.Operators[user] = true
+			}
+			var canceled [3]bool
+			caller := newOpsConnection(conns, 1, 1, test.user, &canceled[0])
+			newOpsConnection(conns, 2, 2, "CN=alice", &canceled[1])
+			newOpsConnection(conns, 3, 3, "CN=bob", &canceled[2])
+
+			cmd := bson.D{bson.DocElem{"currentOp", 1}}
+			if test.ownOps {
+				cmd = append(cmd, bson.DocElem{"$ownOps", true})
+			}
+			got := listedOps(t, caller, cmd)
+			if len(got) != len(test.want) {
+				t.Fatalf("currentOp listed %v, want %v", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Fatalf("currentOp listed %v, want %v", got, test.want)
+				}
+			}
+
+			// killOp reaches the operations that currentOp lists without
+			// $ownOps.
+			listed := map[int64]bool{}
+			for _, opid := range listedOps(t, caller, bson.D{bson.DocElem{"currentOp", 1}}) {
+				listed[opid] = true
+			}
+			for opid := int64(1); opid <= 3; opid++ {
+				_, err := caller.handleKillOp(mongo.QueryOp{
+					Collection: "admin.$cmd",
+					Query:      bson.D{bson.DocElem{"killOp", 1}, bson.DocElem{"op", opid}},
+				})
+				if listed[opid] {
+					if err != nil || !canceled[opid-1] {
+						t.Errorf("killOp %d: %v, canceled %t", opid, err, canceled[opid-1])
+					}
+					continue
+				}
+				cmdErr, ok := errors.Cause(err).(*mongo.CommandError)
+				if !ok || cmdErr.Code != mongo.ErrorCodeUnauthorized || canceled[opid-1] {
+					t.Errorf("killOp %d: %v, canceled %t, want Unauthorized", opid, err, canceled[opid-1])
+				}
+			}
+		})
+	}
+}
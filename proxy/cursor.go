@@ -0,0 +1,252 @@
+package proxy
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/lego/mongotunnel/util/context"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Translated queries read all their rows at once, and reply with the first
+// batch. The rest stays behind a cursor that getMore reads in batches, and
+// that closes once it is exhausted, with killCursors, with the session it
+// was opened in or when it stays idle for CursorTimeout. A cursor with a
+// tail is never exhausted: getMore waits for its next documents instead.
+
+// defaultBatchSize - The size of a first batch when the query sets none.
+const defaultBatchSize = 101
+
+// defaultAwaitTime - How long getMore waits for the documents of a tail
+// when it sets no maxTimeMS.
+const defaultAwaitTime = time.Second
+
+// tail - The documents arriving after the end of a cursor.
+type tail interface {
+	// next returns the documents that arrive until the deadline, at most n
+	// of them unless n is 0. It returns as soon as there are any.
+	next(deadline time.Time, n int) ([]interface{}, error)
+	// resumeToken is the position of the tail to report with each batch,
+	// if it has one.
+	resumeToken() interface{}
+	close()
+}
+
+// cursor - The documents of a query that were not returned yet.
+type cursor struct {
+	ns   string
+	docs []interface{}
+	// session is the key of the session the cursor was opened in, if any.
+	session string
+	// conn is the ID of the connection that opened the cursor.
+	conn      uint64
+	opened    time.Time
+	lastUse   time.Time
+	noTimeout bool
+	tail      tail
+	// waiting is set while getMore waits on the tail.
+	waiting bool
+}
+
+// reply - A reply holding a batch of the cursor.
+func (c *cursor) reply(batch string, docs []interface{}, id int64) *mongo.ReplyOp {
+	if c.tail != nil {
+		if token := c.tail.resumeToken(); token != nil {
+			return batchReply(c.ns, batch, docs, id, bson.DocElem{"postBatchResumeToken", token})
+		}
+	}
+	return batchReply(c.ns, batch, docs, id)
+}
+
+// openCursor - Split the reply to a find or aggregate into its first batch
+// and a cursor for the rest, attached to the session of the query.
+func (s *Sessions) openCursor(ctx *context.Context, query bson.D, session string, reply mongo.Op) mongo.Op {
+	replyOp, ok := reply.(*mongo.ReplyOp)
+	if !ok {
+		return reply
+	}
+	doc, ok := replyOp.Documents.Map()["cursor"].(bson.D)
+	if !ok {
+		return reply
+	}
+	m := doc.Map()
+	ns, _ := m["ns"].(string)
+	docs, _ := m["firstBatch"].([]interface{})
+	batchSize := firstBatchSize(query)
+	if batchSize < 0 || len(docs) <= batchSize {
+		return reply
+	}
+
+	id := s.register(&cursor{
+		ns:        ns,
+		docs:      docs[batchSize:],
+		session:   session,
+		conn:      ctx.ConnID,
+		noTimeout: truthy(query.Map()["noCursorTimeout"]),
+	})
+	return batchReply(ns, "firstBatch", docs[:batchSize], id)
+}
+
+// register - Open a cursor, attached to its session. Returns its id.
+func (s *Sessions) register(c *cursor) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.startSweeper()
+	id := s.cursorID()
+	c.opened = time.Now()
+	c.lastUse = c.opened
+	s.cursors[id] = c
+	if c.session != "" {
+		s.touch(c.session).cursors[id] = true
+	}
+	return id
+}
+
+// firstBatchSize - How many documents the first batch of a query holds, or
+// -1 when the query leaves no cursor open.
+func firstBatchSize(query bson.D) int {
+	m := query.Map()
+	var batchSize interface{}
+	switch query[0].Name {
+	case "find":
+		if truthy(m["singleBatch"]) {
+			return -1
+		}
+		if limit, ok := toInt64(m["limit"]); ok && limit < 0 {
+			return -1
+		}
+		batchSize = m["batchSize"]
+	case "aggregate":
+		options, _ := m["cursor"].(bson.D)
+		batchSize = options.Map()["batchSize"]
+	default:
+		return -1
+	}
+	if n, ok := toInt64(batchSize); ok && n >= 0 {
+		return int(n)
+	}
+	return defaultBatchSize
+}
+
+// cursorID - A new cursor id. Callers hold mu.
+func (s *Sessions) cursorID() int64 {
+	for {
+		id := rand.Int63()
+		if _, ok := s.cursors[id]; id != 0 && !ok {
+			return id
+		}
+	}
+}
+
+// closeCursor - Forget a cursor. Callers hold mu.
+func (s *Sessions) closeCursor(id int64) {
+	c := s.cursors[id]
+	if c == nil {
+		return
+	}
+	if sess := s.sessions[c.session]; sess != nil {
+		delete(sess.cursors, id)
+	}
+	if c.tail != nil {
+		c.tail.close()
+	}
+	delete(s.cursors, id)
+}
+
+// ownsCursor - Whether getMore or killCursors is for cursors opened by
+// translated queries.
+func (s *Sessions) ownsCursor(query bson.D) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if query[0].Name == "getMore" {
+		id, _ := toInt64(query[0].Value)
+		return s.cursors[id] != nil
+	}
+	ids, _ := query.Map()["cursors"].([]interface{})
+	for _, id := range ids {
+		if id, ok := toInt64(id); ok && s.cursors[id] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// getMore - Answer getMore with the next batch of a cursor. Once a cursor
+// with a tail has no documents left, it waits up to maxTimeMS for more.
+func (s *Sessions) getMore(query bson.D) (mongo.Op, error) {
+	id, _ := toInt64(query[0].Value)
+	m := query.Map()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.cursors[id]
+	if c == nil {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeCursorNotFound, "cursor id %d not found", id)
+	}
+	if c.waiting {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeConflictingOperationInProgress, "cursor id %d is already in use", id)
+	}
+	if c.session != "" {
+		s.touch(c.session)
+	}
+	c.lastUse = time.Now()
+
+	batchSize, _ := toInt64(m["batchSize"])
+	if len(c.docs) == 0 && c.tail != nil {
+		wait := defaultAwaitTime
+		if ms, ok := toInt64(m["maxTimeMS"]); ok && ms > 0 {
+			wait = time.Duration(ms) * time.Millisecond
+		}
+		// Other commands go on while this one waits.
+		c.waiting = true
+		s.mu.Unlock()
+		docs, err := c.tail.next(time.Now().Add(wait), int(batchSize))
+		s.mu.Lock()
+		c.waiting = false
+		c.lastUse = time.Now()
+		if s.cursors[id] != c {
+			return nil, mongo.NewCommandError(mongo.ErrorCodeCursorNotFound, "cursor id %d was killed", id)
+		}
+		if err != nil {
+			s.closeCursor(id)
+			return nil, err
+		}
+		c.docs = docs
+	}
+
+	n := len(c.docs)
+	if batchSize > 0 && int(batchSize) < n {
+		n = int(batchSize)
+	}
+	batch := c.docs[:n]
+	c.docs = c.docs[n:]
+	if len(c.docs) == 0 && c.tail == nil {
+		s.closeCursor(id)
+		id = 0
+	}
+	return c.reply("nextBatch", batch, id), nil
+}
+
+// killCursors - Answer killCursors, closing the cursors it lists.
+func (s *Sessions) killCursors(query bson.D) (mongo.Op, error) {
+	ids, _ := query.Map()["cursors"].([]interface{})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	killed, notFound := []interface{}{}, []interface{}{}
+	for _, v := range ids {
+		id, _ := toInt64(v)
+		if s.cursors[id] == nil {
+			notFound = append(notFound, id)
+			continue
+		}
+		s.closeCursor(id)
+		killed = append(killed, id)
+	}
+	return newReply(bson.D{
+		bson.DocElem{"cursorsKilled", killed},
+		bson.DocElem{"cursorsNotFound", notFound},
+		bson.DocElem{"cursorsAlive", []interface{}{}},
+		bson.DocElem{"cursorsUnknown", []interface{}{}},
+		bson.DocElem{"ok", 1},
+	}), nil
+}
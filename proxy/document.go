@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// scanDocuments - Read every row into a document, converting the values
+// the driver returns into BSON types. Columns the translator added for its
+// own use are dropped.
+func scanDocuments(rows *sql.Rows) ([]interface{}, error) {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []interface{}
+	for rows.Next() {
+		// Create a slice of interface{}'s to represent each column,
+		// and a second slice to contain pointers to each item in the columns slice.
+		columns := make([]interface{}, len(types))
+		columnPointers := make([]interface{}, len(types))
+		for i := range columns {
+			columnPointers[i] = &columns[i]
+		}
+
+		if err := rows.Scan(columnPointers...); err != nil {
+			return nil, err
+		}
+
+		doc := make(bson.D, 0, len(types))
+		for i, t := range types {
+			if strings.HasPrefix(t.Name(), internalPrefix) {
+				continue
+			}
+			value, err := bsonValue(t.DatabaseTypeName(), columns[i])
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to convert column %s", t.Name())
+			}
+			doc = append(doc, bson.DocElem{t.Name(), value})
+		}
+		docs = append(docs, doc)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if docs == nil {
+		// An empty batch is still an array.
+		docs = []interface{}{}
+	}
+	return docs, nil
+}
+
+// bsonValue - Convert a column value. The driver returns the text of
+// types it does not know as bytes.
+func bsonValue(typeName string, v interface{}) (interface{}, error) {
+	b, ok := v.([]byte)
+	if !ok {
+		return v, nil
+	}
+	switch typeName {
+	case "JSONB", "JSON":
+		return decodeJSON(b)
+	case "NUMERIC":
+		return parseNumber(string(b))
+	case "BYTEA":
+		return b, nil
+	}
+	return string(b), nil
+}
+
+// encodeJSON - Encode BSON values as JSON, keeping the order of document
+// fields.
+func encodeJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := writeJSON(&buf, v)
+	return buf.Bytes(), err
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case bson.D:
+		buf.WriteByte('{')
+		for i, elem := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, err := json.Marshal(elem.Name)
+			if err != nil {
+				return err
+			}
+			buf.Write(key)
+			buf.WriteByte(':')
+			if err := writeJSON(buf, elem.Value); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, elem := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeJSON(buf, elem); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	default:
+		b, err := json.Marshal(jsonValue(v))
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	}
+	return nil
+}
+
+// decodeJSON - Decode JSON into BSON values, keeping the order of object
+// keys.
+func decodeJSON(b []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return decodeJSONValue(dec)
+}
+
+func decodeJSONValue(dec *json.Decoder) (interface{}, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := token.(type) {
+	case json.Delim:
+		if t == '{' {
+			doc := bson.D{}
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				value, err := decodeJSONValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				doc = append(doc, bson.DocElem{key.(string), value})
+			}
+			_, err := dec.Token()
+			return doc, err
+		}
+		array := []interface{}{}
+		for dec.More() {
+			value, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		_, err := dec.Token()
+		return array, err
+	case json.Number:
+		return parseNumber(t.String())
+	}
+	return token, nil
+}
+
+// parseNumber - Integers become int, which is encoded as a 32 or 64 bit
+// integer depending on its size, and everything else a double.
+func parseNumber(s string) (interface{}, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if n >= math.MinInt32 && n <= math.MaxInt32 {
+			return int(n), nil
+		}
+		return n, nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
@@ -0,0 +1,320 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/lego/mongotunnel/util/context"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// explain answers with the statement a command compiles into instead of
+// running it. The queryPlanner section holds the SQL and the output of
+// EXPLAIN, and at executionStats verbosity or above the executionStats
+// section holds the output of EXPLAIN ANALYZE along with the numbers read
+// from it. EXPLAIN ANALYZE executes the statement, so a DELETE is rolled
+// back afterwards.
+
+const (
+	verbosityQueryPlanner     = "queryPlanner"
+	verbosityExecutionStats   = "executionStats"
+	verbosityAllPlansExecuted = "allPlansExecution"
+)
+
+// explainSavepoint - The savepoint an explained DELETE is rolled back to
+// inside a transaction.
+const explainSavepoint = internalPrefix + "explain"
+
+// errExplainRollback - Rolls back the statements of an explain that ran
+// without failing.
+var errExplainRollback = errors.New("explain rollback")
+
+// explainedStatement - The statement an explained command compiles into.
+// SQL is empty when the collection does not exist and nothing would run.
+type explainedStatement struct {
+	sql  string
+	args []interface{}
+	// deletes is set for a DELETE, whose rows are deleted rather than
+	// returned.
+	deletes bool
+}
+
+// handleExplain - Answer explain of find, aggregate, count or delete.
+func handleExplain(ctx *context.Context, query mongo.QueryOp) (mongo.Op, error) {
+	databaseName := strings.Split(query.Collection, ".")[0]
+	command, ok := query.Query[0].Value.(bson.D)
+	if !ok || len(command) == 0 {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "explain command requires a nested object")
+	}
+	verbosity := verbosityAllPlansExecuted
+	if v, ok := query.Query.Map()["verbosity"]; ok {
+		verbosity, _ = v.(string)
+		switch verbosity {
+		case verbosityQueryPlanner, verbosityExecutionStats, verbosityAllPlansExecuted:
+		default:
+			return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "verbosity string must be one of {'queryPlanner', 'executionStats', 'allPlansExecution'}")
+		}
+	}
+	return explainCommand(ctx, databaseName, command, verbosity)
+}
+
+// explainCommand - The explain reply for command on the database.
+func explainCommand(ctx *context.Context, databaseName string, command bson.D, verbosity string) (mongo.Op, error) {
+	tableName, ok := command[0].Value.(string)
+	if !ok {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "collection name has invalid type %T", command[0].Value)
+	}
+	statement, err := explainedCommand(ctx, databaseName, tableName, command)
+	if err != nil {
+		return nil, err
+	}
+
+	winningPlan := bson.D{bson.DocElem{"stage", "EOF"}}
+	if statement.sql != "" {
+		plan, err := explainStatement(ctx, "EXPLAIN ", statement)
+		if err != nil {
+			return nil, err
+		}
+		winningPlan = bson.D{
+			bson.DocElem{"stage", "SQL"},
+			bson.DocElem{"sql", statement.sql},
+			bson.DocElem{"args", statementArgs(statement.args)},
+			bson.DocElem{"plan", plan},
+		}
+	}
+	reply := bson.D{bson.DocElem{"queryPlanner", bson.D{
+		bson.DocElem{"plannerVersion", 1},
+		bson.DocElem{"namespace", fmt.Sprintf("%s.%s", databaseName, tableName)},
+		bson.DocElem{"indexFilterSet", false},
+		bson.DocElem{"parsedQuery", command},
+		bson.DocElem{"winningPlan", winningPlan},
+		bson.DocElem{"rejectedPlans", []interface{}{}},
+	}}}
+
+	if verbosity != verbosityQueryPlanner {
+		stats, err := explainExecution(ctx, statement)
+		if err != nil {
+			return nil, err
+		}
+		reply = append(reply, bson.DocElem{"executionStats", stats})
+	}
+	return newReply(append(reply, bson.DocElem{"ok", 1})), nil
+}
+
+// explainedCommand - The statement command would run.
+func explainedCommand(ctx *context.Context, databaseName, tableName string, command bson.D) (explainedStatement, error) {
+	m := command.Map()
+	var pipeline []interface{}
+	switch command[0].Name {
+	case "find":
+		pipeline = findPipeline(m)
+	case "aggregate":
+		pipeline, _ = m["pipeline"].([]interface{})
+		if isChangeStream(command) {
+			return explainedStatement{}, mongo.NewCommandError(mongo.ErrorCodeNotImplemented, "explain of $changeStream is not supported by the SQL translator")
+		}
+	case "count":
+		pipeline = countPipeline(m)
+		compiler, err := compilePipeline(ctx, databaseName, tableName, pipeline)
+		if err != nil || compiler == nil {
+			return explainedStatement{}, err
+		}
+		statement, args := countStatement(compiler, databaseName, tableName, pipeline)
+		return explainedStatement{sql: statement, args: args}, nil
+	case "delete":
+		return explainedDelete(ctx, databaseName, tableName, m)
+	default:
+		return explainedStatement{}, mongo.NewCommandError(mongo.ErrorCodeCommandNotFound, "explain of %s is not supported by the SQL translator", command[0].Name)
+	}
+
+	compiler, err := compilePipeline(ctx, databaseName, tableName, pipeline)
+	if err != nil || compiler == nil {
+		return explainedStatement{}, err
+	}
+	statement, args := compiler.SQL()
+	return explainedStatement{sql: statement, args: args}, nil
+}
+
+// explainedDelete - The DELETE of a delete command, which MongoDB only
+// explains with a single statement.
+func explainedDelete(ctx *context.Context, databaseName, tableName string, m bson.M) (explainedStatement, error) {
+	deletes, _ := m["deletes"].([]interface{})
+	if len(deletes) != 1 {
+		return explainedStatement{}, mongo.NewCommandError(mongo.ErrorCodeInvalidOptions, "explained delete must have exactly one statement")
+	}
+	spec, ok := deletes[0].(bson.D)
+	if !ok {
+		return explainedStatement{}, mongo.NewCommandError(mongo.ErrorCodeBadValue, "delete statements must be objects")
+	}
+	columns, err := tableColumns(ctx, databaseName, tableName)
+	if isUndefinedTable(err) {
+		return explainedStatement{}, nil
+	}
+	if err != nil {
+		return explainedStatement{}, err
+	}
+	statement := spec.Map()
+	q, _ := statement["q"].(bson.D)
+	limit, _ := toInt64(statement["limit"])
+	sql, args, err := deleteStatement(databaseName, tableName, columns, q, limit == 1)
+	if err != nil {
+		return explainedStatement{}, err
+	}
+	return explainedStatement{sql: sql, args: args, deletes: true}, nil
+}
+
+// explainStatement - The output of statement under the EXPLAIN variant
+// prefix.
+func explainStatement(ctx *context.Context, prefix string, statement explainedStatement) ([]string, error) {
+	ctx.Log.Debug("sql=%s%s args=%v", prefix, statement.sql, statement.args)
+	rows, err := ctx.SQL().Query(prefix+statement.sql, statement.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return explainLines(rows)
+}
+
+// explainExecution - The executionStats of statement, from running it
+// under EXPLAIN ANALYZE.
+func explainExecution(ctx *context.Context, statement explainedStatement) (bson.D, error) {
+	if statement.sql == "" {
+		return bson.D{
+			bson.DocElem{"executionSuccess", true},
+			bson.DocElem{"nReturned", 0},
+			bson.DocElem{"executionTimeMillis", 0},
+			bson.DocElem{"totalKeysExamined", 0},
+			bson.DocElem{"totalDocsExamined", 0},
+			bson.DocElem{"executionStages", bson.D{bson.DocElem{"stage", "EOF"}}},
+		}, nil
+	}
+
+	var plan []string
+	start := time.Now()
+	run := func(ctx *context.Context) (err error) {
+		plan, err = explainStatement(ctx, "EXPLAIN ANALYZE ", statement)
+		return err
+	}
+	var err error
+	if statement.deletes {
+		err = rolledBack(ctx, run)
+	} else {
+		err = run(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	stats := analyzeStats(plan)
+	if stats.executionTime < 0 {
+		stats.executionTime = time.Since(start)
+	}
+
+	stage := bson.D{
+		bson.DocElem{"stage", "SQL"},
+		bson.DocElem{"sql", statement.sql},
+		bson.DocElem{"plan", plan},
+	}
+	returned := stats.rows
+	if statement.deletes {
+		stage = append(stage, bson.DocElem{"nWouldDelete", stats.rows})
+		returned = 0
+	}
+	return bson.D{
+		bson.DocElem{"executionSuccess", true},
+		bson.DocElem{"nReturned", returned},
+		bson.DocElem{"executionTimeMillis", int(stats.executionTime / time.Millisecond)},
+		bson.DocElem{"totalKeysExamined", stats.rowsRead},
+		bson.DocElem{"totalDocsExamined", stats.rowsRead},
+		bson.DocElem{"executionStages", stage},
+	}, nil
+}
+
+// rolledBack - Run f on a copy of ctx whose statements are rolled back
+// afterwards, to a savepoint of its transaction or with a transaction of
+// its own.
+func rolledBack(ctx *context.Context, f func(*context.Context) error) error {
+	if ctx.Tx != nil {
+		err := savepoint(ctx, explainSavepoint, func() error {
+			if err := f(ctx); err != nil {
+				return err
+			}
+			return errExplainRollback
+		})
+		if err == errExplainRollback {
+			return nil
+		}
+		return err
+	}
+	tx, err := ctx.DB.BeginTx(ctx.RequestContext(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	txCtx := *ctx
+	txCtx.Tx = tx
+	return f(&txCtx)
+}
+
+// analyzedStats - The numbers of an EXPLAIN ANALYZE, which are -1 when
+// the output does not have them, as with versions of CockroachDB before
+// 21.1.
+type analyzedStats struct {
+	executionTime time.Duration
+	rows          int
+	rowsRead      int
+}
+
+// analyzeStats - Read the execution time, the rows of the root of the
+// plan and the rows read from KV out of EXPLAIN ANALYZE output. 23.1 calls
+// the rows read "rows decoded".
+func analyzeStats(plan []string) analyzedStats {
+	stats := analyzedStats{executionTime: -1, rows: -1, rowsRead: -1}
+	for _, line := range plan {
+		key, value, ok := planField(line)
+		if !ok {
+			continue
+		}
+		switch key {
+		case "execution time":
+			if d, err := time.ParseDuration(value); err == nil {
+				stats.executionTime = d
+			}
+		case "rows read from KV", "rows decoded from KV":
+			if n, ok := leadingInt(value); ok {
+				stats.rowsRead = n
+			}
+		case "actual row count":
+			// The root of the plan comes first.
+			if n, ok := leadingInt(value); ok && stats.rows < 0 {
+				stats.rows = n
+			}
+		}
+	}
+	return stats
+}
+
+// planField - The key and value of a "key: value" line of a plan.
+func planField(line string) (key, value string, ok bool) {
+	line = strings.TrimLeft(strings.TrimSpace(line), "│├└• ")
+	colon := strings.Index(line, ":")
+	if colon < 0 {
+		return "", "", false
+	}
+	return strings.TrimSpace(line[:colon]), strings.TrimSpace(line[colon+1:]), true
+}
+
+// leadingInt - The integer s starts with, ignoring thousands separators.
+func leadingInt(s string) (int, bool) {
+	end := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != ','
+	})
+	if end >= 0 {
+		s = s[:end]
+	}
+	n, err := strconv.Atoi(strings.Replace(s, ",", "", -1))
+	return n, err == nil
+}
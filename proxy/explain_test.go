@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnalyzeStats(t *testing.T) {
+	tests := []struct {
+		name  string
+		plan  string
+		stats analyzedStats
+	}{
+		{
+			name: "21.1",
+			plan: `planning time: 712µs
+execution time: 2ms
+distribution: local
+vectorized: true
+rows read from KV: 3 (24 B)
+maximum memory usage: 10 KiB
+network usage: 0 B (0 messages)
+
+• filter
+│ cluster nodes: n1
+│ actual row count: 1
+│ estimated row count: 1
+│ filter: x = 1
+│
+└── • scan
+      cluster nodes: n1
+      actual row count: 3
+      KV rows read: 3
+      KV bytes read: 24 B
+      missing stats
+      table: t@primary
+      spans: FULL SCAN`,
+			stats: analyzedStats{executionTime: 2 * time.Millisecond, rows: 1, rowsRead: 3},
+		},
+		{
+			name: "22.2",
+			plan: `planning time: 1ms
+execution time: 1.5s
+distribution: full
+vectorized: true
+rows read from KV: 1,234,567 (98 MiB, 42 gRPC calls)
+cumulative time spent in KV: 1.2s
+maximum memory usage: 3.1 MiB
+network usage: 0 B (0 messages)
+regions: us-east1
+
+• sort
+│ nodes: n1
+│ regions: us-east1
+│ actual row count: 1,000
+│ estimated max memory allocated: 2.0 MiB
+│ order: +x
+│
+└── • scan
+      nodes: n1
+      regions: us-east1
+      actual row count: 1,234,567
+      KV time: 1.2s
+      KV contention time: 0µs
+      KV rows read: 1,234,567
+      KV bytes read: 98 MiB
+      KV gRPC calls: 42
+      estimated row count: 1,234,567 (100% of the table; stats collected 1 hour ago)
+      table: t@t_pkey
+      spans: FULL SCAN`,
+			stats: analyzedStats{executionTime: 1500 * time.Millisecond, rows: 1000, rowsRead: 1234567},
+		},
+		{
+			name: "23.1",
+			plan: `planning time: 390µs
+execution time: 850µs
+distribution: local
+vectorized: true
+rows decoded from KV: 0 (0 B, 1 gRPC calls)
+cumulative time spent in KV: 540µs
+maximum memory usage: 20 KiB
+network usage: 0 B (0 messages)
+sql cpu time: 95µs
+isolation level: serializable
+priority: normal
+quality of service: regular
+
+• scan
+  sql nodes: n1
+  kv nodes: n1
+  actual row count: 0
+  KV time: 540µs
+  KV contention time: 0µs
+  KV rows decoded: 0
+  KV bytes read: 0 B
+  KV gRPC calls: 1
+  estimated max memory allocated: 10 KiB
+  sql cpu time: 95µs
+  estimated row count: 1 (100% of the table; stats collected 2 days ago)
+  table: t@t_pkey
+  spans: [/1 - /1]`,
+			stats: analyzedStats{executionTime: 850 * time.Microsecond, rows: 0, rowsRead: 0},
+		},
+		{
+			name: "missing",
+			plan: `tree | field | description
+scan |       |
+     | table | t@primary
+     | spans | FULL SCAN`,
+			stats: analyzedStats{executionTime: -1, rows: -1, rowsRead: -1},
+		},
+		{
+			name: "unparsable",
+			plan: `execution time: soon
+rows read from KV: many
+• scan
+  actual row count: unknown`,
+			stats: analyzedStats{executionTime: -1, rows: -1, rowsRead: -1},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if stats := analyzeStats(strings.Split(test.plan, "\n")); stats != test.stats {
+				t.Errorf("got %+v, want %+v", stats, test.stats)
+			}
+		})
+	}
+}
+
+func TestPlanField(t *testing.T) {
+	tests := []struct {
+		line       string
+		key, value string
+		ok         bool
+	}{
+		{"execution time: 2ms", "execution time", "2ms", true},
+		{"│ actual row count: 1", "actual row count", "1", true},
+		{"      actual row count: 3", "actual row count", "3", true},
+		{"├── • scan", "", "", false},
+		{"  spans: [/1 - /1]", "spans", "[/1 - /1]", true},
+		{"", "", "", false},
+	}
+	for _, test := range tests {
+		key, value, ok := planField(test.line)
+		if key != test.key || value != test.value || ok != test.ok {
+			t.Errorf("planField(%q) = %q, %q, %v, want %q, %q, %v", test.line, key, value, ok, test.key, test.value, test.ok)
+		}
+	}
+}
+
+func TestLeadingInt(t *testing.T) {
+	tests := []struct {
+		s  string
+		n  int
+		ok bool
+	}{
+		{"3", 3, true},
+		{"1,234,567 (98 MiB, 42 gRPC calls)", 1234567, true},
+		{"0 (0 B)", 0, true},
+		{"many", 0, false},
+		{"", 0, false},
+	}
+	for _, test := range tests {
+		n, ok := leadingInt(test.s)
+		if n != test.n || ok != test.ok {
+			t.Errorf("leadingInt(%q) = %d, %v, want %d, %v", test.s, n, ok, test.n, test.ok)
+		}
+	}
+}
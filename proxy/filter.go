@@ -0,0 +1,307 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lego/mongotunnel/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Query filters compile to a SQL condition. A missing field is NULL, so
+// conditions that may be NULL are wrapped before negating them, since
+// MongoDB treats `$ne` and `$nin` as true for a missing field.
+
+// filter - Compile a query filter against the columns of b. An empty
+// filter compiles to TRUE.
+func (c *pipelineCompiler) filter(b *selectBlock, filter bson.D) (string, error) {
+	var conds []string
+	for _, elem := range filter {
+		var cond string
+		var err error
+		switch elem.Name {
+		case "$and", "$or", "$nor":
+			cond, err = c.logical(b, elem.Name, elem.Value)
+		case "$comment":
+			continue
+		case "$expr":
+			var expr sqlExpr
+			if expr, err = c.expression(b, elem.Value); err == nil {
+				cond = "COALESCE(" + boolean(expr) + ", FALSE)"
+			}
+		case "$text", "$where", "$jsonSchema":
+			err = mongo.NewCommandError(mongo.ErrorCodeNotImplemented, "%s is not supported by the SQL translator", elem.Name)
+		default:
+			if strings.HasPrefix(elem.Name, "$") {
+				err = mongo.NewCommandError(mongo.ErrorCodeBadValue, "unknown top level operator: %s", elem.Name)
+				break
+			}
+			cond, err = c.fieldFilter(b.field(elem.Name), elem.Value)
+		}
+		if err != nil {
+			return "", err
+		}
+		conds = append(conds, cond)
+	}
+	return conjunction(conds), nil
+}
+
+func conjunction(conds []string) string {
+	switch len(conds) {
+	case 0:
+		return "TRUE"
+	case 1:
+		return conds[0]
+	}
+	return "(" + strings.Join(conds, " AND ") + ")"
+}
+
+func negate(cond string) string {
+	return "NOT COALESCE(" + cond + ", FALSE)"
+}
+
+func (c *pipelineCompiler) logical(b *selectBlock, op string, v interface{}) (string, error) {
+	clauses, ok := v.([]interface{})
+	if !ok || len(clauses) == 0 {
+		return "", mongo.NewCommandError(mongo.ErrorCodeBadValue, "%s must be a nonempty array", op)
+	}
+	conds := make([]string, len(clauses))
+	for i, clause := range clauses {
+		doc, ok := clause.(bson.D)
+		if !ok {
+			return "", mongo.NewCommandError(mongo.ErrorCodeBadValue, "%s argument's entries must be objects", op)
+		}
+		cond, err := c.filter(b, doc)
+		if err != nil {
+			return "", err
+		}
+		conds[i] = cond
+	}
+	switch op {
+	case "$and":
+		return conjunction(conds), nil
+	case "$or":
+		return "(" + strings.Join(conds, " OR ") + ")", nil
+	default:
+		return negate("(" + strings.Join(conds, " OR ") + ")"), nil
+	}
+}
+
+// fieldFilter - The condition for one field: an equality, a regular
+// expression, or a document of operators.
+func (c *pipelineCompiler) fieldFilter(field sqlExpr, v interface{}) (string, error) {
+	switch v := v.(type) {
+	case bson.RegEx:
+		return c.regex(field, v), nil
+	case bson.D:
+		if len(v) > 0 && strings.HasPrefix(v[0].Name, "$") {
+			return c.operators(field, v)
+		}
+	}
+	return c.equal(field, v)
+}
+
+func (c *pipelineCompiler) operators(field sqlExpr, ops bson.D) (string, error) {
+	var conds []string
+	m := ops.Map()
+	for _, op := range ops {
+		var cond string
+		var err error
+		switch op.Name {
+		case "$eq":
+			cond, err = c.equal(field, op.Value)
+		case "$ne":
+			cond, err = c.equal(field, op.Value)
+			cond = negate(cond)
+		case "$gt", "$gte", "$lt", "$lte":
+			cond, err = c.compare(field, comparisonOperators[op.Name], op.Value)
+		case "$in", "$nin":
+			cond, err = c.in(field, op.Name, op.Value)
+		case "$exists":
+			cond = field.sql + " IS NULL"
+			if truthy(op.Value) {
+				cond = field.sql + " IS NOT NULL"
+			}
+		case "$regex":
+			cond, err = c.regexOperator(field, op.Value, m["$options"])
+		case "$options":
+			if _, ok := m["$regex"]; !ok {
+				return "", mongo.NewCommandError(mongo.ErrorCodeBadValue, "$options needs a $regex")
+			}
+			continue
+		case "$not":
+			switch not := op.Value.(type) {
+			case bson.RegEx:
+				cond = c.regex(field, not)
+			case bson.D:
+				cond, err = c.operators(field, not)
+			default:
+				err = mongo.NewCommandError(mongo.ErrorCodeBadValue, "$not needs a regex or a document")
+			}
+			cond = negate(cond)
+		case "$size":
+			n, ok := toInt64(op.Value)
+			if !ok {
+				err = mongo.NewCommandError(mongo.ErrorCodeBadValue, "$size needs a number")
+			} else if field.json {
+				cond = fmt.Sprintf("(jsonb_typeof(%[1]s) = 'array' AND jsonb_array_length(%[1]s) = %d)", field.sql, n)
+			} else {
+				cond = "FALSE"
+			}
+		case "$all", "$elemMatch", "$type", "$mod", "$bitsAllSet", "$bitsAllClear", "$bitsAnySet", "$bitsAnyClear",
+			"$geoWithin", "$geoIntersects", "$near", "$nearSphere":
+			err = mongo.NewCommandError(mongo.ErrorCodeNotImplemented, "%s is not supported by the SQL translator", op.Name)
+		default:
+			err = mongo.NewCommandError(mongo.ErrorCodeBadValue, "unknown operator: %s", op.Name)
+		}
+		if err != nil {
+			return "", err
+		}
+		conds = append(conds, cond)
+	}
+	return conjunction(conds), nil
+}
+
+var comparisonOperators = map[string]string{
+	"$gt":  ">",
+	"$gte": ">=",
+	"$lt":  "<",
+	"$lte": "<=",
+}
+
+// equal - Equality as MongoDB has it: null matches a missing field, and a
+// scalar matches an array containing it.
+func (c *pipelineCompiler) equal(field sqlExpr, v interface{}) (string, error) {
+	if re, ok := v.(bson.RegEx); ok {
+		return c.regex(field, re), nil
+	}
+	if v == nil {
+		if field.json {
+			return fmt.Sprintf("(%[1]s IS NULL OR %[1]s = 'null'::JSONB)", field.sql), nil
+		}
+		return field.sql + " IS NULL", nil
+	}
+	if !field.json {
+		value, err := c.literal(v)
+		if err != nil {
+			return "", err
+		}
+		return field.sql + " = " + value.sql, nil
+	}
+
+	value, err := c.jsonLiteral(v)
+	if err != nil {
+		return "", err
+	}
+	switch v.(type) {
+	case bson.D, bson.M, []interface{}:
+		return field.sql + " = " + value.sql, nil
+	}
+	element, err := c.jsonLiteral([]interface{}{v})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("(%[1]s = %[2]s OR %[1]s @> %[3]s)", field.sql, value.sql, element.sql), nil
+}
+
+// compare - A range comparison. JSONB values only compare with values of
+// the same type, like MongoDB's type bracketing.
+func (c *pipelineCompiler) compare(field sqlExpr, op string, v interface{}) (string, error) {
+	if !field.json {
+		value, err := c.literal(v)
+		if err != nil {
+			return "", err
+		}
+		return field.sql + " " + op + " " + value.sql, nil
+	}
+	switch v := v.(type) {
+	case int, int32, int64, float64:
+		value, err := c.literal(v)
+		if err != nil {
+			return "", err
+		}
+		return numeric(field) + " " + op + " " + value.sql, nil
+	case string:
+		return text(field) + " " + op + " " + c.param(v) + "::TEXT", nil
+	case time.Time:
+		// Dates are kept in JSONB as RFC 3339 strings.
+		return text(field) + " " + op + " " + c.param(v.UTC().Format(time.RFC3339Nano)) + "::TEXT", nil
+	}
+	value, err := c.jsonLiteral(v)
+	if err != nil {
+		return "", err
+	}
+	return field.sql + " " + op + " " + value.sql, nil
+}
+
+func (c *pipelineCompiler) in(field sqlExpr, op string, v interface{}) (string, error) {
+	values, ok := v.([]interface{})
+	if !ok {
+		return "", mongo.NewCommandError(mongo.ErrorCodeBadValue, "%s needs an array", op)
+	}
+	conds := make([]string, len(values))
+	for i, value := range values {
+		cond, err := c.equal(field, value)
+		if err != nil {
+			return "", err
+		}
+		conds[i] = cond
+	}
+	cond := "FALSE"
+	if len(conds) > 0 {
+		cond = "(" + strings.Join(conds, " OR ") + ")"
+	}
+	if op == "$nin" {
+		return negate(cond), nil
+	}
+	return cond, nil
+}
+
+func (c *pipelineCompiler) regexOperator(field sqlExpr, pattern, options interface{}) (string, error) {
+	re := bson.RegEx{}
+	switch p := pattern.(type) {
+	case string:
+		re.Pattern = p
+	case bson.RegEx:
+		re = p
+	default:
+		return "", mongo.NewCommandError(mongo.ErrorCodeBadValue, "$regex has to be a string")
+	}
+	if options != nil {
+		o, ok := options.(string)
+		if !ok {
+			return "", mongo.NewCommandError(mongo.ErrorCodeBadValue, "$options has to be a string")
+		}
+		re.Options = o
+	}
+	return c.regex(field, re), nil
+}
+
+// regex - Match a regular expression. CockroachDB uses Go's regexp syntax,
+// which takes the i, m and s options inline.
+func (c *pipelineCompiler) regex(field sqlExpr, re bson.RegEx) string {
+	pattern := re.Pattern
+	var flags string
+	for _, o := range re.Options {
+		if strings.ContainsRune("ims", o) {
+			flags += string(o)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	return text(field) + " ~ " + c.param(pattern) + "::TEXT"
+}
+
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case int, int32, int64, float64:
+		return fmt.Sprint(v) != "0"
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestFilterRegex(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter bson.D
+		sql    string
+		code   mongo.ErrorCode
+	}{
+		{
+			name:   "regex with options",
+			filter: bson.D{{"name", bson.D{{"$regex", "^a"}, {"$options", "i"}}}},
+			sql:    `SELECT "_id", "name", "qty", "tags" FROM "db"."items" WHERE "name" ~ $1::TEXT`,
+		},
+		{
+			name:   "options before regex",
+			filter: bson.D{{"name", bson.D{{"$options", "i"}, {"$regex", "^a"}}}},
+			sql:    `SELECT "_id", "name", "qty", "tags" FROM "db"."items" WHERE "name" ~ $1::TEXT`,
+		},
+		{
+			name:   "options without regex",
+			filter: bson.D{{"name", bson.D{{"$options", "i"}}}},
+			code:   mongo.ErrorCodeBadValue,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			compiler := newPipelineCompiler("db", "items", testColumns, nil)
+			err := compiler.stage(bson.D{{"$match", test.filter}})
+			if test.code != 0 {
+				cmdErr, ok := errors.Cause(err).(*mongo.CommandError)
+				if !ok || cmdErr.Code != test.code {
+					t.Fatalf("got %v, want code %d", err, test.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			sql, args := compiler.SQL()
+			if sql != test.sql {
+				t.Errorf("SQL\n%s\nwant\n%s", sql, test.sql)
+			}
+			if len(args) != 1 || args[0] != "(?i)^a" {
+				t.Errorf("args %#v, want the pattern with its options", args)
+			}
+		})
+	}
+}
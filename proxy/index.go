@@ -0,0 +1,473 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/lego/mongotunnel/util/context"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MongoDB indexes become CockroachDB secondary indexes: the key fields
+// are the indexed columns or JSONB expressions, sparse and partial indexes
+// get a WHERE clause, and a TTL index sets the row-level TTL of the table to
+// expire rows by the date in its field, which JSONB holds as a string.
+// The MongoDB specification is kept as the comment of the index, so that
+// listIndexes returns options SQL cannot express. Indexes created some
+// other way are described from their columns.
+
+// indexCommentPrefix - Marks index comments holding a MongoDB index
+// specification.
+const indexCommentPrefix = "mongotunnel:"
+
+// idIndexName - What MongoDB calls the index on _id, which is the primary
+// key of the table.
+const idIndexName = "_id_"
+
+// backendIndex - An index as the backend has it, with its MongoDB
+// description.
+type backendIndex struct {
+	name    string
+	primary bool
+	spec    bson.D
+}
+
+func (i backendIndex) key() bson.D {
+	key, _ := i.spec.Map()["key"].(bson.D)
+	return key
+}
+
+func (i backendIndex) mongoName() string {
+	name, _ := i.spec.Map()["name"].(string)
+	return name
+}
+
+// handleCreateIndexes - Answer createIndexes. Indexes that already exist
+// with the same key are left alone, like MongoDB does. Every specification
+// is checked before anything changes, and the columns of fields no document
+// has yet are added together before the indexes are created.
+func handleCreateIndexes(ctx *context.Context, query mongo.QueryOp) (mongo.Op, error) {
+	databaseName := strings.Split(query.Collection, ".")[0]
+	tableName, ok := query.Query[0].Value.(string)
+	if !ok {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "collection name has invalid type %T", query.Query[0].Value)
+	}
+	specs, _ := query.Query.Map()["indexes"].([]interface{})
+	if len(specs) == 0 {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "Must specify at least one index to create")
+	}
+
+	columns, err := tableColumns(ctx, databaseName, tableName)
+	created := false
+	if isUndefinedTable(err) {
+		// Like MongoDB, indexing a collection creates it.
+		if err := createCollection(ctx, databaseName, tableName); err != nil {
+			return nil, err
+		}
+		created = true
+		columns, err = tableColumns(ctx, databaseName, tableName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	existing, err := backendIndexes(ctx, databaseName, tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	before := len(existing)
+	var addStatements, indexStatements []string
+	for _, v := range specs {
+		spec, ok := v.(bson.D)
+		if !ok {
+			return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "the index specification must be an object")
+		}
+		// Fields no document has yet get a column to index.
+		key, _ := spec.Map()["key"].(bson.D)
+		var fields []string
+		for _, elem := range key {
+			fields = append(fields, strings.Split(elem.Name, ".")[0])
+		}
+		withFields, add := addColumnStatements(databaseName, tableName, columns, fields)
+		index, statements, err := createIndexStatements(databaseName, tableName, withFields, spec)
+		if err != nil {
+			return nil, err
+		}
+		if exists, err := indexExists(existing, index); exists || err != nil {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		columns = withFields
+		addStatements = append(addStatements, add...)
+		indexStatements = append(indexStatements, statements...)
+		existing = append(existing, index)
+	}
+
+	if len(addStatements) > 0 {
+		if err := execAtomically(ctx, addStatements); err != nil {
+			return nil, err
+		}
+	}
+	for _, statement := range indexStatements {
+		ctx.Log.Debug("sql=%s", statement)
+		if _, err := ctx.SQL().Exec(statement); err != nil {
+			return nil, err
+		}
+	}
+	after := len(existing)
+
+	reply := bson.D{
+		bson.DocElem{"createdCollectionAutomatically", created},
+		bson.DocElem{"numIndexesBefore", before},
+		bson.DocElem{"numIndexesAfter", after},
+	}
+	if before == after {
+		reply = append(reply, bson.DocElem{"note", "all indexes already exist"})
+	}
+	return newReply(append(reply, bson.DocElem{"ok", 1})), nil
+}
+
+// indexExists - Whether an index like index is already there. Reusing a
+// name for another key, or a key under another name, is an error.
+func indexExists(existing []backendIndex, index backendIndex) (bool, error) {
+	for _, other := range existing {
+		sameName := other.mongoName() == index.mongoName()
+		sameKey := equalKeys(other.key(), index.key())
+		switch {
+		case sameName && sameKey:
+			return true, nil
+		case sameName:
+			return false, mongo.NewCommandError(mongo.ErrorCodeIndexKeySpecsConflict, "An existing index has the same name as the requested index. Requested index: %v, existing index: %v", index.spec, other.spec)
+		case sameKey:
+			return false, mongo.NewCommandError(mongo.ErrorCodeIndexOptionsConflict, "Index already exists with a different name: %s", other.mongoName())
+		}
+	}
+	return false, nil
+}
+
+// equalKeys - Whether two index keys are the same fields in the same
+// order and directions.
+func equalKeys(a, b bson.D) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || !equalValues(a[i].Value, b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// createIndexStatements - The statements creating the index described by
+// spec.
+func createIndexStatements(databaseName, tableName string, columns []column, spec bson.D) (backendIndex, []string, error) {
+	m := spec.Map()
+	key, ok := m["key"].(bson.D)
+	if !ok || len(key) == 0 {
+		return backendIndex{}, nil, mongo.NewCommandError(mongo.ErrorCodeCannotCreateIndex, "The index spec must have a non-empty 'key' object")
+	}
+	name, _ := m["name"].(string)
+	if name == "" {
+		name = defaultIndexName(key)
+	}
+	if name == idIndexName {
+		return backendIndex{}, nil, mongo.NewCommandError(mongo.ErrorCodeCannotCreateIndex, "The index name '%s' is reserved for the _id index", idIndexName)
+	}
+
+	b := newSelectBlock(quoteIdent(tableName), quoteIdent(tableName), columns)
+	compiler := &pipelineCompiler{
+		compilerState: &compilerState{database: databaseName, inline: true},
+		collection:    tableName,
+		block:         b,
+	}
+	var parts, present []string
+	var fields []sqlExpr
+	for _, elem := range key {
+		direction, ok := toInt64(elem.Value)
+		if !ok || direction == 0 {
+			return backendIndex{}, nil, mongo.NewCommandError(mongo.ErrorCodeNotImplemented, "%v indexes are not supported by the SQL translator", elem.Value)
+		}
+		field := b.field(elem.Name)
+		if field == nullExpr {
+			return backendIndex{}, nil, mongo.NewCommandError(mongo.ErrorCodeCannotCreateIndex, "cannot index %s, since %s is not a JSONB column of %s.%s", elem.Name, strings.Split(elem.Name, ".")[0], databaseName, tableName)
+		}
+		expr := field.sql
+		if strings.Contains(expr, "->") {
+			// Expressions are indexed in parentheses.
+			expr = "(" + expr + ")"
+		}
+		if direction < 0 {
+			expr += " DESC"
+		} else {
+			expr += " ASC"
+		}
+		parts = append(parts, expr)
+		present = append(present, field.sql+" IS NOT NULL")
+		fields = append(fields, field)
+	}
+
+	var where []string
+	if truthy(m["sparse"]) {
+		where = append(where, "("+strings.Join(present, " OR ")+")")
+	}
+	if partial, ok := m["partialFilterExpression"].(bson.D); ok {
+		cond, err := compiler.filter(b, partial)
+		if err != nil {
+			return backendIndex{}, nil, err
+		}
+		where = append(where, cond)
+	}
+
+	table := quoteIdent(databaseName) + "." + quoteIdent(tableName)
+	create := "CREATE INDEX "
+	if truthy(m["unique"]) {
+		create = "CREATE UNIQUE INDEX "
+	}
+	create += quoteIdent(name) + " ON " + table + " (" + strings.Join(parts, ", ") + ")"
+	if len(where) > 0 {
+		create += " WHERE " + conjunction(where)
+	}
+
+	// The stored specification is the one MongoDB would list.
+	stored := bson.D{{"v", 2}, {"key", key}, {"name", name}}
+	for _, elem := range spec {
+		switch elem.Name {
+		case "v", "key", "name", "ns":
+		default:
+			stored = append(stored, elem)
+		}
+	}
+	comment, err := encodeJSON(stored)
+	if err != nil {
+		return backendIndex{}, nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "%v cannot be converted to JSON: %s", spec, err)
+	}
+	statements := []string{
+		create,
+		fmt.Sprintf("COMMENT ON INDEX %s@%s IS %s", table, quoteIdent(name), quoteString(indexCommentPrefix+string(comment))),
+	}
+
+	if v, ok := m["expireAfterSeconds"]; ok {
+		seconds, ok := toInt64(v)
+		switch {
+		case !ok || seconds < 0:
+			return backendIndex{}, nil, mongo.NewCommandError(mongo.ErrorCodeCannotCreateIndex, "TTL index 'expireAfterSeconds' option must be a non-negative number")
+		case len(key) != 1:
+			return backendIndex{}, nil, mongo.NewCommandError(mongo.ErrorCodeCannotCreateIndex, "TTL indexes are single-field indexes, compound indexes do not support TTL")
+		}
+		// Rows whose field is not a date expire at NULL, which is never,
+		// as MongoDB leaves such documents alone.
+		expiration := fmt.Sprintf("%s + '%d seconds'::INTERVAL", timestamp(fields[0]), seconds)
+		statements = append(statements, fmt.Sprintf("ALTER TABLE %s SET (ttl_expiration_expression = %s)", table, quoteString(expiration)))
+	}
+	return backendIndex{name: name, spec: stored}, statements, nil
+}
+
+// defaultIndexName - The name MongoDB gives an index, such as a_1_b_-1.
+func defaultIndexName(key bson.D) string {
+	parts := make([]string, len(key))
+	for i, elem := range key {
+		parts[i] = fmt.Sprintf("%s_%v", elem.Name, elem.Value)
+	}
+	return strings.Join(parts, "_")
+}
+
+// handleListIndexes - Answer listIndexes with the indexes the table has.
+func handleListIndexes(ctx *context.Context, query mongo.QueryOp) (mongo.Op, error) {
+	databaseName := strings.Split(query.Collection, ".")[0]
+	tableName, ok := query.Query[0].Value.(string)
+	if !ok {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "collection name has invalid type %T", query.Query[0].Value)
+	}
+	indexes, err := backendIndexes(ctx, databaseName, tableName)
+	if isUndefinedTable(err) {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeNamespaceNotFound, "ns does not exist: %s.%s", databaseName, tableName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]interface{}, len(indexes))
+	for i, index := range indexes {
+		docs[i] = index.spec
+	}
+	return cursorReply(fmt.Sprintf("%s.$cmd.listIndexes.%s", databaseName, tableName), docs), nil
+}
+
+// handleDropIndexes - Answer dropIndexes, which names the indexes to drop,
+// gives the key of one, or drops all but the _id index with "*".
+func handleDropIndexes(ctx *context.Context, query mongo.QueryOp) (mongo.Op, error) {
+	databaseName := strings.Split(query.Collection, ".")[0]
+	tableName, ok := query.Query[0].Value.(string)
+	if !ok {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "collection name has invalid type %T", query.Query[0].Value)
+	}
+	indexes, err := backendIndexes(ctx, databaseName, tableName)
+	if isUndefinedTable(err) {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeNamespaceNotFound, "ns does not exist: %s.%s", databaseName, tableName)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	byName := func(name string) (backendIndex, error) {
+		if name == idIndexName {
+			return backendIndex{}, mongo.NewCommandError(mongo.ErrorCodeInvalidOptions, "cannot drop _id index")
+		}
+		for _, index := range indexes {
+			if index.mongoName() == name {
+				return index, nil
+			}
+		}
+		return backendIndex{}, mongo.NewCommandError(mongo.ErrorCodeIndexNotFound, "index not found with name [%s]", name)
+	}
+
+	var drop []backendIndex
+	switch index := query.Query.Map()["index"].(type) {
+	case string:
+		if index != "*" {
+			found, err := byName(index)
+			if err != nil {
+				return nil, err
+			}
+			drop = append(drop, found)
+			break
+		}
+		for _, found := range indexes {
+			if !found.primary {
+				drop = append(drop, found)
+			}
+		}
+	case []interface{}:
+		for _, v := range index {
+			name, _ := v.(string)
+			found, err := byName(name)
+			if err != nil {
+				return nil, err
+			}
+			drop = append(drop, found)
+		}
+	case bson.D:
+		for _, found := range indexes {
+			if equalKeys(found.key(), index) {
+				drop = append(drop, found)
+			}
+		}
+		switch {
+		case len(drop) == 0:
+			return nil, mongo.NewCommandError(mongo.ErrorCodeIndexNotFound, "can't find index with key: %v", index)
+		case drop[0].primary:
+			return nil, mongo.NewCommandError(mongo.ErrorCodeInvalidOptions, "cannot drop _id index")
+		}
+		drop = drop[:1]
+	default:
+		return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "'index' must be a string, an array of strings or an object")
+	}
+
+	table := quoteIdent(databaseName) + "." + quoteIdent(tableName)
+	for _, index := range drop {
+		statements := []string{fmt.Sprintf("DROP INDEX %s@%s", table, quoteIdent(index.name))}
+		if _, ok := index.spec.Map()["expireAfterSeconds"]; ok {
+			statements = append(statements, fmt.Sprintf("ALTER TABLE %s RESET (ttl)", table))
+		}
+		for _, statement := range statements {
+			ctx.Log.Debug("sql=%s", statement)
+			if _, err := ctx.SQL().Exec(statement); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return newReply(bson.D{
+		bson.DocElem{"nIndexesWas", len(indexes)},
+		bson.DocElem{"ok", 1},
+	}), nil
+}
+
+// backendIndexes - The indexes of a table, primary key first. Indexes
+// without a stored specification are described from their columns, and a
+// primary key on _id is the _id index. The primary key CockroachDB adds to
+// tables without one indexes no visible field, so it is left out.
+func backendIndexes(ctx *context.Context, databaseName, tableName string) ([]backendIndex, error) {
+	statement := fmt.Sprintf("SHOW INDEXES FROM %s.%s WITH COMMENT", quoteIdent(databaseName), quoteIdent(tableName))
+	ctx.Log.Debug("sql=%s", statement)
+	rows, err := ctx.SQL().Query(statement)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	docs, err := scanDocuments(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	var indexes []*backendIndex
+	var comments []string
+	var unique []bool
+	byName := make(map[string]int)
+	for _, v := range docs {
+		row := v.(bson.D).Map()
+		name, _ := row["index_name"].(string)
+		if storing, _ := row["storing"].(bool); storing {
+			continue
+		}
+		if implicit, _ := row["implicit"].(bool); implicit {
+			continue
+		}
+		i, ok := byName[name]
+		if !ok {
+			i = len(indexes)
+			byName[name] = i
+			nonUnique, _ := row["non_unique"].(bool)
+			comment, _ := row["comment"].(string)
+			indexes = append(indexes, &backendIndex{
+				name:    name,
+				primary: name == "primary" || name == tableName+"_pkey",
+			})
+			comments = append(comments, comment)
+			unique = append(unique, !nonUnique)
+		}
+		columnName, _ := row["column_name"].(string)
+		direction := 1
+		if d, _ := row["direction"].(string); d == "DESC" {
+			direction = -1
+		}
+		index := indexes[i]
+		index.spec = append(index.spec, bson.DocElem{columnName, direction})
+	}
+
+	var result []backendIndex
+	for i, index := range indexes {
+		// Until here spec only holds the key.
+		key := index.spec
+		if strings.HasPrefix(comments[i], indexCommentPrefix) {
+			stored, err := decodeJSON([]byte(strings.TrimPrefix(comments[i], indexCommentPrefix)))
+			if spec, ok := stored.(bson.D); ok && err == nil {
+				index.spec = spec
+				result = append(result, *index)
+				continue
+			}
+			ctx.Log.Warn("ignoring the invalid specification of index %s on %s.%s: %v", index.name, databaseName, tableName, err)
+		}
+		name := index.name
+		if index.primary {
+			if equalKeys(key, bson.D{{"rowid", 1}}) {
+				continue
+			}
+			if equalKeys(key, bson.D{{"_id", 1}}) {
+				name = idIndexName
+			}
+		}
+		index.spec = bson.D{{"v", 2}, {"key", key}, {"name", name}}
+		if unique[i] && !index.primary {
+			index.spec = append(index.spec, bson.DocElem{"unique", true})
+		}
+		if index.primary {
+			result = append([]backendIndex{*index}, result...)
+		} else {
+			result = append(result, *index)
+		}
+	}
+	return result, nil
+}
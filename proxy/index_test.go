@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestCreateIndexTTL(t *testing.T) {
+	columns := []column{{"_id", false}, {"created", false}, {"expires", true}, {"meta", true}}
+	tests := []struct {
+		name string
+		key  bson.D
+		ttl  interface{}
+		// expiration is the ttl_expiration_expression set, or empty for
+		// an error with code.
+		expiration string
+		code       mongo.ErrorCode
+	}{
+		{
+			name:       "column",
+			key:        bson.D{{"created", 1}},
+			ttl:        3600,
+			expiration: `"created" + '3600 seconds'::INTERVAL`,
+		},
+		{
+			name:       "JSONB column",
+			key:        bson.D{{"expires", 1}},
+			ttl:        0,
+			expiration: `(CASE WHEN (CASE WHEN jsonb_typeof("expires") = 'string' THEN "expires" #>> '{}' END) ~ '` + rfc3339Pattern + `' THEN ((CASE WHEN jsonb_typeof("expires") = 'string' THEN "expires" #>> '{}' END))::TIMESTAMPTZ END) + '0 seconds'::INTERVAL`,
+		},
+		{
+			name:       "JSONB path",
+			key:        bson.D{{"meta.at", -1}},
+			ttl:        int64(60),
+			expiration: `(CASE WHEN (CASE WHEN jsonb_typeof("meta"->'at') = 'string' THEN "meta"->'at' #>> '{}' END) ~ '` + rfc3339Pattern + `' THEN ((CASE WHEN jsonb_typeof("meta"->'at') = 'string' THEN "meta"->'at' #>> '{}' END))::TIMESTAMPTZ END) + '60 seconds'::INTERVAL`,
+		},
+		{name: "negative", key: bson.D{{"created", 1}}, ttl: -1, code: mongo.ErrorCodeCannotCreateIndex},
+		{name: "compound", key: bson.D{{"created", 1}, {"expires", 1}}, ttl: 60, code: mongo.ErrorCodeCannotCreateIndex},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spec := bson.D{{"key", test.key}, {"expireAfterSeconds", test.ttl}}
+			_, statements, err := createIndexStatements("db", "items", columns, spec)
+			if test.expiration == "" {
+				cmdErr, ok := errors.Cause(err).(*mongo.CommandError)
+				if !ok || cmdErr.Code != test.code {
+					t.Fatalf("got %v, want error code %d", err, test.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := `ALTER TABLE "db"."items" SET (ttl_expiration_expression = ` + quoteString(test.expiration) + `)`
+			if got := statements[len(statements)-1]; got != want {
+				t.Errorf("got\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestCreateIndexesChecksSpecsFirst(t *testing.T) {
+	d := &scriptedDriver{answer: func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		if strings.HasPrefix(query, "SHOW INDEXES") {
+			return []string{"index_name", "column_name"}, nil, nil
+		}
+		return []string{"_id", "name"}, nil, nil
+	}}
+	ctx := newSQLContext(d.open(t))
+	_, err := handleCreateIndexes(ctx, mongo.QueryOp{
+		Collection: "db.$cmd",
+		Query: bson.D{
+			{"createIndexes", "items"},
+			{"indexes", []interface{}{
+				bson.D{{"key", bson.D{{"added", 1}}}, {"name", "added_1"}},
+				bson.D{{"key", bson.D{}}, {"name", "empty"}},
+			}},
+		},
+	})
+	cmdErr, ok := errors.Cause(err).(*mongo.CommandError)
+	if !ok || cmdErr.Code != mongo.ErrorCodeCannotCreateIndex {
+		t.Fatalf("got %v, want CannotCreateIndex", err)
+	}
+	for _, statement := range d.ran() {
+		if strings.HasPrefix(statement, "ALTER") || strings.HasPrefix(statement, "CREATE") {
+			t.Errorf("ran %s for an invalid specification", statement)
+		}
+	}
+}
+
+func TestCreateIndexesAddsColumns(t *testing.T) {
+	d := &scriptedDriver{answer: func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		if strings.HasPrefix(query, "SHOW INDEXES") {
+			return []string{"index_name", "column_name"}, nil, nil
+		}
+		return []string{"_id", "name"}, nil, nil
+	}}
+	ctx := newSQLContext(d.open(t))
+	if _, err := handleCreateIndexes(ctx, mongo.QueryOp{
+		Collection: "db.$cmd",
+		Query: bson.D{
+			{"createIndexes", "items"},
+			{"indexes", []interface{}{bson.D{{"key", bson.D{{"added", 1}}}, {"name", "added_1"}}}},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var altered bool
+	for _, statement := range d.ran() {
+		altered = altered || strings.HasPrefix(statement, `ALTER TABLE "db"."items" ADD COLUMN IF NOT EXISTS "added"`)
+		if strings.HasPrefix(statement, "CREATE INDEX") && !altered {
+			t.Errorf("ran %s before adding its column", statement)
+		}
+	}
+	if commits, _ := d.ended(); !altered || commits != 1 {
+		t.Errorf("added the column %t in %d transactions", altered, commits)
+	}
+}
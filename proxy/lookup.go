@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lego/mongotunnel/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// lookup - Compile $lookup into a correlated subquery that collects the
+// joined documents into a JSONB array, which becomes the `as` field. Both
+// the localField/foreignField form and the pipeline form are supported,
+// as well as the two combined.
+func (c *pipelineCompiler) lookup(v interface{}) error {
+	spec, ok := v.(bson.D)
+	if !ok {
+		return mongo.NewCommandError(mongo.ErrorCodeBadValue, "the $lookup specification must be an object")
+	}
+	m := spec.Map()
+	from, _ := m["from"].(string)
+	as, _ := m["as"].(string)
+	localField, hasLocal := m["localField"].(string)
+	foreignField, hasForeign := m["foreignField"].(string)
+	pipeline, hasPipeline := m["pipeline"].([]interface{})
+	let, _ := m["let"].(bson.D)
+	switch {
+	case from == "":
+		return mongo.NewCommandError(mongo.ErrorCodeBadValue, "$lookup requires a 'from' collection name")
+	case as == "":
+		return mongo.NewCommandError(mongo.ErrorCodeBadValue, "must specify 'as' field for a $lookup")
+	case hasLocal != hasForeign:
+		return mongo.NewCommandError(mongo.ErrorCodeBadValue, "$lookup requires both or neither of 'localField' and 'foreignField' to be specified")
+	case !hasLocal && !hasPipeline:
+		return mongo.NewCommandError(mongo.ErrorCodeBadValue, "$lookup requires either 'pipeline' or both 'localField' and 'foreignField' to be specified")
+	case strings.Contains(as, "."):
+		return mongo.NewCommandError(mongo.ErrorCodeNotImplemented, "$lookup into the nested field %s is not supported by the SQL translator", as)
+	}
+
+	if c.block.projected() || c.block.limited() {
+		c.wrap()
+	}
+	b := c.block
+	// The subquery refers to the outer columns by their qualified names,
+	// since the joined collection may have columns of the same name.
+	outer := *b
+	outer.qualify = true
+
+	var joined sqlExpr
+	columns, err := c.columnsOf(from)
+	switch {
+	case isUndefinedTable(err):
+		// Like a collection that does not exist, nothing joins.
+		joined = sqlExpr{"'[]'::JSONB", true}
+	case err != nil:
+		return err
+	default:
+		var foreignEqual func(*selectBlock) string
+		if hasLocal {
+			foreignEqual = func(inner *selectBlock) string {
+				return lookupEqual(inner.field(foreignField), outer.field(localField))
+			}
+		}
+		joined, err = c.joinSubquery(&outer, from, columns, let, foreignEqual, pipeline)
+		if err != nil {
+			return err
+		}
+	}
+
+	var items []selectItem
+	replaced := false
+	for _, item := range b.items() {
+		if item.name == as {
+			item.sqlExpr, replaced = joined, true
+		}
+		items = append(items, item)
+	}
+	if !replaced {
+		items = append(items, selectItem{joined, as})
+	}
+	b.selects = items
+	return nil
+}
+
+// joinSubquery - Compile the pipeline run on the joined collection for
+// each outer document. foreignEqual, if set, is the localField/foreignField
+// condition.
+func (c *pipelineCompiler) joinSubquery(outer *selectBlock, from string, columns []column, let bson.D, foreignEqual func(*selectBlock) string, pipeline []interface{}) (sqlExpr, error) {
+	name := quoteIdent(c.alias("l"))
+	inner := &pipelineCompiler{
+		compilerState: c.compilerState,
+		block:         newSelectBlock(quoteIdent(c.database)+"."+quoteIdent(from)+" AS "+name, name, columns),
+		variables:     make(map[string]sqlExpr),
+	}
+	// Variables of an enclosing $lookup stay visible.
+	for k, v := range c.variables {
+		inner.variables[k] = v
+	}
+	for _, elem := range let {
+		expr, err := c.expression(outer, elem.Value)
+		if err != nil {
+			return nullExpr, err
+		}
+		inner.variables[elem.Name] = expr
+	}
+	if foreignEqual != nil {
+		inner.block.where = append(inner.block.where, foreignEqual(inner.block))
+	}
+	for _, stage := range pipeline {
+		if err := inner.stage(stage); err != nil {
+			return nullExpr, err
+		}
+	}
+	return inner.aggregateDocuments(), nil
+}
+
+// aggregateDocuments - Turn the compiled pipeline into a scalar subquery
+// returning its documents as a JSONB array, in order.
+func (c *pipelineCompiler) aggregateDocuments() sqlExpr {
+	if c.block.projected() || c.block.limited() {
+		c.wrap()
+	}
+	b := c.block
+	var args []string
+	for _, col := range b.columns {
+		if !strings.HasPrefix(col.name, internalPrefix) {
+			args = append(args, quoteString(col.name), quoteIdent(col.name))
+		}
+	}
+	orderBy := ""
+	if len(b.orderBy) > 0 {
+		orderBy = " ORDER BY " + strings.Join(b.orderBy, ", ")
+	}
+	agg := fmt.Sprintf("COALESCE(jsonb_agg(%s%s), '[]'::JSONB)", jsonbObject(args).sql, orderBy)
+	b.selects = []selectItem{{sqlExpr{agg, true}, internalPrefix + "documents"}}
+	b.orderBy = nil
+	return sqlExpr{"(" + b.String() + ")", true}
+}
+
+// lookupEqual - Whether a foreign field matches a local one. As in
+// MongoDB, a value matches an array containing it, and a missing local
+// field matches a missing or null foreign field.
+func lookupEqual(foreign, local sqlExpr) string {
+	if foreign == nullExpr {
+		return local.sql + " IS NULL"
+	}
+	if local == nullExpr {
+		return foreign.sql + " IS NULL"
+	}
+	var eq string
+	switch {
+	case !foreign.json && !local.json:
+		eq = foreign.sql + " = " + local.sql
+	case !foreign.json:
+		eq = fmt.Sprintf("(to_jsonb(%[1]s) = %[2]s OR %[2]s @> jsonb_build_array(%[1]s))", foreign.sql, local.sql)
+	case !local.json:
+		eq = fmt.Sprintf("(%[1]s = to_jsonb(%[2]s) OR %[1]s @> jsonb_build_array(%[2]s))", foreign.sql, local.sql)
+	default:
+		eq = fmt.Sprintf("(%[1]s = %[2]s OR %[2]s @> jsonb_build_array(%[1]s) OR %[1]s @> jsonb_build_array(%[2]s))", foreign.sql, local.sql)
+	}
+	return fmt.Sprintf("(%s OR (%s IS NULL AND %s IS NULL))", eq, foreign.sql, local.sql)
+}
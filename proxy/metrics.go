@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"database/sql"
+
+	"github.com/lego/mongotunnel/util/metrics"
+)
+
+// targetSynthesized - The target of requests the proxy answers itself, such
+// as the handshake, rather than the remote or the translator.
+const targetSynthesized = "synthesized"
+
+// commandOther - The command label of commands outside metricCommands.
+const commandOther = "other"
+
+// metricCommands - The commands that keep their name as a label. Clients
+// name commands as they like, so the rest are counted together as
+// commandOther rather than each adding series to the registry.
+var metricCommands = map[string]bool{
+	"find": true, "getMore": true, "killCursors": true, "aggregate": true, "count": true, "distinct": true,
+	"insert": true, "update": true, "delete": true, "findAndModify": true,
+	"create": true, "drop": true, "dropDatabase": true, "renameCollection": true,
+	"createIndexes": true, "dropIndexes": true, "listIndexes": true, "listCollections": true, "listDatabases": true,
+	"startSession": true, "endSessions": true, "commitTransaction": true, "abortTransaction": true,
+	"isMaster": true, "ismaster": true, "hello": true, "ping": true, "buildInfo": true, "buildinfo": true,
+	"saslStart": true, "saslContinue": true, "authenticate": true, "logout": true, "getnonce": true,
+	"getLastError": true, "explain": true, "currentOp": true, "killOp": true, "serverStatus": true, "connectionStatus": true,
+}
+
+// commandLabel - The command label of a request.
+func commandLabel(command string) string {
+	if command == "" || metricCommands[command] {
+		return command
+	}
+	return commandOther
+}
+
+// latencyBuckets - The upper bounds of the latency histogram, in seconds.
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics - The metrics of all proxied connections, served to Prometheus.
+// Share one between connections.
+type Metrics struct {
+	*metrics.Registry
+
+	connectionsActive *metrics.Gauge
+	connectionsTotal  *metrics.Counter
+	requests          *metrics.Counter
+	latency           *metrics.Histogram
+	bytes             *metrics.Counter
+	errors            *metrics.Counter
+}
+
+// NewMetrics - Create the metrics of the proxy.
+func NewMetrics() *Metrics {
+	r := metrics.NewRegistry()
+	return &Metrics{
+		Registry:          r,
+		connectionsActive: r.Gauge("mongotunnel_connections_active", "Client connections currently open."),
+		connectionsTotal:  r.Counter("mongotunnel_connections_total", "Client connections accepted."),
+		requests:          r.Counter("mongotunnel_requests_total", "Client requests by opcode, command and the target that answered them.", "opcode", "command", "target"),
+		latency:           r.Histogram("mongotunnel_request_duration_seconds", "Time from reading a request to writing its reply.", latencyBuckets, "command", "target"),
+		bytes:             r.Counter("mongotunnel_client_bytes_total", "Bytes read from (in) and written to (out) clients.", "direction"),
+		errors:            r.Counter("mongotunnel_errors_total", "Error replies by code.", "code", "code_name"),
+	}
+}
+
+// WatchSessions - Report the sessions and cursors of the translator.
+func (m *Metrics) WatchSessions(s *Sessions) {
+	m.GaugeFunc("mongotunnel_sessions_active", "Logical sessions known to the translator.", func() float64 {
+		sessions, _ := s.counts()
+		return float64(sessions)
+	})
+	m.GaugeFunc("mongotunnel_cursors_open", "Cursors of translated queries currently open.", func() float64 {
+		_, cursors := s.counts()
+		return float64(cursors)
+	})
+}
+
+// WatchDB - Report the connection pool of CockroachDB.
+func (m *Metrics) WatchDB(db *sql.DB) {
+	m.GaugeFunc("mongotunnel_sql_connections_max_open", "Maximum open connections to CockroachDB.", func() float64 {
+		return float64(db.Stats().MaxOpenConnections)
+	})
+	m.GaugeFunc("mongotunnel_sql_connections_open", "Open connections to CockroachDB.", func() float64 {
+		return float64(db.Stats().OpenConnections)
+	})
+	m.GaugeFunc("mongotunnel_sql_connections_in_use", "Connections to CockroachDB currently in use.", func() float64 {
+		return float64(db.Stats().InUse)
+	})
+	m.GaugeFunc("mongotunnel_sql_connections_idle", "Idle connections to CockroachDB.", func() float64 {
+		return float64(db.Stats().Idle)
+	})
+	m.CounterFunc("mongotunnel_sql_connections_wait_total", "Waits for a connection to CockroachDB.", func() float64 {
+		return float64(db.Stats().WaitCount)
+	})
+	m.CounterFunc("mongotunnel_sql_connections_wait_seconds_total", "Time spent waiting for a connection to CockroachDB.", func() float64 {
+		return db.Stats().WaitDuration.Seconds()
+	})
+	m.CounterFunc("mongotunnel_sql_connections_closed_max_idle_total", "Connections to CockroachDB closed by the idle limit.", func() float64 {
+		return float64(db.Stats().MaxIdleClosed)
+	})
+	m.CounterFunc("mongotunnel_sql_connections_closed_max_lifetime_total", "Connections to CockroachDB closed by the lifetime limit.", func() float64 {
+		return float64(db.Stats().MaxLifetimeClosed)
+	})
+}
+
+// connectionOpened - Count a client connection.
+func (p *Proxy) connectionOpened() {
+	if p.Metrics == nil {
+		return
+	}
+	p.Metrics.connectionsActive.Add(1)
+	p.Metrics.connectionsTotal.Inc()
+}
+
+// connectionClosed - Count a client connection as closed.
+func (p *Proxy) connectionClosed() {
+	if p.Metrics == nil {
+		return
+	}
+	p.Metrics.connectionsActive.Add(-1)
+}
@@ -0,0 +1,19 @@
+package proxy
+
+import "testing"
+
+func TestCommandLabel(t *testing.T) {
+	tests := []struct {
+		command, want string
+	}{
+		{"find", "find"},
+		{"", ""},
+		{"commitTransaction", "commitTransaction"},
+		{"madeUp0123", commandOther},
+	}
+	for _, test := range tests {
+		if got := commandLabel(test.command); got != test.want {
+			t.Errorf("commandLabel(%q) = %q, want %q", test.command, got, test.want)
+		}
+	}
+}
@@ -3,15 +3,23 @@ package proxy
 import (
 	"github.com/lego/mongotunnel/mongo"
 	"github.com/lego/mongotunnel/util/context"
-	"github.com/pkg/errors"
 	"gopkg.in/mgo.v2/bson"
 )
 
 // Handles initial connection negotiation messages and replies with hardcodeded values.
 
 func isNegotiation(ctx *context.Context, query mongo.QueryOp) bool {
-	if query.Collection == "admin.$cmd" {
+	if query.Collection != "admin.$cmd" && query.Collection != "$external.$cmd" {
+		return false
+	}
+	if len(query.Query) == 0 {
+		return false
+	}
+	switch query.Query[0].Name {
+	case "ismaster", "isMaster":
 		return true
+	case "authenticate":
+		return isX509Authenticate(query)
 	}
 	return false
 }
@@ -22,8 +30,12 @@ func createNegotiationReply(ctx *context.Context, query mongo.QueryOp) (mongo.Op
 	// 	ctx.Log.Warn("query[%d]=%v", i, doc)
 	// }
 	// if len(query.Query) == 0 {
-	doc := query.Query.Map()
-	if doc["ismaster"] == 1 {
+	if query.Query[0].Name == "authenticate" {
+		return createX509AuthReply(ctx, query)
+	}
+
+	// Drivers send the command as 1, 1.0 or true.
+	if truthy(query.Query[0].Value) {
 		return &mongo.ReplyOp{
 			Flags:     mongo.ReplyFlagShardConfigStale,
 			CursorID:  0,
@@ -37,6 +49,7 @@ func createNegotiationReply(ctx *context.Context, query mongo.QueryOp) (mongo.Op
 				bson.DocElem{"localTime", "2017-11-10 14:39:34.347 -0500 EST"},
 				bson.DocElem{"maxWireVersion", 5},
 				bson.DocElem{"minWireVersion", 0},
+				bson.DocElem{"logicalSessionTimeoutMinutes", logicalSessionTimeoutMinutes},
 				// Whoa, we can declare the server as readonly? By
 				// observation, the ruby driver does not respect it
 				// though.
@@ -46,5 +59,5 @@ func createNegotiationReply(ctx *context.Context, query mongo.QueryOp) (mongo.Op
 		}, nil
 	}
 	// }
-	return nil, errors.Errorf("could not identify negotiation query")
+	return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "could not identify negotiation query %v", query.Query[0])
 }
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/lego/mongotunnel/util/context"
+	"github.com/lego/mongotunnel/util/log"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestCreateNegotiationReply(t *testing.T) {
+	ctx := context.NewContext(&log.NullLogger{})
+	tests := []struct {
+		command bson.DocElem
+		ok      bool
+	}{
+		{bson.DocElem{"isMaster", 1}, true},
+		{bson.DocElem{"isMaster", 1.0}, true},
+		{bson.DocElem{"ismaster", true}, true},
+		{bson.DocElem{"ismaster", int64(1)}, true},
+		{bson.DocElem{"isMaster", 0}, false},
+		{bson.DocElem{"isMaster", false}, false},
+	}
+	for _, test := range tests {
+		query := mongo.QueryOp{Collection: "admin.$cmd", Query: bson.D{test.command}}
+		if !isNegotiation(ctx, query) {
+			t.Errorf("isNegotiation(%v) = false", test.command)
+			continue
+		}
+		reply, err := createNegotiationReply(ctx, query)
+		if !test.ok {
+			if _, ok := errors.Cause(err).(*mongo.CommandError); !ok {
+				t.Errorf("createNegotiationReply(%v) = %v, want a command error", test.command, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("createNegotiationReply(%v): %v", test.command, err)
+			continue
+		}
+		if doc := reply.(*mongo.ReplyOp).Documents.Map(); doc["ismaster"] != true || doc["ok"] != 1 {
+			t.Errorf("createNegotiationReply(%v) = %v", test.command, doc)
+		}
+	}
+}
@@ -0,0 +1,1174 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lego/mongotunnel/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The translator maps a collection to a table of the same name, and each
+// top-level field of a document to a column. Fields nested below a JSONB
+// column are reached with the JSONB operators, so `a.b.c` becomes
+// `"a"->'b'->'c'`.
+//
+// An aggregation pipeline is compiled into a single SELECT by adding each
+// stage to the clauses of the current selectBlock for as long as SQL
+// evaluates them in the same order as the pipeline, and wrapping the block
+// in a subquery when it does not.
+
+// internalPrefix - Names the columns the translator adds for its own use.
+// They are dropped from the returned documents.
+const internalPrefix = "__mt_"
+
+// orderColumn - Carries the order of a subquery to the query around it,
+// since SQL does not keep the order of a subquery.
+const orderColumn = internalPrefix + "order"
+
+// column - A column of the relation a stage reads. JSON columns hold JSONB
+// and can be navigated into with dotted paths.
+type column struct {
+	name string
+	json bool
+}
+
+// sqlExpr - A compiled SQL expression, and whether it evaluates to JSONB.
+type sqlExpr struct {
+	sql  string
+	json bool
+}
+
+var nullExpr = sqlExpr{sql: "NULL"}
+
+type selectItem struct {
+	sqlExpr
+	name string
+}
+
+// selectBlock - One SELECT. Its clauses are kept separately until the
+// pipeline is compiled, so that stages can keep adding to them.
+type selectBlock struct {
+	from string
+	// name qualifies the columns of from, and qualify makes field use it,
+	// for references from inside a correlated subquery.
+	name    string
+	qualify bool
+	columns []column
+	joins   []string
+	where   []string
+	groupBy []string
+	having  []string
+	// selects is nil while every input column is passed through.
+	selects  []selectItem
+	distinct bool
+	orderBy  []string
+	offset   int64
+	// limit is -1 for no limit.
+	limit int64
+}
+
+func newSelectBlock(from, name string, columns []column) *selectBlock {
+	return &selectBlock{
+		from:    from,
+		name:    name,
+		columns: columns,
+		limit:   -1,
+	}
+}
+
+func passthrough(columns []column) []selectItem {
+	items := make([]selectItem, 0, len(columns))
+	for _, col := range columns {
+		items = append(items, selectItem{sqlExpr{quoteIdent(col.name), col.json}, col.name})
+	}
+	return items
+}
+
+// projected - Whether the block has its own select list, so that later
+// stages see different columns than its input.
+func (b *selectBlock) projected() bool {
+	return b.selects != nil
+}
+
+// limited - Whether the block has an OFFSET or LIMIT, which SQL applies
+// after every other clause.
+func (b *selectBlock) limited() bool {
+	return b.limit >= 0 || b.offset > 0
+}
+
+func (b *selectBlock) items() []selectItem {
+	if b.selects == nil {
+		return passthrough(b.columns)
+	}
+	return b.selects
+}
+
+// outputs - The columns of the block's result.
+func (b *selectBlock) outputs() []column {
+	items := b.items()
+	columns := make([]column, len(items))
+	for i, item := range items {
+		columns[i] = column{item.name, item.json}
+	}
+	return columns
+}
+
+// field - The expression for a dotted field path. Fields that do not exist
+// evaluate to NULL, like a missing field in MongoDB.
+func (b *selectBlock) field(path string) sqlExpr {
+	parts := strings.Split(path, ".")
+	for _, col := range b.columns {
+		if col.name != parts[0] {
+			continue
+		}
+		expr := sqlExpr{quoteIdent(col.name), col.json}
+		if b.qualify {
+			expr.sql = b.name + "." + expr.sql
+		}
+		if len(parts) == 1 {
+			return expr
+		}
+		if !col.json {
+			return nullExpr
+		}
+		return sqlExpr{expr.sql + jsonPath(parts[1:]), true}
+	}
+	return nullExpr
+}
+
+func (b *selectBlock) hasColumn(name string) bool {
+	for _, col := range b.columns {
+		if col.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *selectBlock) String() string {
+	var buf bytes.Buffer
+	buf.WriteString("SELECT ")
+	if b.distinct {
+		buf.WriteString("DISTINCT ")
+	}
+	items := b.items()
+	if len(items) == 0 {
+		items = []selectItem{{nullExpr, internalPrefix + "empty"}}
+	}
+	for i, item := range items {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(item.sql)
+		if name := quoteIdent(item.name); item.sql != name {
+			buf.WriteString(" AS " + name)
+		}
+	}
+	buf.WriteString(" FROM " + b.from)
+	for _, join := range b.joins {
+		buf.WriteString(" " + join)
+	}
+	if len(b.where) > 0 {
+		buf.WriteString(" WHERE " + strings.Join(b.where, " AND "))
+	}
+	if len(b.groupBy) > 0 {
+		buf.WriteString(" GROUP BY " + strings.Join(b.groupBy, ", "))
+	}
+	if len(b.having) > 0 {
+		buf.WriteString(" HAVING " + strings.Join(b.having, " AND "))
+	}
+	if len(b.orderBy) > 0 {
+		buf.WriteString(" ORDER BY " + strings.Join(b.orderBy, ", "))
+	}
+	if b.offset > 0 {
+		fmt.Fprintf(&buf, " OFFSET %d", b.offset)
+	}
+	if b.limit >= 0 {
+		fmt.Fprintf(&buf, " LIMIT %d", b.limit)
+	}
+	return buf.String()
+}
+
+// pipelineCompiler - Compiles the stages of one pipeline into SQL. The
+// pipelines of $lookup stages get their own compiler, sharing the state of
+// the query they are part of.
+type pipelineCompiler struct {
+	*compilerState
+	collection string
+	block      *selectBlock
+	// stages counts the stages compiled so far.
+	stages int
+	// variables are the `let` variables of a $lookup pipeline.
+	variables map[string]sqlExpr
+}
+
+// compilerState - What all the pipelines of one query share.
+type compilerState struct {
+	database string
+	// columnsOf looks up the columns of the collections $lookup joins.
+	columnsOf func(collection string) ([]column, error)
+	args      []interface{}
+	aliases   int
+	// inline writes arguments into the SQL as literals, for statements
+	// that cannot take placeholders such as partial index predicates.
+	inline bool
+}
+
+func newPipelineCompiler(database, collection string, columns []column, columnsOf func(string) ([]column, error)) *pipelineCompiler {
+	from := quoteIdent(database) + "." + quoteIdent(collection)
+	return &pipelineCompiler{
+		compilerState: &compilerState{
+			database:  database,
+			columnsOf: columnsOf,
+		},
+		collection: collection,
+		block:      newSelectBlock(from, quoteIdent(collection), columns),
+	}
+}
+
+// SQL - The compiled query and its arguments.
+func (c *pipelineCompiler) SQL() (string, []interface{}) {
+	return c.block.String(), c.args
+}
+
+func (c *compilerState) param(v interface{}) string {
+	if c.inline {
+		return sqlLiteral(v)
+	}
+	c.args = append(c.args, v)
+	return fmt.Sprintf("$%d", len(c.args))
+}
+
+func (c *compilerState) alias(kind string) string {
+	c.aliases++
+	return fmt.Sprintf("%s%s%d", internalPrefix, kind, c.aliases)
+}
+
+// wrap - Start a new block reading the result of the current one.
+func (c *pipelineCompiler) wrap() {
+	b := c.block
+	ordered := len(b.orderBy) > 0
+	if ordered {
+		var items []selectItem
+		for _, item := range b.items() {
+			if item.name != orderColumn {
+				items = append(items, item)
+			}
+		}
+		number := fmt.Sprintf("row_number() OVER (ORDER BY %s)", strings.Join(b.orderBy, ", "))
+		b.selects = append(items, selectItem{sqlExpr{sql: number}, orderColumn})
+	}
+	name := quoteIdent(c.alias("s"))
+	c.block = newSelectBlock("("+b.String()+") AS "+name, name, b.outputs())
+	if ordered {
+		c.block.orderBy = []string{quoteIdent(orderColumn)}
+	}
+}
+
+// pipelineStages - The stages the translator can compile. It is filled in
+// by init since $lookup compiles nested pipelines through it.
+var pipelineStages map[string]func(*pipelineCompiler, interface{}) error
+
+func init() {
+	pipelineStages = map[string]func(*pipelineCompiler, interface{}) error{
+		"$match":     (*pipelineCompiler).match,
+		"$project":   (*pipelineCompiler).project,
+		"$group":     (*pipelineCompiler).group,
+		"$sort":      (*pipelineCompiler).sort,
+		"$limit":     (*pipelineCompiler).limit,
+		"$lookup":    (*pipelineCompiler).lookup,
+		"$skip":      (*pipelineCompiler).skip,
+		"$count":     (*pipelineCompiler).count,
+		"$unwind":    (*pipelineCompiler).unwind,
+		"$collStats": (*pipelineCompiler).collStats,
+	}
+}
+
+// unsupportedStages - Stages MongoDB has that the translator cannot
+// compile. Anything in neither map is not a stage at all.
+var unsupportedStages = map[string]bool{
+	"$addFields":       true,
+	"$bucket":          true,
+	"$bucketAuto":      true,
+	"$changeStream":    true,
+	"$currentOp":       true,
+	"$densify":         true,
+	"$documents":       true,
+	"$facet":           true,
+	"$fill":            true,
+	"$geoNear":         true,
+	"$graphLookup":     true,
+	"$indexStats":      true,
+	"$listSessions":    true,
+	"$merge":           true,
+	"$out":             true,
+	"$redact":          true,
+	"$replaceRoot":     true,
+	"$replaceWith":     true,
+	"$sample":          true,
+	"$set":             true,
+	"$setWindowFields": true,
+	"$sortByCount":     true,
+	"$unionWith":       true,
+	"$unset":           true,
+}
+
+// stage - Add one pipeline stage.
+func (c *pipelineCompiler) stage(v interface{}) error {
+	stage, ok := v.(bson.D)
+	if !ok || len(stage) != 1 {
+		return mongo.NewCommandError(mongo.ErrorCodeBadValue, "a pipeline stage specification object must contain exactly one field")
+	}
+	name := stage[0].Name
+	if compile, ok := pipelineStages[name]; ok {
+		c.stages++
+		return compile(c, stage[0].Value)
+	}
+	if unsupportedStages[name] {
+		return mongo.NewCommandError(mongo.ErrorCodeNotImplemented, "%s is not supported by the SQL translator", name)
+	}
+	return mongo.NewCommandError(mongo.ErrorCodeUnrecognizedPipelineStage, "Unrecognized pipeline stage name: '%s'", name)
+}
+
+func (c *pipelineCompiler) match(v interface{}) error {
+	filter, ok := v.(bson.D)
+	if !ok {
+		return mongo.NewCommandError(mongo.ErrorCodeBadValue, "the match filter must be an expression in an object")
+	}
+	if c.block.projected() || c.block.limited() {
+		c.wrap()
+	}
+	cond, err := c.filter(c.block, filter)
+	if err != nil {
+		return err
+	}
+	if cond != "TRUE" {
+		c.block.where = append(c.block.where, cond)
+	}
+	return nil
+}
+
+func (c *pipelineCompiler) sort(v interface{}) error {
+	spec, ok := v.(bson.D)
+	if !ok || len(spec) == 0 {
+		return mongo.NewCommandError(mongo.ErrorCodeBadValue, "$sort key specification must be a non-empty object")
+	}
+	if c.block.projected() || c.block.limited() {
+		c.wrap()
+	}
+	var terms []string
+	for _, elem := range spec {
+		direction, ok := toInt64(elem.Value)
+		if !ok || (direction != 1 && direction != -1) {
+			if _, meta := elem.Value.(bson.D); meta {
+				return mongo.NewCommandError(mongo.ErrorCodeNotImplemented, "$meta sort keys are not supported by the SQL translator")
+			}
+			return mongo.NewCommandError(mongo.ErrorCodeBadValue, "$sort key ordering must be 1 (for ascending) or -1 (for descending)")
+		}
+		term := c.block.field(elem.Name).sql
+		if direction < 0 {
+			term += " DESC"
+		}
+		terms = append(terms, term)
+	}
+	// Sorts are stable, so an earlier sort breaks ties.
+	c.block.orderBy = append(terms, c.block.orderBy...)
+	return nil
+}
+
+func (c *pipelineCompiler) limit(v interface{}) error {
+	n, ok := toInt64(v)
+	if !ok || n <= 0 {
+		return mongo.NewCommandError(mongo.ErrorCodeBadValue, "the limit must be positive")
+	}
+	if c.block.limit < 0 || n < c.block.limit {
+		c.block.limit = n
+	}
+	return nil
+}
+
+func (c *pipelineCompiler) skip(v interface{}) error {
+	n, ok := toInt64(v)
+	if !ok || n < 0 {
+		return mongo.NewCommandError(mongo.ErrorCodeBadValue, "the skip must be a non-negative number")
+	}
+	c.block.offset += n
+	if c.block.limit >= 0 {
+		// A skip after a limit skips into the limited rows.
+		c.block.limit -= n
+		if c.block.limit < 0 {
+			c.block.limit = 0
+		}
+	}
+	return nil
+}
+
+func (c *pipelineCompiler) count(v interface{}) error {
+	name, ok := v.(string)
+	if !ok || name == "" || strings.HasPrefix(name, "$") || strings.Contains(name, ".") {
+		return mongo.NewCommandError(mongo.ErrorCodeBadValue, "the count field must be a non-empty string without $ or .")
+	}
+	c.countRows(name)
+	// MongoDB returns nothing rather than a count of zero.
+	c.block.having = append(c.block.having, "count(*) > 0")
+	return nil
+}
+
+// countRows - Replace the documents with their count.
+func (c *pipelineCompiler) countRows(name string) {
+	if c.block.projected() || c.block.limited() {
+		c.wrap()
+	}
+	b := c.block
+	b.selects = []selectItem{{sqlExpr{sql: "count(*)"}, name}}
+	b.orderBy = nil
+}
+
+// distinctValues - Replace the documents with the distinct values of a
+// field, with arrays contributing each of their elements.
+func (c *pipelineCompiler) distinctValues(path, name string) error {
+	if err := c.unwind("$" + path); err != nil {
+		return err
+	}
+	c.wrap()
+	b := c.block
+	field := b.field(path)
+	b.selects = []selectItem{{field, name}}
+	b.where = append(b.where, field.sql+" IS NOT NULL")
+	b.distinct = true
+	b.orderBy = nil
+	return nil
+}
+
+// collStats - Only the document count is supported, from the table
+// statistics.
+func (c *pipelineCompiler) collStats(v interface{}) error {
+	spec, ok := v.(bson.D)
+	if !ok {
+		return mongo.NewCommandError(mongo.ErrorCodeBadValue, "$collStats must take a nested object")
+	}
+	if c.stages != 1 {
+		return mongo.NewCommandError(mongo.ErrorCodeBadValue, "$collStats is only valid as the first stage in a pipeline")
+	}
+	var items []selectItem
+	for _, elem := range spec {
+		if elem.Name != "count" {
+			return mongo.NewCommandError(mongo.ErrorCodeNotImplemented, "$collStats %s is not supported by the SQL translator", elem.Name)
+		}
+		items = append(items, selectItem{sqlExpr{sql: estimatedCount(c.database, c.collection)}, "count"})
+	}
+	stats := &selectBlock{selects: items, from: "(SELECT 1) AS " + quoteIdent(c.alias("one")), limit: -1}
+	name := quoteIdent(c.alias("s"))
+	c.block = newSelectBlock("("+stats.String()+") AS "+name, name, stats.outputs())
+	return nil
+}
+
+// estimatedCount - The row count from the table statistics, or an exact
+// count if the table has none yet.
+func estimatedCount(database, collection string) string {
+	return fmt.Sprintf("COALESCE((SELECT max(estimated_row_count) FROM %s.crdb_internal.table_row_statistics WHERE table_name = %s), (SELECT count(*) FROM %s.%s))",
+		quoteIdent(database), quoteString(collection), quoteIdent(database), quoteIdent(collection))
+}
+
+func (c *pipelineCompiler) unwind(v interface{}) error {
+	var path, indexField string
+	var preserve bool
+	switch spec := v.(type) {
+	case string:
+		path = spec
+	case bson.D:
+		m := spec.Map()
+		path, _ = m["path"].(string)
+		indexField, _ = m["includeArrayIndex"].(string)
+		preserve, _ = m["preserveNullAndEmptyArrays"].(bool)
+	default:
+		return mongo.NewCommandError(mongo.ErrorCodeBadValue, "expected either a string or an object as specification for $unwind stage")
+	}
+	if !strings.HasPrefix(path, "$") || len(path) < 2 {
+		return mongo.NewCommandError(mongo.ErrorCodeBadValue, "path option to $unwind stage should be prefixed with a '$': %s", path)
+	}
+	path = path[1:]
+
+	if c.block.projected() || c.block.limited() {
+		c.wrap()
+	}
+	b := c.block
+	items := passthrough(b.columns)
+	field := b.field(path)
+	if !field.json {
+		// A scalar unwinds to itself, and a missing field to nothing.
+		if !preserve {
+			b.where = append(b.where, field.sql+" IS NOT NULL")
+		}
+		if indexField != "" {
+			items = append(items, selectItem{sqlExpr{sql: "CASE WHEN " + field.sql + " IS NOT NULL THEN 0 END"}, indexField})
+		}
+		b.selects = items
+		return nil
+	}
+
+	alias := c.alias("unwind")
+	value, index := alias+"_value", alias+"_index"
+	array := fmt.Sprintf("CASE jsonb_typeof(%[1]s) WHEN 'array' THEN %[1]s WHEN 'null' THEN NULL ELSE jsonb_build_array(%[1]s) END", field.sql)
+	join := "INNER JOIN"
+	if preserve {
+		join = "LEFT JOIN"
+	}
+	b.joins = append(b.joins, fmt.Sprintf("%s LATERAL jsonb_array_elements(%s) WITH ORDINALITY AS %s(%s, %s) ON TRUE",
+		join, array, quoteIdent(alias), quoteIdent(value), quoteIdent(index)))
+
+	parts := strings.SplitN(path, ".", 2)
+	for i, item := range items {
+		if item.name != parts[0] {
+			continue
+		}
+		if len(parts) == 1 {
+			items[i].sqlExpr = sqlExpr{quoteIdent(value), true}
+		} else {
+			set := fmt.Sprintf("COALESCE(jsonb_set(%s, %s, %s), %s)", item.sql, quoteString(pgArray(strings.Split(parts[1], "."))), quoteIdent(value), item.sql)
+			items[i].sqlExpr = sqlExpr{set, true}
+		}
+	}
+	if indexField != "" {
+		items = append(items, selectItem{sqlExpr{sql: quoteIdent(index) + " - 1"}, indexField})
+	}
+	b.selects = items
+	if len(b.orderBy) > 0 {
+		b.orderBy = append(b.orderBy, quoteIdent(index))
+	}
+	return nil
+}
+
+// projectionNode - One field of a $project specification. Dotted paths and
+// nested documents both become children.
+type projectionNode struct {
+	name     string
+	path     string
+	include  bool
+	exclude  bool
+	expr     interface{}
+	computed bool
+	children []*projectionNode
+}
+
+func (n *projectionNode) find(name string) *projectionNode {
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (n *projectionNode) child(name string) *projectionNode {
+	if c := n.find(name); c != nil {
+		return c
+	}
+	path := name
+	if n.path != "" {
+		path = n.path + "." + name
+	}
+	c := &projectionNode{name: name, path: path}
+	n.children = append(n.children, c)
+	return c
+}
+
+// parseProjection - Build the projection tree, and report whether it is an
+// exclusion projection.
+func parseProjection(spec bson.D) (*projectionNode, bool, error) {
+	root := &projectionNode{}
+	if err := root.add(spec); err != nil {
+		return nil, false, err
+	}
+	var inclusion, exclusion string
+	var walk func(n *projectionNode)
+	walk = func(n *projectionNode) {
+		for _, c := range n.children {
+			switch {
+			case c.exclude && c.path != "_id":
+				exclusion = c.path
+			case c.include || c.computed:
+				inclusion = c.path
+			}
+			walk(c)
+		}
+	}
+	walk(root)
+	if inclusion != "" && exclusion != "" {
+		return nil, false, mongo.NewCommandError(mongo.ErrorCodeBadValue, "Cannot do exclusion on field %s in inclusion projection", exclusion)
+	}
+	if inclusion == "" && exclusion == "" {
+		// Only `_id: 0`, or nothing at all.
+		return root, true, nil
+	}
+	return root, exclusion != "", nil
+}
+
+func (n *projectionNode) add(spec bson.D) error {
+	for _, elem := range spec {
+		if strings.HasPrefix(elem.Name, "$") {
+			return mongo.NewCommandError(mongo.ErrorCodeBadValue, "FieldPath field names may not start with '$': %s", elem.Name)
+		}
+		node := n
+		for _, part := range strings.Split(elem.Name, ".") {
+			node = node.child(part)
+		}
+		switch v := elem.Value.(type) {
+		case bool:
+			node.include, node.exclude = v, !v
+		case int, int32, int64, float64:
+			node.include, node.exclude = truthy(v), !truthy(v)
+		case bson.D:
+			if len(v) > 0 && strings.HasPrefix(v[0].Name, "$") {
+				node.expr, node.computed = v, true
+			} else if err := node.add(v); err != nil {
+				return err
+			}
+		default:
+			node.expr, node.computed = v, true
+		}
+	}
+	return nil
+}
+
+func (c *pipelineCompiler) project(v interface{}) error {
+	spec, ok := v.(bson.D)
+	if !ok {
+		return mongo.NewCommandError(mongo.ErrorCodeBadValue, "$project specification must be an object")
+	}
+	return c.projectSpec(spec)
+}
+
+func (c *pipelineCompiler) projectSpec(spec bson.D) error {
+	root, exclusion, err := parseProjection(spec)
+	if err != nil {
+		return err
+	}
+	if c.block.projected() {
+		c.wrap()
+	}
+	b := c.block
+
+	var items []selectItem
+	if exclusion {
+		excluded := make(map[string]*projectionNode)
+		for _, n := range root.children {
+			excluded[n.name] = n
+		}
+		for _, item := range passthrough(b.columns) {
+			n, ok := excluded[item.name]
+			switch {
+			case item.name == orderColumn:
+			case !ok:
+				items = append(items, item)
+			case n.exclude:
+			default:
+				// Remove nested fields from a JSONB column.
+				if item.json {
+					for _, path := range excludedPaths(n) {
+						item.sql = fmt.Sprintf("(%s #- %s)", item.sql, quoteString(pgArray(strings.Split(path, ".")[1:])))
+					}
+				}
+				items = append(items, item)
+			}
+		}
+		if items == nil {
+			items = []selectItem{}
+		}
+		b.selects = items
+		return nil
+	}
+
+	// Inclusion projections keep _id unless it is excluded.
+	if root.find("_id") == nil {
+		id := &projectionNode{name: "_id", path: "_id", include: true}
+		root.children = append([]*projectionNode{id}, root.children...)
+	}
+	for _, n := range root.children {
+		if n.exclude {
+			continue
+		}
+		if n.include && !b.hasColumn(n.name) {
+			// Missing fields are left out.
+			continue
+		}
+		expr, err := c.projectNode(b, n)
+		if err != nil {
+			return err
+		}
+		items = append(items, selectItem{expr, n.name})
+	}
+	if items == nil {
+		items = []selectItem{}
+	}
+	b.selects = items
+	return nil
+}
+
+func (c *pipelineCompiler) projectNode(b *selectBlock, n *projectionNode) (sqlExpr, error) {
+	switch {
+	case n.include:
+		return b.field(n.path), nil
+	case n.computed:
+		return c.expression(b, n.expr)
+	}
+	var args []string
+	for _, child := range n.children {
+		if child.exclude {
+			continue
+		}
+		expr, err := c.projectNode(b, child)
+		if err != nil {
+			return nullExpr, err
+		}
+		args = append(args, quoteString(child.name), expr.sql)
+	}
+	return jsonbObject(args), nil
+}
+
+func excludedPaths(n *projectionNode) []string {
+	if n.exclude {
+		return []string{n.path}
+	}
+	var paths []string
+	for _, c := range n.children {
+		paths = append(paths, excludedPaths(c)...)
+	}
+	return paths
+}
+
+func (c *pipelineCompiler) group(v interface{}) error {
+	spec, ok := v.(bson.D)
+	if !ok {
+		return mongo.NewCommandError(mongo.ErrorCodeBadValue, "a group's fields must be specified in an object")
+	}
+	m := spec.Map()
+	id, ok := m["_id"]
+	if !ok {
+		return mongo.NewCommandError(mongo.ErrorCodeBadValue, "a group specification must include an _id")
+	}
+	if c.block.projected() || c.block.limited() {
+		c.wrap()
+	}
+	b := c.block
+
+	idExpr, keys, err := c.groupKey(b, id)
+	if err != nil {
+		return err
+	}
+	items := []selectItem{{idExpr, "_id"}}
+	for _, elem := range spec {
+		if elem.Name == "_id" {
+			continue
+		}
+		if strings.Contains(elem.Name, ".") {
+			return mongo.NewCommandError(mongo.ErrorCodeBadValue, "the group aggregate field name '%s' cannot be used because $group's field names cannot contain '.'", elem.Name)
+		}
+		expr, err := c.accumulator(b, elem.Name, elem.Value)
+		if err != nil {
+			return err
+		}
+		items = append(items, selectItem{expr, elem.Name})
+	}
+
+	if len(keys) > 0 {
+		b.groupBy = keys
+	} else {
+		// A constant _id puts every document in one group, but there is
+		// no group at all without documents.
+		b.having = append(b.having, "count(*) > 0")
+	}
+	b.selects = items
+	b.orderBy = nil
+	return nil
+}
+
+// groupKey - The _id of a group and the expressions to GROUP BY. An _id
+// document groups by each of its fields.
+func (c *pipelineCompiler) groupKey(b *selectBlock, id interface{}) (sqlExpr, []string, error) {
+	if doc, ok := id.(bson.D); ok && (len(doc) == 0 || !strings.HasPrefix(doc[0].Name, "$")) {
+		var args, keys []string
+		for _, elem := range doc {
+			expr, err := c.expression(b, elem.Value)
+			if err != nil {
+				return nullExpr, nil, err
+			}
+			args = append(args, quoteString(elem.Name), expr.sql)
+			if !isConstant(elem.Value) {
+				keys = append(keys, expr.sql)
+			}
+		}
+		return jsonbObject(args), keys, nil
+	}
+	expr, err := c.expression(b, id)
+	if err != nil || isConstant(id) {
+		return expr, nil, err
+	}
+	return expr, []string{expr.sql}, nil
+}
+
+// isConstant - Whether an expression is a literal, which is left out of
+// GROUP BY.
+func isConstant(v interface{}) bool {
+	switch v := v.(type) {
+	case string:
+		return !strings.HasPrefix(v, "$")
+	case bson.D:
+		return len(v) == 1 && v[0].Name == "$literal"
+	case []interface{}:
+		for _, elem := range v {
+			if !isConstant(elem) {
+				return false
+			}
+		}
+		return true
+	}
+	return true
+}
+
+func (c *pipelineCompiler) accumulator(b *selectBlock, name string, v interface{}) (sqlExpr, error) {
+	spec, ok := v.(bson.D)
+	if !ok || len(spec) != 1 {
+		return nullExpr, mongo.NewCommandError(mongo.ErrorCodeBadValue, "the field '%s' must be an accumulator object", name)
+	}
+	op, arg := spec[0].Name, spec[0].Value
+	if op == "$sum" {
+		switch arg.(type) {
+		case int, int32, int64, float64:
+			// {$sum: 1} counts documents.
+			if n := fmt.Sprint(arg); n != "1" {
+				return sqlExpr{sql: "count(*) * " + n}, nil
+			}
+			return sqlExpr{sql: "count(*)"}, nil
+		}
+	}
+
+	expr, err := c.expression(b, arg)
+	if err != nil {
+		return nullExpr, err
+	}
+	orderBy := ""
+	if len(b.orderBy) > 0 {
+		orderBy = " ORDER BY " + strings.Join(b.orderBy, ", ")
+	}
+	switch op {
+	case "$sum":
+		return sqlExpr{sql: "COALESCE(sum(" + numeric(expr) + "), 0)"}, nil
+	case "$avg":
+		return sqlExpr{sql: "avg(" + numeric(expr) + ")"}, nil
+	case "$min":
+		return sqlExpr{"min(" + expr.sql + ")", expr.json}, nil
+	case "$max":
+		return sqlExpr{"max(" + expr.sql + ")", expr.json}, nil
+	case "$push":
+		// Missing values are not pushed.
+		push := fmt.Sprintf("COALESCE(jsonb_agg(%s%s) FILTER (WHERE %s IS NOT NULL), '[]'::JSONB)", expr.sql, orderBy, expr.sql)
+		return sqlExpr{push, true}, nil
+	case "$first":
+		if expr.json {
+			return sqlExpr{"(jsonb_agg(" + expr.sql + orderBy + ") -> 0)", true}, nil
+		}
+		return sqlExpr{sql: "(array_agg(" + expr.sql + orderBy + "))[1]"}, nil
+	}
+	if strings.HasPrefix(op, "$") {
+		return nullExpr, mongo.NewCommandError(mongo.ErrorCodeNotImplemented, "accumulator %s is not supported by the SQL translator", op)
+	}
+	return nullExpr, mongo.NewCommandError(mongo.ErrorCodeBadValue, "the field '%s' must be an accumulator object", name)
+}
+
+// expression - Compile an aggregation expression: a field path, a literal,
+// a document of expressions, or one of a few operators.
+func (c *pipelineCompiler) expression(b *selectBlock, v interface{}) (sqlExpr, error) {
+	switch v := v.(type) {
+	case string:
+		if strings.HasPrefix(v, "$$") {
+			return c.variable(v)
+		}
+		if strings.HasPrefix(v, "$") {
+			return b.field(v[1:]), nil
+		}
+	case []interface{}:
+		args := make([]string, len(v))
+		for i, elem := range v {
+			expr, err := c.expression(b, elem)
+			if err != nil {
+				return nullExpr, err
+			}
+			args[i] = expr.sql
+		}
+		return sqlExpr{"jsonb_build_array(" + strings.Join(args, ", ") + ")", true}, nil
+	case bson.D:
+		if len(v) == 1 && strings.HasPrefix(v[0].Name, "$") {
+			return c.operator(b, v[0].Name, v[0].Value)
+		}
+		var args []string
+		for _, elem := range v {
+			if strings.HasPrefix(elem.Name, "$") {
+				return nullExpr, mongo.NewCommandError(mongo.ErrorCodeBadValue, "field names in an expression object may not start with '$': %s", elem.Name)
+			}
+			expr, err := c.expression(b, elem.Value)
+			if err != nil {
+				return nullExpr, err
+			}
+			args = append(args, quoteString(elem.Name), expr.sql)
+		}
+		return jsonbObject(args), nil
+	}
+	return c.literal(v)
+}
+
+// variable - A `$$name` or `$$name.path` reference to a $lookup variable.
+func (c *pipelineCompiler) variable(ref string) (sqlExpr, error) {
+	parts := strings.Split(ref[2:], ".")
+	expr, ok := c.variables[parts[0]]
+	if !ok {
+		return nullExpr, mongo.NewCommandError(mongo.ErrorCodeNotImplemented, "variable %s is not supported by the SQL translator", ref)
+	}
+	if len(parts) == 1 {
+		return expr, nil
+	}
+	if !expr.json {
+		return nullExpr, nil
+	}
+	return sqlExpr{"(" + expr.sql + ")" + jsonPath(parts[1:]), true}, nil
+}
+
+var comparisonExpressions = map[string]string{
+	"$eq":  "=",
+	"$ne":  "<>",
+	"$gt":  ">",
+	"$gte": ">=",
+	"$lt":  "<",
+	"$lte": "<=",
+}
+
+var arithmeticOperators = map[string]string{
+	"$add":      " + ",
+	"$subtract": " - ",
+	"$multiply": " * ",
+	"$divide":   " / ",
+}
+
+func (c *pipelineCompiler) operator(b *selectBlock, op string, arg interface{}) (sqlExpr, error) {
+	if op == "$literal" {
+		return c.literal(arg)
+	}
+	args, ok := arg.([]interface{})
+	if !ok {
+		args = []interface{}{arg}
+	}
+	exprs := make([]sqlExpr, len(args))
+	for i, a := range args {
+		expr, err := c.expression(b, a)
+		if err != nil {
+			return nullExpr, err
+		}
+		exprs[i] = expr
+	}
+
+	if cmp, ok := comparisonExpressions[op]; ok {
+		if len(exprs) != 2 {
+			return nullExpr, mongo.NewCommandError(mongo.ErrorCodeBadValue, "expression %s takes exactly 2 arguments. %d were passed in.", op, len(exprs))
+		}
+		a, b := exprs[0], exprs[1]
+		if a.json != b.json {
+			a, b = jsonb(a), jsonb(b)
+		}
+		return sqlExpr{sql: "(" + a.sql + " " + cmp + " " + b.sql + ")"}, nil
+	}
+	switch op {
+	case "$and", "$or":
+		terms := make([]string, len(exprs))
+		for i, expr := range exprs {
+			terms[i] = boolean(expr)
+		}
+		return sqlExpr{sql: "(" + strings.Join(terms, " "+strings.ToUpper(op[1:])+" ") + ")"}, nil
+	case "$not":
+		if len(exprs) != 1 {
+			return nullExpr, mongo.NewCommandError(mongo.ErrorCodeBadValue, "expression $not takes exactly 1 argument. %d were passed in.", len(exprs))
+		}
+		return sqlExpr{sql: "(NOT " + boolean(exprs[0]) + ")"}, nil
+	case "$in":
+		if len(exprs) != 2 {
+			return nullExpr, mongo.NewCommandError(mongo.ErrorCodeBadValue, "expression $in takes exactly 2 arguments. %d were passed in.", len(exprs))
+		}
+		return sqlExpr{sql: "(" + jsonb(exprs[1]).sql + " @> jsonb_build_array(" + exprs[0].sql + "))"}, nil
+	}
+	if sep, ok := arithmeticOperators[op]; ok {
+		if (op == "$subtract" || op == "$divide") && len(exprs) != 2 {
+			return nullExpr, mongo.NewCommandError(mongo.ErrorCodeBadValue, "expression %s takes exactly 2 arguments. %d were passed in.", op, len(exprs))
+		}
+		terms := make([]string, len(exprs))
+		for i, expr := range exprs {
+			terms[i] = numeric(expr)
+			if op == "$divide" {
+				terms[i] += "::FLOAT8"
+			}
+		}
+		return sqlExpr{sql: "(" + strings.Join(terms, sep) + ")"}, nil
+	}
+	if op == "$concat" {
+		terms := make([]string, len(exprs))
+		for i, expr := range exprs {
+			terms[i] = text(expr)
+		}
+		return sqlExpr{sql: "(" + strings.Join(terms, " || ") + ")"}, nil
+	}
+	return nullExpr, mongo.NewCommandError(mongo.ErrorCodeNotImplemented, "expression %s is not supported by the SQL translator", op)
+}
+
+// literal - A constant as a typed placeholder.
+func (c *pipelineCompiler) literal(v interface{}) (sqlExpr, error) {
+	switch v := v.(type) {
+	case nil:
+		return nullExpr, nil
+	case string:
+		return sqlExpr{sql: c.param(v) + "::TEXT"}, nil
+	case bson.ObjectId:
+		return sqlExpr{sql: c.param(v.Hex()) + "::TEXT"}, nil
+	case bool:
+		return sqlExpr{sql: c.param(v) + "::BOOL"}, nil
+	case int, int32, int64:
+		n, _ := toInt64(v)
+		return sqlExpr{sql: c.param(n) + "::INT8"}, nil
+	case float64:
+		return sqlExpr{sql: c.param(v) + "::FLOAT8"}, nil
+	case time.Time:
+		return sqlExpr{sql: c.param(v) + "::TIMESTAMPTZ"}, nil
+	case bson.D, bson.M, []interface{}:
+		return c.jsonLiteral(v)
+	}
+	return nullExpr, mongo.NewCommandError(mongo.ErrorCodeNotImplemented, "values of type %T are not supported by the SQL translator", v)
+}
+
+func (c *pipelineCompiler) jsonLiteral(v interface{}) (sqlExpr, error) {
+	b, err := json.Marshal(jsonValue(v))
+	if err != nil {
+		return nullExpr, mongo.NewCommandError(mongo.ErrorCodeBadValue, "%v cannot be converted to JSON: %s", v, err)
+	}
+	return sqlExpr{c.param(string(b)) + "::JSONB", true}, nil
+}
+
+// jsonb - The expression as JSONB.
+func jsonb(e sqlExpr) sqlExpr {
+	switch {
+	case e.json:
+		return e
+	case e == nullExpr:
+		return sqlExpr{"NULL::JSONB", true}
+	}
+	return sqlExpr{"to_jsonb(" + e.sql + ")", true}
+}
+
+// boolean - The expression as a condition.
+func boolean(e sqlExpr) string {
+	if e.json {
+		return "(" + e.sql + " = 'true'::JSONB)"
+	}
+	return e.sql
+}
+
+// jsonbObject - Build a JSONB object from alternating keys and values.
+// Functions take at most 100 arguments, so larger objects are built in
+// parts.
+func jsonbObject(args []string) sqlExpr {
+	var parts []string
+	for len(args) > 100 {
+		parts = append(parts, "jsonb_build_object("+strings.Join(args[:100], ", ")+")")
+		args = args[100:]
+	}
+	parts = append(parts, "jsonb_build_object("+strings.Join(args, ", ")+")")
+	if len(parts) == 1 {
+		return sqlExpr{parts[0], true}
+	}
+	return sqlExpr{"(" + strings.Join(parts, " || ") + ")", true}
+}
+
+// numeric - The expression as a number. JSONB values that are not numbers
+// are NULL, which aggregates skip like MongoDB does.
+func numeric(e sqlExpr) string {
+	if !e.json {
+		return e.sql
+	}
+	return fmt.Sprintf("(CASE WHEN jsonb_typeof(%[1]s) = 'number' THEN (%[1]s #>> '{}')::FLOAT8 END)", e.sql)
+}
+
+// text - The expression as a string, NULL for JSONB values that are not
+// strings.
+func text(e sqlExpr) string {
+	if !e.json {
+		return e.sql
+	}
+	return fmt.Sprintf("(CASE WHEN jsonb_typeof(%[1]s) = 'string' THEN %[1]s #>> '{}' END)", e.sql)
+}
+
+// rfc3339Pattern - Matches the strings dates are kept in JSONB as.
+const rfc3339Pattern = `^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})$`
+
+// timestamp - The expression as a TIMESTAMPTZ, NULL for JSONB values that
+// are not dates.
+func timestamp(e sqlExpr) string {
+	if !e.json {
+		return e.sql
+	}
+	return fmt.Sprintf("(CASE WHEN %[1]s ~ %[2]s THEN (%[1]s)::TIMESTAMPTZ END)", text(e), quoteString(rfc3339Pattern))
+}
+
+func jsonPath(parts []string) string {
+	var buf bytes.Buffer
+	for _, part := range parts {
+		if _, err := strconv.Atoi(part); err == nil {
+			buf.WriteString("->" + part)
+		} else {
+			buf.WriteString("->" + quoteString(part))
+		}
+	}
+	return buf.String()
+}
+
+// pgArray - A text array literal, as taken by the JSONB path functions.
+func pgArray(elems []string) string {
+	quoted := make([]string, len(elems))
+	for i, elem := range elems {
+		quoted[i] = `"` + strings.Replace(strings.Replace(elem, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+	}
+	return "{" + strings.Join(quoted, ",") + "}"
+}
+
+// sqlLiteral - A placeholder argument written as a literal. Literals are
+// always cast to their type like placeholders are.
+func sqlLiteral(v interface{}) string {
+	switch v := v.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return quoteString(strconv.FormatFloat(v, 'g', -1, 64))
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		if v {
+			return "TRUE"
+		}
+		return "FALSE"
+	case time.Time:
+		return quoteString(v.Format(time.RFC3339Nano))
+	case string:
+		return quoteString(v)
+	}
+	return quoteString(fmt.Sprint(v))
+}
+
+func quoteIdent(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+func quoteString(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var testColumns = []column{{"_id", false}, {"name", false}, {"qty", false}, {"tags", true}}
+
+func TestCompilePipeline(t *testing.T) {
+	tests := []struct {
+		name     string
+		pipeline []interface{}
+		sql      string
+		args     []interface{}
+	}{
+		{
+			name:     "empty",
+			pipeline: []interface{}{},
+			sql:      `SELECT "_id", "name", "qty", "tags" FROM "db"."items"`,
+		},
+		{
+			name:     "match",
+			pipeline: []interface{}{bson.D{{"$match", bson.D{{"qty", bson.D{{"$gt", 5}}}}}}},
+			sql:      `SELECT "_id", "name", "qty", "tags" FROM "db"."items" WHERE "qty" > $1::INT8`,
+			args:     []interface{}{int64(5)},
+		},
+		{
+			name: "match, sort, skip and limit in one block",
+			pipeline: []interface{}{
+				bson.D{{"$match", bson.D{{"name", "a"}}}},
+				bson.D{{"$sort", bson.D{{"qty", -1}}}},
+				bson.D{{"$skip", 2}},
+				bson.D{{"$limit", 3}},
+			},
+			sql:  `SELECT "_id", "name", "qty", "tags" FROM "db"."items" WHERE "name" = $1::TEXT ORDER BY "qty" DESC OFFSET 2 LIMIT 3`,
+			args: []interface{}{"a"},
+		},
+		{
+			name:     "project",
+			pipeline: []interface{}{bson.D{{"$project", bson.D{{"name", 1}, {"_id", 0}}}}},
+			sql:      `SELECT "name" FROM "db"."items"`,
+		},
+		{
+			name:     "match in a JSON column",
+			pipeline: []interface{}{bson.D{{"$match", bson.D{{"tags.color", "red"}}}}},
+			sql:      `SELECT "_id", "name", "qty", "tags" FROM "db"."items" WHERE ("tags"->'color' = $1::JSONB OR "tags"->'color' @> $2::JSONB)`,
+			args:     []interface{}{`"red"`, `["red"]`},
+		},
+		{
+			name:     "or and in",
+			pipeline: []interface{}{bson.D{{"$match", bson.D{{"$or", []interface{}{bson.D{{"qty", 1}}, bson.D{{"name", bson.D{{"$in", []interface{}{"a", "b"}}}}}}}}}}},
+			sql:      `SELECT "_id", "name", "qty", "tags" FROM "db"."items" WHERE ("qty" = $1::INT8 OR ("name" = $2::TEXT OR "name" = $3::TEXT))`,
+			args:     []interface{}{int64(1), "a", "b"},
+		},
+		{
+			name:     "group",
+			pipeline: []interface{}{bson.D{{"$group", bson.D{{"_id", "$name"}, {"total", bson.D{{"$sum", "$qty"}}}}}}},
+			sql:      `SELECT "name" AS "_id", COALESCE(sum("qty"), 0) AS "total" FROM "db"."items" GROUP BY "name"`,
+		},
+		{
+			name:     "count",
+			pipeline: []interface{}{bson.D{{"$count", "n"}}},
+			sql:      `SELECT count(*) AS "n" FROM "db"."items" HAVING count(*) > 0`,
+		},
+		{
+			name:     "match after limit wraps",
+			pipeline: []interface{}{bson.D{{"$limit", 3}}, bson.D{{"$match", bson.D{{"name", "a"}}}}},
+			sql:      `SELECT "_id", "name", "qty", "tags" FROM (SELECT "_id", "name", "qty", "tags" FROM "db"."items" LIMIT 3) AS "__mt_s1" WHERE "name" = $1::TEXT`,
+			args:     []interface{}{"a"},
+		},
+		{
+			name: "sort after limit keeps the earlier order",
+			pipeline: []interface{}{
+				bson.D{{"$sort", bson.D{{"qty", 1}}}},
+				bson.D{{"$limit", 2}},
+				bson.D{{"$sort", bson.D{{"name", 1}}}},
+			},
+			sql: `SELECT "_id", "name", "qty", "tags", "__mt_order" FROM (SELECT "_id", "name", "qty", "tags", row_number() OVER (ORDER BY "qty") AS "__mt_order" FROM "db"."items" ORDER BY "qty" LIMIT 2) AS "__mt_s1" ORDER BY "name", "__mt_order"`,
+		},
+	}
+	for _, test := range tests {
+		compiler := newPipelineCompiler("db", "items", testColumns, nil)
+		for _, stage := range test.pipeline {
+			if err := compiler.stage(stage); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+		sql, args := compiler.SQL()
+		if sql != test.sql {
+			t.Errorf("%s: SQL\n%s\nwant\n%s", test.name, sql, test.sql)
+		}
+		if len(args) != 0 || len(test.args) != 0 {
+			if !reflect.DeepEqual(args, test.args) {
+				t.Errorf("%s: args %#v, want %#v", test.name, args, test.args)
+			}
+		}
+	}
+}
+
+func TestCompilePipelineErrors(t *testing.T) {
+	tests := []struct {
+		stage interface{}
+		code  mongo.ErrorCode
+	}{
+		{bson.D{{"$out", "x"}}, mongo.ErrorCodeNotImplemented},
+		{bson.D{{"$nope", 1}}, mongo.ErrorCodeUnrecognizedPipelineStage},
+		{bson.D{{"$match", bson.D{}}, {"$limit", 1}}, mongo.ErrorCodeBadValue},
+	}
+	for _, test := range tests {
+		err := newPipelineCompiler("db", "items", testColumns, nil).stage(test.stage)
+		cmdErr, ok := errors.Cause(err).(*mongo.CommandError)
+		if !ok || cmdErr.Code != test.code {
+			t.Errorf("stage(%v) = %v, want code %d", test.stage, err, test.code)
+		}
+	}
+}
@@ -0,0 +1,563 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/lego/mongotunnel/util/log"
+	"github.com/pkg/errors"
+)
+
+// PoolOptions - Settings for a Pool of upstream connections.
+type PoolOptions struct {
+	// Dial opens a new connection to the remote.
+	Dial func() (net.Conn, error)
+	// MinSize connections are kept open even when idle.
+	MinSize int
+	// MaxSize bounds the number of upstream connections. Once reached,
+	// requests are pipelined onto the least busy connection.
+	MaxSize int
+	// IdleTimeout closes connections above MinSize that have had nothing
+	// in flight for this long, and releases idle session affinity.
+	IdleTimeout time.Duration
+	Log         log.Logger
+}
+
+// Pool - Shares a bounded set of upstream connections between all client
+// connections. Client request IDs are rewritten per upstream connection, so
+// any client can use any connection, except that open cursors and logical
+// sessions stay on the connection they started on. Pooled connections are
+// never authenticated: a client that authenticates is given a connection of
+// its own instead, so only clients that do not authenticate against the
+// remote share connections.
+type Pool struct {
+	opts PoolOptions
+
+	mu       sync.Mutex
+	dialed   *sync.Cond
+	conns    []*upstreamConn
+	dialing  int
+	cursors  map[int64]*upstreamConn
+	sessions map[string]*sessionAffinity
+	closed   bool
+	done     chan struct{}
+}
+
+type sessionAffinity struct {
+	conn     *upstreamConn
+	lastUsed time.Time
+}
+
+// NewPool - Create a Pool and open MinSize connections.
+func NewPool(opts PoolOptions) (*Pool, error) {
+	if opts.Dial == nil {
+		return nil, errors.New("pool requires a dial function")
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = 1
+	}
+	if opts.MinSize > opts.MaxSize {
+		opts.MinSize = opts.MaxSize
+	}
+	if opts.Log == nil {
+		opts.Log = &log.NullLogger{}
+	}
+	p := &Pool{
+		opts:     opts,
+		cursors:  make(map[int64]*upstreamConn),
+		sessions: make(map[string]*sessionAffinity),
+		done:     make(chan struct{}),
+	}
+	p.dialed = sync.NewCond(&p.mu)
+	for i := 0; i < opts.MinSize; i++ {
+		conn, err := p.dial()
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.mu.Lock()
+		p.conns = append(p.conns, conn)
+		p.mu.Unlock()
+	}
+	if opts.IdleTimeout > 0 {
+		go p.reap()
+	}
+	return p, nil
+}
+
+// Client - An Upstream for one client connection.
+func (p *Pool) Client() Upstream {
+	return &pooledUpstream{
+		pool:    p,
+		cursors: make(map[int64]bool),
+		replies: newReplyQueue(),
+	}
+}
+
+// Close - Close every upstream connection.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	conns := p.conns
+	p.conns = nil
+	close(p.done)
+	p.dialed.Broadcast()
+	p.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.close(nil)
+	}
+	return nil
+}
+
+// Size - The number of open upstream connections.
+func (p *Pool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+func (p *Pool) dial() (*upstreamConn, error) {
+	netConn, err := p.opts.Dial()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to dial upstream")
+	}
+	conn := newUpstreamConn(netConn)
+	conn.onReply = p.trackReply
+	conn.onClose = p.remove
+	conn.start()
+	p.opts.Log.Debug("opened upstream connection to %s", netConn.RemoteAddr())
+	return conn, nil
+}
+
+// acquire - Pick the connection for a request: the one holding its cursor
+// or session if there is one, otherwise an idle connection, a new one if the
+// pool has room, or the connection with the fewest requests in flight.
+func (p *Pool) acquire(info requestInfo) (*upstreamConn, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, errors.New("pool is closed")
+	}
+	if conn := p.affinity(info); conn != nil {
+		p.mu.Unlock()
+		return conn, nil
+	}
+
+	var best *upstreamConn
+	for {
+		bestInflight := 0
+		best = nil
+		for _, conn := range p.conns {
+			n := conn.inflight()
+			if best == nil || n < bestInflight {
+				best, bestInflight = conn, n
+			}
+		}
+		full := len(p.conns)+p.dialing >= p.opts.MaxSize
+		if best != nil && (bestInflight == 0 || full) {
+			p.pinSession(info, best)
+			p.mu.Unlock()
+			return best, nil
+		}
+		if !full {
+			break
+		}
+		// Every slot is taken by a connection still being dialed.
+		p.dialed.Wait()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, errors.New("pool is closed")
+		}
+	}
+	p.dialing++
+	p.mu.Unlock()
+
+	conn, err := p.dial()
+
+	p.mu.Lock()
+	p.dialing--
+	p.dialed.Broadcast()
+	if err != nil {
+		defer p.mu.Unlock()
+		if best != nil {
+			p.opts.Log.Warn("%+v, reusing a busy connection", err)
+			p.pinSession(info, best)
+			return best, nil
+		}
+		return nil, err
+	}
+	if p.closed {
+		p.mu.Unlock()
+		conn.close(nil)
+		return nil, errors.New("pool is closed")
+	}
+	p.conns = append(p.conns, conn)
+	p.pinSession(info, conn)
+	p.mu.Unlock()
+	return conn, nil
+}
+
+// affinity - The connection a request is bound to, if any. Must be called
+// with p.mu held.
+func (p *Pool) affinity(info requestInfo) *upstreamConn {
+	if info.cursorID != 0 {
+		if conn, ok := p.cursors[info.cursorID]; ok {
+			return conn
+		}
+	}
+	for _, id := range info.killedCursors {
+		if conn, ok := p.cursors[id]; ok {
+			return conn
+		}
+	}
+	if info.session != "" {
+		if s, ok := p.sessions[info.session]; ok {
+			s.lastUsed = time.Now()
+			return s.conn
+		}
+	}
+	return nil
+}
+
+// pinSession - Must be called with p.mu held.
+func (p *Pool) pinSession(info requestInfo, conn *upstreamConn) {
+	if info.session == "" {
+		return
+	}
+	p.sessions[info.session] = &sessionAffinity{
+		conn:     conn,
+		lastUsed: time.Now(),
+	}
+}
+
+func (p *Pool) trackReply(conn *upstreamConn, req *pendingRequest, msg *mongo.Message) {
+	cursorID, cursorGone := inspectReply(msg)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if req.cursorID != 0 && (cursorGone || cursorID == 0) {
+		delete(p.cursors, req.cursorID)
+	}
+	if cursorID != 0 {
+		p.cursors[cursorID] = conn
+	}
+}
+
+// holdsCursor - Whether the cursor a request continues or kills lives on a
+// pooled connection.
+func (p *Pool) holdsCursor(info requestInfo) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.cursors[info.cursorID]; ok {
+		return true
+	}
+	for _, id := range info.killedCursors {
+		if _, ok := p.cursors[id]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Pool) forgetCursors(ids []int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, id := range ids {
+		delete(p.cursors, id)
+	}
+}
+
+// remove - Drop a failed or closed connection and everything bound to it.
+func (p *Pool) remove(conn *upstreamConn, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, c := range p.conns {
+		if c == conn {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			break
+		}
+	}
+	for id, c := range p.cursors {
+		if c == conn {
+			delete(p.cursors, id)
+		}
+	}
+	for key, s := range p.sessions {
+		if s.conn == conn {
+			delete(p.sessions, key)
+		}
+	}
+	if p.closed {
+		return
+	}
+	if err == errUpstreamClosed {
+		p.opts.Log.Debug("closed upstream connection, %d open", len(p.conns))
+	} else {
+		p.opts.Log.Warn("lost upstream connection: %s", err)
+	}
+}
+
+// reap - Close idle connections above MinSize and expire idle sessions.
+func (p *Pool) reap() {
+	ticker := time.NewTicker(p.opts.IdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case now := <-ticker.C:
+			p.reapOnce(now)
+		}
+	}
+}
+
+func (p *Pool) reapOnce(now time.Time) {
+	p.mu.Lock()
+	for key, s := range p.sessions {
+		if now.Sub(s.lastUsed) > p.opts.IdleTimeout {
+			delete(p.sessions, key)
+		}
+	}
+	bound := make(map[*upstreamConn]bool)
+	for _, conn := range p.cursors {
+		bound[conn] = true
+	}
+	for _, s := range p.sessions {
+		bound[s.conn] = true
+	}
+	var expired []*upstreamConn
+	for _, conn := range p.conns {
+		if len(p.conns)-len(expired) <= p.opts.MinSize {
+			break
+		}
+		lastUsed, idle := conn.idleSince()
+		if idle && !bound[conn] && now.Sub(lastUsed) > p.opts.IdleTimeout {
+			expired = append(expired, conn)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, conn := range expired {
+		conn.close(nil)
+	}
+}
+
+// pooledUpstream - The Upstream handed to each client of a Pool.
+type pooledUpstream struct {
+	pool *Pool
+	// replies hands the client its replies off the read loop of the shared
+	// connection.
+	replies *replyQueue
+
+	mu sync.Mutex
+	// sticky is the connection the next message must use.
+	sticky *upstreamConn
+	// own is the connection dialed for the client alone once it starts to
+	// authenticate. Everything but the cursors it opened on pooled
+	// connections goes there from then on, so that neither its
+	// credentials nor their absence are shared with other clients.
+	own *upstreamConn
+	// cursors are the cursors this client has open, killed on Close.
+	cursors map[int64]bool
+	closed  bool
+}
+
+func (u *pooledUpstream) Send(msg *mongo.Message, reply ReplyFunc) error {
+	info := inspectRequest(msg)
+
+	u.mu.Lock()
+	conn := u.sticky
+	u.sticky = nil
+	own := u.own
+	u.mu.Unlock()
+
+	var err error
+	if own == nil && info.authenticates {
+		if own, err = u.dialOwn(); err != nil {
+			return err
+		}
+	}
+	if own != nil && !u.pool.holdsCursor(info) {
+		// A failed connection of its own is not replaced by a pooled
+		// one, which would drop the client's authentication.
+		conn = own
+	} else if conn == nil || conn.isClosed() {
+		if conn, err = u.pool.acquire(info); err != nil {
+			return err
+		}
+	}
+	if len(info.killedCursors) > 0 {
+		u.forget(info.killedCursors)
+		u.pool.forgetCursors(info.killedCursors)
+	}
+
+	tracked := func(replyMsg *mongo.Message, err error) {
+		if err == nil {
+			u.track(info, replyMsg)
+		}
+		u.replies.push(func() { reply(replyMsg, err) })
+	}
+	err = conn.send(msg, info, tracked)
+	if err == errUpstreamClosed && conn != own {
+		// The connection was reaped or failed after it was picked.
+		if conn, err = u.pool.acquire(info); err != nil {
+			return err
+		}
+		err = conn.send(msg, info, tracked)
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.sticky {
+		u.mu.Lock()
+		u.sticky = conn
+		u.mu.Unlock()
+	}
+	return nil
+}
+
+// dialOwn - Open the connection of the client's own, unless it has one.
+func (u *pooledUpstream) dialOwn() (*upstreamConn, error) {
+	netConn, err := u.pool.opts.Dial()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to dial upstream")
+	}
+	conn := newUpstreamConn(netConn)
+	conn.start()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.closed || u.own != nil {
+		conn.close(nil)
+		if u.closed {
+			return nil, errUpstreamClosed
+		}
+		return u.own, nil
+	}
+	u.own = conn
+	u.pool.opts.Log.Debug("client authenticates, opened its own upstream connection to %s", netConn.RemoteAddr())
+	return conn, nil
+}
+
+func (u *pooledUpstream) track(info requestInfo, msg *mongo.Message) {
+	cursorID, cursorGone := inspectReply(msg)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if info.cursorID != 0 && (cursorGone || cursorID == 0) {
+		delete(u.cursors, info.cursorID)
+	}
+	if cursorID != 0 {
+		u.cursors[cursorID] = true
+	}
+}
+
+func (u *pooledUpstream) forget(ids []int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, id := range ids {
+		delete(u.cursors, id)
+	}
+}
+
+// Close - Kill the cursors the client left open, since they would
+// otherwise pin their upstream connection until the server times them out.
+func (u *pooledUpstream) Close() error {
+	u.mu.Lock()
+	if u.closed {
+		u.mu.Unlock()
+		return nil
+	}
+	u.closed = true
+	var ids []int64
+	for id := range u.cursors {
+		ids = append(ids, id)
+	}
+	u.cursors = nil
+	own := u.own
+	u.mu.Unlock()
+	defer u.replies.close()
+	if own != nil {
+		defer own.close(nil)
+	}
+
+	if len(ids) > 0 {
+		u.pool.opts.Log.Debug("killing %d abandoned cursors", len(ids))
+	}
+	// Cursors may live on different connections, so kill them one at a
+	// time to let each follow its own affinity.
+	for _, id := range ids {
+		msg, err := mongo.NewMessage(&mongo.KillCursorsOp{CursorIDs: []int64{id}}, 0, 0)
+		if err != nil {
+			return err
+		}
+		if err := u.Send(msg, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replyQueue - Runs the replies of one client in order on a goroutine of its
+// own, so that a client slow to read its replies does not hold up the other
+// clients of the connection they arrive on.
+type replyQueue struct {
+	mu      sync.Mutex
+	pending []func()
+	wake    chan struct{}
+	closed  bool
+}
+
+func newReplyQueue() *replyQueue {
+	q := &replyQueue{wake: make(chan struct{}, 1)}
+	go q.run()
+	return q
+}
+
+// push - Queue a reply. Replies pushed after close are dropped, since the
+// client is gone.
+func (q *replyQueue) push(reply func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.pending = append(q.pending, reply)
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *replyQueue) run() {
+	for range q.wake {
+		for {
+			q.mu.Lock()
+			if len(q.pending) == 0 {
+				q.mu.Unlock()
+				break
+			}
+			reply := q.pending[0]
+			q.pending[0] = nil
+			q.pending = q.pending[1:]
+			q.mu.Unlock()
+			reply()
+		}
+	}
+}
+
+// close - Stop once the queued replies have run.
+func (q *replyQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.wake)
+	}
+}
@@ -0,0 +1,441 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lego/mongotunnel/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// fakeRemote - The remote end of pooled connections, over net.Pipe. Every
+// query is reported on received and answered with the reply of answer,
+// unless answer returns nil. OP_MSG commands are handed to answer as the
+// query of an OP_QUERY and answered with an OP_MSG, unless they carry
+// moreToCome.
+type fakeRemote struct {
+	answer   func(query mongo.QueryOp) *mongo.ReplyOp
+	received chan received
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+// received - A query the remote read, and the connection it arrived on.
+type received struct {
+	conn  int
+	head  mongo.MsgHead
+	query mongo.QueryOp
+}
+
+func newFakeRemote(answer func(query mongo.QueryOp) *mongo.ReplyOp) *fakeRemote {
+	return &fakeRemote{
+		answer:   answer,
+		received: make(chan received, 16),
+	}
+}
+
+func (r *fakeRemote) dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	r.mu.Lock()
+	n := len(r.conns)
+	r.conns = append(r.conns, server)
+	r.mu.Unlock()
+	go r.serve(n, server)
+	return client, nil
+}
+
+func (r *fakeRemote) serve(n int, conn net.Conn) {
+	for {
+		msg, err := mongo.ReadMessage(conn)
+		if err != nil {
+			return
+		}
+		query := mongo.QueryOp{}
+		msgOp := mongo.MsgOp{}
+		if msg.Head.Opcode == mongo.Opcode_MSG {
+			msgOp.ReadFromBuffer(msg.BodyBuffer())
+			query.Query = msgOp.Body
+		} else {
+			query.ReadFromBuffer(msg.BodyBuffer())
+		}
+		r.received <- received{conn: n, head: msg.Head, query: query}
+		if msgOp.Flags&mongo.MsgFlagMoreToCome != 0 {
+			continue
+		}
+		if reply := r.answer(query); reply != nil {
+			var op mongo.Op = reply
+			if msg.Head.Opcode == mongo.Opcode_MSG {
+				op = &mongo.MsgOp{Body: reply.Documents}
+			}
+			out, err := mongo.NewMessage(op, 0, msg.Head.ResponseID)
+			if err != nil {
+				return
+			}
+			out.WriteTo(conn)
+		}
+	}
+}
+
+// fail - Close the remote end of the n-th connection.
+func (r *fakeRemote) fail(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conns[n].Close()
+}
+
+func (r *fakeRemote) dialed() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.conns)
+}
+
+func (r *fakeRemote) next(t *testing.T) received {
+	t.Helper()
+	select {
+	case got := <-r.received:
+		return got
+	case <-time.After(5 * time.Second):
+		t.Fatal("the remote received nothing")
+	}
+	return received{}
+}
+
+// answerCommands - Answer find with cursor 42, leave hold unanswered, and
+// echo anything else.
+func answerCommands(query mongo.QueryOp) *mongo.ReplyOp {
+	switch query.Query[0].Name {
+	case "find":
+		return newReply(bson.D{
+			bson.DocElem{"cursor", bson.D{bson.DocElem{"id", int64(42)}, bson.DocElem{"firstBatch", []interface{}{}}}},
+			bson.DocElem{"ok", 1},
+		})
+	case "hold":
+		return nil
+	}
+	return newReply(append(bson.D{bson.DocElem{"ok", 1}}, query.Query...))
+}
+
+type upstreamReply struct {
+	msg *mongo.Message
+	err error
+}
+
+// queryMessage - Frame cmd as an OP_QUERY on db.$cmd.
+func queryMessage(t *testing.T, id int32, cmd bson.D) *mongo.Message {
+	t.Helper()
+	query := mongo.QueryOp{Collection: "db.$cmd", Limit: -1, Query: cmd}
+	var body bytes.Buffer
+	if err := query.WriteToBuffer(&body); err != nil {
+		t.Fatal(err)
+	}
+	return &mongo.Message{
+		Head: mongo.MsgHead{TotalLen: mongo.MsgHeadSize() + int32(body.Len()), ResponseID: id, Opcode: mongo.Opcode_QUERY},
+		Body: body.Bytes(),
+	}
+}
+
+// sendCommand - Send cmd through u as request id, returning where its reply
+// arrives.
+func sendCommand(t *testing.T, u Upstream, id int32, cmd bson.D) <-chan upstreamReply {
+	t.Helper()
+	msg := queryMessage(t, id, cmd)
+	replies := make(chan upstreamReply, 1)
+	if err := u.Send(msg, func(msg *mongo.Message, err error) {
+		replies <- upstreamReply{msg, err}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return replies
+}
+
+func waitReply(t *testing.T, replies <-chan upstreamReply) upstreamReply {
+	t.Helper()
+	select {
+	case reply := <-replies:
+		return reply
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply arrived")
+	}
+	return upstreamReply{}
+}
+
+func replyDocument(t *testing.T, msg *mongo.Message) bson.M {
+	t.Helper()
+	replyOp := mongo.ReplyOp{}
+	if err := replyOp.ReadFromBuffer(msg.BodyBuffer()); err != nil {
+		t.Fatal(err)
+	}
+	return replyOp.Documents.Map()
+}
+
+func newTestPool(t *testing.T, remote *fakeRemote, minSize, maxSize int) *Pool {
+	t.Helper()
+	pool, err := NewPool(PoolOptions{Dial: remote.dial, MinSize: minSize, MaxSize: maxSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func TestPoolRewritesRequestIDs(t *testing.T) {
+	remote := newFakeRemote(answerCommands)
+	pool := newTestPool(t, remote, 1, 1)
+	defer pool.Close()
+
+	a, b := pool.Client(), pool.Client()
+	defer a.Close()
+	defer b.Close()
+
+	// Both clients use request ID 7 on the one connection.
+	aReplies := sendCommand(t, a, 7, bson.D{bson.DocElem{"ping", 1}, bson.DocElem{"client", "a"}})
+	first := remote.next(t)
+	bReplies := sendCommand(t, b, 7, bson.D{bson.DocElem{"ping", 1}, bson.DocElem{"client", "b"}})
+	second := remote.next(t)
+	if first.head.ResponseID == second.head.ResponseID {
+		t.Errorf("both requests reached the remote as request %d", first.head.ResponseID)
+	}
+
+	for client, replies := range map[string]<-chan upstreamReply{"a": aReplies, "b": bReplies} {
+		reply := waitReply(t, replies)
+		if reply.err != nil {
+			t.Fatalf("client %s: %v", client, reply.err)
+		}
+		if reply.msg.Head.ResponseTo != 7 {
+			t.Errorf("client %s got a reply to %d, want 7", client, reply.msg.Head.ResponseTo)
+		}
+		if got := replyDocument(t, reply.msg)["client"]; got != client {
+			t.Errorf("client %s got the reply of client %v", client, got)
+		}
+	}
+}
+
+func TestPoolAffinity(t *testing.T) {
+	lsid := bson.D{bson.DocElem{"id", bson.Binary{Kind: 4, Data: []byte("0123456789abcdef")}}}
+	tests := []struct {
+		name string
+		// open binds something to the connection it runs on.
+		open bson.D
+		// follow must reach the same connection.
+		follow bson.D
+	}{
+		{
+			name:   "cursor",
+			open:   bson.D{bson.DocElem{"find", "t"}},
+			follow: bson.D{bson.DocElem{"getMore", int64(42)}, bson.DocElem{"collection", "t"}},
+		},
+		{
+			name:   "session",
+			open:   bson.D{bson.DocElem{"ping", 1}, bson.DocElem{"lsid", lsid}},
+			follow: bson.D{bson.DocElem{"ping", 1}, bson.DocElem{"lsid", lsid}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			remote := newFakeRemote(answerCommands)
+			pool := newTestPool(t, remote, 2, 2)
+			defer pool.Close()
+			client := pool.Client()
+			defer client.Close()
+
+			if reply := waitReply(t, sendCommand(t, client, 1, test.open)); reply.err != nil {
+				t.Fatal(reply.err)
+			}
+			bound := remote.next(t).conn
+
+			// Keep the bound connection busy, so that only affinity
+			// brings the next request there.
+			other := pool.Client()
+			defer other.Close()
+			sendCommand(t, other, 1, bson.D{bson.DocElem{"hold", 1}})
+			if busy := remote.next(t).conn; busy != bound {
+				t.Fatalf("hold reached connection %d, want %d", busy, bound)
+			}
+
+			if reply := waitReply(t, sendCommand(t, client, 2, test.follow)); reply.err != nil {
+				t.Fatal(reply.err)
+			}
+			if got := remote.next(t).conn; got != bound {
+				t.Errorf("%s reached connection %d, want %d", test.follow[0].Name, got, bound)
+			}
+		})
+	}
+}
+
+func TestPoolConnectionFailure(t *testing.T) {
+	remote := newFakeRemote(answerCommands)
+	pool := newTestPool(t, remote, 1, 2)
+	defer pool.Close()
+
+	a, b := pool.Client(), pool.Client()
+	defer a.Close()
+	defer b.Close()
+
+	held := sendCommand(t, a, 1, bson.D{bson.DocElem{"hold", 1}})
+	failed := remote.next(t).conn
+	remote.fail(failed)
+	if reply := waitReply(t, held); reply.err == nil {
+		t.Error("the request held by the failed connection got a reply")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for pool.Size() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the pool kept %d connections", pool.Size())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Both clients go on over a new connection.
+	for i, client := range []Upstream{a, b} {
+		reply := waitReply(t, sendCommand(t, client, 2, bson.D{bson.DocElem{"ping", 1}}))
+		if reply.err != nil {
+			t.Fatalf("client %d: %v", i, reply.err)
+		}
+		if got := remote.next(t).conn; got == failed {
+			t.Errorf("client %d reached the failed connection", i)
+		}
+	}
+}
+
+func TestPoolAuthenticatedClientGetsOwnConnection(t *testing.T) {
+	remote := newFakeRemote(answerCommands)
+	pool := newTestPool(t, remote, 1, 1)
+	defer pool.Close()
+
+	authed, anonymous := pool.Client(), pool.Client()
+	defer anonymous.Close()
+
+	if reply := waitReply(t, sendCommand(t, authed, 1, bson.D{bson.DocElem{"find", "t"}})); reply.err != nil {
+		t.Fatal(reply.err)
+	}
+	shared := remote.next(t).conn
+
+	if reply := waitReply(t, sendCommand(t, authed, 2, bson.D{bson.DocElem{"saslStart", 1}, bson.DocElem{"mechanism", "SCRAM-SHA-1"}})); reply.err != nil {
+		t.Fatal(reply.err)
+	}
+	own := remote.next(t).conn
+	if own == shared {
+		t.Fatal("saslStart reached the pooled connection")
+	}
+	if pool.Size() != 1 {
+		t.Errorf("the pool has %d connections, want 1", pool.Size())
+	}
+
+	tests := []struct {
+		client Upstream
+		cmd    bson.D
+		want   int
+	}{
+		{authed, bson.D{bson.DocElem{"saslContinue", 1}}, own},
+		{authed, bson.D{bson.DocElem{"ping", 1}}, own},
+		// The cursor opened before authenticating stays where it is.
+		{authed, bson.D{bson.DocElem{"getMore", int64(42)}, bson.DocElem{"collection", "t"}}, shared},
+		{anonymous, bson.D{bson.DocElem{"ping", 1}}, shared},
+	}
+	for i, test := range tests {
+		if reply := waitReply(t, sendCommand(t, test.client, int32(3+i), test.cmd)); reply.err != nil {
+			t.Fatal(reply.err)
+		}
+		if got := remote.next(t).conn; got != test.want {
+			t.Errorf("%s reached connection %d, want %d", test.cmd[0].Name, got, test.want)
+		}
+	}
+
+	// A failed connection of its own is not swapped for a pooled one.
+	remote.fail(own)
+	msg := queryMessage(t, 10, bson.D{bson.DocElem{"ping", 1}})
+	if err := authed.Send(msg, func(*mongo.Message, error) {}); err == nil {
+		t.Error("sending over a failed connection of its own succeeded")
+	}
+	authed.Close()
+	if remote.dialed() != 2 {
+		t.Errorf("dialed %d connections, want 2", remote.dialed())
+	}
+}
+
+func TestUpstreamMsgRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream func(remote *fakeRemote) Upstream
+	}{
+		{"pooled", func(remote *fakeRemote) Upstream {
+			pool := newTestPool(t, remote, 1, 1)
+			t.Cleanup(func() { pool.Close() })
+			return pool.Client()
+		}},
+		{"dedicated", func(remote *fakeRemote) Upstream {
+			conn, _ := remote.dial()
+			return newDedicatedUpstream(conn, func(error) {})
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			remote := newFakeRemote(answerCommands)
+			u := test.upstream(remote)
+			defer u.Close()
+
+			// A moreToCome request is not answered, and must not take
+			// the reply of the next one.
+			send := func(id int32, flags mongo.MsgOpFlags, cmd bson.D) <-chan upstreamReply {
+				msg, err := mongo.NewMessage(&mongo.MsgOp{Flags: flags, Body: cmd}, id, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				replies := make(chan upstreamReply, 1)
+				if err := u.Send(msg, func(msg *mongo.Message, err error) {
+					replies <- upstreamReply{msg, err}
+				}); err != nil {
+					t.Fatal(err)
+				}
+				return replies
+			}
+			unanswered := send(6, mongo.MsgFlagMoreToCome, bson.D{bson.DocElem{"insert", "t"}})
+			remote.next(t)
+			reply := waitReply(t, send(7, 0, bson.D{bson.DocElem{"ping", 1}, bson.DocElem{"$db", "admin"}}))
+			remote.next(t)
+			if reply.err != nil {
+				t.Fatal(reply.err)
+			}
+			if reply.msg.Head.Opcode != mongo.Opcode_MSG || reply.msg.Head.ResponseTo != 7 {
+				t.Fatalf("got %s in reply to %d, want MSG in reply to 7", reply.msg.Head.Opcode, reply.msg.Head.ResponseTo)
+			}
+			msgOp := mongo.MsgOp{}
+			if err := msgOp.ReadFromBuffer(reply.msg.BodyBuffer()); err != nil {
+				t.Fatal(err)
+			}
+			if msgOp.Body.Map()["$db"] != "admin" {
+				t.Errorf("got the reply %v", msgOp.Body)
+			}
+			select {
+			case reply := <-unanswered:
+				t.Errorf("the moreToCome request got %v", reply)
+			default:
+			}
+		})
+	}
+}
+
+func TestPoolSpeculativeAuthenticate(t *testing.T) {
+	remote := newFakeRemote(answerCommands)
+	pool := newTestPool(t, remote, 1, 1)
+	defer pool.Close()
+	client := pool.Client()
+	defer client.Close()
+
+	hello := bson.D{
+		bson.DocElem{"hello", 1},
+		bson.DocElem{"speculativeAuthenticate", bson.D{bson.DocElem{"saslStart", 1}, bson.DocElem{"mechanism", "SCRAM-SHA-256"}}},
+	}
+	if reply := waitReply(t, sendCommand(t, client, 1, hello)); reply.err != nil {
+		t.Fatal(reply.err)
+	}
+	if got := remote.next(t).conn; got == 0 {
+		t.Error("a handshake authenticating speculatively reached the pooled connection")
+	}
+	if pool.Size() != 1 {
+		t.Errorf("the pool has %d connections, want 1", pool.Size())
+	}
+}
@@ -1,30 +1,87 @@
 package proxy
 
 import (
-	"bytes"
+	gocontext "context"
 	"crypto/tls"
-	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/lego/mongotunnel/mongo"
+	"github.com/lego/mongotunnel/util/capture"
 	"github.com/lego/mongotunnel/util/context"
 	"github.com/lego/mongotunnel/util/log"
+	"github.com/lego/mongotunnel/util/trace"
+	"github.com/pkg/errors"
 )
 
 // Proxy - Manages a Proxy connection, piping data between local and remote.
 type Proxy struct {
 	sentBytes     uint64
 	receivedBytes uint64
+	readBytes     uint64
+	client        net.Addr
+	opened        time.Time
 	laddr, raddr  *net.TCPAddr
-	lconn, rconn  io.ReadWriteCloser
-	erred         bool
+	lconn         io.ReadWriteCloser
+	upstream      Upstream
+	errOnce       sync.Once
 	errsig        chan bool
 	tlsUnwrapp    bool
 	tlsAddress    string
+	tlsConfig     *tls.Config
+	standalone    bool
+
+	// done is canceled once the connection closes, and with it the
+	// statements of its requests.
+	done       gocontext.Context
+	cancelDone gocontext.CancelFunc
+
+	// shadowed is closed once the latest shadowed statement has run.
+	shadowed chan struct{}
+
+	// writeMu serializes replies to the client, which come both from the
+	// upstream and from replies generated by the proxy.
+	writeMu    sync.Mutex
+	responseID int32
 
 	Matcher  func([]byte)
 	Replacer func([]byte) []byte
+	// Router decides where each query is answered. DefaultRouter is used
+	// when nil.
+	Router *Router
+	// Shadow receives comparisons for queries routed to TargetBoth.
+	Shadow *ShadowReporter
+	// Sessions holds the logical sessions of translated commands, with
+	// their transactions and cursors. Share one between connections, since
+	// sessions are not tied to a connection. Commands are only translated
+	// when set.
+	Sessions *Sessions
+	// Metrics receives the measurements of the connection when set.
+	Metrics *Metrics
+	// Tracer records the spans of requests when set.
+	Tracer *trace.Tracer
+	// Capture receives every message to and from the client when set.
+	Capture *capture.Writer
+	// SlowQueryThreshold logs the queries taking at least this long, with
+	// the SQL they ran, when positive.
+	SlowQueryThreshold time.Duration
+	// ExplainSlowQueries also logs the plans of slow queries.
+	ExplainSlowQueries bool
+	// Connections lists the connection while it is open, and answers
+	// currentOp, killOp and serverStatus, when set. Share one between
+	// connections.
+	Connections *Connections
+	requests    requests
+
+	// HandshakeTimeout bounds the TLS handshakes with the client and the
+	// remote when positive.
+	HandshakeTimeout time.Duration
+	// RequireIdentity refuses to translate the commands of clients that
+	// have not authenticated with the proxy, when set.
+	RequireIdentity bool
 
 	// Settings
 	Nagles    bool
@@ -33,25 +90,48 @@ type Proxy struct {
 }
 
 // New - Create a new Proxy instance. Takes over local connection passed in,
-// and closes it when finished.
-func New(lconn *net.TCPConn, laddr, raddr *net.TCPAddr) *Proxy {
+// and closes it when finished. The local connection may be a *tls.Conn when
+// TLS is terminated on the listener.
+func New(lconn net.Conn, laddr, raddr *net.TCPAddr) *Proxy {
+	done, cancelDone := gocontext.WithCancel(gocontext.Background())
 	return &Proxy{
-		lconn:  lconn,
-		laddr:  laddr,
-		raddr:  raddr,
-		erred:  false,
-		errsig: make(chan bool),
-		ctx:    context.NewContext(&log.NullLogger{}),
+		lconn:      lconn,
+		client:     lconn.RemoteAddr(),
+		laddr:      laddr,
+		raddr:      raddr,
+		errsig:     make(chan bool),
+		responseID: 400,
+		ctx:        context.NewContext(&log.NullLogger{}),
+		done:       done,
+		cancelDone: cancelDone,
 	}
 }
 
 // NewTLSUnwrapped - Create a new Proxy instance with a remote TLS server for
 // which we want to unwrap the TLS to be able to connect without encryption
-// locally
-func NewTLSUnwrapped(lconn *net.TCPConn, laddr, raddr *net.TCPAddr, addr string) *Proxy {
+// locally. When the local connection is also TLS this re-encrypts toward the
+// upstream. A nil config uses the crypto/tls defaults.
+func NewTLSUnwrapped(lconn net.Conn, laddr, raddr *net.TCPAddr, addr string, config *tls.Config) *Proxy {
 	p := New(lconn, laddr, raddr)
 	p.tlsUnwrapp = true
 	p.tlsAddress = addr
+	p.tlsConfig = config
+	return p
+}
+
+// NewPooled - Create a new Proxy instance that sends requests over
+// connections shared through pool instead of dialing its own.
+func NewPooled(lconn net.Conn, laddr, raddr *net.TCPAddr, pool *Pool) *Proxy {
+	p := New(lconn, laddr, raddr)
+	p.upstream = pool.Client()
+	return p
+}
+
+// NewStandalone - Create a new Proxy instance without a remote. Every query
+// is answered from CockroachDB, and anything else fails.
+func NewStandalone(lconn net.Conn, laddr *net.TCPAddr) *Proxy {
+	p := New(lconn, laddr, nil)
+	p.standalone = true
 	return p
 }
 
@@ -59,6 +139,19 @@ type setNoDelayer interface {
 	SetNoDelay(bool) error
 }
 
+type netConner interface {
+	NetConn() net.Conn
+}
+
+func setNoDelay(conn io.ReadWriteCloser) {
+	if tlsConn, ok := conn.(netConner); ok {
+		conn = tlsConn.NetConn()
+	}
+	if conn, ok := conn.(setNoDelayer); ok {
+		conn.SetNoDelay(true)
+	}
+}
+
 func (p *Proxy) Ctx() *context.Context {
 	return p.ctx
 }
@@ -66,96 +159,118 @@ func (p *Proxy) Ctx() *context.Context {
 // Start - open connection to remote and start proxying data.
 func (p *Proxy) Start() {
 	defer p.lconn.Close()
+	p.connectionOpened()
+	defer p.connectionClosed()
+
+	// Complete the client handshake up front so certificate problems are
+	// reported here rather than as a failed read.
+	if tlsConn, ok := p.lconn.(*tls.Conn); ok {
+		if p.HandshakeTimeout > 0 {
+			tlsConn.SetDeadline(time.Now().Add(p.HandshakeTimeout))
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			p.ctx.Log.Warn("TLS handshake failed: %+v", err)
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		state := tlsConn.ConnectionState()
+		p.ctx.SetTLSState(&state)
+	}
+	if p.Connections != nil {
+		p.opened = time.Now()
+		p.Connections.add(p)
+		defer p.Connections.remove(p)
+	}
 
-	var err error
 	//connect to remote
-	if p.tlsUnwrapp {
-		p.rconn, err = tls.Dial("tcp", p.tlsAddress, nil)
-	} else {
-		p.rconn, err = net.DialTCP("tcp", nil, p.raddr)
+	if p.upstream == nil && !p.standalone {
+		var rconn net.Conn
+		var err error
+		if p.tlsUnwrapp {
+			dialer := &net.Dialer{Timeout: p.HandshakeTimeout}
+			rconn, err = tls.DialWithDialer(dialer, "tcp", p.tlsAddress, p.tlsConfig)
+		} else {
+			rconn, err = net.DialTCP("tcp", nil, p.raddr)
+		}
+		if err != nil {
+			p.ctx.Log.Warn("Remote connection failed: %+v", err)
+			return
+		}
+		//nagles?
+		if p.Nagles {
+			setNoDelay(rconn)
+		}
+		p.upstream = newDedicatedUpstream(rconn, func(err error) {
+			p.err("Read failed '%s'\n", err)
+		})
 	}
-	if err != nil {
-		p.ctx.Log.Warn("Remote connection failed: %+v", err)
-		return
+	if p.upstream != nil {
+		defer p.upstream.Close()
 	}
-	defer p.rconn.Close()
 
 	//nagles?
 	if p.Nagles {
-		if conn, ok := p.lconn.(setNoDelayer); ok {
-			conn.SetNoDelay(true)
-		}
-		if conn, ok := p.rconn.(setNoDelayer); ok {
-			conn.SetNoDelay(true)
-		}
+		setNoDelay(p.lconn)
 	}
 
 	//display both ends
-	p.ctx.Log.Info("Opened %s >>> %s", p.laddr.String(), p.raddr.String())
+	if p.standalone {
+		p.ctx.Log.Info("Opened %s without a remote", p.laddr.String())
+	} else {
+		p.ctx.Log.Info("Opened %s >>> %s", p.laddr.String(), p.raddr.String())
+	}
 
-	//bidirectional copy
-	go p.pipe(p.lconn, p.rconn)
-	go p.pipe(p.rconn, p.lconn)
+	//client messages are read here, replies arrive through the upstream
+	go p.pipe()
 
 	//wait for close...
 
 	<-p.errsig
-	p.ctx.Log.Info("Closed (%d bytes sent, %d bytes recieved)", p.sentBytes, p.receivedBytes)
+	p.ctx.Log.Info("Closed (%d bytes sent, %d bytes recieved)", atomic.LoadUint64(&p.sentBytes), atomic.LoadUint64(&p.receivedBytes))
 }
 
 func (p *Proxy) err(s string, err error) {
-	if p.erred {
-		return
-	}
-	if err != io.EOF {
-		p.ctx.Log.Warn(s, err)
-	}
-	p.errsig <- true
-	p.erred = true
+	p.errOnce.Do(func() {
+		if err != io.EOF && err != errUpstreamClosed {
+			p.ctx.Log.Warn(s, err)
+		}
+		p.cancelDone()
+		close(p.errsig)
+	})
 }
 
-// func WriteInt(b *bytes.Buffer, i int32) {
-// 	binary.Write(b, binary.LittleEndian, []byte{
-// 		byte(i),
-// 		byte(i >> 8),
-// 		byte(i >> 16),
-// 		byte(i >> 24),
-// 	})
-// }
-
-func (p *Proxy) pipe(src, dst io.ReadWriter) {
-	islocal := src == p.lconn
-
-	var dataDirection string
-	if islocal {
-		dataDirection = ">>> %d bytes sent%s"
-	} else {
-		dataDirection = "<<< %d bytes recieved%s"
-	}
-
-	var byteFormat string
+func (p *Proxy) byteFormat() string {
 	if p.OutputHex {
-		byteFormat = "%x"
-	} else {
-		byteFormat = "%s"
+		return "%x"
 	}
+	return "%s"
+}
 
-	responseID := int32(400)
+// pipe - Handle the messages of the client one at a time until it
+// disconnects. Replies from the upstream are relayed from the upstream's
+// own goroutine.
+func (p *Proxy) pipe() {
+	messages := make(chan *mongo.Message)
+	go p.readMessages(messages)
+	for msg := range messages {
+		p.handleMessage(msg)
+	}
+}
 
-	//directional copy (64k buffer)
-	buff := make([]byte, 0xffff)
+// readMessages - Read framed messages from the client into messages until
+// it disconnects. Reading goes on while a message is handled, so that a
+// disconnect cancels its statements right away.
+func (p *Proxy) readMessages(messages chan<- *mongo.Message) {
+	defer close(messages)
 	for {
-		n, err := src.Read(buff)
+		msg, err := mongo.ReadMessage(p.lconn)
 		if err != nil {
 			p.err("Read failed '%s'\n", err)
 			return
 		}
-		b := buff[:n]
-		if islocal {
-			p.ctx.Log.LogC(log.Info, log.RedEmphasized, "INCOMING")
-		} else {
-			p.ctx.Log.LogC(log.Info, log.BlueEmphasized, "OUTGOING")
-		}
+		atomic.AddUint64(&p.readBytes, uint64(msg.Head.TotalLen))
+		p.record(capture.In, msg)
+		p.ctx.Log.LogC(log.Info, log.RedEmphasized, "INCOMING")
 
 		// //execute match
 		// if p.Matcher != nil {
@@ -167,152 +282,288 @@ func (p *Proxy) pipe(src, dst io.ReadWriter) {
 		// 	b = p.Replacer(b)
 		// }
 
-		// out = mongo.AuthCmd{}
-		// err = bson.Unmarshal(b, &out)
-		// if err == nil {
-		// 	p.ctx.Log.Debug("==== UNMARSHALLED ====%v\n", out)
-		// 	p.ctx.Log.Debug("AuthCmd: %v\n", out)
-		// } else {
-		// 	p.ctx.Log.Debug("AuthCmd unmarshal failed '%s'\n", err)
-		// }
-		//
-		mongobuf := bytes.NewBuffer(b)
+		select {
+		case messages <- msg:
+		case <-p.done.Done():
+			return
+		}
+	}
+}
 
-		msgHead := mongo.MsgHead{}
-		if err := msgHead.ReadFromBuffer(mongobuf); err != nil {
-			p.ctx.Log.Warn("MsgHeader read failed: '%s'\n", err)
+func (p *Proxy) handleMessage(msg *mongo.Message) {
+	p.ctx.Log.Debug("   %s", msg.Head)
+	p.startRequest(msg)
+	mongobuf := msg.BodyBuffer()
+
+	switch msg.Head.Opcode {
+	case mongo.Opcode_QUERY:
+		queryOp := mongo.QueryOp{}
+		if err := queryOp.ReadFromBuffer(mongobuf); err != nil {
+			p.ctx.Log.Warn("failed to read queryOp: %+v", err)
+			break
+		}
+		p.ctx.Log.Debug("   %s", queryOp)
+		database, collection, command := commandNamespace(queryOp)
+		namespace := database
+		if collection != "" {
+			namespace += "." + collection
 		}
-		p.ctx.Log.Debug("   %s", msgHead)
-
-		shouldDualWrite := false
-		var dualWriteBytes []byte
-		switch msgHead.Opcode {
-		case mongo.Opcode_QUERY:
-			queryOp := mongo.QueryOp{}
-			if err := queryOp.ReadFromBuffer(mongobuf); err != nil {
-				p.ctx.Log.Warn("failed to read queryOp: %+v", err)
-			} else {
-				p.ctx.Log.Debug("   %s", queryOp)
+		p.annotateRequest(msg.Head.ResponseID, namespace, command, "")
+		span := p.traceRequest(msg.Head.ResponseID, traceParent(queryOp.Query))
+		request, cancel := p.startOperation(msg.Head.ResponseID, queryOp.Query)
+		defer cancel()
+
+		if isNegotiation(p.ctx, queryOp) {
+			p.annotateRequest(msg.Head.ResponseID, "", "", targetSynthesized)
+			replyOp, err := createNegotiationReply(p.ctx, queryOp)
+			if err != nil {
+				p.ctx.Log.Warn("failed to create negotiation reply: %+v", err)
+				p.writeError(err, msg.Head.ResponseID)
+				return
 			}
-
-			if isNegotiation(p.ctx, queryOp) {
-				replyOp, err := createNegotiationReply(p.ctx, queryOp)
-				if err != nil {
-					p.ctx.Log.Warn("failed to create negotiation reply: %+v", err)
-					panic("oops")
-				}
-				p.ctx.Log.LogC(log.Info, log.BlueEmphasized, "GENERATED OUTGOING")
-				p.ctx.Log.Debug("   %s", replyOp)
-				replyMsgHead := mongo.NewMsgHead(replyOp, 0 /* responseID */, 0 /* reponseTo */)
-				replyMsgHead.WriteToBuffer(src)
-				replyOp.WriteToBuffer(src)
-				p.receivedBytes += uint64(replyMsgHead.TotalLen)
-				continue
-			} else if isQuery(p.ctx, queryOp) {
-				p.ctx.Log.Debug("is a query!")
-				replyOp, err := handleQuery(p.ctx, queryOp)
-				if err != nil {
-					p.ctx.Log.Warn("failed to handle query reply: %+v", err)
-				} else {
-					p.ctx.Log.LogC(log.Info, log.BlueEmphasized, "GENERATED OUTGOING")
-					p.ctx.Log.Debug("   %s", replyOp)
-					replyMsgHead := mongo.NewMsgHead(replyOp, responseID, msgHead.ResponseID)
-					replyMsgHead.WriteToBuffer(src)
-					replyOp.WriteToBuffer(src)
-					p.receivedBytes += uint64(replyMsgHead.TotalLen)
-					responseID++
-					continue
-				}
+			p.useIdentity()
+			p.writeReply(replyOp, msg.Head.ResponseID)
+			return
+		}
+		if p.isProxyCommand(queryOp) {
+			p.annotateRequest(msg.Head.ResponseID, "", "", targetSynthesized)
+			replyOp, err := p.handleProxyCommand(queryOp)
+			if err != nil {
+				p.writeError(err, msg.Head.ResponseID)
+				return
 			}
+			p.writeReply(replyOp, msg.Head.ResponseID)
+			return
+		}
+		// Lines logged while answering the query carry what it is.
+		ctx := *p.ctx
+		ctx.Span = span
+		ctx.Statements = p.recordStatements(msg.Head.ResponseID, queryOp.Query)
+		ctx.Request = request
+		if p.routeQuery(withLogFields(&ctx, log.Fields{
+			"request_id": msg.Head.ResponseID,
+			"opcode":     msg.Head.Opcode.String(),
+			"command":    command,
+			"ns":         namespace,
+		}), msg, queryOp) {
+			return
+		}
+	case mongo.Opcode_COMMAND:
+		commandOp := mongo.CommandOp{}
+		if err := commandOp.ReadFromBuffer(mongobuf); err != nil {
+			p.ctx.Log.Warn("failed to read commandOp: %+v", err)
+		} else {
+			p.ctx.Log.Debug("   commandOp=%s", commandOp)
+		}
+	case mongo.Opcode_GET_MORE:
+		getMoreOp := mongo.GetMoreOp{}
+		if err := getMoreOp.ReadFromBuffer(mongobuf); err != nil {
+			p.ctx.Log.Warn("failed to read getMoreOp: %+v", err)
+		} else {
+			p.ctx.Log.Debug("   %s", getMoreOp)
+		}
+	case mongo.Opcode_KILL_CURSORS:
+		killCursorsOp := mongo.KillCursorsOp{}
+		if err := killCursorsOp.ReadFromBuffer(mongobuf); err != nil {
+			p.ctx.Log.Warn("failed to read killCursorsOp: %+v", err)
+		} else {
+			p.ctx.Log.Debug("   %s", killCursorsOp)
+		}
+	case mongo.Opcode_MSG:
+		msgOp := mongo.MsgOp{}
+		if err := msgOp.ReadFromBuffer(mongobuf); err != nil {
+			p.ctx.Log.Warn("failed to read msgOp: %+v", err)
+		} else {
+			p.ctx.Log.Debug("   %s", msgOp)
+		}
+	case mongo.Opcode_INSERT, mongo.Opcode_UPDATE, mongo.Opcode_DELETE, mongo.Opcode_COMPRESSED:
+	default:
+		p.ctx.Log.Warn("unhandled opcode=%s, forwarding as is", msg.Head.Opcode)
+	}
 
-			// if query.Map()["insert"] != nil {
-			// 	p.ctx.Log.Debug("Inserting into: %s", query.Map()["insert"])
-
-			// 	dualWriteTable := "employees"
-			// 	query[0].Value = dualWriteTable
-			// 	dualWriteQuery, err := bson.Marshal(query)
-			// 	if err != nil {
-			// 		p.ctx.Log.Debug("failed to unmarshal query: %+v", err)
-			// 	}
-			// 	p.ctx.Log.Debug("Dual write query: %v", query)
-
-			// 	newBuf := bytes.NewBuffer([]byte{})
-			// 	WriteInt(newBuf, totalLen)       // Modified after
-			// 	WriteInt(newBuf, responseId+100) // Modified for uniqueness
-			// 	WriteInt(newBuf, responseTo)
-			// 	WriteInt(newBuf, opCode)
-			// 	WriteInt(newBuf, int32(queryOp.Flags))
-			// 	newBuf.WriteString(queryOp.Collection)
-			// 	newBuf.WriteByte(0x0) // String null terminator
-			// 	WriteInt(newBuf, queryOp.Skip)
-			// 	WriteInt(newBuf, queryOp.Limit)
-			// 	newBuf.Write(dualWriteQuery)
-			// 	dualWriteBytesLocal := newBuf.Bytes()
-			// 	newQueryLen := len(dualWriteBytesLocal)
-			// 	dualWriteBytes = make([]byte, newQueryLen)
-			// 	for i := 1; i < newQueryLen; i++ {
-			// 		dualWriteBytes[i] = dualWriteBytesLocal[i]
-			// 	}
-			// 	shouldDualWrite = true
-			// }
-		case mongo.Opcode_COMMAND:
-			commandOp := mongo.CommandOp{}
-			if err := commandOp.ReadFromBuffer(mongobuf); err != nil {
-				p.ctx.Log.Warn("failed to read commandOp: %+v", err)
-			} else {
-				p.ctx.Log.Debug("   commandOp=%s", commandOp)
-			}
-		case mongo.Opcode_COMMANDREPLY:
-			commandReplyOp := mongo.CommandReplyOp{}
-			if err := commandReplyOp.ReadFromBuffer(mongobuf); err != nil {
-				p.ctx.Log.Warn("failed to read commandReplyOp: %+v", err)
-			} else {
-				p.ctx.Log.Debug("   commandReplyOp=%s", commandReplyOp)
-			}
-		case mongo.Opcode_REPLY:
-			replyOp := mongo.ReplyOp{}
-			if err := replyOp.ReadFromBuffer(mongobuf); err != nil {
-				p.ctx.Log.Warn("failed to read replyOp: %+v", err)
-			} else {
-				p.ctx.Log.Debug("   %s", replyOp)
+	p.traceRequest(msg.Head.ResponseID, trace.SpanContext{})
+	p.forward(msg)
+}
+
+// routeQuery - Answer a query where the Router sends it. Returns false when
+// it should be forwarded to the upstream unchanged.
+func (p *Proxy) routeQuery(ctx *context.Context, msg *mongo.Message, query mongo.QueryOp) bool {
+	router := p.Router
+	if router == nil {
+		router = DefaultRouter()
+	}
+	database, collection, command := commandNamespace(query)
+	target := router.RouteQuery(ctx, query)
+	switch {
+	case p.standalone:
+		target = TargetSQL
+	case command == "getMore" || command == "killCursors":
+		// Cursors continue where they were opened.
+		target = TargetUpstream
+		if p.Sessions != nil && p.Sessions.ownsCursor(query.Query) {
+			target = TargetSQL
+		}
+	case isTransactionEnd(command):
+		// Transactions end where they run, which is both sides for a
+		// shadowed transaction.
+		switch {
+		case p.Sessions == nil || !p.Sessions.active(readTransactionFields(query.Query)):
+			target = TargetUpstream
+		case target != TargetBoth || p.Shadow == nil:
+			target = TargetSQL
+		}
+	case isSessionCommand(command) && target != TargetSQL && p.Sessions != nil:
+		// Sessions span both sides, so the translated side of a session
+		// ends or is refreshed as well.
+		if command != "startSession" {
+			if err := p.Sessions.updateSessions(command, query.Query); err != nil {
+				ctx.Log.Warn("failed to update sessions: %+v", err)
 			}
+		}
+	}
+	ctx = withLogFields(ctx, log.Fields{"route": target.String()})
+	ctx.Log.Debug("routing %s on %s.%s to %s", command, database, collection, target)
 
-			p.ctx.Log.Debug("documents: %#v", replyOp.Documents)
+	switch target {
+	case TargetBoth:
+		if p.Shadow == nil || p.Sessions == nil || p.refusesTranslation(ctx) || !isQuery(ctx, query) && !isTransactionEnd(command) {
+			return false
+		}
+		p.annotateRequest(msg.Head.ResponseID, "", "", target.String())
+		p.shadowQuery(ctx, msg, query)
+		return true
+	case TargetSQL:
+		p.annotateRequest(msg.Head.ResponseID, "", "", target.String())
+		replyOp, err := p.handleSQL(ctx, query)
+		if err != nil {
+			err = interruption(ctx, err)
+			ctx.Log.Warn("failed to handle query reply: %+v", err)
+			p.writeError(err, msg.Head.ResponseID)
+			return true
+		}
+		p.writeReply(replyOp, msg.Head.ResponseID)
+		return true
+	}
+	return false
+}
 
-			// p.ctx.Log.Warn("negotiation replyOp docLen=%d", len(replyOp.Documents))
-			// for i, doc := range replyOp.Documents {
-			// 	p.ctx.Log.Warn("replyOp[%d]=%v", i, doc)
-			// }
-			// p.ctx.Log.Warn("neg replyMap=%v", replyOp.Documents.Map())
-		default:
-			panic(fmt.Sprintf("unhandled opcode=%s", msgHead.Opcode))
+// forward - Send a client message to the upstream.
+func (p *Proxy) forward(msg *mongo.Message) {
+	p.forwardWithReply(msg, p.relay)
+}
+
+// forwardWithReply - Send a client message to the upstream, handing its
+// replies to reply rather than relaying them straight to the client.
+func (p *Proxy) forwardWithReply(msg *mongo.Message, reply ReplyFunc) {
+	if p.standalone {
+		// There is nowhere to forward to. Fail anything the client is
+		// waiting on, and drop unacknowledged writes.
+		if inspectRequest(msg).expectsReply {
+			p.annotateRequest(msg.Head.ResponseID, "", "", targetSynthesized)
+			p.writeError(mongo.NewCommandError(mongo.ErrorCodeCommandNotFound, "%s is not supported without a remote", msg.Head.Opcode), msg.Head.ResponseID)
+		} else {
+			p.ctx.Log.Warn("dropping %s without a remote", msg.Head.Opcode)
 		}
+		return
+	}
 
-		p.ctx.Log.Debug(dataDirection, n, "")
-		p.ctx.Log.Trace(byteFormat, b)
+	p.ctx.Log.Debug(">>> %d bytes sent", msg.Head.TotalLen)
+	p.ctx.Log.Trace(p.byteFormat(), msg.Bytes())
 
-		//write out result
-		n, err = dst.Write(b)
-		if err != nil {
-			p.err("Write failed '%s'\n", err)
-			return
+	if err := p.upstream.Send(msg, p.traceUpstream(msg, reply)); err != nil {
+		p.err("Write failed '%s'\n", err)
+		return
+	}
+	atomic.AddUint64(&p.sentBytes, uint64(msg.Head.TotalLen))
+}
+
+// relay - Pass an upstream reply back to the client.
+func (p *Proxy) relay(msg *mongo.Message, err error) {
+	if err != nil {
+		p.err("Read failed '%s'\n", err)
+		return
+	}
+	p.ctx.Log.LogC(log.Info, log.BlueEmphasized, "OUTGOING")
+	p.ctx.Log.Debug("   %s", msg.Head)
+
+	switch msg.Head.Opcode {
+	case mongo.Opcode_COMMANDREPLY:
+		commandReplyOp := mongo.CommandReplyOp{}
+		if err := commandReplyOp.ReadFromBuffer(msg.BodyBuffer()); err != nil {
+			p.ctx.Log.Warn("failed to read commandReplyOp: %+v", err)
+		} else {
+			p.ctx.Log.Debug("   commandReplyOp=%s", commandReplyOp)
 		}
-		if islocal {
-			p.sentBytes += uint64(n)
+	case mongo.Opcode_REPLY:
+		replyOp := mongo.ReplyOp{}
+		if err := replyOp.ReadFromBuffer(msg.BodyBuffer()); err != nil {
+			p.ctx.Log.Warn("failed to read replyOp: %+v", err)
 		} else {
-			p.receivedBytes += uint64(n)
+			p.ctx.Log.Debug("   %s", replyOp)
 		}
 
-		// Dual write to separate table
-		if shouldDualWrite {
-			p.ctx.Log.Debug("=== DUAL WRITE BEGIN ===")
-			p.ctx.Log.Debug(dataDirection, len(dualWriteBytes), "")
-			p.ctx.Log.Trace(byteFormat, dualWriteBytes)
-			p.ctx.Log.Debug("=== DUAL WRITE END ===")
-			n, err = dst.Write(dualWriteBytes)
-			if err == nil {
-				p.ctx.Log.Debug("Dual write success")
-			}
-		}
+		p.ctx.Log.Debug("documents: %#v", replyOp.Documents)
+	}
+
+	p.ctx.Log.Debug("<<< %d bytes recieved", msg.Head.TotalLen)
+	p.ctx.Log.Trace(p.byteFormat(), msg.Bytes())
+
+	if err := p.write(msg); err != nil {
+		p.err("Write failed '%s'\n", err)
+	}
+}
+
+// writeReply - Send a reply generated by the proxy to the client.
+func (p *Proxy) writeReply(replyOp mongo.Op, responseTo int32) {
+	p.ctx.Log.LogC(log.Info, log.BlueEmphasized, "GENERATED OUTGOING")
+	p.ctx.Log.Debug("   %s", replyOp)
+
+	msg, err := mongo.NewMessage(replyOp, atomic.AddInt32(&p.responseID, 1), responseTo)
+	if err != nil {
+		p.ctx.Log.Warn("failed to encode reply: %+v", err)
+		return
+	}
+	if err := p.write(msg); err != nil {
+		p.err("Write failed '%s'\n", err)
+	}
+}
+
+// writeError - Reply to a request with a failed command document.
+func (p *Proxy) writeError(err error, responseTo int32) {
+	cmdErr, ok := errors.Cause(err).(*mongo.CommandError)
+	if !ok {
+		cmdErr = mongo.NewCommandError(mongo.ErrorCodeInternalError, "%s", err)
+	}
+	p.writeReply(newReply(cmdErr.Document()), responseTo)
+}
+
+func (p *Proxy) write(msg *mongo.Message) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	span := p.requestSpan(msg.Head.ResponseTo).Child("write reply")
+	n, err := msg.WriteTo(p.lconn)
+	span.SetError(err)
+	span.End()
+	if err == nil {
+		p.record(capture.Out, msg)
+	}
+	atomic.AddUint64(&p.receivedBytes, uint64(n))
+	p.finishRequest(msg, n)
+	return err
+}
+
+// record - Append a message to the capture, when there is one.
+func (p *Proxy) record(direction capture.Direction, msg *mongo.Message) {
+	if p.Capture == nil {
+		return
+	}
+	err := p.Capture.Write(capture.Record{
+		Time:      time.Now(),
+		Conn:      p.ctx.ConnID,
+		Direction: direction,
+		Data:      msg.Bytes(),
+	})
+	if err != nil {
+		p.ctx.Log.Warn("failed to capture message: %+v", err)
 	}
 }
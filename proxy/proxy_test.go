@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"bytes"
+	gocontext "context"
+	"database/sql"
+	"database/sql/driver"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// blockingDriver - A database/sql driver whose statements run until their
+// context is canceled, reporting on started and canceled.
+type blockingDriver struct {
+	started  chan string
+	canceled chan string
+}
+
+func (d *blockingDriver) Open(name string) (driver.Conn, error) {
+	return blockingConn{d}, nil
+}
+
+type blockingConn struct {
+	d *blockingDriver
+}
+
+func (c blockingConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported")
+}
+
+func (c blockingConn) Close() error {
+	return nil
+}
+
+func (c blockingConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+func (c blockingConn) run(ctx gocontext.Context, query string) error {
+	c.d.started <- query
+	<-ctx.Done()
+	c.d.canceled <- query
+	return ctx.Err()
+}
+
+func (c blockingConn) QueryContext(ctx gocontext.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return nil, c.run(ctx, query)
+}
+
+func (c blockingConn) ExecContext(ctx gocontext.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return nil, c.run(ctx, query)
+}
+
+func init() {
+	sql.Register("blocking", blockingTestDriver)
+}
+
+var blockingTestDriver = &blockingDriver{
+	started:  make(chan string, 1),
+	canceled: make(chan string, 1),
+}
+
+// startBlocking - A standalone proxy translating onto the blocking driver,
+// and the client end of its connection.
+func startBlocking(t *testing.T) net.Conn {
+	t.Helper()
+	db, err := sql.Open("blocking", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	client, server := net.Pipe()
+	p := NewStandalone(server, &net.TCPAddr{})
+	p.Sessions = NewSessions()
+	t.Cleanup(func() { p.Sessions.Close() })
+	p.Ctx().SetDB(db)
+	go p.Start()
+	return client
+}
+
+// sendFind - Send cmd to the proxy and return the statement it starts.
+func sendFind(t *testing.T, client net.Conn, cmd bson.D) string {
+	t.Helper()
+	query := mongo.QueryOp{
+		Collection: "db.$cmd",
+		Limit:      -1,
+		Query:      cmd,
+	}
+	var body bytes.Buffer
+	if err := query.WriteToBuffer(&body); err != nil {
+		t.Fatal(err)
+	}
+	msg := &mongo.Message{
+		Head: mongo.MsgHead{TotalLen: mongo.MsgHeadSize() + int32(body.Len()), ResponseID: 1, Opcode: mongo.Opcode_QUERY},
+		Body: body.Bytes(),
+	}
+	if _, err := msg.WriteTo(client); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case statement := <-blockingTestDriver.started:
+		return statement
+	case <-time.After(5 * time.Second):
+		t.Fatal("the find ran no statement")
+	}
+	return ""
+}
+
+func TestDisconnectCancelsStatement(t *testing.T) {
+	client := startBlocking(t)
+	statement := sendFind(t, client, bson.D{bson.DocElem{"find", "t"}, bson.DocElem{"filter", bson.D{}}})
+	client.Close()
+	select {
+	case canceled := <-blockingTestDriver.canceled:
+		if canceled != statement {
+			t.Errorf("canceled %q, want %q", canceled, statement)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%q was not canceled when the client disconnected", statement)
+	}
+}
+
+func TestMaxTimeMSExpires(t *testing.T) {
+	client := startBlocking(t)
+	defer client.Close()
+	statement := sendFind(t, client, bson.D{
+		bson.DocElem{"find", "t"},
+		bson.DocElem{"filter", bson.D{}},
+		bson.DocElem{"maxTimeMS", 10},
+	})
+	select {
+	case canceled := <-blockingTestDriver.canceled:
+		if canceled != statement {
+			t.Errorf("canceled %q, want %q", canceled, statement)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%q was not canceled when maxTimeMS ran out", statement)
+	}
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := mongo.ReadMessage(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replyOp := mongo.ReplyOp{}
+	if err := replyOp.ReadFromBuffer(msg.BodyBuffer()); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := toInt64(replyOp.Documents.Map()["code"]); mongo.ErrorCode(code) != mongo.ErrorCodeMaxTimeMSExpired {
+		t.Errorf("got %v, want MaxTimeMSExpired", replyOp.Documents)
+	}
+}
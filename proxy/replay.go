@@ -0,0 +1,438 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/lego/mongotunnel/util/capture"
+	"github.com/pkg/errors"
+)
+
+// Replay sends the client requests of a capture to a target, one
+// connection per captured connection and in the captured order, waiting
+// for each reply before the next request. Replies are compared with those
+// captured after dropping the fields that differ between runs. Cursor IDs
+// the target hands out are mapped from the captured ones, so that getMore
+// and killCursors reach the cursors opened by the replay.
+
+// volatileFields - Reply fields that differ from run to run, by name at any
+// depth or by dotted path.
+var volatileFields = []string{
+	"localTime",
+	"operationTime",
+	"$clusterTime",
+	"$gleStats",
+	"electionId",
+	"lastWrite",
+	"lastOp",
+	"opTime",
+	"connectionId",
+	"postBatchResumeToken",
+	"cursor.id",
+}
+
+// defaultReplayTimeout - How long a reply is awaited without a Timeout.
+const defaultReplayTimeout = 30 * time.Second
+
+// ReplayStats - How the replies of a replay compared.
+type ReplayStats struct {
+	Requests int
+	Matched  int
+	Differed int
+	// Failed counts requests the target did not answer.
+	Failed int
+	// Unrecorded counts requests answered without a captured reply to
+	// compare with.
+	Unrecorded int
+}
+
+// Replayer - Replays captures against a target.
+type Replayer struct {
+	// Target is the host:port of the proxy or mongod.
+	Target string
+	// Timing waits between requests as long as the client did.
+	Timing bool
+	// Timeout bounds the wait for each reply, defaultReplayTimeout when
+	// zero.
+	Timeout time.Duration
+	// Ignore lists fields to drop besides volatileFields.
+	Ignore []string
+	// Out receives the differences.
+	Out io.Writer
+}
+
+// replayConn - A connection to the target standing for a captured one.
+type replayConn struct {
+	conn net.Conn
+	// cursors maps captured cursor IDs to those of the target.
+	cursors map[int64]int64
+}
+
+type replyKey struct {
+	conn       uint64
+	responseTo int32
+}
+
+// Replay - Replay the records of a capture.
+func (r *Replayer) Replay(records []capture.Record) (ReplayStats, error) {
+	var stats ReplayStats
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = defaultReplayTimeout
+	}
+	ignore := make(map[string]bool)
+	for _, field := range append(volatileFields, r.Ignore...) {
+		ignore[field] = true
+	}
+
+	recorded := make(map[replyKey]*mongo.Message)
+	for _, rec := range records {
+		if rec.Direction != capture.Out {
+			continue
+		}
+		msg, err := mongo.ReadMessage(bytes.NewReader(rec.Data))
+		if err != nil {
+			continue
+		}
+		key := replyKey{rec.Conn, msg.Head.ResponseTo}
+		if _, ok := recorded[key]; !ok {
+			recorded[key] = msg
+		}
+	}
+
+	conns := make(map[uint64]*replayConn)
+	defer func() {
+		for _, c := range conns {
+			c.conn.Close()
+		}
+	}()
+
+	var first time.Time
+	start := time.Now()
+	for _, rec := range records {
+		if rec.Direction != capture.In {
+			continue
+		}
+		msg, err := mongo.ReadMessage(bytes.NewReader(rec.Data))
+		if err != nil {
+			return stats, errors.Wrapf(err, "conn=%d: failed to read captured message", rec.Conn)
+		}
+		if first.IsZero() {
+			first = rec.Time
+		}
+		if r.Timing {
+			time.Sleep(time.Until(start.Add(rec.Time.Sub(first))))
+		}
+
+		c, ok := conns[rec.Conn]
+		if !ok {
+			conn, err := net.DialTimeout("tcp", r.Target, timeout)
+			if err != nil {
+				return stats, err
+			}
+			c = &replayConn{conn: conn, cursors: make(map[int64]int64)}
+			conns[rec.Conn] = c
+		}
+
+		info := inspectRequest(msg)
+		if info.expectsReply {
+			stats.Requests++
+		}
+		label := replayLabel(rec.Conn, msg)
+		reply, err := c.roundTrip(c.mapCursors(msg), info.expectsReply, timeout)
+		if err != nil {
+			stats.Failed++
+			fmt.Fprintf(r.Out, "%s: %s\n", label, err)
+			c.conn.Close()
+			delete(conns, rec.Conn)
+			continue
+		}
+		if reply == nil {
+			continue
+		}
+		want, ok := recorded[replyKey{rec.Conn, msg.Head.ResponseID}]
+		if !ok {
+			stats.Unrecorded++
+			continue
+		}
+
+		diffs := c.compare(want, reply, ignore, orderedRequest(msg))
+		if len(diffs) == 0 {
+			stats.Matched++
+			continue
+		}
+		stats.Differed++
+		fmt.Fprintf(r.Out, "%s: %d differences\n", label, len(diffs))
+		for _, diff := range diffs {
+			fmt.Fprintf(r.Out, "   %s\n", diff)
+		}
+	}
+	return stats, nil
+}
+
+// roundTrip - Send a request, and wait for its reply when it has one.
+// Replies to other requests, such as the rest of an exhaust cursor, are
+// skipped.
+func (c *replayConn) roundTrip(msg *mongo.Message, expectsReply bool, timeout time.Duration) (*mongo.Message, error) {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := msg.WriteTo(c.conn); err != nil {
+		return nil, err
+	}
+	if !expectsReply {
+		return nil, nil
+	}
+	for {
+		reply, err := mongo.ReadMessage(c.conn)
+		if err != nil {
+			return nil, err
+		}
+		if reply.Head.ResponseTo == msg.Head.ResponseID {
+			return reply, nil
+		}
+	}
+}
+
+// mapCursors - The request with the captured cursor IDs it names replaced
+// by those of the target.
+func (c *replayConn) mapCursors(msg *mongo.Message) *mongo.Message {
+	mapID := func(v interface{}) (interface{}, bool) {
+		id, ok := toInt64(v)
+		if !ok {
+			return v, false
+		}
+		live, ok := c.cursors[id]
+		if !ok {
+			return v, false
+		}
+		return live, true
+	}
+
+	switch msg.Head.Opcode {
+	case mongo.Opcode_QUERY:
+		query := mongo.QueryOp{}
+		if err := query.ReadFromBuffer(msg.BodyBuffer()); err != nil || len(query.Query) == 0 {
+			return msg
+		}
+		changed := false
+		switch query.Query[0].Name {
+		case "getMore":
+			query.Query[0].Value, changed = mapID(query.Query[0].Value)
+		case "killCursors":
+			for i, elem := range query.Query {
+				ids, ok := elem.Value.([]interface{})
+				if elem.Name != "cursors" || !ok {
+					continue
+				}
+				mapped := make([]interface{}, len(ids))
+				for j, id := range ids {
+					var ok bool
+					mapped[j], ok = mapID(id)
+					changed = changed || ok
+				}
+				query.Query[i].Value = mapped
+			}
+		}
+		if !changed {
+			return msg
+		}
+		var body bytes.Buffer
+		if err := query.WriteToBuffer(&body); err != nil {
+			return msg
+		}
+		return withBody(msg, body.Bytes())
+	case mongo.Opcode_GET_MORE:
+		// The cursor ID ends the body.
+		if len(msg.Body) < 8 {
+			return msg
+		}
+		id := int64(binary.LittleEndian.Uint64(msg.Body[len(msg.Body)-8:]))
+		live, ok := c.cursors[id]
+		if !ok {
+			return msg
+		}
+		body := append([]byte(nil), msg.Body...)
+		binary.LittleEndian.PutUint64(body[len(body)-8:], uint64(live))
+		return withBody(msg, body)
+	case mongo.Opcode_KILL_CURSORS:
+		op := mongo.KillCursorsOp{}
+		if err := op.ReadFromBuffer(msg.BodyBuffer()); err != nil {
+			return msg
+		}
+		for i, id := range op.CursorIDs {
+			if live, ok := c.cursors[id]; ok {
+				op.CursorIDs[i] = live
+			}
+		}
+		mapped, err := mongo.NewMessage(&op, msg.Head.ResponseID, msg.Head.ResponseTo)
+		if err != nil {
+			return msg
+		}
+		return mapped
+	}
+	return msg
+}
+
+// withBody - A copy of msg with another body.
+func withBody(msg *mongo.Message, body []byte) *mongo.Message {
+	head := msg.Head
+	head.TotalLen = mongo.MsgHeadSize() + int32(len(body))
+	return &mongo.Message{Head: head, Body: body}
+}
+
+// compare - The differences of a reply of the target from the captured
+// one, learning the cursors it opens.
+func (c *replayConn) compare(want, got *mongo.Message, ignore map[string]bool, ordered bool) []string {
+	if want.Head.Opcode != mongo.Opcode_REPLY || got.Head.Opcode != mongo.Opcode_REPLY {
+		if want.Head.Opcode != got.Head.Opcode || !bytes.Equal(want.Body, got.Body) {
+			return []string{fmt.Sprintf("%s reply differs from the captured %s reply", got.Head.Opcode, want.Head.Opcode)}
+		}
+		return nil
+	}
+	wantOp, gotOp := mongo.ReplyOp{}, mongo.ReplyOp{}
+	if err := wantOp.ReadFromBuffer(want.BodyBuffer()); err != nil {
+		return []string{fmt.Sprintf("failed to read captured reply: %s", err)}
+	}
+	if err := gotOp.ReadFromBuffer(got.BodyBuffer()); err != nil {
+		return []string{fmt.Sprintf("failed to read reply: %s", err)}
+	}
+
+	if wantOp.CursorID != 0 {
+		c.cursors[wantOp.CursorID] = gotOp.CursorID
+	}
+	_, wantID := cursorBatch(wantOp.Documents.Map())
+	_, gotID := cursorBatch(gotOp.Documents.Map())
+	if wantID != 0 {
+		c.cursors[wantID] = gotID
+	}
+
+	var diffs []string
+	if (wantOp.CursorID == 0) != (gotOp.CursorID == 0) {
+		diffs = append(diffs, fmt.Sprintf("cursor open: %t != %t", wantOp.CursorID != 0, gotOp.CursorID != 0))
+	}
+	return append(diffs, diffValues("", normalizeValue(wantOp.Documents), normalizeValue(gotOp.Documents), ignore, ordered)...)
+}
+
+// diffValues - The differences between two normalized values, as a path
+// and both sides. Batches of unordered queries are compared in any order.
+func diffValues(path string, want, got interface{}, ignore map[string]bool, ordered bool) []string {
+	switch w := want.(type) {
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make(map[string]bool)
+		for k := range w {
+			keys[k] = true
+		}
+		for k := range g {
+			keys[k] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+
+		var diffs []string
+		for _, k := range sorted {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			if ignore[k] || ignore[p] {
+				continue
+			}
+			wv, inWant := w[k]
+			gv, inGot := g[k]
+			switch {
+			case !inGot:
+				diffs = append(diffs, fmt.Sprintf("%s: missing, captured %s", p, fingerprint(wv)))
+			case !inWant:
+				diffs = append(diffs, fmt.Sprintf("%s: %s, not captured", p, fingerprint(gv)))
+			default:
+				diffs = append(diffs, diffValues(p, wv, gv, ignore, ordered)...)
+			}
+		}
+		return diffs
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok {
+			break
+		}
+		if !ordered && isBatchPath(path) {
+			w, g = sortedByFingerprint(w), sortedByFingerprint(g)
+		}
+		var diffs []string
+		if len(w) != len(g) {
+			diffs = append(diffs, fmt.Sprintf("%s: %d elements != captured %d", path, len(g), len(w)))
+		}
+		for i := 0; i < len(w) && i < len(g); i++ {
+			diffs = append(diffs, diffValues(fmt.Sprintf("%s[%d]", path, i), w[i], g[i], ignore, ordered)...)
+		}
+		return diffs
+	}
+	if reflect.DeepEqual(want, got) {
+		return nil
+	}
+	return []string{fmt.Sprintf("%s: %s != captured %s", path, fingerprint(got), fingerprint(want))}
+}
+
+// isBatchPath - Whether a path holds the documents of a query.
+func isBatchPath(path string) bool {
+	return path == "cursor.firstBatch" || path == "cursor.nextBatch" || path == "result"
+}
+
+func sortedByFingerprint(values []interface{}) []interface{} {
+	sorted := append([]interface{}(nil), values...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return fingerprint(sorted[i]) < fingerprint(sorted[j])
+	})
+	return sorted
+}
+
+// orderedRequest - Whether the documents of a request come in a defined
+// order.
+func orderedRequest(msg *mongo.Message) bool {
+	if msg.Head.Opcode != mongo.Opcode_QUERY {
+		return true
+	}
+	query := mongo.QueryOp{}
+	if err := query.ReadFromBuffer(msg.BodyBuffer()); err != nil || len(query.Query) == 0 {
+		return true
+	}
+	switch query.Query[0].Name {
+	case "find", "aggregate":
+		return orderedQuery(query.Query)
+	case "getMore":
+		// Batches after the first follow whatever order the cursor has.
+		return false
+	}
+	if !strings.HasSuffix(query.Collection, ".$cmd") {
+		// A legacy query, with its sort as $orderby.
+		_, ok := query.Query.Map()["$orderby"]
+		return ok
+	}
+	return true
+}
+
+// replayLabel - Names a request in the output.
+func replayLabel(conn uint64, msg *mongo.Message) string {
+	label := fmt.Sprintf("conn=%d request=%d %s", conn, msg.Head.ResponseID, msg.Head.Opcode)
+	if msg.Head.Opcode == mongo.Opcode_QUERY {
+		query := mongo.QueryOp{}
+		if err := query.ReadFromBuffer(msg.BodyBuffer()); err == nil && len(query.Query) > 0 {
+			database, collection, command := commandNamespace(query)
+			label = fmt.Sprintf("conn=%d request=%d %s %s.%s", conn, msg.Head.ResponseID, command, database, collection)
+		}
+	}
+	return label
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffValues(t *testing.T) {
+	doc := func(fields ...interface{}) map[string]interface{} {
+		m := make(map[string]interface{})
+		for i := 0; i < len(fields); i += 2 {
+			m[fields[i].(string)] = fields[i+1]
+		}
+		return m
+	}
+	tests := []struct {
+		name      string
+		want, got interface{}
+		ignore    map[string]bool
+		ordered   bool
+		diffs     []string
+	}{
+		{
+			name: "equal",
+			want: doc("ok", 1.0, "n", 2.0),
+			got:  doc("ok", 1.0, "n", 2.0),
+		},
+		{
+			name:  "changed, missing and extra fields",
+			want:  doc("a", 1.0, "b", "x", "c", true),
+			got:   doc("a", 2.0, "c", true, "d", "y"),
+			diffs: []string{`a: 2 != captured 1`, `b: missing, captured "x"`, `d: "y", not captured`},
+		},
+		{
+			name:   "ignored fields",
+			want:   doc("ok", 1.0, "operationTime", 1.0, "cursor", doc("id", 5.0)),
+			got:    doc("ok", 1.0, "operationTime", 2.0, "cursor", doc("id", 7.0)),
+			ignore: map[string]bool{"operationTime": true, "cursor.id": true},
+		},
+		{
+			name:  "nested paths",
+			want:  doc("cursor", doc("firstBatch", []interface{}{doc("_id", 1.0, "v", "a")})),
+			got:   doc("cursor", doc("firstBatch", []interface{}{doc("_id", 1.0, "v", "b")})),
+			diffs: []string{`cursor.firstBatch[0].v: "b" != captured "a"`},
+		},
+		{
+			name: "unordered batch in any order",
+			want: doc("cursor", doc("firstBatch", []interface{}{doc("_id", 1.0), doc("_id", 2.0)})),
+			got:  doc("cursor", doc("firstBatch", []interface{}{doc("_id", 2.0), doc("_id", 1.0)})),
+		},
+		{
+			name:    "ordered batch in order",
+			want:    doc("cursor", doc("firstBatch", []interface{}{doc("_id", 1.0), doc("_id", 2.0)})),
+			got:     doc("cursor", doc("firstBatch", []interface{}{doc("_id", 2.0), doc("_id", 1.0)})),
+			ordered: true,
+			diffs:   []string{`cursor.firstBatch[0]._id: 2 != captured 1`, `cursor.firstBatch[1]._id: 1 != captured 2`},
+		},
+		{
+			name:  "other arrays in order",
+			want:  doc("a", []interface{}{1.0, 2.0}),
+			got:   doc("a", []interface{}{2.0, 1.0}),
+			diffs: []string{`a[0]: 2 != captured 1`, `a[1]: 1 != captured 2`},
+		},
+		{
+			name:  "lengths",
+			want:  doc("result", []interface{}{1.0, 2.0}),
+			got:   doc("result", []interface{}{1.0}),
+			diffs: []string{`result: 1 elements != captured 2`},
+		},
+		{
+			name:  "types",
+			want:  doc("a", doc("b", 1.0)),
+			got:   doc("a", "b"),
+			diffs: []string{`a: "b" != captured {"b":1}`},
+		},
+	}
+	for _, test := range tests {
+		diffs := diffValues("", test.want, test.got, test.ignore, test.ordered)
+		if len(diffs) != 0 || len(test.diffs) != 0 {
+			if !reflect.DeepEqual(diffs, test.diffs) {
+				t.Errorf("%s: diffs %q, want %q", test.name, diffs, test.diffs)
+			}
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package proxy
+
+import (
+	"github.com/lego/mongotunnel/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// newReply - Wrap a single command reply document in an OP_REPLY.
+func newReply(doc bson.D) *mongo.ReplyOp {
+	return &mongo.ReplyOp{
+		Flags:     mongo.ReplyFlagShardConfigStale,
+		CursorID:  0,
+		FirstDoc:  0,
+		ReplyDocs: 1,
+		Documents: doc,
+	}
+}
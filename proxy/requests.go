@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	gocontext "context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/lego/mongotunnel/util/context"
+	"github.com/lego/mongotunnel/util/log"
+	"github.com/lego/mongotunnel/util/trace"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Requests are tracked from when the client message is read until the
+// first reply to it is written, for metrics, tracing and logging.
+
+// trackedRequest - A request waiting for its reply.
+type trackedRequest struct {
+	id        int32
+	replied   bool
+	opcode    string
+	command   string
+	namespace string
+	target    string
+	start     time.Time
+	span      *trace.Span
+	// query and statements are kept to log slow queries.
+	query      bson.D
+	statements *context.StatementLog
+	// opid, session and cancel are the operation ID, the logical session
+	// and the cancellation of the request, for Connections and killOp.
+	opid    int64
+	session string
+	cancel  gocontext.CancelFunc
+}
+
+// requests - The requests of a connection waiting for their reply, by
+// request ID.
+type requests struct {
+	mu      sync.Mutex
+	pending map[int32]*trackedRequest
+	// session and identity are the latest logical session and the
+	// authenticated user of the connection, for Connections.
+	session  string
+	identity *context.Identity
+}
+
+// fieldLogger - The logger of the connection, when it takes fields.
+func (p *Proxy) fieldLogger() (log.FieldLogger, bool) {
+	logger, ok := p.ctx.Log.(log.FieldLogger)
+	return logger, ok
+}
+
+// tracksRequests - Whether anything needs requests tracked.
+func (p *Proxy) tracksRequests() bool {
+	_, logged := p.fieldLogger()
+	return p.Metrics != nil || p.Tracer != nil || p.SlowQueryThreshold > 0 || p.Connections != nil || logged
+}
+
+// withLogFields - A copy of ctx whose logger adds fields to its lines, or
+// ctx itself when its logger does not take fields.
+func withLogFields(ctx *context.Context, fields log.Fields) *context.Context {
+	logger, ok := ctx.Log.(log.FieldLogger)
+	if !ok {
+		return ctx
+	}
+	c := *ctx
+	c.Log = logger.WithFields(fields)
+	return &c
+}
+
+// startRequest - Begin tracking a client message. Messages without a reply
+// are done right away.
+func (p *Proxy) startRequest(msg *mongo.Message) {
+	if !p.tracksRequests() {
+		return
+	}
+	if p.Metrics != nil {
+		p.Metrics.bytes.Add(float64(msg.Head.TotalLen), "in")
+	}
+	req := &trackedRequest{
+		id:     msg.Head.ResponseID,
+		opcode: msg.Head.Opcode.String(),
+		target: TargetUpstream.String(),
+		start:  time.Now(),
+	}
+	if p.Connections != nil {
+		req.opid = p.Connections.opID()
+	}
+	if !inspectRequest(msg).expectsReply {
+		p.requestDone(req, nil)
+		return
+	}
+	p.requests.mu.Lock()
+	defer p.requests.mu.Unlock()
+	if p.requests.pending == nil {
+		p.requests.pending = make(map[int32]*trackedRequest)
+	}
+	p.requests.pending[msg.Head.ResponseID] = req
+}
+
+// annotateRequest - Record the namespace and command of a request or the
+// target that answers it. Empty values are left as they are.
+func (p *Proxy) annotateRequest(requestID int32, namespace, command, target string) {
+	if !p.tracksRequests() {
+		return
+	}
+	p.requests.mu.Lock()
+	defer p.requests.mu.Unlock()
+	req, ok := p.requests.pending[requestID]
+	if !ok {
+		return
+	}
+	if namespace != "" {
+		req.namespace = namespace
+	}
+	if command != "" {
+		req.command = command
+	}
+	if target != "" {
+		req.target = target
+		req.span.SetAttribute("mongotunnel.route", target)
+	}
+}
+
+// finishRequest - Complete the request a reply written to the client
+// answers.
+func (p *Proxy) finishRequest(msg *mongo.Message, n int64) {
+	if !p.tracksRequests() {
+		return
+	}
+	if p.Metrics != nil {
+		p.Metrics.bytes.Add(float64(n), "out")
+	}
+
+	var cmdErr *mongo.CommandError
+	if msg.Head.Opcode == mongo.Opcode_REPLY {
+		replyOp := mongo.ReplyOp{}
+		if err := replyOp.ReadFromBuffer(msg.BodyBuffer()); err == nil {
+			cmdErr = replyError(replyOp.Documents)
+		}
+	}
+	if cmdErr != nil && p.Metrics != nil {
+		p.Metrics.errors.Inc(strconv.Itoa(int(cmdErr.Code)), cmdErr.Code.String())
+	}
+
+	p.requests.mu.Lock()
+	req, ok := p.requests.pending[msg.Head.ResponseTo]
+	delete(p.requests.pending, msg.Head.ResponseTo)
+	p.requests.mu.Unlock()
+	if !ok {
+		// Later replies of an exhaust cursor.
+		return
+	}
+	req.replied = true
+	p.requestDone(req, cmdErr)
+}
+
+// requestDone - Measure, trace and log a finished request.
+func (p *Proxy) requestDone(req *trackedRequest, cmdErr *mongo.CommandError) {
+	duration := time.Since(req.start)
+	if cmdErr != nil {
+		req.span.SetAttribute("mongotunnel.error_code", int(cmdErr.Code))
+		req.span.SetError(cmdErr)
+	}
+	req.span.End()
+	if p.SlowQueryThreshold > 0 && duration >= p.SlowQueryThreshold && req.query != nil {
+		p.logSlowQuery(req, duration, cmdErr)
+	}
+	if p.Connections != nil {
+		p.Connections.countOp(req.opcode, req.command)
+	}
+	if p.Metrics != nil {
+		command := commandLabel(req.command)
+		p.Metrics.requests.Inc(req.opcode, command, req.target)
+		if req.replied {
+			p.Metrics.latency.Observe(duration.Seconds(), command, req.target)
+		}
+	}
+
+	logger, ok := p.fieldLogger()
+	if !ok {
+		return
+	}
+	fields := log.Fields{
+		"request_id":  req.id,
+		"opcode":      req.opcode,
+		"route":       req.target,
+		"duration_ms": float64(duration) / float64(time.Millisecond),
+	}
+	if req.command != "" {
+		fields["command"] = req.command
+	}
+	if req.namespace != "" {
+		fields["ns"] = req.namespace
+	}
+	if cmdErr != nil {
+		fields["error"] = cmdErr.Message
+		fields["code"] = int(cmdErr.Code)
+		fields["code_name"] = cmdErr.Code.String()
+	}
+	logger.WithFields(fields).Info("request")
+}
+
+// replyError - The error of a failed command reply.
+func replyError(doc bson.D) *mongo.CommandError {
+	m := doc.Map()
+	ok, present := m["ok"]
+	if !present || truthy(ok) {
+		return nil
+	}
+	code, _ := toInt64(m["code"])
+	message, _ := m["errmsg"].(string)
+	return &mongo.CommandError{Code: mongo.ErrorCode(code), Message: message}
+}
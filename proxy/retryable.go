@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/lego/mongotunnel/util/context"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Drivers retry a write once after a network error, with the same lsid and
+// txnNumber. A retryable write runs in an SQL transaction of its own, which
+// also records its reply for the session in retryableWritesTable. A retry
+// of a write that committed gets the recorded reply and does not write
+// again. Like MongoDB, only the latest txnNumber of a session is kept, and
+// records expire along with sessions.
+
+// metadataDatabase - The database of the translator's own tables.
+const metadataDatabase = internalPrefix + "system"
+
+// retryableWritesTable - The table recording the replies of retryable
+// writes.
+const retryableWritesTable = "retryable_writes"
+
+// isRetryableWrite - Whether a command is deduplicated when it carries a
+// txnNumber.
+func isRetryableWrite(command string) bool {
+	switch command {
+	case "insert", "update", "delete":
+		return true
+	}
+	return false
+}
+
+// retryableWrite - Run a write once per txnNumber of its session, answering
+// retries with the reply of the write.
+func (p *Proxy) retryableWrite(ctx *context.Context, query mongo.QueryOp, fields transactionFields) (mongo.Op, error) {
+	if err := p.Sessions.createWritesTable(ctx); err != nil {
+		return nil, err
+	}
+	tx, err := ctx.DB.BeginTx(ctx.RequestContext(), nil)
+	if err != nil {
+		return nil, err
+	}
+	txCtx := *ctx
+	txCtx.Tx = tx
+
+	reply, err := recordedWrite(&txCtx, fields)
+	if err != nil || reply != nil {
+		tx.Rollback()
+		return reply, err
+	}
+	reply, err = handleStatement(&txCtx, query)
+	if err == nil {
+		err = recordWrite(&txCtx, fields, reply)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		// A retry running at the same time may have committed first.
+		if recorded, _ := recordedWrite(ctx, fields); recorded != nil {
+			return recorded, nil
+		}
+		return nil, err
+	}
+	return reply, nil
+}
+
+// createWritesTable - Create retryableWritesTable the first time it is
+// needed.
+func (s *Sessions) createWritesTable(ctx *context.Context) error {
+	s.mu.Lock()
+	created := s.writesTable
+	s.mu.Unlock()
+	if created {
+		return nil
+	}
+
+	if err := createDatabase(ctx, metadataDatabase); err != nil {
+		return err
+	}
+	statement := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s.%s (`+
+		`session TEXT PRIMARY KEY, txn_number INT8 NOT NULL, reply BYTES NOT NULL`+
+		`) WITH (ttl_expire_after = '%d minutes')`,
+		quoteIdent(metadataDatabase), quoteIdent(retryableWritesTable), logicalSessionTimeoutMinutes)
+	ctx.Log.Debug("sql=%s", statement)
+	if _, err := ctx.DB.ExecContext(ctx.RequestContext(), statement); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.writesTable = true
+	s.mu.Unlock()
+	return nil
+}
+
+// recordedWrite - The reply of the write with the txnNumber of a command,
+// or nil if the write has not run yet.
+func recordedWrite(ctx *context.Context, fields transactionFields) (mongo.Op, error) {
+	statement := fmt.Sprintf("SELECT txn_number, reply FROM %s.%s WHERE session = $1", quoteIdent(metadataDatabase), quoteIdent(retryableWritesTable))
+	ctx.Log.Debug("sql=%s args=[%s]", statement, fields.session)
+	var txnNumber int64
+	var data []byte
+	err := ctx.SQL().QueryRow(statement, fields.session).Scan(&txnNumber, &data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case txnNumber > fields.txnNumber:
+		return nil, mongo.NewCommandError(mongo.ErrorCodeTransactionTooOld, "txnNumber %d is less than last txnNumber %d seen in session", fields.txnNumber, txnNumber)
+	case txnNumber < fields.txnNumber:
+		return nil, nil
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	ctx.Log.Debug("answering retry of txnNumber %d of session %s from its recorded reply", txnNumber, fields.session)
+	return newReply(doc), nil
+}
+
+// recordWrite - Record the reply of a write, replacing the record of the
+// previous write of the session.
+func recordWrite(ctx *context.Context, fields transactionFields, reply mongo.Op) error {
+	replyOp, ok := reply.(*mongo.ReplyOp)
+	if !ok {
+		return errors.Errorf("cannot record a reply of type %T", reply)
+	}
+	data, err := bson.Marshal(replyOp.Documents)
+	if err != nil {
+		return err
+	}
+	statement := fmt.Sprintf("UPSERT INTO %s.%s (session, txn_number, reply) VALUES ($1, $2, $3)", quoteIdent(metadataDatabase), quoteIdent(retryableWritesTable))
+	ctx.Log.Debug("sql=%s args=[%s %d]", statement, fields.session, fields.txnNumber)
+	_, err = ctx.SQL().Exec(statement, fields.session, fields.txnNumber, data)
+	return err
+}
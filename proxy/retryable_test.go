@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/lego/mongotunnel/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestRetryableWrite(t *testing.T) {
+	recordedReply, err := bson.Marshal(bson.D{bson.DocElem{"n", 1}, bson.DocElem{"recorded", true}, bson.DocElem{"ok", 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		txnNumber int64
+		// recorded is the txnNumber recorded for the session, or 0 for
+		// none.
+		recorded int64
+		// code is the error code of the write, answered is set when the
+		// recorded reply answers it, and writes when it runs.
+		code     mongo.ErrorCode
+		answered bool
+		writes   bool
+	}{
+		{name: "first write", txnNumber: 1, writes: true},
+		{name: "next write", txnNumber: 2, recorded: 1, writes: true},
+		{name: "retry", txnNumber: 2, recorded: 2, answered: true},
+		{name: "older", txnNumber: 1, recorded: 2, code: mongo.ErrorCodeTransactionTooOld},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &scriptedDriver{answer: func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+				if strings.HasPrefix(query, "SELECT txn_number, reply") {
+					if test.recorded == 0 {
+						return []string{"txn_number", "reply"}, nil, nil
+					}
+					return []string{"txn_number", "reply"}, [][]driver.Value{{test.recorded, recordedReply}}, nil
+				}
+				return []string{"_id"}, nil, nil
+			}}
+			ctx := newSQLContext(d.open(t))
+			p := &Proxy{Sessions: NewSessions()}
+			defer p.Sessions.Close()
+			fields := transactionFields{session: "s", txnNumber: test.txnNumber, retryable: true}
+			reply, err := p.retryableWrite(ctx, mongo.QueryOp{
+				Collection: "db.$cmd",
+				Query: bson.D{
+					bson.DocElem{"insert", "items"},
+					bson.DocElem{"documents", []interface{}{bson.D{bson.DocElem{"_id", 1}}}},
+				},
+			}, fields)
+			if test.code != 0 {
+				if commandErrorCode(err) != test.code {
+					t.Fatalf("got %v, want code %d", err, test.code)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			var inserted, recorded bool
+			for _, statement := range d.ran() {
+				inserted = inserted || strings.HasPrefix(statement, `INSERT INTO "db"."items"`)
+				recorded = recorded || strings.HasPrefix(statement, "UPSERT INTO")
+			}
+			if inserted != test.writes || recorded != test.writes {
+				t.Errorf("inserted %t and recorded %t, want %t", inserted, recorded, test.writes)
+			}
+			commits, rollbacks := d.ended()
+			if test.writes && (commits != 1 || rollbacks != 0) || !test.writes && (commits != 0 || rollbacks != 1) {
+				t.Errorf("committed %d and rolled back %d transactions", commits, rollbacks)
+			}
+			if test.answered && reply.(*mongo.ReplyOp).Documents.Map()["recorded"] != true {
+				t.Errorf("the retry got %v, not the recorded reply", reply.(*mongo.ReplyOp).Documents)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/lego/mongotunnel/util/context"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Target - Where a request is answered.
+type Target int
+
+const (
+	// TargetUpstream forwards to the remote MongoDB.
+	TargetUpstream Target = iota
+	// TargetSQL answers from CockroachDB through the translator.
+	TargetSQL
+	// TargetBoth forwards to the remote MongoDB and shadows the request to
+	// CockroachDB, see ShadowReporter.
+	TargetBoth
+)
+
+func (t Target) String() string {
+	switch t {
+	case TargetUpstream:
+		return "upstream"
+	case TargetSQL:
+		return "sql"
+	case TargetBoth:
+		return "both"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseTarget - Parse "upstream", "sql" or "both".
+func ParseTarget(s string) (Target, error) {
+	switch strings.ToLower(s) {
+	case "upstream", "mongo", "mongodb":
+		return TargetUpstream, nil
+	case "sql", "crdb", "cockroach":
+		return TargetSQL, nil
+	case "both", "shadow":
+		return TargetBoth, nil
+	}
+	return TargetUpstream, errors.Errorf("unknown route target %q", s)
+}
+
+// Rule - Routes the requests whose database, collection and command match.
+// Each field is a path.Match pattern, and an empty field matches anything.
+type Rule struct {
+	Database   string
+	Collection string
+	Command    string
+	Target     Target
+}
+
+func (r Rule) matches(database, collection, command string) bool {
+	return matchPattern(r.Database, database) &&
+		matchPattern(r.Collection, collection) &&
+		matchPattern(r.Command, command)
+}
+
+func matchPattern(pattern, s string) bool {
+	if pattern == "" || pattern == "*" {
+		return true
+	}
+	ok, err := path.Match(pattern, s)
+	return err == nil && ok
+}
+
+func (r Rule) String() string {
+	s := orStar(r.Database) + "." + orStar(r.Collection)
+	if r.Command != "" {
+		s += ":" + r.Command
+	}
+	return s + "=" + r.Target.String()
+}
+
+func orStar(s string) string {
+	if s == "" {
+		return "*"
+	}
+	return s
+}
+
+// ParseRule - Parse a rule in the form `database.collection[:command]=target`,
+// for example `shop.orders=sql` or `shop.*:find=both`. The collection is
+// everything after the first dot, so `db.system.users` works.
+func ParseRule(s string) (Rule, error) {
+	var rule Rule
+	eq := strings.LastIndex(s, "=")
+	if eq < 0 {
+		return rule, errors.Errorf("route %q is missing =target", s)
+	}
+	target, err := ParseTarget(strings.TrimSpace(s[eq+1:]))
+	if err != nil {
+		return rule, err
+	}
+	rule.Target = target
+
+	match := strings.TrimSpace(s[:eq])
+	if colon := strings.LastIndex(match, ":"); colon >= 0 {
+		rule.Command = match[colon+1:]
+		match = match[:colon]
+	}
+	if dot := strings.Index(match, "."); dot >= 0 {
+		rule.Database, rule.Collection = match[:dot], match[dot+1:]
+	} else {
+		rule.Database = match
+	}
+	for _, pattern := range []string{rule.Database, rule.Collection, rule.Command} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return rule, errors.Wrapf(err, "invalid pattern in route %q", s)
+		}
+	}
+	return rule, nil
+}
+
+// ParseRules - Parse comma or newline separated rules. Blank lines and
+// lines starting with # are skipped, so the same syntax works for a file.
+func ParseRules(spec string) ([]Rule, error) {
+	var rules []Rule
+	scanner := bufio.NewScanner(strings.NewReader(spec))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, part := range strings.Split(line, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			rule, err := ParseRule(part)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, rule)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// ReadRules - ParseRules on the contents of r.
+func ReadRules(r io.Reader) ([]Rule, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRules(string(b))
+}
+
+// Router - Picks the Target for each request from the first matching Rule,
+// falling back to Default.
+type Router struct {
+	Rules   []Rule
+	Default Target
+	// Translatable sends requests routed to TargetSQL that the translator
+	// cannot answer to the remote instead.
+	Translatable bool
+}
+
+// DefaultRouter - The routing the proxy has always done: find commands
+// outside of admin go to CockroachDB and everything else, legacy queries
+// included, to the remote.
+func DefaultRouter() *Router {
+	return &Router{
+		Rules:        []Rule{{Command: "find", Target: TargetSQL}},
+		Default:      TargetUpstream,
+		Translatable: true,
+	}
+}
+
+// Route - The target for a command on database.collection.
+func (r *Router) Route(database, collection, command string) Target {
+	for _, rule := range r.Rules {
+		if rule.matches(database, collection, command) {
+			return rule.Target
+		}
+	}
+	return r.Default
+}
+
+// RouteQuery - The target for a query, by the namespace and command of
+// commandNamespace.
+func (r *Router) RouteQuery(ctx *context.Context, query mongo.QueryOp) Target {
+	target := r.Route(commandNamespace(query))
+	if target == TargetSQL && r.Translatable && !isQuery(ctx, query) {
+		return TargetUpstream
+	}
+	return target
+}
+
+// UsesTarget - Whether any request could be routed to t.
+func (r *Router) UsesTarget(t Target) bool {
+	if r.Default == t {
+		return true
+	}
+	for _, rule := range r.Rules {
+		if rule.Target == t {
+			return true
+		}
+	}
+	return false
+}
+
+// commandNamespace - The database, collection and command of a query. Most
+// commands name their collection as the value of the command itself, while
+// getMore carries it separately and explain takes it from the command it
+// explains. Commands without a collection, such as ping, return an empty
+// collection.
+func commandNamespace(query mongo.QueryOp) (database, collection, command string) {
+	database = strings.SplitN(query.Collection, ".", 2)[0]
+	if !strings.HasSuffix(query.Collection, ".$cmd") {
+		// A legacy query directly on a collection.
+		return database, strings.TrimPrefix(query.Collection, database+"."), "find"
+	}
+	if len(query.Query) == 0 {
+		return database, "", ""
+	}
+	command = query.Query[0].Name
+	switch command {
+	case "getMore":
+		collection, _ = query.Query.Map()["collection"].(string)
+	case "explain":
+		if explained, ok := query.Query[0].Value.(bson.D); ok && len(explained) > 0 {
+			collection, _ = explained[0].Value.(string)
+		}
+	default:
+		collection, _ = query.Query[0].Value.(string)
+	}
+	return database, collection, command
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/lego/mongotunnel/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		spec string
+		want Rule
+	}{
+		{"shop.orders=sql", Rule{Database: "shop", Collection: "orders", Target: TargetSQL}},
+		{"shop.*:find=both", Rule{Database: "shop", Collection: "*", Command: "find", Target: TargetBoth}},
+		{"db.system.users=upstream", Rule{Database: "db", Collection: "system.users", Target: TargetUpstream}},
+		{"analytics=crdb", Rule{Database: "analytics", Target: TargetSQL}},
+		{" shop.orders = mongo ", Rule{Database: "shop", Collection: "orders", Target: TargetUpstream}},
+	}
+	for _, test := range tests {
+		rule, err := ParseRule(test.spec)
+		if err != nil {
+			t.Errorf("ParseRule(%q): %v", test.spec, err)
+			continue
+		}
+		if rule != test.want {
+			t.Errorf("ParseRule(%q) = %+v, want %+v", test.spec, rule, test.want)
+		}
+	}
+
+	for _, spec := range []string{"shop.orders", "shop.orders=nowhere", "shop.[=sql"} {
+		if _, err := ParseRule(spec); err == nil {
+			t.Errorf("ParseRule(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("# reports stay\nshop.reports=upstream\n\nshop.*=sql, analytics.*:find=both\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"shop.reports=upstream", "shop.*=sql", "analytics.*:find=both"}
+	if len(rules) != len(want) {
+		t.Fatalf("got %d rules, want %d", len(rules), len(want))
+	}
+	for i, rule := range rules {
+		if rule.String() != want[i] {
+			t.Errorf("rule %d = %s, want %s", i, rule, want[i])
+		}
+	}
+}
+
+func TestRoute(t *testing.T) {
+	router := &Router{
+		Rules: []Rule{
+			{Database: "shop", Collection: "reports", Target: TargetUpstream},
+			{Database: "shop", Collection: "*", Target: TargetSQL},
+			{Database: "analytics", Command: "find", Target: TargetBoth},
+		},
+		Default: TargetUpstream,
+	}
+	tests := []struct {
+		database, collection, command string
+		want                          Target
+	}{
+		{"shop", "reports", "find", TargetUpstream},
+		{"shop", "orders", "insert", TargetSQL},
+		{"analytics", "events", "find", TargetBoth},
+		{"analytics", "events", "aggregate", TargetUpstream},
+		{"other", "things", "find", TargetUpstream},
+	}
+	for _, test := range tests {
+		if got := router.Route(test.database, test.collection, test.command); got != test.want {
+			t.Errorf("Route(%s, %s, %s) = %s, want %s", test.database, test.collection, test.command, got, test.want)
+		}
+	}
+}
+
+func TestCommandNamespace(t *testing.T) {
+	tests := []struct {
+		query                         mongo.QueryOp
+		database, collection, command string
+	}{
+		{
+			mongo.QueryOp{Collection: "shop.$cmd", Query: bson.D{bson.DocElem{"find", "orders"}}},
+			"shop", "orders", "find",
+		},
+		{
+			mongo.QueryOp{Collection: "shop.orders", Query: bson.D{bson.DocElem{"status", "A"}}},
+			"shop", "orders", "find",
+		},
+		{
+			mongo.QueryOp{Collection: "db.system.users", Query: bson.D{}},
+			"db", "system.users", "find",
+		},
+		{
+			mongo.QueryOp{Collection: "shop.$cmd", Query: bson.D{bson.DocElem{"getMore", int64(42)}, bson.DocElem{"collection", "orders"}}},
+			"shop", "orders", "getMore",
+		},
+		{
+			mongo.QueryOp{Collection: "shop.$cmd", Query: bson.D{bson.DocElem{"explain", bson.D{bson.DocElem{"count", "orders"}}}}},
+			"shop", "orders", "explain",
+		},
+		{
+			mongo.QueryOp{Collection: "admin.$cmd", Query: bson.D{bson.DocElem{"ping", 1}}},
+			"admin", "", "ping",
+		},
+		{
+			mongo.QueryOp{Collection: "admin.$cmd"},
+			"admin", "", "",
+		},
+	}
+	for _, test := range tests {
+		database, collection, command := commandNamespace(test.query)
+		if database != test.database || collection != test.collection || command != test.command {
+			t.Errorf("commandNamespace(%s %v) = %s, %s, %s, want %s, %s, %s", test.query.Collection, test.query.Query,
+				database, collection, command, test.database, test.collection, test.command)
+		}
+	}
+}
+
+func TestRouteQuery(t *testing.T) {
+	translateAll := &Router{Default: TargetSQL}
+	tests := []struct {
+		name   string
+		router *Router
+		query  mongo.QueryOp
+		want   Target
+	}{
+		{
+			"find command",
+			DefaultRouter(),
+			mongo.QueryOp{Collection: "shop.$cmd", Query: bson.D{bson.DocElem{"find", "orders"}}},
+			TargetSQL,
+		},
+		{
+			"legacy query on a collection",
+			DefaultRouter(),
+			mongo.QueryOp{Collection: "shop.orders", Query: bson.D{bson.DocElem{"status", "A"}}},
+			TargetUpstream,
+		},
+		{
+			"find on admin",
+			DefaultRouter(),
+			mongo.QueryOp{Collection: "admin.$cmd", Query: bson.D{bson.DocElem{"find", "system.users"}}},
+			TargetUpstream,
+		},
+		{
+			"insert",
+			DefaultRouter(),
+			mongo.QueryOp{Collection: "shop.$cmd", Query: bson.D{bson.DocElem{"insert", "orders"}}},
+			TargetUpstream,
+		},
+		{
+			"legacy query routed to sql by a rule",
+			translateAll,
+			mongo.QueryOp{Collection: "shop.orders", Query: bson.D{bson.DocElem{"status", "A"}}},
+			TargetSQL,
+		},
+		{
+			"admin command routed to sql by a rule",
+			translateAll,
+			mongo.QueryOp{Collection: "admin.$cmd", Query: bson.D{bson.DocElem{"listDatabases", 1}}},
+			TargetSQL,
+		},
+	}
+	for _, test := range tests {
+		if got := test.router.RouteQuery(nil, test.query); got != test.want {
+			t.Errorf("%s: RouteQuery = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package proxy
+
+import (
+	gocontext "context"
+	"crypto/rand"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/lego/mongotunnel/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Drivers attach a logical session (lsid) to their commands, and end it with
+// endSessions. Translated commands of a session share its transactions and
+// cursors, which end with it. Sessions that stay idle for
+// logicalSessionTimeoutMinutes end on their own, as on MongoDB, swept every
+// sweepInterval from the first session or cursor on until Close.
+
+// logicalSessionTimeoutMinutes - How long a session may stay idle, as
+// advertised to drivers in ismaster.
+const logicalSessionTimeoutMinutes = 30
+
+// defaultCursorTimeout - How long a cursor may stay idle, as MongoDB's
+// default cursorTimeoutMillis.
+const defaultCursorTimeout = 10 * time.Minute
+
+// sweepInterval - How often idle sessions, transactions and cursors are
+// looked for.
+const sweepInterval = time.Second
+
+// Sessions - The logical sessions of the translator, with their SQL
+// transactions and cursors. Drivers may use a session over different
+// connections, so it is shared by all of them.
+type Sessions struct {
+	// Timeout is how long a session may stay idle before it ends.
+	Timeout time.Duration
+	// TransactionLifetime is how long a transaction may stay open before it
+	// is aborted.
+	TransactionLifetime time.Duration
+	// CursorTimeout is how long a cursor may stay idle before it is closed.
+	CursorTimeout time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*session
+	cursors  map[int64]*cursor
+	sweeper  sync.Once
+	// closed is closed by Close, which stops the sweeper.
+	closed    chan struct{}
+	closeOnce sync.Once
+	// writesTable is set once retryableWritesTable exists.
+	writesTable bool
+}
+
+// session - A logical session.
+type session struct {
+	lastUse time.Time
+	// done is canceled once the session ends, which rolls back its
+	// transaction.
+	done       gocontext.Context
+	cancelDone gocontext.CancelFunc
+	// txn is the latest transaction of the session, if any.
+	txn     *sessionTransaction
+	cursors map[int64]bool
+}
+
+// NewSessions - Create an empty Sessions.
+func NewSessions() *Sessions {
+	return &Sessions{
+		Timeout:             logicalSessionTimeoutMinutes * time.Minute,
+		TransactionLifetime: defaultTransactionLifetime,
+		CursorTimeout:       defaultCursorTimeout,
+		sessions:            make(map[string]*session),
+		cursors:             make(map[int64]*cursor),
+		closed:              make(chan struct{}),
+	}
+}
+
+// Close - Stop sweeping and end every session, rolling back its
+// transaction, and close every cursor.
+func (s *Sessions) Close() {
+	s.closeOnce.Do(func() { close(s.closed) })
+	s.mu.Lock()
+	var txs []*sql.Tx
+	for key := range s.sessions {
+		if tx := s.end(key); tx != nil {
+			txs = append(txs, tx)
+		}
+	}
+	for id := range s.cursors {
+		s.closeCursor(id)
+	}
+	s.mu.Unlock()
+	rollbackAll(txs)
+}
+
+// use - Mark a session as used, starting it on first use.
+func (s *Sessions) use(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.touch(key)
+}
+
+// touch - The session with the key, marked as used. Callers hold mu.
+func (s *Sessions) touch(key string) *session {
+	s.startSweeper()
+	sess := s.sessions[key]
+	if sess == nil {
+		sess = &session{cursors: make(map[int64]bool)}
+		sess.done, sess.cancelDone = gocontext.WithCancel(gocontext.Background())
+		s.sessions[key] = sess
+	}
+	sess.lastUse = time.Now()
+	return sess
+}
+
+// startSweeper - Start sweeping, unless it has started. Callers hold mu.
+func (s *Sessions) startSweeper() {
+	s.sweeper.Do(func() {
+		go s.sweepEvery(sweepInterval)
+	})
+}
+
+// sweepEvery - Sweep at each interval until Close, rolling back the
+// transactions the sweep ends once mu is released.
+func (s *Sessions) sweepEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			txs := s.sweep(now)
+			s.mu.Unlock()
+			rollbackAll(txs)
+		}
+	}
+}
+
+// sweep - End idle sessions, abort transactions that outlived their
+// lifetime and close idle cursors. Returns the transactions to roll back.
+// Callers hold mu.
+func (s *Sessions) sweep(now time.Time) []*sql.Tx {
+	var txs []*sql.Tx
+	for key, sess := range s.sessions {
+		if now.Sub(sess.lastUse) > s.Timeout {
+			if tx := s.end(key); tx != nil {
+				txs = append(txs, tx)
+			}
+			continue
+		}
+		if txn := sess.txn; txn != nil && txn.tx != nil && now.Sub(txn.started) > s.TransactionLifetime {
+			txs = append(txs, txn.take())
+		}
+	}
+	for id, c := range s.cursors {
+		if !c.noTimeout && !c.waiting && now.Sub(c.lastUse) > s.CursorTimeout {
+			s.closeCursor(id)
+		}
+	}
+	return txs
+}
+
+// end - End a session, closing its cursors. Returns its transaction, which
+// the caller rolls back once it releases mu. Callers hold mu.
+func (s *Sessions) end(key string) *sql.Tx {
+	sess := s.sessions[key]
+	if sess == nil {
+		return nil
+	}
+	var tx *sql.Tx
+	if sess.txn != nil {
+		tx = sess.txn.take()
+	}
+	for id := range sess.cursors {
+		s.closeCursor(id)
+	}
+	delete(s.sessions, key)
+	sess.cancelDone()
+	return tx
+}
+
+// rollbackAll - Roll back transactions taken out of sessions.
+func rollbackAll(txs []*sql.Tx) {
+	for _, tx := range txs {
+		tx.Rollback()
+	}
+}
+
+// counts - How many sessions and cursors are open.
+func (s *Sessions) counts() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions), len(s.cursors)
+}
+
+// startSession - Answer startSession with a new random UUID session.
+func (s *Sessions) startSession() (mongo.Op, error) {
+	uuid := make([]byte, 16)
+	if _, err := rand.Read(uuid); err != nil {
+		return nil, err
+	}
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	lsid := bson.D{bson.DocElem{"id", bson.Binary{Kind: 0x04, Data: uuid}}}
+
+	s.use(sessionKey(lsid))
+	return newReply(bson.D{
+		bson.DocElem{"id", lsid},
+		bson.DocElem{"timeoutMinutes", logicalSessionTimeoutMinutes},
+		bson.DocElem{"ok", 1},
+	}), nil
+}
+
+// updateSessions - Apply endSessions, killSessions or refreshSessions to
+// the sessions they list.
+func (s *Sessions) updateSessions(command string, query bson.D) error {
+	lsids, ok := query[0].Value.([]interface{})
+	if !ok {
+		return mongo.NewCommandError(mongo.ErrorCodeBadValue, "%s must be an array of sessions", command)
+	}
+	var txs []*sql.Tx
+	defer func() {
+		rollbackAll(txs)
+	}()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, lsid := range lsids {
+		doc, ok := lsid.(bson.D)
+		if !ok {
+			return mongo.NewCommandError(mongo.ErrorCodeBadValue, "%s must be an array of sessions", command)
+		}
+		key := sessionKey(doc)
+		if command == "refreshSessions" {
+			if s.sessions[key] != nil {
+				s.touch(key)
+			}
+			continue
+		}
+		if tx := s.end(key); tx != nil {
+			txs = append(txs, tx)
+		}
+	}
+	return nil
+}
+
+// handleSessions - Answer endSessions, killSessions or refreshSessions.
+func (s *Sessions) handleSessions(command string, query bson.D) (mongo.Op, error) {
+	if err := s.updateSessions(command, query); err != nil {
+		return nil, err
+	}
+	return newReply(bson.D{bson.DocElem{"ok", 1}}), nil
+}
+
+// isSessionCommand - Whether a command manages sessions.
+func isSessionCommand(command string) bool {
+	switch command {
+	case "startSession", "endSessions", "killSessions", "refreshSessions":
+		return true
+	}
+	return false
+}
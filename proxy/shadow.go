@@ -0,0 +1,467 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/lego/mongotunnel/util/context"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Shadow mode sends translatable requests to both the remote MongoDB and the
+// CockroachDB translator. The client always gets the MongoDB reply, and the
+// translated reply is compared against it in the background. Writes are
+// mirrored too, so that CockroachDB holds the same data as the remote, and
+// the translated statements of a connection run one after the other so that
+// they see its earlier writes. Reads run alongside the remote, while
+// anything else is only mirrored once the remote reports that it succeeded.
+// Mirrored requests run in the transactions of their sessions and retryable
+// writes run once per txnNumber, as when they are routed to CockroachDB, and
+// commitTransaction and abortTransaction end the mirrored transactions along
+// with those of the remote.
+
+// ShadowReport - One line of the shadow report, written for every request
+// where the translated reply differs from the MongoDB reply.
+type ShadowReport struct {
+	Time        time.Time   `json:"time"`
+	Conn        uint64      `json:"conn"`
+	RequestID   int32       `json:"requestId"`
+	Namespace   string      `json:"ns"`
+	Command     string      `json:"command"`
+	Query       interface{} `json:"query"`
+	Kind        string      `json:"kind"`
+	Error       string      `json:"error,omitempty"`
+	Differences []string    `json:"differences,omitempty"`
+	Mongo       interface{} `json:"mongo"`
+	SQL         interface{} `json:"sql,omitempty"`
+	MongoMillis float64     `json:"mongoMillis"`
+	SQLMillis   float64     `json:"sqlMillis"`
+}
+
+const (
+	shadowKindMismatch = "mismatch"
+	shadowKindSQLError = "sqlError"
+)
+
+// ShadowReporter - Writes ShadowReports as JSON lines and counts outcomes.
+// It is shared by all connections.
+type ShadowReporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+
+	matched    uint64
+	mismatched uint64
+	errored    uint64
+}
+
+// NewShadowReporter - Create a ShadowReporter writing to w.
+func NewShadowReporter(w io.Writer) *ShadowReporter {
+	return &ShadowReporter{enc: json.NewEncoder(w)}
+}
+
+// Stats - The number of compared requests that matched, differed, or
+// failed on the SQL side.
+func (r *ShadowReporter) Stats() (matched, mismatched, errored uint64) {
+	return atomic.LoadUint64(&r.matched), atomic.LoadUint64(&r.mismatched), atomic.LoadUint64(&r.errored)
+}
+
+func (r *ShadowReporter) match() {
+	atomic.AddUint64(&r.matched, 1)
+}
+
+// Report - Record a failed comparison.
+func (r *ShadowReporter) Report(report *ShadowReport) error {
+	if report.Kind == shadowKindSQLError {
+		atomic.AddUint64(&r.errored, 1)
+	} else {
+		atomic.AddUint64(&r.mismatched, 1)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.enc.Encode(report)
+}
+
+type shadowResult struct {
+	reply    mongo.Op
+	err      error
+	duration time.Duration
+	// skipped is set when the remote did not run the request, so neither
+	// did CockroachDB.
+	skipped bool
+}
+
+// shadowReads - The commands mirrored without waiting for the remote, since
+// they change nothing.
+var shadowReads = map[string]bool{
+	"find":            true,
+	"aggregate":       true,
+	"count":           true,
+	"distinct":        true,
+	"explain":         true,
+	"listCollections": true,
+	"listIndexes":     true,
+	"listDatabases":   true,
+}
+
+// shadowQuery - Forward msg to the remote and run the same query through
+// the translator, comparing once both have answered. Reads run
+// concurrently, while other commands wait for the remote to succeed.
+func (p *Proxy) shadowQuery(ctx *context.Context, msg *mongo.Message, query mongo.QueryOp) {
+	// The statement may outlive the request, which the remote answers, but
+	// not the connection.
+	shadowCtx := *ctx
+	shadowCtx.Request = p.done
+	_, _, command := commandNamespace(query)
+	read := shadowReads[command]
+	remote := make(chan *mongo.Message, 1)
+	sqlResult := make(chan shadowResult, 1)
+	previous, done := p.shadowed, make(chan struct{})
+	p.shadowed = done
+	go func() {
+		defer close(done)
+		if previous != nil {
+			select {
+			case <-previous:
+			case <-p.done.Done():
+			}
+		}
+		if !read {
+			var reply *mongo.Message
+			select {
+			case reply = <-remote:
+			case <-p.done.Done():
+			}
+			if !p.remoteSucceeded(&shadowCtx, command, reply) {
+				if fields := readTransactionFields(query.Query); fields.inTransaction {
+					// The remote aborts its transaction when a command
+					// in it fails.
+					p.Sessions.fail(fields)
+				}
+				sqlResult <- shadowResult{skipped: true}
+				return
+			}
+		}
+		start := time.Now()
+		reply, err := p.shadowStatement(&shadowCtx, query)
+		sqlResult <- shadowResult{reply, err, time.Since(start), false}
+	}()
+
+	start := time.Now()
+	p.forwardWithReply(msg, func(reply *mongo.Message, err error) {
+		mongoDuration := time.Since(start)
+		p.relay(reply, err)
+		select {
+		case remote <- reply:
+		default:
+			// Later replies of an exhaust cursor.
+		}
+		if err != nil {
+			return
+		}
+		// Waiting on the translator here would hold up the connection the
+		// reply came from.
+		go func() {
+			result := <-sqlResult
+			if result.skipped {
+				return
+			}
+			p.compareShadow(msg.Head.ResponseID, query, reply, mongoDuration, result)
+		}()
+	})
+}
+
+// shadowStatement - Run a shadowed query as handleSQL would, but return its
+// whole result rather than opening a cursor, since getMore goes to the
+// cursor of the remote.
+func (p *Proxy) shadowStatement(ctx *context.Context, query mongo.QueryOp) (mongo.Op, error) {
+	fields := readTransactionFields(query.Query)
+	switch query.Query[0].Name {
+	case "commitTransaction":
+		return p.Sessions.commit(fields)
+	case "abortTransaction":
+		return p.Sessions.abort(fields)
+	}
+	return p.sessionStatement(ctx, query, fields)
+}
+
+// remoteSucceeded - Whether the remote reply to a command that is not a
+// read reports that it ran. A nil reply is that of a failed connection.
+// abortTransaction always counts as run, since the transaction is over
+// either way.
+func (p *Proxy) remoteSucceeded(ctx *context.Context, command string, reply *mongo.Message) bool {
+	if command == "abortTransaction" {
+		return true
+	}
+	if reply == nil {
+		ctx.Log.Debug("shadow: not mirroring %s, the remote did not answer", command)
+		return false
+	}
+	replyOp := mongo.ReplyOp{}
+	if err := replyOp.ReadFromBuffer(reply.BodyBuffer()); err != nil {
+		ctx.Log.Warn("shadow: not mirroring %s, failed to read the remote reply: %+v", command, err)
+		return false
+	}
+	doc := replyOp.Documents.Map()
+	if !truthy(doc["ok"]) {
+		ctx.Log.Debug("shadow: not mirroring %s, the remote failed it", command)
+		return false
+	}
+	if writeErrors, ok := doc["writeErrors"].([]interface{}); ok && len(writeErrors) > 0 {
+		if n, _ := toInt64(doc["n"]); n > 0 {
+			ctx.Log.Warn("shadow: not mirroring %s, the remote wrote %d documents but rejected others, so CockroachDB drifts apart", command, n)
+		} else {
+			ctx.Log.Debug("shadow: not mirroring %s, the remote rejected it", command)
+		}
+		return false
+	}
+	return true
+}
+
+func (p *Proxy) compareShadow(requestID int32, query mongo.QueryOp, reply *mongo.Message, mongoDuration time.Duration, result shadowResult) {
+	mongoReply := mongo.ReplyOp{}
+	if err := mongoReply.ReadFromBuffer(reply.BodyBuffer()); err != nil {
+		p.ctx.Log.Warn("shadow: failed to read MongoDB reply: %+v", err)
+		return
+	}
+
+	report := &ShadowReport{
+		Time:        time.Now(),
+		Conn:        p.ctx.ConnID,
+		RequestID:   requestID,
+		Namespace:   shadowNamespace(query),
+		Command:     query.Query[0].Name,
+		Query:       jsonValue(query.Query),
+		Mongo:       jsonValue(mongoReply.Documents),
+		MongoMillis: mongoDuration.Seconds() * 1000,
+		SQLMillis:   result.duration.Seconds() * 1000,
+	}
+
+	sqlReply, isReply := result.reply.(*mongo.ReplyOp)
+	switch {
+	case result.err != nil:
+		report.Kind = shadowKindSQLError
+		report.Error = result.err.Error()
+	case !isReply:
+		p.ctx.Log.Warn("shadow: translator answered %s with %T instead of a reply", report.Command, result.reply)
+		report.Kind = shadowKindMismatch
+		report.Differences = []string{fmt.Sprintf("reply: %T", result.reply)}
+	default:
+		sqlDoc := sqlReply.Documents
+		report.Differences = compareReplies(mongoReply.Documents, sqlDoc, orderedQuery(query.Query))
+		if len(report.Differences) == 0 {
+			p.Shadow.match()
+			return
+		}
+		report.Kind = shadowKindMismatch
+		report.SQL = jsonValue(sqlDoc)
+	}
+
+	p.ctx.Log.Debug("shadow: %s on %s: %s %v", report.Kind, report.Namespace, report.Error, report.Differences)
+	if err := p.Shadow.Report(report); err != nil {
+		p.ctx.Log.Warn("shadow: failed to write report: %+v", err)
+	}
+}
+
+func shadowNamespace(query mongo.QueryOp) string {
+	database := strings.TrimSuffix(query.Collection, ".$cmd")
+	return fmt.Sprintf("%s.%v", database, query.Query[0].Value)
+}
+
+// compareReplies - List the differences between two command replies. Only
+// `ok` and the returned documents are compared, since cursor IDs never
+// match. Without a sort the documents are compared as a multiset.
+func compareReplies(mongoDoc, sqlDoc bson.D, ordered bool) []string {
+	var diffs []string
+	mongoMap, sqlMap := mongoDoc.Map(), sqlDoc.Map()
+	if !equalValues(mongoMap["ok"], sqlMap["ok"]) {
+		diffs = append(diffs, fmt.Sprintf("ok: %v != %v", mongoMap["ok"], sqlMap["ok"]))
+	}
+
+	mongoBatch, mongoCursorID := cursorBatch(mongoMap)
+	sqlBatch, _ := cursorBatch(sqlMap)
+	// A still open MongoDB cursor means its batch is only a prefix of the
+	// result.
+	partial := mongoCursorID != 0
+
+	if ordered {
+		n := len(mongoBatch)
+		if !partial && len(sqlBatch) != n {
+			diffs = append(diffs, fmt.Sprintf("documents: %d != %d", n, len(sqlBatch)))
+		}
+		if len(sqlBatch) < n {
+			n = len(sqlBatch)
+		}
+		for i := 0; i < n; i++ {
+			if !equalValues(mongoBatch[i], sqlBatch[i]) {
+				diffs = append(diffs, fmt.Sprintf("documents[%d]: %s != %s", i, fingerprint(mongoBatch[i]), fingerprint(sqlBatch[i])))
+			}
+		}
+		return diffs
+	}
+
+	remaining := make(map[string]int)
+	for _, doc := range sqlBatch {
+		remaining[fingerprint(doc)]++
+	}
+	for _, doc := range mongoBatch {
+		key := fingerprint(doc)
+		if remaining[key] == 0 {
+			diffs = append(diffs, fmt.Sprintf("missing from SQL: %s", key))
+			continue
+		}
+		remaining[key]--
+	}
+	if !partial {
+		var extra []string
+		for key, n := range remaining {
+			for ; n > 0; n-- {
+				extra = append(extra, fmt.Sprintf("extra in SQL: %s", key))
+			}
+		}
+		sort.Strings(extra)
+		diffs = append(diffs, extra...)
+	}
+	return diffs
+}
+
+// orderedQuery - Whether a query returns its documents in a defined order:
+// a find with a sort, or a pipeline sorted after its last $group.
+func orderedQuery(query bson.D) bool {
+	m := query.Map()
+	if _, ok := m["sort"]; ok {
+		return true
+	}
+	pipeline, _ := m["pipeline"].([]interface{})
+	ordered := false
+	for _, v := range pipeline {
+		if stage, ok := v.(bson.D); ok && len(stage) > 0 {
+			switch stage[0].Name {
+			case "$sort":
+				ordered = true
+			case "$group":
+				ordered = false
+			}
+		}
+	}
+	return ordered
+}
+
+func cursorBatch(reply bson.M) ([]interface{}, int64) {
+	cursor, ok := reply["cursor"].(bson.D)
+	if !ok {
+		// Aggregations without a cursor.
+		result, _ := reply["result"].([]interface{})
+		return result, 0
+	}
+	m := cursor.Map()
+	id, _ := toInt64(m["id"])
+	if batch, ok := m["firstBatch"].([]interface{}); ok {
+		return batch, id
+	}
+	batch, _ := m["nextBatch"].([]interface{})
+	return batch, id
+}
+
+func equalValues(a, b interface{}) bool {
+	return reflect.DeepEqual(normalizeValue(a), normalizeValue(b))
+}
+
+func fingerprint(v interface{}) string {
+	b, err := json.Marshal(normalizeValue(v))
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(b)
+}
+
+// normalizeValue - Reduce BSON and SQL driver values to a common form:
+// documents become maps without null fields, numbers become float64, and
+// ObjectIds, byte slices and times become strings.
+func normalizeValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.D:
+		return normalizeValue(v.Map())
+	case bson.M:
+		return normalizeValue(map[string]interface{}(v))
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			if val == nil {
+				continue
+			}
+			m[k] = normalizeValue(val)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, val := range v {
+			s[i] = normalizeValue(val)
+		}
+		return s
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case float64:
+		if math.IsNaN(v) {
+			return "NaN"
+		}
+		return v
+	case bson.ObjectId:
+		return v.Hex()
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	}
+	return v
+}
+
+// jsonValue - Convert BSON values into something encoding/json renders
+// readably.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.D:
+		m := make(map[string]interface{}, len(v))
+		for _, elem := range v {
+			m[elem.Name] = jsonValue(elem.Value)
+		}
+		return m
+	case bson.M:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[k] = jsonValue(val)
+		}
+		return m
+	case map[string]interface{}:
+		return jsonValue(bson.M(v))
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, val := range v {
+			s[i] = jsonValue(val)
+		}
+		return s
+	case bson.ObjectId:
+		return v.Hex()
+	case []byte:
+		return string(v)
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Sprintf("%v", v)
+		}
+	}
+	return v
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/lego/mongotunnel/util/context"
+	"github.com/lego/mongotunnel/util/log"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestRemoteSucceeded(t *testing.T) {
+	writeError := bson.D{bson.DocElem{"index", 0}, bson.DocElem{"code", 11000}}
+	tests := []struct {
+		name    string
+		command string
+		reply   bson.D
+		want    bool
+	}{
+		{"ok", "insert", bson.D{bson.DocElem{"n", 1}, bson.DocElem{"ok", 1}}, true},
+		{"failed", "insert", bson.D{bson.DocElem{"ok", 0}, bson.DocElem{"code", 13}}, false},
+		{"rejected", "insert", bson.D{bson.DocElem{"n", 0}, bson.DocElem{"writeErrors", []interface{}{writeError}}, bson.DocElem{"ok", 1}}, false},
+		{"partial", "insert", bson.D{bson.DocElem{"n", 2}, bson.DocElem{"writeErrors", []interface{}{writeError}}, bson.DocElem{"ok", 1}}, false},
+		{"failed commit", "commitTransaction", bson.D{bson.DocElem{"ok", 0}, bson.DocElem{"code", 251}}, false},
+		{"failed abort", "abortTransaction", bson.D{bson.DocElem{"ok", 0}, bson.DocElem{"code", 251}}, true},
+		{"no reply", "update", nil, false},
+	}
+	p := &Proxy{}
+	ctx := context.NewContext(&log.NullLogger{})
+	for _, test := range tests {
+		var reply *mongo.Message
+		if test.reply != nil {
+			var err error
+			if reply, err = mongo.NewMessage(newReply(test.reply), 1, 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := p.remoteSucceeded(ctx, test.command, reply); got != test.want {
+			t.Errorf("%s: remoteSucceeded = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+// shadowBatch - A find reply holding docs, with the cursor left open when id
+// is not 0.
+func shadowBatch(id int64, ok int, docs ...interface{}) bson.D {
+	return bson.D{
+		bson.DocElem{"cursor", bson.D{bson.DocElem{"id", id}, bson.DocElem{"ns", "db.t"}, bson.DocElem{"firstBatch", docs}}},
+		bson.DocElem{"ok", ok},
+	}
+}
+
+func TestCompareReplies(t *testing.T) {
+	a := bson.D{bson.DocElem{"_id", 1}, bson.DocElem{"x", "a"}}
+	b := bson.D{bson.DocElem{"_id", 2}, bson.DocElem{"x", "b"}}
+	tests := []struct {
+		name       string
+		mongo, sql bson.D
+		ordered    bool
+		want       []string
+	}{
+		{name: "same", mongo: shadowBatch(0, 1, a, b), sql: shadowBatch(0, 1, a, b)},
+		{name: "unordered in another order", mongo: shadowBatch(0, 1, a, b), sql: shadowBatch(0, 1, b, a)},
+		{
+			name:    "ordered in another order",
+			mongo:   shadowBatch(0, 1, a, b),
+			sql:     shadowBatch(0, 1, b, a),
+			ordered: true,
+			want:    []string{`documents[0]: {"_id":1,"x":"a"} != {"_id":2,"x":"b"}`, `documents[1]: {"_id":2,"x":"b"} != {"_id":1,"x":"a"}`},
+		},
+		{
+			name:    "ordered with fewer documents",
+			mongo:   shadowBatch(0, 1, a, b),
+			sql:     shadowBatch(0, 1, a),
+			ordered: true,
+			want:    []string{"documents: 2 != 1"},
+		},
+		{
+			name:  "unordered missing and extra",
+			mongo: shadowBatch(0, 1, a),
+			sql:   shadowBatch(0, 1, b),
+			want:  []string{`missing from SQL: {"_id":1,"x":"a"}`, `extra in SQL: {"_id":2,"x":"b"}`},
+		},
+		// An open MongoDB cursor only returned a prefix of the result.
+		{name: "partial", mongo: shadowBatch(42, 1, a), sql: shadowBatch(0, 1, a, b)},
+		{name: "partial ordered", mongo: shadowBatch(42, 1, a), sql: shadowBatch(0, 1, a, b), ordered: true},
+		{
+			name:  "ok",
+			mongo: shadowBatch(0, 1),
+			sql:   bson.D{bson.DocElem{"ok", 0}, bson.DocElem{"errmsg", "failed"}},
+			want:  []string{"ok: 1 != 0"},
+		},
+		{name: "numbers of another type", mongo: bson.D{bson.DocElem{"ok", 1.0}}, sql: bson.D{bson.DocElem{"ok", int64(1)}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := compareReplies(test.mongo, test.sql, test.ordered)
+			if len(got) != 0 || len(test.want) != 0 {
+				if !reflect.DeepEqual(got, test.want) {
+					t.Errorf("got %q, want %q", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestNormalizeValue(t *testing.T) {
+	id := bson.ObjectIdHex("5a934e000102030405000000")
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.FixedZone("", 3600))
+	tests := []struct {
+		name string
+		v    interface{}
+		want interface{}
+	}{
+		{"int", 3, 3.0},
+		{"int32", int32(3), 3.0},
+		{"int64", int64(3), 3.0},
+		{"ObjectId", id, "5a934e000102030405000000"},
+		{"bytes", []byte("ab"), "ab"},
+		{"time", at, "2020-01-02T02:04:05Z"},
+		{
+			name: "document without null fields",
+			v:    bson.D{bson.DocElem{"a", 1}, bson.DocElem{"b", nil}, bson.DocElem{"c", []interface{}{int32(2), "x"}}},
+			want: map[string]interface{}{"a": 1.0, "c": []interface{}{2.0, "x"}},
+		},
+	}
+	for _, test := range tests {
+		if got := normalizeValue(test.v); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.name, got, test.want)
+		}
+	}
+	// Field order and null fields do not matter.
+	if !equalValues(bson.D{bson.DocElem{"a", 1}, bson.DocElem{"b", 2}}, bson.M{"b": int64(2), "a": 1.0, "c": nil}) {
+		t.Error("equal documents compare unequal")
+	}
+}
+
+func TestCompareShadowOtherReply(t *testing.T) {
+	var out bytes.Buffer
+	p := &Proxy{ctx: context.NewContext(&log.NullLogger{}), Shadow: NewShadowReporter(&out)}
+	query := mongo.QueryOp{Collection: "db.$cmd", Query: bson.D{bson.DocElem{"find", "t"}}}
+	reply, err := mongo.NewMessage(newReply(shadowBatch(0, 1)), 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.compareShadow(1, query, reply, 0, shadowResult{reply: &mongo.KillCursorsOp{}})
+
+	var report ShadowReport
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatalf("reported %q: %v", out.String(), err)
+	}
+	if report.Kind != shadowKindMismatch {
+		t.Errorf("reported a %s, want a mismatch", report.Kind)
+	}
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	gocontext "context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/lego/mongotunnel/util/context"
+	"github.com/lego/mongotunnel/util/log"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Queries slower than SlowQueryThreshold are logged as warnings with their
+// command and the SQL statements they ran, each with its arguments, rows
+// and duration. With ExplainSlowQueries the plans of their SELECTs are
+// logged as well, from EXPLAIN ANALYZE, which runs them again. SELECTs of a
+// transaction, which read its own writes, only get their plan from EXPLAIN.
+// Few slow queries are explained at a time, each within
+// slowQueryExplainTimeout, and the others are not explained, so that a
+// burst of slow queries does not load the database further.
+
+// maxSlowQueryExplains - How many slow queries are explained at a time.
+const maxSlowQueryExplains = 2
+
+// slowQueryExplainTimeout - How long explaining a slow query may take.
+const slowQueryExplainTimeout = 30 * time.Second
+
+// slowQueryExplains - Holds a slot for each slow query being explained, on
+// any connection.
+var slowQueryExplains = make(chan struct{}, maxSlowQueryExplains)
+
+// recordStatements - Keep the command of a query, and return the log its
+// SQL statements are recorded in, when slow queries are logged.
+func (p *Proxy) recordStatements(requestID int32, command bson.D) *context.StatementLog {
+	if p.SlowQueryThreshold <= 0 {
+		return nil
+	}
+	p.requests.mu.Lock()
+	defer p.requests.mu.Unlock()
+	req, ok := p.requests.pending[requestID]
+	if !ok {
+		return nil
+	}
+	req.query = command
+	req.statements = context.NewStatementLog()
+	return req.statements
+}
+
+// logSlowQuery - Log a query that took longer than SlowQueryThreshold.
+func (p *Proxy) logSlowQuery(req *trackedRequest, duration time.Duration, cmdErr *mongo.CommandError) {
+	statements := req.statements.Statements()
+	if logger, ok := p.fieldLogger(); ok {
+		encoded := make([]map[string]interface{}, len(statements))
+		for i, s := range statements {
+			encoded[i] = map[string]interface{}{
+				"sql":         s.SQL,
+				"args":        statementArgs(s.Args),
+				"rows":        s.Rows,
+				"duration_ms": float64(s.Duration) / float64(time.Millisecond),
+			}
+			if s.Err != nil {
+				encoded[i]["error"] = s.Err.Error()
+			}
+		}
+		fields := log.Fields{
+			"request_id":  req.id,
+			"command":     req.command,
+			"ns":          req.namespace,
+			"route":       req.target,
+			"duration_ms": float64(duration) / float64(time.Millisecond),
+			"query":       jsonValue(req.query),
+			"statements":  encoded,
+		}
+		if cmdErr != nil {
+			fields["error"] = cmdErr.Message
+		}
+		logger.WithFields(fields).Warn("slow query")
+	} else {
+		p.ctx.Log.Warn("slow query: %s on %s took %s from %s: %s", req.command, req.namespace, duration, req.target, fingerprint(req.query))
+		for _, s := range statements {
+			p.ctx.Log.Warn("   sql=%s args=%v rows=%d duration=%s err=%v", s.SQL, statementArgs(s.Args), s.Rows, s.Duration, s.Err)
+		}
+	}
+
+	if p.ExplainSlowQueries {
+		select {
+		case slowQueryExplains <- struct{}{}:
+			go func() {
+				defer func() { <-slowQueryExplains }()
+				p.explainSlowQuery(req.id, statements)
+			}()
+		default:
+			p.ctx.Log.Debug("not explaining slow query %d, %d are being explained", req.id, maxSlowQueryExplains)
+		}
+	}
+}
+
+// explainSlowQuery - Log the plans of the SELECTs of a slow query. Other
+// statements are not run again, since EXPLAIN ANALYZE executes them.
+func (p *Proxy) explainSlowQuery(requestID int32, statements []context.Statement) {
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), slowQueryExplainTimeout)
+	defer cancel()
+	for _, s := range statements {
+		if s.Err != nil || !isSelect(s.SQL) {
+			continue
+		}
+		plan, err := explain(ctx, p.ctx.DB, s.SQL, s.Args, !s.InTransaction)
+		if err != nil {
+			p.ctx.Log.Warn("failed to explain slow query %d: %+v", requestID, err)
+			continue
+		}
+		if logger, ok := p.fieldLogger(); ok {
+			logger.WithFields(log.Fields{
+				"request_id": requestID,
+				"sql":        s.SQL,
+				"plan":       plan,
+			}).Warn("slow query plan")
+		} else {
+			p.ctx.Log.Warn("slow query %d plan of %s:\n%s", requestID, s.SQL, strings.Join(plan, "\n"))
+		}
+	}
+}
+
+// isSelect - Whether a statement only reads.
+func isSelect(statement string) bool {
+	fields := strings.Fields(statement)
+	if len(fields) == 0 {
+		return false
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "SELECT", "VALUES", "TABLE":
+		return true
+	case "WITH":
+		return !writingSubquery.MatchString(statement)
+	}
+	return false
+}
+
+// writingSubquery - Matches a WITH subquery that writes, as updates count
+// the documents they change with one.
+var writingSubquery = regexp.MustCompile(`(?i)\bAS\s*\(\s*(INSERT|UPSERT|UPDATE|DELETE)\b`)
+
+// explain - Run a statement under EXPLAIN, or EXPLAIN ANALYZE when
+// analyze is set, returning each row of its output with its columns joined
+// by tabs.
+func explain(ctx gocontext.Context, db *sql.DB, statement string, args []interface{}, analyze bool) ([]string, error) {
+	prefix := "EXPLAIN "
+	if analyze {
+		prefix = "EXPLAIN ANALYZE "
+	}
+	rows, err := db.QueryContext(ctx, prefix+statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return explainLines(rows)
+}
+
+// explainLines - The rows of EXPLAIN output, whatever its columns are,
+// which differ between versions of CockroachDB.
+func explainLines(rows *sql.Rows) ([]string, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		parts := make([]string, len(values))
+		for i, v := range values {
+			parts[i] = v.String
+		}
+		lines = append(lines, strings.TrimRight(strings.Join(parts, "\t"), "\t"))
+	}
+	return lines, rows.Err()
+}
+
+// statementArgs - Arguments readable in logs, with bytes as text.
+func statementArgs(args []interface{}) []interface{} {
+	readable := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch arg := arg.(type) {
+		case []byte:
+			readable[i] = string(arg)
+		case nil, string, bool, int, int32, int64, float64:
+			readable[i] = arg
+		default:
+			readable[i] = fmt.Sprint(arg)
+		}
+	}
+	return readable
+}
@@ -0,0 +1,22 @@
+package proxy
+
+import "testing"
+
+func TestIsSelect(t *testing.T) {
+	tests := []struct {
+		statement string
+		read      bool
+	}{
+		{`SELECT "_id" FROM "db"."items"`, true},
+		{`WITH "t" AS (SELECT 1) SELECT * FROM "t"`, true},
+		// Writes must not run again under EXPLAIN ANALYZE.
+		{updateStatement("db", "items", `"a" = $1`, []string{"a"}, []string{"$2"}, false), false},
+		{`INSERT INTO "db"."items" ("_id") VALUES ($1)`, false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := isSelect(test.statement); got != test.read {
+			t.Errorf("isSelect(%q) = %t, want %t", test.statement, got, test.read)
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 
 	"github.com/lego/mongotunnel/mongo"
 	"github.com/lego/mongotunnel/util/context"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -18,107 +20,353 @@ func isStatement(ctx *context.Context, query mongo.QueryOp) bool {
 	return false
 }
 
-func isQuery(ctx *context.Context, query mongo.QueryOp) bool {
+func isAdminStatement(ctx *context.Context, query mongo.QueryOp) bool {
+	return query.Collection == "admin.$cmd"
+}
+
+// statementHandlers - The commands the translator can answer from
+// CockroachDB.
+var statementHandlers = map[string]func(*context.Context, mongo.QueryOp) (mongo.Op, error){
+	"find":      handleQuery,
+	"aggregate": handleAggregate,
+	"count":     handleCount,
+	"distinct":  handleDistinct,
+	"insert":    handleInsert,
+	"update":    handleUpdate,
+	"delete":    handleDelete,
+	"explain":   handleExplain,
+
+	"createIndexes": handleCreateIndexes,
+	"listIndexes":   handleListIndexes,
+	"dropIndexes":   handleDropIndexes,
+	"deleteIndexes": handleDropIndexes,
+
+	"listCollections": handleListCollections,
+	"create":          handleCreate,
+	"drop":            handleDrop,
+	"dropDatabase":    handleDropDatabase,
+}
+
+// adminStatementHandlers - The commands on admin the translator can
+// answer. They concern the whole catalog rather than one database.
+var adminStatementHandlers = map[string]func(*context.Context, mongo.QueryOp) (mongo.Op, error){
+	"listDatabases":    handleListDatabases,
+	"renameCollection": handleRenameCollection,
+}
+
+// statementHandler - The handler for query, if the translator has one.
+func statementHandler(ctx *context.Context, query mongo.QueryOp) (func(*context.Context, mongo.QueryOp) (mongo.Op, error), bool) {
+	if len(query.Query) == 0 {
+		return nil, false
+	}
+	if isAdminStatement(ctx, query) {
+		handler, ok := adminStatementHandlers[query.Query[0].Name]
+		return handler, ok
+	}
 	if !isStatement(ctx, query) {
-		return false
+		return nil, false
 	}
+	handler, ok := statementHandlers[query.Query[0].Name]
+	return handler, ok
+}
 
-	// FIXME(joey): Do we need to check the length? I hope not...
-	if query.Query[0].Name == "find" {
-		return true
-	}
+// isQuery - Whether the translator can answer query.
+func isQuery(ctx *context.Context, query mongo.QueryOp) bool {
+	_, ok := statementHandler(ctx, query)
+	return ok
+}
 
-	return false
+// handleStatement - Answer a query for which isQuery is true.
+func handleStatement(ctx *context.Context, query mongo.QueryOp) (mongo.Op, error) {
+	handler, ok := statementHandler(ctx, query)
+	if !ok {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeCommandNotFound, "no such command: '%s'", query.Query[0].Name)
+	}
+	ctx, span := ctx.StartSpan("translate " + query.Query[0].Name)
+	defer span.End()
+	reply, err := handler(ctx, query)
+	span.SetError(err)
+	return reply, err
 }
 
+// handleQuery - Answer find by compiling it into the equivalent pipeline.
 func handleQuery(ctx *context.Context, query mongo.QueryOp) (mongo.Op, error) {
 	databaseName := strings.Split(query.Collection, ".")[0]
-	queryParts := query.Query
-
-	// TODO(joey): These may not be ordered, but this was the order from
-	// the Ruby driver. if they are not then using query.Map() would be
-	// better.
-
-	// Retrieve query.
-	tableName := queryParts[0].Value
-	queryParts = queryParts[1:]
+	tableName, ok := query.Query[0].Value.(string)
+	if !ok {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "collection name has invalid type %T", query.Query[0].Value)
+	}
+	pipeline := findPipeline(query.Query.Map())
 
-	// Retrieve filter.
-	var filter map[string]interface{}
-	if len(queryParts) > 0 && queryParts[0].Name == "filter" {
-		filter = queryParts[0].Value.(bson.D).Map()
-		queryParts = queryParts[1:]
+	ctx.Log.Debug("query for database=%s table=%s with pipeline=%v", databaseName, tableName, pipeline)
+	replyRows, err := runPipeline(ctx, databaseName, tableName, pipeline)
+	if err != nil {
+		return nil, err
 	}
+	return cursorReply(fmt.Sprintf("%s.%s", databaseName, tableName), replyRows), nil
+}
 
-	// Retrieve limit.
-	limit := -1
-	if len(queryParts) > 0 && queryParts[0].Name == "limit" {
-		limit = queryParts[0].Value.(int)
-		queryParts = queryParts[1:]
+// findPipeline - The pipeline equivalent to the options of find.
+func findPipeline(find bson.M) []interface{} {
+	var pipeline []interface{}
+	if filter, ok := find["filter"].(bson.D); ok && len(filter) > 0 {
+		pipeline = append(pipeline, bson.D{{"$match", filter}})
+	}
+	if sort, ok := find["sort"].(bson.D); ok && len(sort) > 0 {
+		pipeline = append(pipeline, bson.D{{"$sort", sort}})
 	}
+	if skip, ok := toInt64(find["skip"]); ok && skip > 0 {
+		pipeline = append(pipeline, bson.D{{"$skip", skip}})
+	}
+	if limit, ok := toInt64(find["limit"]); ok && limit != 0 {
+		// A negative limit asks for a single batch of that size.
+		if limit < 0 {
+			limit = -limit
+		}
+		pipeline = append(pipeline, bson.D{{"$limit", limit}})
+	}
+	if projection, ok := find["projection"].(bson.D); ok && len(projection) > 0 {
+		pipeline = append(pipeline, bson.D{{"$project", projection}})
+	}
+	return pipeline
+}
 
-	ctx.Log.Debug("query for database=%s table=%s with filter=%v and limit=%d", databaseName, tableName, filter, limit)
+// handleAggregate - Answer aggregate by compiling its pipeline into one
+// SELECT.
+func handleAggregate(ctx *context.Context, query mongo.QueryOp) (mongo.Op, error) {
+	databaseName := strings.Split(query.Collection, ".")[0]
+	tableName, ok := query.Query[0].Value.(string)
+	if !ok {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeNotImplemented, "aggregate on a database is not supported by the SQL translator")
+	}
+	aggregate := query.Query.Map()
+	pipeline, ok := aggregate["pipeline"].([]interface{})
+	if !ok {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "'pipeline' option must be specified as an array")
+	}
+	if explain, _ := aggregate["explain"].(bool); explain {
+		return explainCommand(ctx, databaseName, query.Query, verbosityQueryPlanner)
+	}
+	if isChangeStream(query.Query) {
+		// Change streams need a cursor, see Sessions.watch.
+		return nil, mongo.NewCommandError(mongo.ErrorCodeNotImplemented, "$changeStream is only supported as a routed query")
+	}
 
-	rows, err := ctx.DB.Query(fmt.Sprintf("SELECT * FROM %q.%q", databaseName, tableName))
+	ctx.Log.Debug("aggregate for database=%s table=%s with pipeline=%v", databaseName, tableName, pipeline)
+	replyRows, err := runPipeline(ctx, databaseName, tableName, pipeline)
 	if err != nil {
 		return nil, err
 	}
-	cols, err := rows.Columns()
+	if _, ok := aggregate["cursor"]; !ok {
+		// Servers before 3.6 answer in a single document without a cursor.
+		return newReply(bson.D{
+			bson.DocElem{"result", replyRows},
+			bson.DocElem{"ok", 1},
+		}), nil
+	}
+	return cursorReply(fmt.Sprintf("%s.%s", databaseName, tableName), replyRows), nil
+}
+
+// runPipeline - Compile the pipeline for a collection and run it.
+func runPipeline(ctx *context.Context, databaseName, tableName string, pipeline []interface{}) ([]interface{}, error) {
+	compiler, err := compilePipeline(ctx, databaseName, tableName, pipeline)
+	if err != nil || compiler == nil {
+		return []interface{}{}, err
+	}
+	return queryDocuments(ctx, compiler)
+}
+
+// compilePipeline - Compile the pipeline for a collection. The compiler
+// is nil if the collection does not exist.
+func compilePipeline(ctx *context.Context, databaseName, tableName string, pipeline []interface{}) (*pipelineCompiler, error) {
+	columns, err := tableColumns(ctx, databaseName, tableName)
+	if isUndefinedTable(err) {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	ctx.Log.Debug("columns=%v", cols)
+	columnsOf := func(collection string) ([]column, error) {
+		return tableColumns(ctx, databaseName, collection)
+	}
+	compiler := newPipelineCompiler(databaseName, tableName, columns, columnsOf)
+	for _, stage := range pipeline {
+		if err := compiler.stage(stage); err != nil {
+			return nil, err
+		}
+	}
+	return compiler, nil
+}
 
-	var replyRows []interface{}
+// queryDocuments - Run the compiled query and read its documents.
+func queryDocuments(ctx *context.Context, compiler *pipelineCompiler) ([]interface{}, error) {
+	statement, args := compiler.SQL()
+	ctx.Log.Debug("sql=%s args=%v", statement, args)
 
+	rows, err := ctx.SQL().Query(statement, args...)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
-	for rows.Next() {
-		// Create a slice of interface{}'s to represent each column,
-		// and a second slice to contain pointers to each item in the columns slice.
-		columns := make([]interface{}, len(cols))
-		columnPointers := make([]interface{}, len(cols))
-		for i := range columns {
-			columnPointers[i] = &columns[i]
-		}
+	replyRows, err := scanDocuments(rows)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Statements.RowsRead(len(replyRows))
+	ctx.Log.Debug("replyRows=%#v", replyRows)
+	return replyRows, nil
+}
 
-		// Scan the result into the column pointers...
-		if err := rows.Scan(columnPointers...); err != nil {
+// handleCount - Answer count. Without a query this is how drivers ask for
+// estimatedDocumentCount, so the count comes from the table statistics,
+// much like MongoDB answers it from collection metadata.
+func handleCount(ctx *context.Context, query mongo.QueryOp) (mongo.Op, error) {
+	databaseName := strings.Split(query.Collection, ".")[0]
+	tableName, ok := query.Query[0].Value.(string)
+	if !ok {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "collection name has invalid type %T", query.Query[0].Value)
+	}
+	pipeline := countPipeline(query.Query.Map())
+
+	ctx.Log.Debug("count for database=%s table=%s with pipeline=%v", databaseName, tableName, pipeline)
+	compiler, err := compilePipeline(ctx, databaseName, tableName, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var n int64
+	if compiler != nil {
+		statement, args := countStatement(compiler, databaseName, tableName, pipeline)
+		ctx.Log.Debug("sql=%s args=%v", statement, args)
+		if err := ctx.SQL().QueryRow(statement, args...).Scan(&n); err != nil {
 			return nil, err
 		}
+	}
+	return newReply(bson.D{
+		bson.DocElem{"n", int(n)},
+		bson.DocElem{"ok", 1},
+	}), nil
+}
 
-		// Create our map, and retrieve the value for each column from the pointers slice,
-		// storing it in the map with the name of the column as the key.
-		m := make(map[string]interface{})
-		for i, colName := range cols {
-			val := columnPointers[i].(*interface{})
-			m[colName] = *val
+// countPipeline - The pipeline selecting the documents count counts.
+func countPipeline(count bson.M) []interface{} {
+	var pipeline []interface{}
+	if filter, ok := count["query"].(bson.D); ok && len(filter) > 0 {
+		pipeline = append(pipeline, bson.D{{"$match", filter}})
+	}
+	if skip, ok := toInt64(count["skip"]); ok && skip > 0 {
+		pipeline = append(pipeline, bson.D{{"$skip", skip}})
+	}
+	if limit, ok := toInt64(count["limit"]); ok && limit != 0 {
+		if limit < 0 {
+			limit = -limit
 		}
-		replyRows = append(replyRows, m)
+		pipeline = append(pipeline, bson.D{{"$limit", limit}})
 	}
+	return pipeline
+}
 
-	if err := rows.Err(); err != nil {
-		return nil, err
+// countStatement - The SELECT counting the documents of the compiled
+// pipeline, or estimating them from the table statistics when it has no
+// stages.
+func countStatement(compiler *pipelineCompiler, databaseName, tableName string, pipeline []interface{}) (string, []interface{}) {
+	if len(pipeline) == 0 {
+		return "SELECT " + estimatedCount(databaseName, tableName), nil
 	}
+	compiler.countRows("n")
+	return compiler.SQL()
+}
 
-	ctx.Log.Debug("replyRows=%#v", replyRows)
-	replyDocuments := bson.D{
-		bson.DocElem{
-			"cursor",
-			bson.D{
-				bson.DocElem{"firstBatch", replyRows},
-				bson.DocElem{"id", 0},
-				bson.DocElem{"ns", fmt.Sprintf("%s.%s", databaseName, tableName)},
-			},
-		},
-		bson.DocElem{"ok", 1},
+// handleDistinct - Answer distinct with a SELECT DISTINCT over the values
+// of the key, unwinding arrays as MongoDB does.
+func handleDistinct(ctx *context.Context, query mongo.QueryOp) (mongo.Op, error) {
+	databaseName := strings.Split(query.Collection, ".")[0]
+	tableName, ok := query.Query[0].Value.(string)
+	if !ok {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "collection name has invalid type %T", query.Query[0].Value)
+	}
+	distinct := query.Query.Map()
+	key, ok := distinct["key"].(string)
+	if !ok || key == "" {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "the key for distinct must be a non-empty string")
 	}
 
-	return &mongo.ReplyOp{
-		Flags:     mongo.ReplyFlagShardConfigStale,
-		CursorID:  0,
-		FirstDoc:  0,
-		ReplyDocs: 1,
-		Documents: replyDocuments,
-	}, nil
+	var pipeline []interface{}
+	if filter, ok := distinct["query"].(bson.D); ok && len(filter) > 0 {
+		pipeline = append(pipeline, bson.D{{"$match", filter}})
+	}
+
+	ctx.Log.Debug("distinct %s for database=%s table=%s with pipeline=%v", key, databaseName, tableName, pipeline)
+	compiler, err := compilePipeline(ctx, databaseName, tableName, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	values := []interface{}{}
+	if compiler != nil {
+		if err := compiler.distinctValues(key, "value"); err != nil {
+			return nil, err
+		}
+		docs, err := queryDocuments(ctx, compiler)
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			values = append(values, doc.(bson.D)[0].Value)
+		}
+	}
+	return newReply(bson.D{
+		bson.DocElem{"values", values},
+		bson.DocElem{"ok", 1},
+	}), nil
+}
+
+// tableColumns - The columns of a table, read from the description of an
+// empty result so that SELECT * decides which columns are visible.
+func tableColumns(ctx *context.Context, databaseName, tableName string) ([]column, error) {
+	var columns []column
+	err := probe(ctx, func() error {
+		rows, err := ctx.SQL().Query(fmt.Sprintf("SELECT * FROM %s.%s LIMIT 0", quoteIdent(databaseName), quoteIdent(tableName)))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		types, err := rows.ColumnTypes()
+		if err != nil {
+			return err
+		}
+		columns = make([]column, len(types))
+		for i, t := range types {
+			typeName := t.DatabaseTypeName()
+			columns[i] = column{t.Name(), typeName == "JSONB" || typeName == "JSON"}
+		}
+		return rows.Err()
+	})
+	return columns, err
+}
+
+// isUndefinedTable - Whether err is for a table or database that does not
+// exist.
+func isUndefinedTable(err error) bool {
+	pqErr, ok := errors.Cause(err).(*pq.Error)
+	return ok && (pqErr.Code == "42P01" || pqErr.Code == "3D000")
+}
+
+// cursorReply - A command reply holding every document in the first batch
+// of an already exhausted cursor.
+func cursorReply(ns string, docs []interface{}) *mongo.ReplyOp {
+	return batchReply(ns, "firstBatch", docs, 0)
+}
+
+// batchReply - A command reply holding one batch of a cursor, which is
+// exhausted when id is 0, followed by any extra cursor fields.
+func batchReply(ns string, batch string, docs []interface{}, id int64, extra ...bson.DocElem) *mongo.ReplyOp {
+	cursor := bson.D{
+		bson.DocElem{batch, docs},
+		bson.DocElem{"id", id},
+		bson.DocElem{"ns", ns},
+	}
+	return newReply(bson.D{
+		bson.DocElem{"cursor", append(cursor, extra...)},
+		bson.DocElem{"ok", 1},
+	})
 }
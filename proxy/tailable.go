@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	gocontext "context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/lego/mongotunnel/util/context"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A tailable find keeps its cursor open after the last document. Rows are
+// ordered by their MVCC timestamp, and the cursor remembers the cluster
+// timestamp its last read ran at, so that getMore reads the rows written
+// after it. Rows written again by an update come again.
+
+// tailPollInterval - How often a waiting getMore looks for new rows.
+const tailPollInterval = 100 * time.Millisecond
+
+// positionColumn - The MVCC timestamp of a row, as read by a tailable
+// cursor.
+const positionColumn = internalPrefix + "position"
+
+// isTailable - Whether a find asks for a tailable cursor, with the tailable
+// option of the command or the flag of its message.
+func isTailable(query mongo.QueryOp) bool {
+	if query.Query[0].Name != "find" {
+		return false
+	}
+	return truthy(query.Query.Map()["tailable"]) || query.Flags&mongo.QueryFlagTailable != 0
+}
+
+// tailQuery - Answer a tailable find with a cursor that stays open for the
+// rows written after it.
+func (s *Sessions) tailQuery(ctx *context.Context, query mongo.QueryOp, session string) (mongo.Op, error) {
+	databaseName := strings.Split(query.Collection, ".")[0]
+	tableName, ok := query.Query[0].Value.(string)
+	if !ok {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "collection name has invalid type %T", query.Query[0].Value)
+	}
+	m := query.Query.Map()
+	if sort, ok := m["sort"].(bson.D); ok && len(sort) > 0 && !(len(sort) == 1 && sort[0].Name == "$natural") {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "cannot use tailable option with a sort other than {$natural: 1}")
+	}
+	for _, option := range []string{"skip", "limit"} {
+		if n, ok := toInt64(m[option]); ok && n != 0 {
+			return nil, mongo.NewCommandError(mongo.ErrorCodeNotImplemented, "%s on a tailable cursor is not supported by the SQL translator", option)
+		}
+	}
+	filter, _ := m["filter"].(bson.D)
+	projection, _ := m["projection"].(bson.D)
+
+	// Later reads belong to the getMores rather than to this request, and
+	// run until the cursor is closed.
+	done, cancel := gocontext.WithCancel(gocontext.Background())
+	tailCtx := *ctx
+	tailCtx.Span = nil
+	tailCtx.Statements = nil
+	tailCtx.Request = done
+	t := &tailableQuery{
+		ctx:        &tailCtx,
+		database:   databaseName,
+		table:      tableName,
+		filter:     filter,
+		projection: projection,
+		awaitData:  truthy(m["awaitData"]) || query.Flags&mongo.QueryFlagAwaitData != 0,
+		position:   "0",
+		cancel:     cancel,
+	}
+	docs, err := t.read()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	batchSize := firstBatchSize(query.Query)
+	if batchSize < 0 || batchSize > len(docs) {
+		batchSize = len(docs)
+	}
+	c := &cursor{
+		ns:        fmt.Sprintf("%s.%s", databaseName, tableName),
+		docs:      docs[batchSize:],
+		session:   session,
+		conn:      ctx.ConnID,
+		noTimeout: truthy(m["noCursorTimeout"]) || query.Flags&mongo.QueryFlagNoCursorTimeout != 0,
+		tail:      t,
+	}
+	id := s.register(c)
+	return c.reply("firstBatch", docs[:batchSize], id), nil
+}
+
+// tailableQuery - The tail of a tailable find.
+type tailableQuery struct {
+	ctx             *context.Context
+	database, table string
+	filter          bson.D
+	projection      bson.D
+	awaitData       bool
+
+	// position is the cluster timestamp of the last read, as a decimal.
+	position string
+	// cancel cancels the Request of ctx, once the cursor is closed.
+	cancel gocontext.CancelFunc
+}
+
+func (t *tailableQuery) next(deadline time.Time, n int) ([]interface{}, error) {
+	if !t.awaitData {
+		// Without awaitData getMore returns what there is right away.
+		deadline = time.Now()
+	}
+	for {
+		docs, err := t.read()
+		if err != nil || len(docs) > 0 {
+			return docs, err
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return docs, nil
+		}
+		if wait > tailPollInterval {
+			wait = tailPollInterval
+		}
+		select {
+		case <-time.After(wait):
+		case <-t.ctx.Request.Done():
+			return docs, nil
+		}
+	}
+}
+
+func (t *tailableQuery) resumeToken() interface{} {
+	return nil
+}
+
+func (t *tailableQuery) close() {
+	t.cancel()
+}
+
+// read - Read the matching rows written since the last read. The read
+// runs in a transaction whose timestamp becomes the new position, since
+// rows committed later get a later MVCC timestamp.
+func (t *tailableQuery) read() ([]interface{}, error) {
+	tx, err := t.ctx.DB.BeginTx(t.ctx.Request, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var position string
+	if err := tx.QueryRowContext(t.ctx.Request, "SELECT cluster_logical_timestamp()::STRING").Scan(&position); err != nil {
+		return nil, err
+	}
+	if _, _, err := parseHLC(position); err != nil {
+		return nil, err
+	}
+	ctx := *t.ctx
+	ctx.Tx = tx
+
+	columns, err := tableColumns(&ctx, t.database, t.table)
+	if isUndefinedTable(err) {
+		t.position = position
+		return []interface{}{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	from := fmt.Sprintf("(SELECT *, crdb_internal_mvcc_timestamp AS %s FROM %s.%s WHERE crdb_internal_mvcc_timestamp > %s) AS %s",
+		quoteIdent(positionColumn), quoteIdent(t.database), quoteIdent(t.table), t.position, quoteIdent(t.table))
+	compiler := newPipelineCompiler(t.database, t.table, columns, nil)
+	compiler.block = newSelectBlock(from, quoteIdent(t.table), append(columns, column{positionColumn, false}))
+
+	pipeline := []interface{}{}
+	if len(t.filter) > 0 {
+		pipeline = append(pipeline, bson.D{{"$match", t.filter}})
+	}
+	pipeline = append(pipeline, bson.D{{"$sort", bson.D{{positionColumn, 1}}}})
+	if len(t.projection) > 0 {
+		pipeline = append(pipeline, bson.D{{"$project", t.projection}})
+	}
+	for _, stage := range pipeline {
+		if err := compiler.stage(stage); err != nil {
+			return nil, err
+		}
+	}
+	docs, err := queryDocuments(&ctx, compiler)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	t.position = position
+	return docs, nil
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	gocontext "context"
+	"database/sql/driver"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lego/mongotunnel/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestIsTailable(t *testing.T) {
+	tests := []struct {
+		name  string
+		query mongo.QueryOp
+		want  bool
+	}{
+		{"option", mongo.QueryOp{Query: bson.D{{"find", "t"}, {"tailable", true}}}, true},
+		{"flag", mongo.QueryOp{Flags: mongo.QueryFlagTailable, Query: bson.D{{"find", "t"}}}, true},
+		{"neither", mongo.QueryOp{Query: bson.D{{"find", "t"}, {"tailable", false}}}, false},
+		{"not a find", mongo.QueryOp{Flags: mongo.QueryFlagTailable, Query: bson.D{{"aggregate", "t"}}}, false},
+	}
+	for _, test := range tests {
+		if got := isTailable(test.query); got != test.want {
+			t.Errorf("%s: isTailable = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+// tailDriver - Answers the reads of a tailable cursor: the cluster
+// timestamp, the columns of the table and the rows written since, which
+// rows hands out one read at a time.
+type tailDriver struct {
+	scriptedDriver
+
+	mu sync.Mutex
+	// rows are the rows of each read, none once they run out.
+	rows  [][][]driver.Value
+	reads int
+}
+
+func newTailDriver(rows ...[][]driver.Value) *tailDriver {
+	d := &tailDriver{rows: rows}
+	d.answer = func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+		switch {
+		case strings.HasPrefix(query, "SELECT cluster_logical_timestamp()"):
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			d.reads++
+			return []string{"cluster_logical_timestamp"}, [][]driver.Value{{formatHLC(int64(d.reads), 0)}}, nil
+		case strings.HasSuffix(query, "LIMIT 0"):
+			return []string{"_id", "x"}, nil, nil
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if len(d.rows) == 0 {
+			return []string{"_id", "x"}, nil, nil
+		}
+		rows := d.rows[0]
+		d.rows = d.rows[1:]
+		return []string{"_id", "x"}, rows, nil
+	}
+	return d
+}
+
+func (d *tailDriver) readCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.reads
+}
+
+func TestTailQueryOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options bson.D
+		code    mongo.ErrorCode
+	}{
+		{name: "natural order", options: bson.D{{"sort", bson.D{{"$natural", 1}}}}},
+		{name: "zero skip and limit", options: bson.D{{"skip", 0}, {"limit", 0}}},
+		{name: "sort", options: bson.D{{"sort", bson.D{{"x", 1}}}}, code: mongo.ErrorCodeBadValue},
+		{name: "natural and another sort", options: bson.D{{"sort", bson.D{{"$natural", 1}, {"x", 1}}}}, code: mongo.ErrorCodeBadValue},
+		{name: "skip", options: bson.D{{"skip", 1}}, code: mongo.ErrorCodeNotImplemented},
+		{name: "limit", options: bson.D{{"limit", 5}}, code: mongo.ErrorCodeNotImplemented},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := newTailDriver()
+			s := NewSessions()
+			defer s.Close()
+			query := mongo.QueryOp{
+				Collection: "db.$cmd",
+				Query:      append(bson.D{{"find", "t"}, {"tailable", true}}, test.options...),
+			}
+			reply, err := s.tailQuery(newSQLContext(d.open(t)), query, "")
+			if test.code != 0 {
+				if commandErrorCode(err) != test.code {
+					t.Fatalf("got %v, want code %d", err, test.code)
+				}
+				if d.readCount() != 0 {
+					t.Error("a rejected tailable find read the table")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			cursor, _ := reply.(*mongo.ReplyOp).Documents.Map()["cursor"].(bson.D)
+			if id, _ := toInt64(cursor.Map()["id"]); id == 0 {
+				t.Error("the tailable cursor was closed after the first batch")
+			}
+		})
+	}
+}
+
+func TestTailNext(t *testing.T) {
+	row := [][]driver.Value{{int64(1), "a"}}
+	tests := []struct {
+		name      string
+		awaitData bool
+		// rows are those of each read after the first.
+		rows  [][][]driver.Value
+		docs  int
+		reads int
+	}{
+		{name: "without awaitData returns at once", rows: [][][]driver.Value{nil, row}, docs: 0, reads: 1},
+		{name: "awaitData waits for rows", awaitData: true, rows: [][][]driver.Value{nil, row}, docs: 1, reads: 2},
+		{name: "rows at once", rows: [][][]driver.Value{row}, docs: 1, reads: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := newTailDriver(test.rows...)
+			ctx := newSQLContext(d.open(t))
+			ctx.Request = gocontext.Background()
+			tail := &tailableQuery{ctx: ctx, database: "db", table: "t", awaitData: test.awaitData, position: "0"}
+
+			docs, err := tail.next(time.Now().Add(5*time.Second), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(docs) != test.docs || d.readCount() != test.reads {
+				t.Errorf("got %d documents in %d reads, want %d in %d", len(docs), d.readCount(), test.docs, test.reads)
+			}
+			// The next read starts where this one ran.
+			if want := formatHLC(int64(d.readCount()), 0); tail.position != want {
+				t.Errorf("position %s, want %s", tail.position, want)
+			}
+		})
+	}
+}
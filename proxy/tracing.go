@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/lego/mongotunnel/util/trace"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Each request that expects a reply is traced with a server span from
+// reading the message to writing its reply, with children for parsing,
+// the upstream round trip, the translation and each SQL statement, and
+// writing the reply. A client continues its trace through the proxy by
+// passing a W3C traceparent in the command, either as $traceparent or in
+// its comment.
+
+// traceparentField - The command field carrying the trace context of the
+// client.
+const traceparentField = "$traceparent"
+
+// traceParent - The trace context a client passed with a command, from
+// $traceparent, or from a comment that is a traceparent, contains
+// "traceparent=<value>" or is a document with a traceparent field.
+func traceParent(command bson.D) trace.SpanContext {
+	m := command.Map()
+	if s, ok := m[traceparentField].(string); ok {
+		if sc, err := trace.ParseTraceparent(s); err == nil {
+			return sc
+		}
+	}
+	switch comment := m["comment"].(type) {
+	case string:
+		if sc, err := trace.ParseTraceparent(comment); err == nil {
+			return sc
+		}
+		for _, field := range strings.FieldsFunc(comment, func(r rune) bool {
+			return r == ' ' || r == ',' || r == ';'
+		}) {
+			if strings.HasPrefix(field, "traceparent=") {
+				if sc, err := trace.ParseTraceparent(strings.TrimPrefix(field, "traceparent=")); err == nil {
+					return sc
+				}
+			}
+		}
+	case bson.D:
+		if s, ok := comment.Map()["traceparent"].(string); ok {
+			if sc, err := trace.ParseTraceparent(s); err == nil {
+				return sc
+			}
+		}
+	}
+	return trace.SpanContext{}
+}
+
+// traceRequest - Start the span of a request waiting for its reply, under
+// parent when the client passed one, along with the span of parsing it.
+// Returns the span of a request that is already traced.
+func (p *Proxy) traceRequest(requestID int32, parent trace.SpanContext) *trace.Span {
+	if p.Tracer == nil {
+		return nil
+	}
+	p.requests.mu.Lock()
+	defer p.requests.mu.Unlock()
+	req, ok := p.requests.pending[requestID]
+	if !ok {
+		return nil
+	}
+	if req.span != nil {
+		return req.span
+	}
+	name := req.opcode
+	if req.command != "" {
+		name = req.command
+	}
+	span := p.Tracer.StartAt(parent, "mongo "+name, req.start)
+	span.SetKind(trace.SpanKindServer)
+	span.SetAttribute("db.system", "mongodb")
+	span.SetAttribute("mongotunnel.conn", p.ctx.ConnID)
+	span.SetAttribute("mongotunnel.request_id", requestID)
+	span.SetAttribute("mongotunnel.opcode", req.opcode)
+	if req.command != "" {
+		span.SetAttribute("db.operation", req.command)
+	}
+	if req.namespace != "" {
+		span.SetAttribute("db.namespace", req.namespace)
+	}
+	span.ChildAt("parse", req.start).End()
+	req.span = span
+	return span
+}
+
+// requestSpan - The span of a request waiting for its reply, if it is
+// traced.
+func (p *Proxy) requestSpan(requestID int32) *trace.Span {
+	if p.Tracer == nil {
+		return nil
+	}
+	p.requests.mu.Lock()
+	defer p.requests.mu.Unlock()
+	if req, ok := p.requests.pending[requestID]; ok {
+		return req.span
+	}
+	return nil
+}
+
+// traceUpstream - Wrap reply to end a span of the round trip of msg to the
+// upstream at its first reply.
+func (p *Proxy) traceUpstream(msg *mongo.Message, reply ReplyFunc) ReplyFunc {
+	span := p.requestSpan(msg.Head.ResponseID).Child("upstream")
+	if span == nil {
+		return reply
+	}
+	span.SetKind(trace.SpanKindClient)
+	if p.raddr != nil {
+		span.SetAttribute("net.peer.name", p.raddr.String())
+	}
+	return func(replyMsg *mongo.Message, err error) {
+		span.SetError(err)
+		span.End()
+		reply(replyMsg, err)
+	}
+}
@@ -0,0 +1,361 @@
+package proxy
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/lego/mongotunnel/util/context"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Commands of a MongoDB transaction carry the session (lsid), the
+// transaction number (txnNumber) and `autocommit: false`, and the first one
+// also `startTransaction: true`. Translated commands of a transaction run in
+// one SQL transaction, which commitTransaction commits and abortTransaction
+// rolls back.
+
+// defaultTransactionLifetime - How long a transaction may stay open, as
+// MongoDB's default transactionLifetimeLimitSeconds.
+const defaultTransactionLifetime = 60 * time.Second
+
+// probeSavepoint - The savepoint statements that may fail run under.
+const probeSavepoint = internalPrefix + "probe"
+
+// statementSavepoint - The savepoint each statement of a write runs under.
+const statementSavepoint = internalPrefix + "statement"
+
+// sessionTransaction - The latest transaction of a session.
+type sessionTransaction struct {
+	txnNumber int64
+	started   time.Time
+	// tx is nil once the transaction is over.
+	tx *sql.Tx
+	// commitDone is closed once the commit of the transaction is over, and
+	// committed set when it succeeded, so that a retried commit gets the
+	// same outcome.
+	commitDone chan struct{}
+	committed  bool
+}
+
+// transactionFields - The session fields of a command.
+type transactionFields struct {
+	session   string
+	txnNumber int64
+	start     bool
+	// inTransaction is set by `autocommit: false`.
+	inTransaction bool
+	// retryable is set for a txnNumber outside of a transaction.
+	retryable bool
+}
+
+func readTransactionFields(query bson.D) transactionFields {
+	m := query.Map()
+	var fields transactionFields
+	if lsid, ok := m["lsid"].(bson.D); ok {
+		fields.session = sessionKey(lsid)
+	}
+	txnNumber, hasTxnNumber := toInt64(m["txnNumber"])
+	fields.txnNumber = txnNumber
+	fields.start = truthy(m["startTransaction"])
+	if autocommit, ok := m["autocommit"]; ok && fields.session != "" {
+		fields.inTransaction = !truthy(autocommit)
+	}
+	fields.retryable = hasTxnNumber && fields.session != "" && !fields.inTransaction
+	return fields
+}
+
+// begin - The SQL transaction a command of a transaction runs in, starting
+// it for the first command. Transactions begin and end outside of mu, since
+// a rollback waits for the statements still running in its transaction.
+func (s *Sessions) begin(ctx *context.Context, fields transactionFields) (*sql.Tx, error) {
+	s.mu.Lock()
+	sess := s.touch(fields.session)
+	txn := sess.txn
+	if !fields.start {
+		defer s.mu.Unlock()
+		if txn == nil || txn.txnNumber != fields.txnNumber || txn.tx == nil {
+			return nil, noSuchTransaction(fields.txnNumber)
+		}
+		return txn.tx, nil
+	}
+
+	var previous *sql.Tx
+	if txn != nil {
+		switch {
+		case fields.txnNumber < txn.txnNumber:
+			s.mu.Unlock()
+			return nil, mongo.NewCommandError(mongo.ErrorCodeTransactionTooOld, "txnNumber %d is less than last txnNumber %d seen in session", fields.txnNumber, txn.txnNumber)
+		case fields.txnNumber == txn.txnNumber:
+			s.mu.Unlock()
+			return nil, mongo.NewCommandError(mongo.ErrorCodeConflictingOperationInProgress, "transaction %d has already been started", fields.txnNumber)
+		case txn.tx != nil:
+			// Starting a transaction aborts the previous one.
+			ctx.Log.Debug("aborting transaction %d of session %s for %d", txn.txnNumber, fields.session, fields.txnNumber)
+			previous = txn.take()
+		}
+	}
+	// The transaction is taken before it begins, so that starting it again
+	// meanwhile conflicts.
+	txn = &sessionTransaction{
+		txnNumber: fields.txnNumber,
+		started:   time.Now(),
+	}
+	sess.txn = txn
+	s.mu.Unlock()
+
+	if previous != nil {
+		previous.Rollback()
+	}
+	// The transaction outlives the request, but not the session.
+	tx, err := ctx.DB.BeginTx(sess.done, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	if s.sessions[fields.session] != sess || sess.txn != txn {
+		// The session ended or started another transaction meanwhile.
+		s.mu.Unlock()
+		tx.Rollback()
+		return nil, noSuchTransaction(fields.txnNumber)
+	}
+	txn.tx = tx
+	s.mu.Unlock()
+	return tx, nil
+}
+
+// take - The SQL transaction of txn, which the caller commits or rolls back
+// after releasing mu. Callers hold mu.
+func (txn *sessionTransaction) take() *sql.Tx {
+	tx := txn.tx
+	txn.tx = nil
+	return tx
+}
+
+// transaction - The transaction of a command, if it is the latest of its
+// session. Callers hold mu.
+func (s *Sessions) transaction(fields transactionFields) *sessionTransaction {
+	sess := s.sessions[fields.session]
+	if sess == nil || sess.txn == nil || sess.txn.txnNumber != fields.txnNumber {
+		return nil
+	}
+	return sess.txn
+}
+
+// active - Whether the transaction of a command is open in CockroachDB.
+func (s *Sessions) active(fields transactionFields) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	txn := s.transaction(fields)
+	return txn != nil && (txn.tx != nil || txn.commitDone != nil)
+}
+
+// commit - Answer commitTransaction. A commit retried while the first one
+// runs waits for its outcome.
+func (s *Sessions) commit(fields transactionFields) (mongo.Op, error) {
+	s.mu.Lock()
+	txn := s.transaction(fields)
+	if txn == nil || (txn.tx == nil && txn.commitDone == nil) {
+		s.mu.Unlock()
+		return nil, noSuchTransaction(fields.txnNumber)
+	}
+	s.touch(fields.session)
+	tx := txn.take()
+	if tx != nil {
+		txn.commitDone = make(chan struct{})
+	}
+	done := txn.commitDone
+	s.mu.Unlock()
+
+	if tx != nil {
+		err := tx.Commit()
+		s.mu.Lock()
+		txn.committed = err == nil
+		s.mu.Unlock()
+		close(done)
+		if err != nil {
+			return nil, transactionError(err, true)
+		}
+		return newReply(bson.D{bson.DocElem{"ok", 1}}), nil
+	}
+
+	<-done
+	s.mu.Lock()
+	committed := txn.committed
+	s.mu.Unlock()
+	if !committed {
+		return nil, noSuchTransaction(fields.txnNumber)
+	}
+	return newReply(bson.D{bson.DocElem{"ok", 1}}), nil
+}
+
+// abort - Answer abortTransaction.
+func (s *Sessions) abort(fields transactionFields) (mongo.Op, error) {
+	s.mu.Lock()
+	txn := s.transaction(fields)
+	if txn == nil || txn.tx == nil {
+		s.mu.Unlock()
+		return nil, noSuchTransaction(fields.txnNumber)
+	}
+	s.touch(fields.session)
+	tx := txn.take()
+	s.mu.Unlock()
+	if err := tx.Rollback(); err != nil {
+		return nil, err
+	}
+	return newReply(bson.D{bson.DocElem{"ok", 1}}), nil
+}
+
+// fail - Roll back a transaction after a command in it failed, which
+// aborts MongoDB transactions too.
+func (s *Sessions) fail(fields transactionFields) {
+	s.mu.Lock()
+	var tx *sql.Tx
+	if txn := s.transaction(fields); txn != nil {
+		tx = txn.take()
+	}
+	s.mu.Unlock()
+	if tx != nil {
+		tx.Rollback()
+	}
+}
+
+// isTransactionEnd - Whether a command ends a transaction.
+func isTransactionEnd(command string) bool {
+	return command == "commitTransaction" || command == "abortTransaction"
+}
+
+// errNoSessions - The failure of translated commands on a proxy without
+// Sessions.
+var errNoSessions = mongo.NewCommandError(mongo.ErrorCodeInternalError, "the proxy has no sessions to translate commands with")
+
+func noSuchTransaction(txnNumber int64) error {
+	return mongo.NewCommandError(mongo.ErrorCodeNoSuchTransaction, "Transaction %d has been aborted.", txnNumber).
+		WithLabels(mongo.ErrorLabelTransientTransactionError)
+}
+
+// transactionError - The failure of a command in a transaction. CockroachDB
+// asks clients to retry transactions that conflicted, which drivers know as
+// a TransientTransactionError. When a commit fails for another reason than
+// the database, it may or may not have happened.
+func transactionError(err error, committing bool) error {
+	if pqErr, ok := errors.Cause(err).(*pq.Error); ok {
+		if pqErr.Code == "40001" {
+			return mongo.NewCommandError(mongo.ErrorCodeWriteConflict, "%s", pqErr.Message).
+				WithLabels(mongo.ErrorLabelTransientTransactionError)
+		}
+		return err
+	}
+	if _, ok := errors.Cause(err).(*mongo.CommandError); !ok && committing {
+		return mongo.NewCommandError(mongo.ErrorCodeInternalError, "%s", err).
+			WithLabels(mongo.ErrorLabelUnknownTransactionCommitResult)
+	}
+	return err
+}
+
+// handleSQL - Answer a query from CockroachDB, inside the SQL transaction
+// of its session if it is part of one. Commands on sessions and their
+// cursors are answered from Sessions.
+func (p *Proxy) handleSQL(ctx *context.Context, query mongo.QueryOp) (mongo.Op, error) {
+	if p.Sessions == nil {
+		return nil, errNoSessions
+	}
+	fields := readTransactionFields(query.Query)
+	_, _, command := commandNamespace(query)
+	if p.refusesTranslation(ctx) {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeUnauthorized, "command %s requires authentication", command)
+	}
+	switch command {
+	case "startSession":
+		return p.Sessions.startSession()
+	case "endSessions", "killSessions", "refreshSessions":
+		return p.Sessions.handleSessions(command, query.Query)
+	case "getMore":
+		return p.Sessions.getMore(query.Query)
+	case "killCursors":
+		return p.Sessions.killCursors(query.Query)
+	case "commitTransaction":
+		return p.Sessions.commit(fields)
+	case "abortTransaction":
+		return p.Sessions.abort(fields)
+	}
+	if !isQuery(ctx, query) {
+		database, collection, command := commandNamespace(query)
+		return nil, mongo.NewCommandError(mongo.ErrorCodeCommandNotFound, "command %s on %s.%s is routed to CockroachDB, which does not support it", command, database, collection)
+	}
+	if isChangeStream(query.Query) {
+		if fields.inTransaction {
+			return nil, mongo.NewCommandError(mongo.ErrorCodeIllegalOperation, "$changeStream cannot run in a transaction")
+		}
+		return p.Sessions.watch(ctx, query, fields.session)
+	}
+	if isTailable(query) {
+		if fields.inTransaction {
+			return nil, mongo.NewCommandError(mongo.ErrorCodeIllegalOperation, "tailable cursors cannot be opened in a transaction")
+		}
+		return p.Sessions.tailQuery(ctx, query, fields.session)
+	}
+	reply, err := p.sessionStatement(ctx, query, fields)
+	if err != nil {
+		return nil, err
+	}
+	return p.Sessions.openCursor(ctx, query.Query, fields.session, reply), nil
+}
+
+// sessionStatement - Run a query inside the SQL transaction of its session
+// if it is part of one, or once per txnNumber if it is a retryable write.
+func (p *Proxy) sessionStatement(ctx *context.Context, query mongo.QueryOp, fields transactionFields) (mongo.Op, error) {
+	_, _, command := commandNamespace(query)
+	if fields.retryable && isRetryableWrite(command) {
+		p.Sessions.use(fields.session)
+		return p.retryableWrite(ctx, query, fields)
+	}
+	if !fields.inTransaction {
+		if fields.session != "" {
+			p.Sessions.use(fields.session)
+		}
+		return handleStatement(ctx, query)
+	}
+
+	tx, err := p.Sessions.begin(ctx, fields)
+	if err != nil {
+		return nil, err
+	}
+	txCtx := *ctx
+	txCtx.Tx = tx
+	txCtx.InTransaction = true
+	reply, err := handleStatement(&txCtx, query)
+	if err != nil {
+		p.Sessions.fail(fields)
+		return nil, transactionError(err, false)
+	}
+	return reply, nil
+}
+
+// probe - Run a statement that fails for missing tables. Inside a
+// transaction a failed statement would abort it, so it runs under a
+// savepoint that is rolled back when it fails.
+func probe(ctx *context.Context, f func() error) error {
+	return savepoint(ctx, probeSavepoint, f)
+}
+
+// savepoint - Run statements under a savepoint when in a transaction, so
+// that only they are rolled back when they fail.
+func savepoint(ctx *context.Context, name string, f func() error) error {
+	if ctx.Tx == nil {
+		return f()
+	}
+	if _, err := ctx.Tx.Exec("SAVEPOINT " + quoteIdent(name)); err != nil {
+		return err
+	}
+	if err := f(); err != nil {
+		if _, rollbackErr := ctx.Tx.Exec("ROLLBACK TO SAVEPOINT " + quoteIdent(name)); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+	_, err := ctx.Tx.Exec("RELEASE SAVEPOINT " + quoteIdent(name))
+	return err
+}
@@ -0,0 +1,389 @@
+package proxy
+
+import (
+	gocontext "context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/lego/mongotunnel/util/context"
+	"github.com/lego/mongotunnel/util/log"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// scriptedDriver - A database/sql connector whose queries are answered by
+// answer, and which records the statements it ran and how its transactions
+// ended. Commits wait for commitWait when it is set, and fail with
+// commitErr.
+type scriptedDriver struct {
+	answer     func(query string, args []driver.NamedValue) (columns []string, rows [][]driver.Value, err error)
+	commitWait chan struct{}
+	commitErr  error
+
+	mu         sync.Mutex
+	statements []string
+	commits    int
+	rollbacks  int
+}
+
+func (d *scriptedDriver) Connect(gocontext.Context) (driver.Conn, error) {
+	return scriptedConn{d}, nil
+}
+
+func (d *scriptedDriver) Driver() driver.Driver {
+	return nil
+}
+
+func (d *scriptedDriver) open(t *testing.T) *sql.DB {
+	db := sql.OpenDB(d)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func (d *scriptedDriver) ran() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.statements...)
+}
+
+func (d *scriptedDriver) ended() (commits, rollbacks int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.commits, d.rollbacks
+}
+
+type scriptedConn struct {
+	d *scriptedDriver
+}
+
+func (c scriptedConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported")
+}
+
+func (c scriptedConn) Close() error {
+	return nil
+}
+
+func (c scriptedConn) Begin() (driver.Tx, error) {
+	return scriptedTx{c.d}, nil
+}
+
+func (c scriptedConn) QueryContext(ctx gocontext.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.d.mu.Lock()
+	c.d.statements = append(c.d.statements, query)
+	c.d.mu.Unlock()
+	if c.d.answer == nil {
+		return &scriptedRows{}, nil
+	}
+	columns, rows, err := c.d.answer(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &scriptedRows{columns: columns, rows: rows}, nil
+}
+
+func (c scriptedConn) ExecContext(ctx gocontext.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.d.mu.Lock()
+	c.d.statements = append(c.d.statements, query)
+	c.d.mu.Unlock()
+	return driver.RowsAffected(0), nil
+}
+
+type scriptedTx struct {
+	d *scriptedDriver
+}
+
+func (tx scriptedTx) Commit() error {
+	if tx.d.commitWait != nil {
+		<-tx.d.commitWait
+	}
+	tx.d.mu.Lock()
+	defer tx.d.mu.Unlock()
+	tx.d.commits++
+	return tx.d.commitErr
+}
+
+func (tx scriptedTx) Rollback() error {
+	tx.d.mu.Lock()
+	defer tx.d.mu.Unlock()
+	tx.d.rollbacks++
+	return nil
+}
+
+type scriptedRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *scriptedRows) Columns() []string {
+	return r.columns
+}
+
+func (r *scriptedRows) Close() error {
+	return nil
+}
+
+func (r *scriptedRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func newSQLContext(db *sql.DB) *context.Context {
+	ctx := context.NewContext(&log.NullLogger{})
+	ctx.SetDB(db)
+	return ctx
+}
+
+func commandErrorCode(err error) mongo.ErrorCode {
+	if cmdErr, ok := errors.Cause(err).(*mongo.CommandError); ok {
+		return cmdErr.Code
+	}
+	return 0
+}
+
+func TestReadTransactionFields(t *testing.T) {
+	lsid := bson.D{bson.DocElem{"id", bson.Binary{Kind: 4, Data: []byte("0123456789abcdef")}}}
+	session := sessionKey(lsid)
+	tests := []struct {
+		name  string
+		query bson.D
+		want  transactionFields
+	}{
+		{
+			name:  "no session",
+			query: bson.D{bson.DocElem{"insert", "t"}, bson.DocElem{"txnNumber", int64(1)}, bson.DocElem{"autocommit", false}},
+			want:  transactionFields{txnNumber: 1},
+		},
+		{
+			name:  "session",
+			query: bson.D{bson.DocElem{"find", "t"}, bson.DocElem{"lsid", lsid}},
+			want:  transactionFields{session: session},
+		},
+		{
+			name:  "retryable write",
+			query: bson.D{bson.DocElem{"insert", "t"}, bson.DocElem{"lsid", lsid}, bson.DocElem{"txnNumber", int64(3)}},
+			want:  transactionFields{session: session, txnNumber: 3, retryable: true},
+		},
+		{
+			name: "transaction start",
+			query: bson.D{
+				bson.DocElem{"insert", "t"}, bson.DocElem{"lsid", lsid}, bson.DocElem{"txnNumber", 4},
+				bson.DocElem{"startTransaction", true}, bson.DocElem{"autocommit", false},
+			},
+			want: transactionFields{session: session, txnNumber: 4, start: true, inTransaction: true},
+		},
+		{
+			name:  "transaction",
+			query: bson.D{bson.DocElem{"find", "t"}, bson.DocElem{"lsid", lsid}, bson.DocElem{"txnNumber", int64(4)}, bson.DocElem{"autocommit", false}},
+			want:  transactionFields{session: session, txnNumber: 4, inTransaction: true},
+		},
+		{
+			name:  "autocommit",
+			query: bson.D{bson.DocElem{"insert", "t"}, bson.DocElem{"lsid", lsid}, bson.DocElem{"txnNumber", int64(5)}, bson.DocElem{"autocommit", true}},
+			want:  transactionFields{session: session, txnNumber: 5, retryable: true},
+		},
+	}
+	for _, test := range tests {
+		if got := readTransactionFields(test.query); got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSessionsBegin(t *testing.T) {
+	d := &scriptedDriver{}
+	ctx := newSQLContext(d.open(t))
+	s := NewSessions()
+	defer s.Close()
+	fields := func(txnNumber int64, start bool) transactionFields {
+		return transactionFields{session: "s", txnNumber: txnNumber, start: start, inTransaction: true}
+	}
+
+	if _, err := s.begin(ctx, fields(5, false)); commandErrorCode(err) != mongo.ErrorCodeNoSuchTransaction {
+		t.Errorf("continuing a transaction that never started: %v, want NoSuchTransaction", err)
+	}
+	first, err := s.begin(ctx, fields(5, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx, err := s.begin(ctx, fields(5, false)); err != nil || tx != first {
+		t.Errorf("continuing transaction 5: %v, got another transaction %t", err, tx != first)
+	}
+
+	tests := []struct {
+		name   string
+		fields transactionFields
+		code   mongo.ErrorCode
+	}{
+		{"restart", fields(5, true), mongo.ErrorCodeConflictingOperationInProgress},
+		{"older", fields(4, true), mongo.ErrorCodeTransactionTooOld},
+		{"continue newer", fields(6, false), mongo.ErrorCodeNoSuchTransaction},
+	}
+	for _, test := range tests {
+		if _, err := s.begin(ctx, test.fields); commandErrorCode(err) != test.code {
+			t.Errorf("%s: %v, want code %d", test.name, err, test.code)
+		}
+	}
+	if _, rollbacks := d.ended(); rollbacks != 0 {
+		t.Fatalf("rejected commands rolled back %d transactions", rollbacks)
+	}
+
+	// A newer transaction aborts the open one.
+	if _, err := s.begin(ctx, fields(7, true)); err != nil {
+		t.Fatal(err)
+	}
+	if _, rollbacks := d.ended(); rollbacks != 1 {
+		t.Errorf("starting transaction 7 rolled back %d transactions, want 1", rollbacks)
+	}
+	if _, err := s.begin(ctx, fields(5, false)); commandErrorCode(err) != mongo.ErrorCodeNoSuchTransaction {
+		t.Errorf("continuing aborted transaction 5: %v, want NoSuchTransaction", err)
+	}
+}
+
+func TestRetriedCommit(t *testing.T) {
+	fields := transactionFields{session: "s", txnNumber: 1, start: true, inTransaction: true}
+	commit := func(s *Sessions) <-chan error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := s.commit(fields)
+			done <- err
+		}()
+		return done
+	}
+
+	t.Run("committed", func(t *testing.T) {
+		d := &scriptedDriver{commitWait: make(chan struct{})}
+		s := NewSessions()
+		defer s.Close()
+		if _, err := s.begin(newSQLContext(d.open(t)), fields); err != nil {
+			t.Fatal(err)
+		}
+		first := commit(s)
+		// The retried commit arrives once the commit has taken the
+		// transaction.
+		for {
+			s.mu.Lock()
+			taken := s.transaction(fields).commitDone != nil
+			s.mu.Unlock()
+			if taken {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		retried := commit(s)
+		select {
+		case err := <-retried:
+			t.Fatalf("the retried commit answered %v before the commit ended", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+		close(d.commitWait)
+		for name, done := range map[string]<-chan error{"commit": first, "retried commit": retried} {
+			if err := <-done; err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+		}
+		if err := <-commit(s); err != nil {
+			t.Errorf("commit retried after the commit: %v", err)
+		}
+		if commits, _ := d.ended(); commits != 1 {
+			t.Errorf("committed %d times, want 1", commits)
+		}
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		d := &scriptedDriver{commitErr: errors.New("connection reset")}
+		s := NewSessions()
+		defer s.Close()
+		if _, err := s.begin(newSQLContext(d.open(t)), fields); err != nil {
+			t.Fatal(err)
+		}
+		err := <-commit(s)
+		cmdErr, ok := errors.Cause(err).(*mongo.CommandError)
+		if !ok || !hasLabel(cmdErr, mongo.ErrorLabelUnknownTransactionCommitResult) {
+			t.Errorf("failed commit: %v, want UnknownTransactionCommitResult", err)
+		}
+		if err := <-commit(s); commandErrorCode(err) != mongo.ErrorCodeNoSuchTransaction {
+			t.Errorf("commit retried after a failed commit: %v, want NoSuchTransaction", err)
+		}
+	})
+}
+
+func hasLabel(err *mongo.CommandError, label string) bool {
+	for _, l := range err.Labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTransactionError(t *testing.T) {
+	duplicate := mongo.NewCommandError(mongo.ErrorCodeDuplicateKey, "duplicate key")
+	tests := []struct {
+		name       string
+		err        error
+		committing bool
+		code       mongo.ErrorCode
+		label      string
+	}{
+		{name: "retry", err: &pq.Error{Code: "40001", Message: "restart transaction"}, code: mongo.ErrorCodeWriteConflict, label: mongo.ErrorLabelTransientTransactionError},
+		{name: "retry on commit", err: errors.Wrap(&pq.Error{Code: "40001"}, "commit"), committing: true, code: mongo.ErrorCodeWriteConflict, label: mongo.ErrorLabelTransientTransactionError},
+		{name: "command error", err: duplicate, committing: true, code: mongo.ErrorCodeDuplicateKey},
+		{name: "lost commit", err: errors.New("driver: bad connection"), committing: true, code: mongo.ErrorCodeInternalError, label: mongo.ErrorLabelUnknownTransactionCommitResult},
+	}
+	for _, test := range tests {
+		err := transactionError(test.err, test.committing)
+		cmdErr, ok := errors.Cause(err).(*mongo.CommandError)
+		if !ok || cmdErr.Code != test.code {
+			t.Errorf("%s: got %v, want code %d", test.name, err, test.code)
+			continue
+		}
+		if test.label != "" && !hasLabel(cmdErr, test.label) {
+			t.Errorf("%s: got labels %v, want %s", test.name, cmdErr.Labels, test.label)
+		}
+	}
+
+	// Other errors pass through.
+	for _, err := range []error{&pq.Error{Code: "23505"}, errors.New("driver: bad connection")} {
+		if got := transactionError(err, false); got != err {
+			t.Errorf("got %v, want %v unchanged", got, err)
+		}
+	}
+}
+
+func TestSessionsClose(t *testing.T) {
+	d := &scriptedDriver{}
+	s := NewSessions()
+	fields := transactionFields{session: "s", txnNumber: 1, start: true, inTransaction: true}
+	if _, err := s.begin(newSQLContext(d.open(t)), fields); err != nil {
+		t.Fatal(err)
+	}
+	swept := make(chan struct{})
+	go func() {
+		s.sweepEvery(time.Millisecond)
+		close(swept)
+	}()
+
+	s.Close()
+	select {
+	case <-swept:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sweeping went on after Close")
+	}
+	if sessions, _ := s.counts(); sessions != 0 {
+		t.Errorf("%d sessions are open after Close", sessions)
+	}
+	if _, rollbacks := d.ended(); rollbacks != 1 {
+		t.Errorf("Close rolled back %d transactions, want 1", rollbacks)
+	}
+}
@@ -0,0 +1,368 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// errUpstreamClosed - Returned by send when the connection was already
+// closed, so nothing was written and the request can be retried elsewhere.
+var errUpstreamClosed = errors.New("upstream connection closed")
+
+// ReplyFunc - Receives the upstream reply to a forwarded message, or the
+// error that ended the upstream connection before a reply arrived.
+type ReplyFunc func(msg *mongo.Message, err error)
+
+// Upstream - Carries client messages to the remote mongod. Each message is
+// sent with the callback that should receive its replies.
+type Upstream interface {
+	Send(msg *mongo.Message, reply ReplyFunc) error
+	Close() error
+}
+
+// requestInfo - What is needed from a client message to route it upstream
+// and to track the cursors it touches.
+type requestInfo struct {
+	expectsReply bool
+	exhaust      bool
+	// cursorID is the cursor continued by a getMore.
+	cursorID int64
+	// killedCursors are the cursors closed by a killCursors.
+	killedCursors []int64
+	// session is the logical session ID the command runs in.
+	session string
+	// sticky is set when the message after this one must go to the same
+	// upstream connection: unacknowledged writes followed by
+	// getLastError.
+	sticky bool
+	// authenticates is set by commands that change who the upstream
+	// connection is authenticated as.
+	authenticates bool
+}
+
+func inspectRequest(msg *mongo.Message) requestInfo {
+	var info requestInfo
+	switch msg.Head.Opcode {
+	case mongo.Opcode_MSG:
+		info.expectsReply = true
+		msgOp := mongo.MsgOp{}
+		if err := msgOp.ReadFromBuffer(msg.BodyBuffer()); err != nil {
+			return info
+		}
+		// With moreToCome the remote does not answer at all.
+		info.expectsReply = msgOp.Flags&mongo.MsgFlagMoreToCome == 0
+		info.exhaust = msgOp.Flags&mongo.MsgFlagExhaustAllowed != 0
+		inspectCommand(msgOp.Body, &info)
+	case mongo.Opcode_COMPRESSED:
+		// The flags and command are compressed, so only the opcode tells
+		// whether a reply follows. A compressed OP_MSG with moreToCome
+		// stays pending until the connection closes.
+		original, ok := mongo.CompressedOpcode(msg.Body)
+		info.expectsReply = !ok || expectsReply(original)
+		info.sticky = ok && isLegacyWrite(original)
+	case mongo.Opcode_QUERY:
+		info.expectsReply = true
+		queryOp := mongo.QueryOp{}
+		if err := queryOp.ReadFromBuffer(msg.BodyBuffer()); err != nil {
+			return info
+		}
+		info.exhaust = queryOp.Flags&mongo.QueryFlagExhaust != 0
+		inspectCommand(queryOp.Query, &info)
+	case mongo.Opcode_COMMAND:
+		info.expectsReply = true
+		commandOp := mongo.CommandOp{}
+		if err := commandOp.ReadFromBuffer(msg.BodyBuffer()); err != nil {
+			return info
+		}
+		inspectCommand(commandOp.CommandArgs, &info)
+	case mongo.Opcode_GET_MORE:
+		info.expectsReply = true
+		getMoreOp := mongo.GetMoreOp{}
+		if err := getMoreOp.ReadFromBuffer(msg.BodyBuffer()); err == nil {
+			info.cursorID = getMoreOp.CursorID
+		}
+	case mongo.Opcode_KILL_CURSORS:
+		killCursorsOp := mongo.KillCursorsOp{}
+		if err := killCursorsOp.ReadFromBuffer(msg.BodyBuffer()); err == nil {
+			info.killedCursors = killCursorsOp.CursorIDs
+		}
+	case mongo.Opcode_INSERT, mongo.Opcode_UPDATE, mongo.Opcode_DELETE:
+		info.sticky = true
+	default:
+		info.expectsReply = expectsReply(msg.Head.Opcode)
+	}
+	return info
+}
+
+// expectsReply - Whether the remote answers requests of the opcode, before
+// looking at their flags.
+func expectsReply(opcode mongo.Opcode) bool {
+	return opcode != mongo.Opcode_KILL_CURSORS && !isLegacyWrite(opcode)
+}
+
+func isLegacyWrite(opcode mongo.Opcode) bool {
+	return opcode == mongo.Opcode_INSERT || opcode == mongo.Opcode_UPDATE || opcode == mongo.Opcode_DELETE
+}
+
+func inspectCommand(cmd bson.D, info *requestInfo) {
+	if len(cmd) == 0 {
+		return
+	}
+	switch cmd[0].Name {
+	case "getMore":
+		info.cursorID, _ = toInt64(cmd[0].Value)
+	case "killCursors":
+		if cursors, ok := cmd.Map()["cursors"].([]interface{}); ok {
+			for _, c := range cursors {
+				if id, ok := toInt64(c); ok {
+					info.killedCursors = append(info.killedCursors, id)
+				}
+			}
+		}
+	case "saslStart", "saslContinue", "authenticate", "logout":
+		info.authenticates = true
+	}
+	// A handshake may authenticate the connection too.
+	if _, ok := cmd.Map()["speculativeAuthenticate"]; ok {
+		info.authenticates = true
+	}
+	if lsid, ok := cmd.Map()["lsid"].(bson.D); ok {
+		info.session = sessionKey(lsid)
+	}
+}
+
+// inspectReply - Return the cursor left open by a reply, and whether the
+// reply reports that the requested cursor no longer exists.
+func inspectReply(msg *mongo.Message) (cursorID int64, cursorGone bool) {
+	if msg.Head.Opcode == mongo.Opcode_MSG {
+		msgOp := mongo.MsgOp{}
+		if err := msgOp.ReadFromBuffer(msg.BodyBuffer()); err != nil {
+			return 0, false
+		}
+		if cursor, ok := msgOp.Body.Map()["cursor"].(bson.D); ok {
+			cursorID, _ = toInt64(cursor.Map()["id"])
+		}
+		return cursorID, false
+	}
+	if msg.Head.Opcode != mongo.Opcode_REPLY {
+		return 0, false
+	}
+	replyOp := mongo.ReplyOp{}
+	err := replyOp.ReadFromBuffer(msg.BodyBuffer())
+	if replyOp.Flags&mongo.ReplyFlagCursorNotFound != 0 {
+		return 0, true
+	}
+	if replyOp.CursorID != 0 || err != nil {
+		return replyOp.CursorID, false
+	}
+	if cursor, ok := replyOp.Documents.Map()["cursor"].(bson.D); ok {
+		cursorID, _ = toInt64(cursor.Map()["id"])
+	}
+	return cursorID, false
+}
+
+func sessionKey(lsid bson.D) string {
+	if id, ok := lsid.Map()["id"].(bson.Binary); ok {
+		return fmt.Sprintf("%x", id.Data)
+	}
+	return fmt.Sprintf("%v", lsid)
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return n, true
+	case int:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case float64:
+		return int64(n), true
+	}
+	return 0, false
+}
+
+type pendingRequest struct {
+	requestID int32
+	cursorID  int64
+	exhaust   bool
+	reply     ReplyFunc
+}
+
+// upstreamConn - A single connection to the remote. Requests are given
+// connection-unique request IDs so that several clients can share it, and
+// replies are mapped back to the ID the client used.
+type upstreamConn struct {
+	conn net.Conn
+	// onReply and onClose let the owner track cursors and failures.
+	onReply func(c *upstreamConn, req *pendingRequest, msg *mongo.Message)
+	onClose func(c *upstreamConn, err error)
+
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	pending  map[int32]*pendingRequest
+	nextID   int32
+	lastUsed time.Time
+	closed   bool
+}
+
+func newUpstreamConn(conn net.Conn) *upstreamConn {
+	return &upstreamConn{
+		conn:     conn,
+		pending:  make(map[int32]*pendingRequest),
+		lastUsed: time.Now(),
+	}
+}
+
+func (c *upstreamConn) start() {
+	go c.readLoop()
+}
+
+func (c *upstreamConn) send(msg *mongo.Message, info requestInfo, reply ReplyFunc) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return errUpstreamClosed
+	}
+	c.nextID++
+	out := *msg
+	out.Head.ResponseID = c.nextID
+	if info.expectsReply {
+		c.pending[out.Head.ResponseID] = &pendingRequest{
+			requestID: msg.Head.ResponseID,
+			cursorID:  info.cursorID,
+			exhaust:   info.exhaust,
+			reply:     reply,
+		}
+	}
+	c.lastUsed = time.Now()
+	c.mu.Unlock()
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := out.WriteTo(c.conn); err != nil {
+		c.close(err)
+		return errors.Wrap(err, "failed to write to upstream")
+	}
+	return nil
+}
+
+func (c *upstreamConn) readLoop() {
+	for {
+		msg, err := mongo.ReadMessage(c.conn)
+		if err != nil {
+			c.close(err)
+			return
+		}
+
+		c.mu.Lock()
+		req, ok := c.pending[msg.Head.ResponseTo]
+		if ok {
+			delete(c.pending, msg.Head.ResponseTo)
+		}
+		c.lastUsed = time.Now()
+		c.mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		if req.exhaust && moreToCome(msg) {
+			// Exhaust replies answer the previous reply rather than
+			// the original request.
+			c.mu.Lock()
+			c.pending[msg.Head.ResponseID] = req
+			c.mu.Unlock()
+		}
+
+		msg.Head.ResponseTo = req.requestID
+		if c.onReply != nil {
+			c.onReply(c, req, msg)
+		}
+		req.reply(msg, nil)
+	}
+}
+
+// moreToCome - Whether the remote follows an exhaust reply with another.
+func moreToCome(msg *mongo.Message) bool {
+	if msg.Head.Opcode == mongo.Opcode_MSG {
+		return len(msg.Body) >= 4 && mongo.MsgOpFlags(binary.LittleEndian.Uint32(msg.Body))&mongo.MsgFlagMoreToCome != 0
+	}
+	cursorID, _ := inspectReply(msg)
+	return cursorID != 0
+}
+
+func (c *upstreamConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *upstreamConn) inflight() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
+}
+
+func (c *upstreamConn) idleSince() (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastUsed, len(c.pending) == 0
+}
+
+// close - Close the connection and fail every request still waiting on it.
+func (c *upstreamConn) close(err error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	pending := c.pending
+	c.pending = make(map[int32]*pendingRequest)
+	c.mu.Unlock()
+
+	c.conn.Close()
+	if err == nil {
+		err = errUpstreamClosed
+	}
+	for _, req := range pending {
+		req.reply(nil, err)
+	}
+	if c.onClose != nil {
+		c.onClose(c, err)
+	}
+}
+
+// dedicatedUpstream - One upstream connection owned by a single client,
+// which is how the proxy has always worked.
+type dedicatedUpstream struct {
+	conn *upstreamConn
+}
+
+// newDedicatedUpstream - Wrap conn. onClose is called once when the remote
+// closes the connection or it fails.
+func newDedicatedUpstream(conn net.Conn, onClose func(error)) *dedicatedUpstream {
+	u := &dedicatedUpstream{conn: newUpstreamConn(conn)}
+	u.conn.onClose = func(_ *upstreamConn, err error) {
+		onClose(err)
+	}
+	u.conn.start()
+	return u
+}
+
+func (u *dedicatedUpstream) Send(msg *mongo.Message, reply ReplyFunc) error {
+	return u.conn.send(msg, inspectRequest(msg), reply)
+}
+
+func (u *dedicatedUpstream) Close() error {
+	u.conn.close(nil)
+	return nil
+}
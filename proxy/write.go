@@ -0,0 +1,652 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lego/mongotunnel/mongo"
+	"github.com/lego/mongotunnel/util/context"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Writes turn documents into rows. Fields without a column get a JSONB
+// column first, see addColumns. JSONB columns store values as JSON with
+// ObjectIds as hex strings and dates as RFC 3339 strings, which is what
+// filters compare against. _id is the TEXT primary key.
+
+// handleInsert - Answer insert, one INSERT per document so that an ordered
+// insert stops at the first failing document like in MongoDB.
+func handleInsert(ctx *context.Context, query mongo.QueryOp) (mongo.Op, error) {
+	databaseName := strings.Split(query.Collection, ".")[0]
+	tableName, ok := query.Query[0].Value.(string)
+	if !ok {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "collection name has invalid type %T", query.Query[0].Value)
+	}
+	m := query.Query.Map()
+	docs, ok := m["documents"].([]interface{})
+	if !ok {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "insert needs a 'documents' array")
+	}
+	ns := fmt.Sprintf("%s.%s", databaseName, tableName)
+
+	var fields []string
+	for _, v := range docs {
+		if doc, ok := v.(bson.D); ok {
+			fields = append(fields, topLevelFields(doc)...)
+		}
+	}
+	columns, err := writableColumns(ctx, databaseName, tableName, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	n := 0
+	var writeErrors []interface{}
+	for i, v := range docs {
+		doc, ok := v.(bson.D)
+		if !ok {
+			return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "documents to insert must be objects")
+		}
+		err := savepoint(ctx, statementSavepoint, func() error {
+			_, err := insertDocument(ctx, databaseName, tableName, columns, doc)
+			return err
+		})
+		if err == nil {
+			n++
+			continue
+		}
+		writeErr, err := writeError(ctx, ns, i, err)
+		if err != nil {
+			return nil, err
+		}
+		writeErrors = append(writeErrors, writeErr)
+		if orderedWrites(m) {
+			break
+		}
+	}
+	return writeReply(bson.D{bson.DocElem{"n", n}}, writeErrors), nil
+}
+
+// handleDelete - Answer delete with a DELETE per statement.
+func handleDelete(ctx *context.Context, query mongo.QueryOp) (mongo.Op, error) {
+	databaseName := strings.Split(query.Collection, ".")[0]
+	tableName, ok := query.Query[0].Value.(string)
+	if !ok {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "collection name has invalid type %T", query.Query[0].Value)
+	}
+	m := query.Query.Map()
+	deletes, ok := m["deletes"].([]interface{})
+	if !ok {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "delete needs a 'deletes' array")
+	}
+	ns := fmt.Sprintf("%s.%s", databaseName, tableName)
+
+	columns, err := tableColumns(ctx, databaseName, tableName)
+	if isUndefinedTable(err) {
+		return writeReply(bson.D{bson.DocElem{"n", 0}}, nil), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var n int64
+	var writeErrors []interface{}
+	for i, v := range deletes {
+		spec, ok := v.(bson.D)
+		if !ok {
+			return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "delete statements must be objects")
+		}
+		statement := spec.Map()
+		q, _ := statement["q"].(bson.D)
+		limit, _ := toInt64(statement["limit"])
+		var deleted int64
+		err := savepoint(ctx, statementSavepoint, func() (err error) {
+			deleted, err = deleteDocuments(ctx, databaseName, tableName, columns, q, limit == 1)
+			return err
+		})
+		if err == nil {
+			n += deleted
+			continue
+		}
+		writeErr, err := writeError(ctx, ns, i, err)
+		if err != nil {
+			return nil, err
+		}
+		writeErrors = append(writeErrors, writeErr)
+		if orderedWrites(m) {
+			break
+		}
+	}
+	return writeReply(bson.D{bson.DocElem{"n", int(n)}}, writeErrors), nil
+}
+
+// handleUpdate - Answer update with an UPDATE per statement, inserting the
+// document of an upsert that matched nothing.
+func handleUpdate(ctx *context.Context, query mongo.QueryOp) (mongo.Op, error) {
+	databaseName := strings.Split(query.Collection, ".")[0]
+	tableName, ok := query.Query[0].Value.(string)
+	if !ok {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "collection name has invalid type %T", query.Query[0].Value)
+	}
+	m := query.Query.Map()
+	updates, ok := m["updates"].([]interface{})
+	if !ok {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "update needs an 'updates' array")
+	}
+	ns := fmt.Sprintf("%s.%s", databaseName, tableName)
+
+	var matched, modified int64
+	var upserted, writeErrors []interface{}
+	for i, v := range updates {
+		spec, ok := v.(bson.D)
+		if !ok {
+			return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "update statements must be objects")
+		}
+		statement := spec.Map()
+		q, _ := statement["q"].(bson.D)
+		var n, changed int64
+		var id interface{}
+		err := savepoint(ctx, statementSavepoint, func() (err error) {
+			n, changed, id, err = updateDocuments(ctx, databaseName, tableName, q, statement["u"], truthy(statement["multi"]), truthy(statement["upsert"]))
+			return err
+		})
+		if err == nil {
+			matched += n
+			modified += changed
+			if id != nil {
+				upserted = append(upserted, bson.D{{"index", i}, {"_id", id}})
+			}
+			continue
+		}
+		writeErr, err := writeError(ctx, ns, i, err)
+		if err != nil {
+			return nil, err
+		}
+		writeErrors = append(writeErrors, writeErr)
+		if orderedWrites(m) {
+			break
+		}
+	}
+
+	reply := bson.D{
+		bson.DocElem{"n", int(matched) + len(upserted)},
+		bson.DocElem{"nModified", int(modified)},
+	}
+	if len(upserted) > 0 {
+		reply = append(reply, bson.DocElem{"upserted", upserted})
+	}
+	return writeReply(reply, writeErrors), nil
+}
+
+// insertDocument - Insert one document, giving it an ObjectId if it has no
+// _id. Returns the _id.
+func insertDocument(ctx *context.Context, databaseName, tableName string, columns []column, doc bson.D) (interface{}, error) {
+	id, ok := doc.Map()["_id"]
+	if !ok {
+		id = bson.NewObjectId()
+		doc = append(bson.D{{"_id", id}}, doc...)
+	}
+
+	isJSON := make(map[string]bool, len(columns))
+	for _, col := range columns {
+		isJSON[col.name] = col.json
+	}
+	names := make([]string, len(doc))
+	values := make([]string, len(doc))
+	args := make([]interface{}, len(doc))
+	for i, elem := range doc {
+		arg, err := sqlArgument(elem.Value, isJSON[elem.Name])
+		if err != nil {
+			return nil, err
+		}
+		names[i] = quoteIdent(elem.Name)
+		values[i] = fmt.Sprintf("$%d", i+1)
+		if isJSON[elem.Name] {
+			values[i] += "::JSONB"
+		}
+		args[i] = arg
+	}
+	statement := fmt.Sprintf("INSERT INTO %s.%s (%s) VALUES (%s)", quoteIdent(databaseName), quoteIdent(tableName), strings.Join(names, ", "), strings.Join(values, ", "))
+	ctx.Log.Debug("sql=%s args=%v", statement, args)
+	if _, err := ctx.SQL().Exec(statement, args...); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// deleteDocuments - Delete the documents matching q, or only the first one.
+func deleteDocuments(ctx *context.Context, databaseName, tableName string, columns []column, q bson.D, justOne bool) (int64, error) {
+	statement, args, err := deleteStatement(databaseName, tableName, columns, q, justOne)
+	if err != nil {
+		return 0, err
+	}
+	ctx.Log.Debug("sql=%s args=%v", statement, args)
+	result, err := ctx.SQL().Exec(statement, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// deleteStatement - The DELETE of the documents matching q, or only the
+// first one.
+func deleteStatement(databaseName, tableName string, columns []column, q bson.D, justOne bool) (string, []interface{}, error) {
+	compiler := newPipelineCompiler(databaseName, tableName, columns, nil)
+	cond, err := compiler.filter(compiler.block, q)
+	if err != nil {
+		return "", nil, err
+	}
+	statement := fmt.Sprintf("DELETE FROM %s.%s WHERE %s", quoteIdent(databaseName), quoteIdent(tableName), cond)
+	if justOne {
+		statement += " LIMIT 1"
+	}
+	return statement, compiler.args, nil
+}
+
+// updateDocuments - Update the documents matching q, or only the first one.
+// Returns how many matched and how many of those actually changed, as
+// nModified counts them. An upsert that matched nothing inserts a document
+// and returns its _id.
+func updateDocuments(ctx *context.Context, databaseName, tableName string, q bson.D, u interface{}, multi, upsert bool) (matched, modified int64, id interface{}, err error) {
+	update, ok := u.(bson.D)
+	if !ok {
+		if _, ok := u.([]interface{}); ok {
+			return 0, 0, nil, mongo.NewCommandError(mongo.ErrorCodeNotImplemented, "updates with an aggregation pipeline are not supported by the SQL translator")
+		}
+		return 0, 0, nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "the update must be an object")
+	}
+	replacement := len(update) == 0 || !strings.HasPrefix(update[0].Name, "$")
+	if replacement && multi {
+		return 0, 0, nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "multi update is not supported for replacement-style update")
+	}
+
+	var fields []string
+	if replacement {
+		fields = topLevelFields(update)
+	} else {
+		for _, op := range update {
+			if spec, ok := op.Value.(bson.D); ok {
+				fields = append(fields, topLevelFields(spec)...)
+			}
+		}
+	}
+	columns, err := tableColumns(ctx, databaseName, tableName)
+	switch {
+	case isUndefinedTable(err) && !upsert:
+		return 0, 0, nil, nil
+	case isUndefinedTable(err) || err == nil:
+		if columns, err = writableColumns(ctx, databaseName, tableName, fields); err != nil {
+			return 0, 0, nil, err
+		}
+	default:
+		return 0, 0, nil, err
+	}
+
+	compiler := newPipelineCompiler(databaseName, tableName, columns, nil)
+	cond, err := compiler.filter(compiler.block, q)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	names, values, err := compiler.updateSets(update, replacement)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if len(names) == 0 {
+		// Nothing changes, but the documents still match.
+		names, values = []string{"_id"}, []string{`"_id"`}
+	}
+	statement := updateStatement(databaseName, tableName, cond, names, values, multi)
+	ctx.Log.Debug("sql=%s args=%v", statement, compiler.args)
+	if err := ctx.SQL().QueryRow(statement, compiler.args...).Scan(&matched, &modified); err != nil {
+		return 0, 0, nil, err
+	}
+	if matched > 0 || !upsert {
+		return matched, modified, nil, nil
+	}
+
+	doc := upsertDocument(q, update, replacement)
+	if columns, err = addColumns(ctx, databaseName, tableName, columns, topLevelFields(doc)); err != nil {
+		return 0, 0, nil, err
+	}
+	id, err = insertDocument(ctx, databaseName, tableName, columns, doc)
+	return 0, 0, id, err
+}
+
+// updateStatement - The UPDATE of the documents matching cond, or only the
+// first one, setting each column of names to the value at the same index.
+// It returns how many documents matched and how many it changed, since rows
+// whose columns already hold the new values are left alone.
+func updateStatement(databaseName, tableName, cond string, names, values []string, multi bool) string {
+	table := quoteIdent(databaseName) + "." + quoteIdent(tableName)
+	sets := make([]string, len(names))
+	columns := make([]string, len(names))
+	for i, name := range names {
+		columns[i] = quoteIdent(name)
+		sets[i] = columns[i] + " = " + values[i]
+	}
+	matched := fmt.Sprintf(`SELECT "_id" FROM %s WHERE %s`, table, cond)
+	if !multi {
+		matched += " LIMIT 1"
+	}
+	return fmt.Sprintf(`WITH "matched" AS (%s), "modified" AS (`+
+		`UPDATE %s SET %s WHERE "_id" IN (SELECT "_id" FROM "matched") AND (%s) IS DISTINCT FROM (%s) RETURNING "_id"`+
+		`) SELECT (SELECT count(*) FROM "matched"), (SELECT count(*) FROM "modified")`,
+		matched, table, strings.Join(sets, ", "), strings.Join(columns, ", "), strings.Join(values, ", "))
+}
+
+// updateSets - The columns an update assigns, and the value of each. Every
+// column is assigned once, so operators on fields inside the same JSONB
+// column apply to it in turn.
+func (c *pipelineCompiler) updateSets(update bson.D, replacement bool) (names, values []string, err error) {
+	b := c.block
+	assigned := make(map[string]string)
+	var order []string
+	set := func(name, expr string) {
+		if _, ok := assigned[name]; !ok {
+			order = append(order, name)
+		}
+		assigned[name] = expr
+	}
+	current := func(name string) string {
+		if expr, ok := assigned[name]; ok {
+			return expr
+		}
+		return quoteIdent(name)
+	}
+	isJSON := make(map[string]bool, len(b.columns))
+	for _, col := range b.columns {
+		isJSON[col.name] = col.json
+	}
+
+	if replacement {
+		// Fields the replacement leaves out are gone.
+		for _, col := range b.columns {
+			if col.name != "_id" && !strings.HasPrefix(col.name, internalPrefix) {
+				set(col.name, "NULL")
+			}
+		}
+		for _, elem := range update {
+			if elem.Name == "_id" {
+				continue
+			}
+			value, err := c.updateValue(elem.Value, isJSON[elem.Name])
+			if err != nil {
+				return nil, nil, err
+			}
+			set(elem.Name, value)
+		}
+	}
+
+	for _, op := range update {
+		if replacement {
+			break
+		}
+		fields, ok := op.Value.(bson.D)
+		if !ok {
+			return nil, nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "Modifiers operate on fields but we found type %T instead", op.Value)
+		}
+		for _, field := range fields {
+			parts := strings.Split(field.Name, ".")
+			name, path := parts[0], parts[1:]
+			if name == "_id" {
+				return nil, nil, mongo.NewCommandError(mongo.ErrorCodeImmutableField, "Performing an update on the path '_id' would modify the immutable field '_id'")
+			}
+			if len(path) > 0 && !isJSON[name] {
+				return nil, nil, mongo.NewCommandError(mongo.ErrorCodeNotImplemented, "cannot update %s, since %s is not a JSONB column", field.Name, name)
+			}
+			jsonColumn := isJSON[name]
+
+			switch op.Name {
+			case "$set":
+				value, err := c.updateValue(field.Value, jsonColumn)
+				if err != nil {
+					return nil, nil, err
+				}
+				if len(path) > 0 {
+					value = jsonbSet(current(name), path, value)
+				}
+				set(name, value)
+			case "$setOnInsert":
+				// Only applies when an upsert inserts.
+			case "$unset":
+				if len(path) > 0 {
+					set(name, current(name)+" #- "+quoteString(pgArray(path)))
+				} else {
+					set(name, "NULL")
+				}
+			case "$inc", "$mul":
+				switch field.Value.(type) {
+				case int, int32, int64, float64:
+				default:
+					return nil, nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "Cannot %s with non-numeric argument: {%s: %v}", strings.TrimPrefix(op.Name, "$"), field.Name, field.Value)
+				}
+				operand, err := c.literal(field.Value)
+				if err != nil {
+					return nil, nil, err
+				}
+				// MongoDB rejects updates touching a path twice, so
+				// the stored value is the old one.
+				old := sqlExpr{quoteIdent(name) + jsonPath(path), jsonColumn}
+				operator := "+"
+				if op.Name == "$mul" {
+					operator = "*"
+				}
+				value := fmt.Sprintf("(COALESCE(%s, 0) %s %s)", numeric(old), operator, operand.sql)
+				if jsonColumn {
+					value = "to_jsonb" + value
+				}
+				if len(path) > 0 {
+					value = jsonbSet(current(name), path, value)
+				}
+				set(name, value)
+			case "$currentDate":
+				value := "now()"
+				if jsonColumn {
+					value = "to_jsonb(now())"
+				}
+				if len(path) > 0 {
+					value = jsonbSet(current(name), path, value)
+				}
+				set(name, value)
+			case "$rename", "$min", "$max", "$push", "$pushAll", "$addToSet", "$pop", "$pull", "$pullAll", "$bit":
+				return nil, nil, mongo.NewCommandError(mongo.ErrorCodeNotImplemented, "%s is not supported by the SQL translator", op.Name)
+			default:
+				return nil, nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "Unknown modifier: %s", op.Name)
+			}
+		}
+	}
+
+	values = make([]string, len(order))
+	for i, name := range order {
+		values[i] = assigned[name]
+	}
+	return order, values, nil
+}
+
+// updateValue - A value written by an update, as JSONB for JSONB columns.
+func (c *pipelineCompiler) updateValue(v interface{}, jsonColumn bool) (string, error) {
+	if jsonColumn {
+		value, err := c.jsonLiteral(v)
+		return value.sql, err
+	}
+	value, err := c.literal(v)
+	return value.sql, err
+}
+
+// jsonbSet - Set the value at a path inside a JSONB document, creating the
+// objects on the way as $set does.
+func jsonbSet(target string, path []string, value string) string {
+	target = "COALESCE(" + target + ", '{}'::JSONB)"
+	if len(path) > 1 {
+		value = jsonbSet(target+jsonPath(path[:1]), path[1:], value)
+	}
+	return fmt.Sprintf("jsonb_set(%s, %s, %s)", target, quoteString(pgArray(path[:1])), value)
+}
+
+// upsertDocument - The document an upsert inserts: the equality conditions
+// of the query with the update applied, or the replacement.
+func upsertDocument(q, update bson.D, replacement bool) bson.D {
+	doc := bson.D{}
+	if replacement {
+		doc = append(doc, update...)
+		if _, ok := doc.Map()["_id"]; ok {
+			return doc
+		}
+		if id, ok := q.Map()["_id"]; ok && !isOperators(id) {
+			doc = append(bson.D{{"_id", id}}, doc...)
+		}
+		return doc
+	}
+
+	for _, elem := range q {
+		if strings.HasPrefix(elem.Name, "$") || isOperators(elem.Value) {
+			continue
+		}
+		if _, ok := elem.Value.(bson.RegEx); ok {
+			continue
+		}
+		doc = setPath(doc, strings.Split(elem.Name, "."), elem.Value)
+	}
+	for _, op := range update {
+		fields, _ := op.Value.(bson.D)
+		for _, field := range fields {
+			path := strings.Split(field.Name, ".")
+			switch op.Name {
+			case "$set", "$setOnInsert", "$inc":
+				doc = setPath(doc, path, field.Value)
+			case "$mul":
+				doc = setPath(doc, path, 0)
+			case "$currentDate":
+				doc = setPath(doc, path, time.Now())
+			}
+		}
+	}
+	return doc
+}
+
+func isOperators(v interface{}) bool {
+	doc, ok := v.(bson.D)
+	return ok && len(doc) > 0 && strings.HasPrefix(doc[0].Name, "$")
+}
+
+// setPath - Set a field at a dotted path, creating the documents on the way.
+func setPath(doc bson.D, path []string, v interface{}) bson.D {
+	for i, elem := range doc {
+		if elem.Name != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			doc[i].Value = v
+		} else {
+			inner, _ := elem.Value.(bson.D)
+			doc[i].Value = setPath(inner, path[1:], v)
+		}
+		return doc
+	}
+	if len(path) == 1 {
+		return append(doc, bson.DocElem{path[0], v})
+	}
+	return append(doc, bson.DocElem{path[0], setPath(bson.D{}, path[1:], v)})
+}
+
+// writableColumns - The columns of a table, creating the table and the
+// columns of fields it does not have yet. CockroachDB cannot write to a
+// column added in the same transaction, so unless the write is part of a
+// client transaction the schema changes commit on their own first.
+func writableColumns(ctx *context.Context, databaseName, tableName string, fields []string) ([]column, error) {
+	if ctx.Tx != nil && !ctx.InTransaction {
+		schemaCtx := *ctx
+		schemaCtx.Tx = nil
+		ctx = &schemaCtx
+	}
+	columns, err := tableColumns(ctx, databaseName, tableName)
+	if isUndefinedTable(err) {
+		if err := createCollection(ctx, databaseName, tableName); err != nil {
+			return nil, err
+		}
+		columns, err = tableColumns(ctx, databaseName, tableName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return addColumns(ctx, databaseName, tableName, columns, fields)
+}
+
+func topLevelFields(doc bson.D) []string {
+	fields := make([]string, len(doc))
+	for i, elem := range doc {
+		fields[i] = strings.Split(elem.Name, ".")[0]
+	}
+	return fields
+}
+
+// sqlArgument - A value as an argument for a column.
+func sqlArgument(v interface{}, isJSON bool) (interface{}, error) {
+	switch v := v.(type) {
+	case bson.D, bson.M, []interface{}:
+		isJSON = true
+	case bson.ObjectId:
+		if !isJSON {
+			return v.Hex(), nil
+		}
+	case bson.Binary:
+		if !isJSON {
+			return v.Data, nil
+		}
+	case int:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	}
+	if !isJSON {
+		return v, nil
+	}
+	b, err := json.Marshal(jsonValue(v))
+	if err != nil {
+		return nil, mongo.NewCommandError(mongo.ErrorCodeBadValue, "%v cannot be converted to JSON: %s", v, err)
+	}
+	return string(b), nil
+}
+
+func orderedWrites(m bson.M) bool {
+	ordered, ok := m["ordered"].(bool)
+	return !ok || ordered
+}
+
+// writeError - The entry of writeErrors for a failed statement. Outside
+// of a client transaction a failed statement does not fail the command, but
+// in one it aborts it.
+func writeError(ctx *context.Context, ns string, index int, err error) (bson.D, error) {
+	if ctx.InTransaction {
+		return nil, err
+	}
+	code, message := mongo.ErrorCode(0), ""
+	switch cause := errors.Cause(err).(type) {
+	case *mongo.CommandError:
+		code, message = cause.Code, cause.Message
+	case *pq.Error:
+		if cause.Code != "23505" {
+			return nil, err
+		}
+		code = mongo.ErrorCodeDuplicateKey
+		message = fmt.Sprintf("E11000 duplicate key error collection: %s index: %s %s", ns, cause.Constraint, cause.Detail)
+	default:
+		return nil, err
+	}
+	return bson.D{
+		bson.DocElem{"index", index},
+		bson.DocElem{"code", int32(code)},
+		bson.DocElem{"errmsg", message},
+	}, nil
+}
+
+func writeReply(reply bson.D, writeErrors []interface{}) *mongo.ReplyOp {
+	if len(writeErrors) > 0 {
+		reply = append(reply, bson.DocElem{"writeErrors", writeErrors})
+	}
+	return newReply(append(reply, bson.DocElem{"ok", 1}))
+}
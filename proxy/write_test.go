@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/lego/mongotunnel/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestUpdateStatement(t *testing.T) {
+	got := updateStatement("db", "items", `"a" = $1`, []string{"a", "b"}, []string{"$2", `"b" + 1`}, false)
+	want := `WITH "matched" AS (SELECT "_id" FROM "db"."items" WHERE "a" = $1 LIMIT 1), "modified" AS (` +
+		`UPDATE "db"."items" SET "a" = $2, "b" = "b" + 1 WHERE "_id" IN (SELECT "_id" FROM "matched") AND ("a", "b") IS DISTINCT FROM ($2, "b" + 1) RETURNING "_id"` +
+		`) SELECT (SELECT count(*) FROM "matched"), (SELECT count(*) FROM "modified")`
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestUpdateReportsModified(t *testing.T) {
+	tests := []struct {
+		name              string
+		update            bson.D
+		matched, modified int64
+	}{
+		{"changed", bson.D{bson.DocElem{"$set", bson.D{bson.DocElem{"a", 2}}}}, 1, 1},
+		{"unchanged", bson.D{bson.DocElem{"$set", bson.D{bson.DocElem{"a", 1}}}}, 1, 0},
+		{"empty", bson.D{bson.DocElem{"$set", bson.D{}}}, 3, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &scriptedDriver{answer: func(query string, args []driver.NamedValue) ([]string, [][]driver.Value, error) {
+				if strings.HasPrefix(query, "WITH") {
+					return []string{"matched", "modified"}, [][]driver.Value{{test.matched, test.modified}}, nil
+				}
+				return []string{"_id", "a"}, nil, nil
+			}}
+			ctx := newSQLContext(d.open(t))
+			reply, err := handleUpdate(ctx, mongo.QueryOp{
+				Collection: "db.$cmd",
+				Query: bson.D{
+					bson.DocElem{"update", "items"},
+					bson.DocElem{"updates", []interface{}{bson.D{
+						bson.DocElem{"q", bson.D{}},
+						bson.DocElem{"u", test.update},
+						bson.DocElem{"multi", true},
+					}}},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc := reply.(*mongo.ReplyOp).Documents.Map()
+			if doc["n"] != int(test.matched) || doc["nModified"] != int(test.modified) {
+				t.Errorf("got n %v, nModified %v, want %d, %d", doc["n"], doc["nModified"], test.matched, test.modified)
+			}
+		})
+	}
+}
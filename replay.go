@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lego/mongotunnel/proxy"
+	"github.com/lego/mongotunnel/util/capture"
+	"github.com/pkg/errors"
+)
+
+// replay - Send the client requests of a capture to a target and report
+// the replies that differ from the captured ones. Fails when any does.
+func replay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	target := flags.String("target", "localhost:9999", "address of the proxy or mongod to replay against")
+	timing := flags.Bool("timing", false, "wait between requests as long as the captured clients did")
+	timeout := flags.Duration("timeout", 30*time.Second, "how long to wait for each reply")
+	ignore := flags.String("ignore", "", "comma separated reply fields to ignore besides the volatile ones, by name or dotted path")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s replay [flags] capture\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	records, err := readCapture(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	r := &proxy.Replayer{
+		Target:  *target,
+		Timing:  *timing,
+		Timeout: *timeout,
+		Out:     os.Stdout,
+	}
+	if *ignore != "" {
+		r.Ignore = strings.Split(*ignore, ",")
+	}
+	stats, err := r.Replay(records)
+	fmt.Printf("replayed %d requests: %d matched, %d differed, %d failed, %d without a captured reply\n",
+		stats.Requests, stats.Matched, stats.Differed, stats.Failed, stats.Unrecorded)
+	if err != nil {
+		return err
+	}
+	if stats.Differed > 0 || stats.Failed > 0 {
+		return errors.New("replies differ from the capture")
+	}
+	return nil
+}
+
+// readCapture - Every record of a capture file.
+func readCapture(name string) ([]capture.Record, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cr, err := capture.NewReader(f)
+	if err != nil {
+		return nil, errors.Wrap(err, name)
+	}
+	var records []capture.Record
+	for {
+		rec, err := cr.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, name)
+		}
+		records = append(records, rec)
+	}
+}
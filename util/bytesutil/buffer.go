@@ -14,6 +14,15 @@ func ReadCString(b *bytes.Buffer) string {
 	return str[:len(str)-1]
 }
 
+// WriteCString - Write s followed by a null terminator.
+func WriteCString(buf io.Writer, s string) error {
+	if _, err := io.WriteString(buf, s); err != nil {
+		return err
+	}
+	_, err := buf.Write([]byte{0x0})
+	return err
+}
+
 func readRawBSON(buf io.Reader) ([]byte, error) {
 	// FIXME(joey): Screw this interface.
 	// if buf.Len() < 4 {
@@ -0,0 +1,140 @@
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A capture file starts with Magic, followed by one record per framed
+// message:
+//
+//	int64   time, in nanoseconds since the Unix epoch
+//	uint64  connection ID
+//	uint8   direction, 0 for messages from the client and 1 for replies to it
+//	uint32  length of the message
+//	[]byte  the message, header included, as it was on the wire
+//
+// Integers are little-endian, like the wire protocol itself.
+
+// Magic - The first bytes of a capture file, ending in the version of the
+// format.
+var Magic = []byte("MTCAP\x00\x00\x01")
+
+// recordHeaderSize - The size of a record before its message.
+const recordHeaderSize = 8 + 8 + 1 + 4
+
+// maxMessageSize - Largest message a record may hold, matching the limit of
+// the wire protocol.
+const maxMessageSize = 48000000
+
+// Direction - Which way a message went.
+type Direction uint8
+
+const (
+	// In - A message from the client.
+	In Direction = 0
+	// Out - A message to the client.
+	Out Direction = 1
+)
+
+func (d Direction) String() string {
+	switch d {
+	case In:
+		return "in"
+	case Out:
+		return "out"
+	default:
+		return fmt.Sprintf("Direction(%d)", uint8(d))
+	}
+}
+
+// Record - A captured message.
+type Record struct {
+	Time      time.Time
+	Conn      uint64
+	Direction Direction
+	Data      []byte
+}
+
+// Writer - Appends records to a capture. Safe for concurrent use by the
+// connections being captured.
+type Writer struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+// NewWriter - Start a capture on w.
+func NewWriter(w io.Writer) (*Writer, error) {
+	cw := &Writer{w: bufio.NewWriter(w)}
+	if _, err := cw.w.Write(Magic); err != nil {
+		return nil, err
+	}
+	return cw, cw.w.Flush()
+}
+
+// Write - Append a record. Each record is flushed, so the capture is
+// readable up to the last message while the proxy runs.
+func (cw *Writer) Write(rec Record) error {
+	var head [recordHeaderSize]byte
+	binary.LittleEndian.PutUint64(head[0:], uint64(rec.Time.UnixNano()))
+	binary.LittleEndian.PutUint64(head[8:], rec.Conn)
+	head[16] = byte(rec.Direction)
+	binary.LittleEndian.PutUint32(head[17:], uint32(len(rec.Data)))
+
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	cw.w.Write(head[:])
+	cw.w.Write(rec.Data)
+	return cw.w.Flush()
+}
+
+// Reader - Reads the records of a capture.
+type Reader struct {
+	r *bufio.Reader
+}
+
+// NewReader - Read a capture from r, checking its magic.
+func NewReader(r io.Reader) (*Reader, error) {
+	cr := &Reader{r: bufio.NewReader(r)}
+	magic := make([]byte, len(Magic))
+	if _, err := io.ReadFull(cr.r, magic); err != nil {
+		return nil, errors.Wrap(err, "failed to read capture header")
+	}
+	if !bytes.Equal(magic, Magic) {
+		return nil, errors.Errorf("not a capture file, or of an unknown version")
+	}
+	return cr, nil
+}
+
+// Next - The next record, or io.EOF after the last one. A record cut short,
+// as by a proxy that was killed, is io.ErrUnexpectedEOF.
+func (cr *Reader) Next() (Record, error) {
+	var head [recordHeaderSize]byte
+	if _, err := io.ReadFull(cr.r, head[:]); err != nil {
+		return Record{}, err
+	}
+	rec := Record{
+		Time:      time.Unix(0, int64(binary.LittleEndian.Uint64(head[0:]))),
+		Conn:      binary.LittleEndian.Uint64(head[8:]),
+		Direction: Direction(head[16]),
+	}
+	n := binary.LittleEndian.Uint32(head[17:])
+	if n > maxMessageSize {
+		return Record{}, errors.Errorf("invalid record length %d", n)
+	}
+	rec.Data = make([]byte, n)
+	if _, err := io.ReadFull(cr.r, rec.Data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Record{}, err
+	}
+	return rec, nil
+}
@@ -0,0 +1,97 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func writeCapture(t *testing.T, records ...Record) []byte {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range records {
+		if err := w.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	records := []Record{
+		{Time: time.Unix(1500000000, 123), Conn: 1, Direction: In, Data: []byte("request")},
+		{Time: time.Unix(1500000001, 0), Conn: 1, Direction: Out, Data: []byte("reply")},
+		{Time: time.Unix(1500000002, 0), Conn: 2, Direction: In, Data: []byte{}},
+	}
+	r, err := NewReader(bytes.NewReader(writeCapture(t, records...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range records {
+		rec, err := r.Next()
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if !rec.Time.Equal(want.Time) || rec.Conn != want.Conn || rec.Direction != want.Direction || !reflect.DeepEqual(rec.Data, want.Data) {
+			t.Errorf("record %d: got %+v, want %+v", i, rec, want)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("got %v after the last record, want io.EOF", err)
+	}
+}
+
+func TestReaderMagic(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short", Magic[:3]},
+		{"other file", []byte("not a capture")},
+		{"other version", append(append([]byte{}, Magic[:len(Magic)-1]...), 2)},
+	}
+	for _, test := range tests {
+		if _, err := NewReader(bytes.NewReader(test.data)); err == nil {
+			t.Errorf("%s: got no error", test.name)
+		}
+	}
+}
+
+func TestReaderTruncated(t *testing.T) {
+	data := writeCapture(t, Record{Time: time.Now(), Conn: 1, Direction: In, Data: []byte("request")})
+	tests := []struct {
+		name string
+		cut  int
+	}{
+		{"in header", len(Magic) + recordHeaderSize/2},
+		{"in message", len(data) - 2},
+	}
+	for _, test := range tests {
+		r, err := NewReader(bytes.NewReader(data[:test.cut]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Next(); err != io.ErrUnexpectedEOF {
+			t.Errorf("%s: got %v, want io.ErrUnexpectedEOF", test.name, err)
+		}
+	}
+}
+
+func TestReaderMessageSize(t *testing.T) {
+	head := make([]byte, recordHeaderSize)
+	binary.LittleEndian.PutUint32(head[17:], maxMessageSize+1)
+	r, err := NewReader(bytes.NewReader(append(append([]byte{}, Magic...), head...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Next(); err == nil || err == io.ErrUnexpectedEOF {
+		t.Errorf("got %v for a record over maxMessageSize", err)
+	}
+}
@@ -1,14 +1,54 @@
 package context
 
 import (
+	gocontext "context"
+	"crypto/tls"
 	"database/sql"
 
 	"github.com/lego/mongotunnel/util/log"
+	"github.com/lego/mongotunnel/util/trace"
 )
 
+// Identity - The user a connection has authenticated as.
+type Identity struct {
+	User      string
+	Database  string
+	Mechanism string
+}
+
+// Queryer - Runs statements, either directly on the database or inside a
+// transaction.
+type Queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
 type Context struct {
 	Log log.Logger
 	DB  *sql.DB
+	// Tx is the transaction a request runs in, if it is part of one.
+	Tx *sql.Tx
+	// InTransaction is set when Tx is a client transaction, which a failed
+	// statement aborts, rather than one the proxy runs a request in.
+	InTransaction bool
+
+	// ConnID identifies the client connection in logs and reports.
+	ConnID uint64
+
+	// TLS is the client connection state when TLS is terminated by the
+	// proxy, and nil otherwise.
+	TLS *tls.ConnectionState
+	// Identity is set once the client has authenticated with the proxy.
+	Identity *Identity
+
+	// Span is the span of the step a request is in, when it is traced.
+	Span *trace.Span
+	// Statements records the SQL statements of a request, when set.
+	Statements *StatementLog
+	// Request is canceled when the request is killed. Statements of the
+	// request run under it when set.
+	Request gocontext.Context
 }
 
 func NewContext(log log.Logger) *Context {
@@ -24,3 +64,133 @@ func (ctx *Context) SetLogger(log log.Logger) {
 func (ctx *Context) SetDB(db *sql.DB) {
 	ctx.DB = db
 }
+
+// SQL - Where the statements of a request run: its transaction if it has
+// one, and the database otherwise. Statements of traced requests get a span
+// each, and those of requests with Statements are recorded there.
+func (ctx *Context) SQL() Queryer {
+	var q contextQueryer = ctx.DB
+	if ctx.Tx != nil {
+		q = ctx.Tx
+	}
+	if ctx.Request != nil {
+		q = requestQueryer{q, ctx.Request}
+	}
+	if ctx.Span != nil || ctx.Statements != nil {
+		return observedQueryer{q, ctx.Span, ctx.Statements, ctx.Tx != nil}
+	}
+	return q
+}
+
+// RequestContext - The context.Context of the request, which is never
+// canceled when it has none.
+func (ctx *Context) RequestContext() gocontext.Context {
+	if ctx.Request == nil {
+		return gocontext.Background()
+	}
+	return ctx.Request
+}
+
+// contextQueryer - A Queryer that also runs statements under a
+// context.Context, as *sql.DB and *sql.Tx do.
+type contextQueryer interface {
+	Queryer
+	ExecContext(ctx gocontext.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx gocontext.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx gocontext.Context, query string, args ...interface{}) *sql.Row
+}
+
+// requestQueryer - Runs statements under the context.Context of a request,
+// so that they are canceled with it.
+type requestQueryer struct {
+	contextQueryer
+	ctx gocontext.Context
+}
+
+func (r requestQueryer) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return r.ExecContext(r.ctx, query, args...)
+}
+
+func (r requestQueryer) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return r.QueryContext(r.ctx, query, args...)
+}
+
+func (r requestQueryer) QueryRow(query string, args ...interface{}) *sql.Row {
+	return r.QueryRowContext(r.ctx, query, args...)
+}
+
+// StartSpan - A copy of ctx in a new step of its request, with the span of
+// the step, which the caller ends. ctx itself is returned when it is not
+// traced.
+func (ctx *Context) StartSpan(name string) (*Context, *trace.Span) {
+	if ctx.Span == nil {
+		return ctx, nil
+	}
+	c := *ctx
+	c.Span = ctx.Span.Child(name)
+	return &c, c.Span
+}
+
+// observedQueryer - Records a client span and a Statement per statement. A
+// query span ends once the first rows arrive, so reading the rest counts
+// toward the span of the caller.
+type observedQueryer struct {
+	q          Queryer
+	span       *trace.Span
+	statements *StatementLog
+	// tx is set when q is a transaction.
+	tx bool
+}
+
+func (o observedQueryer) start(query string, args []interface{}) (*trace.Span, *Statement) {
+	span := o.span.Child("sql")
+	span.SetKind(trace.SpanKindClient)
+	span.SetAttribute("db.system", "cockroachdb")
+	span.SetAttribute("db.statement", query)
+	return span, o.statements.start(query, args, o.tx)
+}
+
+func (o observedQueryer) Exec(query string, args ...interface{}) (sql.Result, error) {
+	span, statement := o.start(query, args)
+	defer span.End()
+	result, err := o.q.Exec(query, args...)
+	span.SetError(err)
+	rows := int64(-1)
+	if err == nil {
+		if n, err := result.RowsAffected(); err == nil {
+			rows = n
+		}
+	}
+	o.statements.finish(statement, rows, err, false)
+	return result, err
+}
+
+func (o observedQueryer) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	span, statement := o.start(query, args)
+	defer span.End()
+	rows, err := o.q.Query(query, args...)
+	span.SetError(err)
+	o.statements.finish(statement, -1, err, true)
+	return rows, err
+}
+
+func (o observedQueryer) QueryRow(query string, args ...interface{}) *sql.Row {
+	span, statement := o.start(query, args)
+	defer span.End()
+	row := o.q.QueryRow(query, args...)
+	span.SetError(row.Err())
+	o.statements.finish(statement, -1, row.Err(), false)
+	return row
+}
+
+func (ctx *Context) SetConnID(id uint64) {
+	ctx.ConnID = id
+}
+
+func (ctx *Context) SetTLSState(state *tls.ConnectionState) {
+	ctx.TLS = state
+}
+
+func (ctx *Context) SetIdentity(identity *Identity) {
+	ctx.Identity = identity
+}
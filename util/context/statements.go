@@ -0,0 +1,96 @@
+package context
+
+import (
+	"sync"
+	"time"
+)
+
+// Statement - A SQL statement a request ran.
+type Statement struct {
+	SQL  string
+	Args []interface{}
+	// Rows is the number of rows read or written, or -1 when unknown.
+	Rows     int64
+	Duration time.Duration
+	Err      error
+	// InTransaction is set when the statement ran in a transaction, whose
+	// writes other connections do not see.
+	InTransaction bool
+
+	start time.Time
+	// reading is set while the rows of a query are being read.
+	reading bool
+}
+
+// StatementLog - The SQL statements of a request, in the order they ran.
+// A nil StatementLog records nothing.
+type StatementLog struct {
+	mu         sync.Mutex
+	statements []*Statement
+}
+
+// NewStatementLog - Create an empty StatementLog.
+func NewStatementLog() *StatementLog {
+	return &StatementLog{}
+}
+
+func (l *StatementLog) start(query string, args []interface{}, inTransaction bool) *Statement {
+	if l == nil {
+		return nil
+	}
+	s := &Statement{
+		SQL:           query,
+		Args:          args,
+		Rows:          -1,
+		InTransaction: inTransaction,
+		start:         time.Now(),
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.statements = append(l.statements, s)
+	return s
+}
+
+func (l *StatementLog) finish(s *Statement, rows int64, err error, reading bool) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s.Rows = rows
+	s.Duration = time.Since(s.start)
+	s.Err = err
+	s.reading = reading && err == nil
+}
+
+// RowsRead - Record that the rows of the last query have been read, which
+// also ends its duration.
+func (l *StatementLog) RowsRead(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := len(l.statements) - 1; i >= 0; i-- {
+		if s := l.statements[i]; s.reading {
+			s.Rows = int64(n)
+			s.Duration = time.Since(s.start)
+			s.reading = false
+			return
+		}
+	}
+}
+
+// Statements - The statements recorded so far.
+func (l *StatementLog) Statements() []Statement {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	statements := make([]Statement, len(l.statements))
+	for i, s := range l.statements {
+		statements[i] = *s
+	}
+	return statements
+}
@@ -0,0 +1,159 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Fields - Structured fields attached to log lines.
+type Fields map[string]interface{}
+
+// FieldLogger - A Logger that can attach fields to every line it logs.
+type FieldLogger interface {
+	Logger
+	// WithFields returns a Logger adding fields to those it already has.
+	WithFields(fields Fields) Logger
+}
+
+func (v Verbosity) String() string {
+	switch v {
+	case Warn:
+		return "warn"
+	case Info:
+		return "info"
+	case Debug:
+		return "debug"
+	case Trace:
+		return "trace"
+	default:
+		return fmt.Sprintf("Verbosity(%d)", int(v))
+	}
+}
+
+// ParseVerbosity - Parse "warn", "info", "debug" or "trace".
+func ParseVerbosity(s string) (Verbosity, error) {
+	switch strings.ToLower(s) {
+	case "warn", "warning":
+		return Warn, nil
+	case "info":
+		return Info, nil
+	case "debug":
+		return Debug, nil
+	case "trace":
+		return Trace, nil
+	}
+	return Info, errors.Errorf("unknown log level %q", s)
+}
+
+// jsonMu serializes the lines of every JSONLogger, so that lines from
+// different connections do not interleave.
+var jsonMu sync.Mutex
+
+// JSONLogger - A Logger that writes each line as a JSON object with the
+// time, level, message and its fields, for log pipelines. Lines above Level
+// are dropped.
+type JSONLogger struct {
+	Level Verbosity
+	// Out receives the lines, os.Stdout when nil.
+	Out    io.Writer
+	fields Fields
+}
+
+// WithFields - A JSONLogger adding fields to those of l.
+func (l JSONLogger) WithFields(fields Fields) Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	l.fields = merged
+	return l
+}
+
+// Trace - Log a very verbose trace message
+func (l JSONLogger) Trace(f string, args ...interface{}) {
+	l.Log(Trace, f, args...)
+}
+
+// Debug - Log a debug message
+func (l JSONLogger) Debug(f string, args ...interface{}) {
+	l.Log(Debug, f, args...)
+}
+
+// Info - Log a general message
+func (l JSONLogger) Info(f string, args ...interface{}) {
+	l.Log(Info, f, args...)
+}
+
+// Warn - Log a warning
+func (l JSONLogger) Warn(f string, args ...interface{}) {
+	l.Log(Warn, f, args...)
+}
+
+// Log - Log a message at the verbosity
+func (l JSONLogger) Log(verbosity Verbosity, f string, args ...interface{}) {
+	if verbosity > l.Level {
+		return
+	}
+	l.output(verbosity, fmt.Sprintf(f, args...))
+}
+
+// LogC - Log a message at the verbosity, without color
+func (l JSONLogger) LogC(verbosity Verbosity, color Color, f string, args ...interface{}) {
+	l.Log(verbosity, f, args...)
+}
+
+func (l JSONLogger) output(verbosity Verbosity, msg string) {
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	writeJSONValue(&buf, time.Now().UTC().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSONValue(&buf, verbosity.String())
+	buf.WriteString(`,"msg":`)
+	writeJSONValue(&buf, strings.TrimSpace(msg))
+
+	keys := make([]string, 0, len(l.fields))
+	for k := range l.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		buf.WriteByte(',')
+		writeJSONValue(&buf, k)
+		buf.WriteByte(':')
+		writeJSONValue(&buf, l.fields[k])
+	}
+	buf.WriteString("}\n")
+
+	out := l.Out
+	if out == nil {
+		out = os.Stdout
+	}
+	jsonMu.Lock()
+	defer jsonMu.Unlock()
+	out.Write(buf.Bytes())
+}
+
+// writeJSONValue - Encode a value, falling back to its string form for
+// values JSON cannot hold.
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
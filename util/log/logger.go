@@ -61,8 +61,10 @@ func (l NullLogger) LogC(verbosity Verbosity, color Color, f string, args ...int
 type ColorLogger struct {
 	VeryVerbose bool
 	Verbose     bool
-	Prefix      string
-	Color       bool
+	// Quiet drops general messages, leaving warnings.
+	Quiet  bool
+	Prefix string
+	Color  bool
 }
 
 // Trace - Log a very verbose trace message
@@ -83,6 +85,9 @@ func (l ColorLogger) Debug(f string, args ...interface{}) {
 
 // Info - Log a general message
 func (l ColorLogger) Info(f string, args ...interface{}) {
+	if l.Quiet {
+		return
+	}
 	l.output(Blue, f, args...)
 }
 
@@ -93,7 +98,9 @@ func (l ColorLogger) Warn(f string, args ...interface{}) {
 
 // Log
 func (l ColorLogger) Log(verbosity Verbosity, f string, args ...interface{}) {
-	if l.VeryVerbose && verbosity > Trace {
+	if l.Quiet && verbosity > Warn {
+		return
+	} else if l.VeryVerbose && verbosity > Trace {
 		return
 	} else if l.Verbose && verbosity > Debug {
 		return
@@ -103,7 +110,9 @@ func (l ColorLogger) Log(verbosity Verbosity, f string, args ...interface{}) {
 
 // LogC
 func (l ColorLogger) LogC(verbosity Verbosity, color Color, f string, args ...interface{}) {
-	if l.VeryVerbose && verbosity > Trace {
+	if l.Quiet && verbosity > Warn {
+		return
+	} else if l.VeryVerbose && verbosity > Trace {
 		return
 	} else if l.Verbose && verbosity > Debug {
 		return
@@ -0,0 +1,201 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ServerOptions - Settings for terminating TLS on the client-facing
+// listener.
+type ServerOptions struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is a PEM bundle used to verify client certificates.
+	ClientCAFile string
+	// ClientAuth is one of "none", "request", "require", "verify-if-given"
+	// or "require-and-verify". Empty defaults to "require-and-verify" when
+	// ClientCAFile is set and "none" otherwise.
+	ClientAuth   string
+	MinVersion   string
+	MaxVersion   string
+	CipherSuites string
+}
+
+// ClientOptions - Settings for TLS connections made toward the upstream.
+type ClientOptions struct {
+	// CAFile is a PEM bundle used to verify the upstream certificate. The
+	// system roots are used when empty.
+	CAFile     string
+	ServerName string
+	// CertFile and KeyFile are an optional client certificate presented to
+	// the upstream.
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+	MinVersion         string
+	MaxVersion         string
+	CipherSuites       string
+}
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require":            tls.RequireAnyClientCert,
+	"verify-if-given":    tls.VerifyClientCertIfGiven,
+	"require-and-verify": tls.RequireAndVerifyClientCert,
+}
+
+// ServerConfig - Build the tls.Config used to accept client connections.
+func ServerConfig(opts ServerOptions) (*tls.Config, error) {
+	if opts.CertFile == "" || opts.KeyFile == "" {
+		return nil, errors.New("server TLS requires both a certificate and a key")
+	}
+	cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load server key pair")
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if err := setProtocol(config, opts.MinVersion, opts.MaxVersion, opts.CipherSuites); err != nil {
+		return nil, err
+	}
+
+	clientAuth := opts.ClientAuth
+	if opts.ClientCAFile != "" {
+		pool, err := loadCertPool(opts.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		if clientAuth == "" {
+			clientAuth = "require-and-verify"
+		}
+	}
+	if clientAuth == "" {
+		clientAuth = "none"
+	}
+	config.ClientAuth, err = ParseClientAuth(clientAuth)
+	if err != nil {
+		return nil, err
+	}
+	if config.ClientCAs == nil && (config.ClientAuth == tls.VerifyClientCertIfGiven || config.ClientAuth == tls.RequireAndVerifyClientCert) {
+		return nil, errors.Errorf("client auth %q requires a client CA bundle", clientAuth)
+	}
+	return config, nil
+}
+
+// ClientConfig - Build the tls.Config used to dial the upstream.
+func ClientConfig(opts ClientOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         opts.ServerName,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+	}
+	if err := setProtocol(config, opts.MinVersion, opts.MaxVersion, opts.CipherSuites); err != nil {
+		return nil, err
+	}
+	if opts.CAFile != "" {
+		pool, err := loadCertPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load client key pair")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// ParseVersion - Parse a TLS version such as "1.2". An empty string
+// returns 0, which leaves the crypto/tls default in place.
+func ParseVersion(s string) (uint16, error) {
+	if s == "" {
+		return 0, nil
+	}
+	v, ok := versions[strings.TrimPrefix(strings.ToLower(s), "tls")]
+	if !ok {
+		return 0, errors.Errorf("unknown TLS version %q", s)
+	}
+	return v, nil
+}
+
+// ParseCipherSuites - Parse a comma separated list of cipher suite names as
+// reported by tls.CipherSuiteName. An empty string returns nil, which
+// leaves the crypto/tls default in place.
+func ParseCipherSuites(s string) ([]uint16, error) {
+	if s == "" {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := known[name]
+		if !ok {
+			return nil, errors.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ParseClientAuth - Parse a client certificate policy name.
+func ParseClientAuth(s string) (tls.ClientAuthType, error) {
+	auth, ok := clientAuthTypes[s]
+	if !ok {
+		return tls.NoClientCert, errors.Errorf("unknown client auth type %q", s)
+	}
+	return auth, nil
+}
+
+func setProtocol(config *tls.Config, minVersion, maxVersion, cipherSuites string) error {
+	var err error
+	if config.MinVersion, err = ParseVersion(minVersion); err != nil {
+		return err
+	}
+	if config.MaxVersion, err = ParseVersion(maxVersion); err != nil {
+		return err
+	}
+	if config.MinVersion != 0 && config.MaxVersion != 0 && config.MinVersion > config.MaxVersion {
+		return errors.Errorf("TLS min version %s is above max version %s", minVersion, maxVersion)
+	}
+	if config.CipherSuites, err = ParseCipherSuites(cipherSuites); err != nil {
+		return err
+	}
+	return nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read CA bundle %s", file)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("no certificates found in CA bundle %s", file)
+	}
+	return pool, nil
+}
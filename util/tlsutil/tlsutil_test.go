@@ -0,0 +1,153 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		s    string
+		want uint16
+		ok   bool
+	}{
+		{"", 0, true},
+		{"1.2", tls.VersionTLS12, true},
+		{"TLS1.3", tls.VersionTLS13, true},
+		{"tls1.0", tls.VersionTLS10, true},
+		{"1.4", 0, false},
+		{"ssl3", 0, false},
+	}
+	for _, test := range tests {
+		v, err := ParseVersion(test.s)
+		if (err == nil) != test.ok || v != test.want {
+			t.Errorf("ParseVersion(%q) = %#x, %v, want %#x", test.s, v, err, test.want)
+		}
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []uint16
+		ok   bool
+	}{
+		{"", nil, true},
+		{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, true},
+		{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_RSA_WITH_RC4_128_SHA", []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_RSA_WITH_RC4_128_SHA}, true},
+		{"TLS_NOPE", nil, false},
+	}
+	for _, test := range tests {
+		ids, err := ParseCipherSuites(test.s)
+		if (err == nil) != test.ok || !reflect.DeepEqual(ids, test.want) {
+			t.Errorf("ParseCipherSuites(%q) = %v, %v, want %v", test.s, ids, err, test.want)
+		}
+	}
+}
+
+func TestParseClientAuth(t *testing.T) {
+	for name, want := range clientAuthTypes {
+		if auth, err := ParseClientAuth(name); err != nil || auth != want {
+			t.Errorf("ParseClientAuth(%q) = %v, %v, want %v", name, auth, err, want)
+		}
+	}
+	if _, err := ParseClientAuth("always"); err == nil {
+		t.Error("ParseClientAuth(\"always\") succeeded, want an error")
+	}
+}
+
+// writeCertificate - Write a self-signed certificate and its key as PEM
+// files into dir.
+func writeCertificate(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestServerConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeCertificate(t, dir)
+
+	tests := []struct {
+		name       string
+		opts       ServerOptions
+		clientAuth tls.ClientAuthType
+		ok         bool
+	}{
+		{"without client certificates", ServerOptions{CertFile: certFile, KeyFile: keyFile}, tls.NoClientCert, true},
+		{"verified by default with a CA", ServerOptions{CertFile: certFile, KeyFile: keyFile, ClientCAFile: certFile}, tls.RequireAndVerifyClientCert, true},
+		{"requested", ServerOptions{CertFile: certFile, KeyFile: keyFile, ClientAuth: "request"}, tls.RequestClientCert, true},
+		{"verified without a CA", ServerOptions{CertFile: certFile, KeyFile: keyFile, ClientAuth: "verify-if-given"}, 0, false},
+		{"without a key", ServerOptions{CertFile: certFile}, 0, false},
+		{"missing CA", ServerOptions{CertFile: certFile, KeyFile: keyFile, ClientCAFile: filepath.Join(dir, "missing.pem")}, 0, false},
+		{"CA without certificates", ServerOptions{CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile}, 0, false},
+		{"min above max", ServerOptions{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.3", MaxVersion: "1.2"}, 0, false},
+	}
+	for _, test := range tests {
+		config, err := ServerConfig(test.opts)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: error %v", test.name, err)
+			continue
+		}
+		if err == nil && config.ClientAuth != test.clientAuth {
+			t.Errorf("%s: client auth %v, want %v", test.name, config.ClientAuth, test.clientAuth)
+		}
+	}
+}
+
+func TestClientConfig(t *testing.T) {
+	config, err := ClientConfig(ClientOptions{ServerName: "db", MinVersion: "1.2", MaxVersion: "1.3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ServerName != "db" || config.MinVersion != tls.VersionTLS12 || config.MaxVersion != tls.VersionTLS13 || config.RootCAs != nil {
+		t.Errorf("ClientConfig = %+v", config)
+	}
+	for _, opts := range []ClientOptions{{MinVersion: "2.0"}, {CipherSuites: "TLS_NOPE"}, {CertFile: "missing.pem"}} {
+		if _, err := ClientConfig(opts); err == nil {
+			t.Errorf("ClientConfig(%+v) succeeded, want an error", opts)
+		}
+	}
+}
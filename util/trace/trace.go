@@ -0,0 +1,339 @@
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lego/mongotunnel/util/log"
+	"github.com/pkg/errors"
+)
+
+// Spans follow the OpenTelemetry data model and the W3C trace context, so
+// that a trace started by a client continues through the proxy. A nil
+// *Tracer and a nil *Span do nothing, which keeps tracing optional for
+// callers.
+
+// TraceID - Identifies a trace.
+type TraceID [16]byte
+
+// SpanID - Identifies a span within a trace.
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+// FlagSampled - The trace flag of traces being recorded.
+const FlagSampled = 0x01
+
+// SpanContext - What a span passes on to its children.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+}
+
+// Valid - Whether the context identifies a span.
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent - The context as a W3C traceparent header.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// ParseTraceparent - Parse a W3C traceparent header, such as
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, errors.Errorf("invalid traceparent %q", s)
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, errors.Errorf("invalid traceparent %q", s)
+	}
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != len(sc.TraceID) {
+		return sc, errors.Errorf("invalid trace ID in traceparent %q", s)
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != len(sc.SpanID) {
+		return sc, errors.Errorf("invalid parent ID in traceparent %q", s)
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return sc, errors.Errorf("invalid flags in traceparent %q", s)
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Flags = flags[0]
+	if !sc.Valid() {
+		return SpanContext{}, errors.Errorf("invalid traceparent %q", s)
+	}
+	return sc, nil
+}
+
+// SpanKind - The role of a span, with the values of OTLP.
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// Span - A timed operation of a trace.
+type Span struct {
+	tracer *Tracer
+
+	mu         sync.Mutex
+	name       string
+	context    SpanContext
+	parent     SpanID
+	kind       SpanKind
+	start, end time.Time
+	attributes map[string]interface{}
+	err        string
+	ended      bool
+}
+
+// Name - The name of the span.
+func (s *Span) Name() string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.name
+}
+
+// SpanContext - The context children of the span inherit.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// SetName - Rename the span, once more is known of what it does.
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = name
+}
+
+// SetKind - Set the role of the span, internal by default.
+func (s *Span) SetKind(kind SpanKind) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kind = kind
+}
+
+// SetAttribute - Set an attribute of the span. Values are strings, booleans,
+// integers or floats.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+// SetError - Mark the span as failed with err, when err is not nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+// Child - Start a span under this one.
+func (s *Span) Child(name string) *Span {
+	return s.ChildAt(name, time.Now())
+}
+
+// ChildAt - Start a span under this one that began at start.
+func (s *Span) ChildAt(name string, start time.Time) *Span {
+	if s == nil {
+		return nil
+	}
+	return s.tracer.StartAt(s.context, name, start)
+}
+
+// End - End the span now. Later calls do nothing.
+func (s *Span) End() {
+	s.EndAt(time.Now())
+}
+
+// EndAt - End the span at end. Later calls do nothing.
+func (s *Span) EndAt(end time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = end
+	s.mu.Unlock()
+	s.tracer.enqueue(s)
+}
+
+// Default batching of ended spans.
+const (
+	DefaultBatchSize     = 512
+	DefaultBatchInterval = time.Second
+	// maxQueued bounds the spans waiting for a slow exporter. Spans beyond
+	// it are dropped.
+	maxQueued = 8 * DefaultBatchSize
+)
+
+// Tracer - Starts spans and hands them to an Exporter in batches once they
+// end.
+type Tracer struct {
+	// Service names the process in exported spans.
+	Service string
+	// Log receives export failures.
+	Log log.Logger
+
+	exporter Exporter
+
+	mu      sync.Mutex
+	queue   []*Span
+	dropped int
+	wake    chan struct{}
+	closed  chan struct{}
+	done    chan struct{}
+}
+
+// NewTracer - Create a Tracer exporting to exporter until closed.
+func NewTracer(service string, exporter Exporter) *Tracer {
+	t := &Tracer{
+		Service:  service,
+		Log:      log.NullLogger{},
+		exporter: exporter,
+		wake:     make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Start - Start a span now, under parent when it is valid or else as the
+// root of a new trace. Nothing is recorded under a parent that is not
+// sampled.
+func (t *Tracer) Start(parent SpanContext, name string) *Span {
+	return t.StartAt(parent, name, time.Now())
+}
+
+// StartAt - Start a span that began at start.
+func (t *Tracer) StartAt(parent SpanContext, name string, start time.Time) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{
+		tracer:     t,
+		name:       name,
+		kind:       SpanKindInternal,
+		start:      start,
+		attributes: make(map[string]interface{}),
+	}
+	if parent.Valid() {
+		if parent.Flags&FlagSampled == 0 {
+			return nil
+		}
+		s.context.TraceID = parent.TraceID
+		s.context.Flags = parent.Flags
+		s.parent = parent.SpanID
+	} else {
+		rand.Read(s.context.TraceID[:])
+		s.context.Flags = FlagSampled
+	}
+	rand.Read(s.context.SpanID[:])
+	return s
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	t.mu.Lock()
+	if len(t.queue) >= maxQueued {
+		t.dropped++
+	} else {
+		t.queue = append(t.queue, s)
+	}
+	full := len(t.queue) >= DefaultBatchSize
+	t.mu.Unlock()
+	if full {
+		select {
+		case t.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run - Export batches every DefaultBatchInterval or once one is full.
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(DefaultBatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.wake:
+		case <-t.closed:
+			t.export()
+			return
+		}
+		t.export()
+	}
+}
+
+func (t *Tracer) export() {
+	for {
+		t.mu.Lock()
+		batch := t.queue
+		if len(batch) > DefaultBatchSize {
+			batch = batch[:DefaultBatchSize]
+		}
+		t.queue = t.queue[len(batch):]
+		dropped := t.dropped
+		t.dropped = 0
+		t.mu.Unlock()
+
+		if dropped > 0 {
+			t.Log.Warn("dropped %d spans waiting for export", dropped)
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(t.Service, batch); err != nil {
+			t.Log.Warn("failed to export %d spans: %+v", len(batch), err)
+		}
+	}
+}
+
+// Close - Export the spans that have ended and stop.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	close(t.closed)
+	<-t.done
+	return nil
+}